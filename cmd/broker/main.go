@@ -1,23 +1,41 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 
 	"github.com/kafka-from-scratch/internal/broker"
+	"github.com/kafka-from-scratch/internal/kafka"
 	"github.com/kafka-from-scratch/internal/server"
+	"github.com/kafka-from-scratch/internal/storage"
 )
 
 func main() {
-	// 创建内存版Broker
-	memoryBroker := broker.NewMemoryBroker()
+	kind := flag.String("broker", "memory", "Broker的实现: memory 内存版(Topic可以用storage.engine选择存储引擎), disk 磁盘分段日志版")
+	dataDir := flag.String("data-dir", "data", "保存Topic元数据和磁盘数据的目录，重启后自动恢复Topic；memory时为空表示不保存")
+	memoryMaxBytes := flag.Int64("memory-max-bytes", 0, "memory: 所有Topic的消息最多占用的内存字节数，0表示不限制")
+	memoryFullPolicy := flag.String("memory-full-policy", "evict", "memory: 内存预算用完时: evict 删除最旧的消息, reject 拒绝写入")
+	segmentBytes := flag.Int64("segment-bytes", storage.DefaultSegmentBytes, "disk: 单个segment文件的最大字节数，最大2147483647")
+	remoteStorageDir := flag.String("remote-storage-dir", "", "disk: 分层存储使用的目录，开启remote.storage.enable的Topic把segment上传到这里；为空表示不开启")
+	kafkaListen := flag.String("kafka-listen", "", "Kafka协议listener的监听地址，例如 :19092，Kafka的客户端库可以直接连接；为空表示不开启")
+	kafkaAdvertised := flag.String("kafka-advertised", "", "Kafka客户端连接使用的 host:port，为空时使用监听地址")
+	kafkaAutoCreate := flag.Bool("kafka-auto-create-topics", true, "Kafka客户端请求不存在的Topic时自动创建，和auto.create.topics.enable一样")
+	flag.Parse()
+
+	b, err := newBroker(*kind, *dataDir, *memoryMaxBytes, *memoryFullPolicy, *segmentBytes, *remoteStorageDir)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// 创建TCP服务器
 	address := ":9092" // 使用Kafka默认端口
-	tcpServer := server.NewTCPServer(address, memoryBroker)
+	tcpServer := server.NewTCPServer(address, b)
 
 	// 启动服务器
 	fmt.Printf("🚀 Mini Kafka Broker 启动中...\n")
@@ -31,15 +49,102 @@ func main() {
 		}
 	}()
 
+	var kafkaListener *kafka.Listener
+	if *kafkaListen != "" {
+		config, err := kafkaConfig(*kafkaAdvertised, *kafkaAutoCreate)
+		if err != nil {
+			log.Fatal(err)
+		}
+		kafkaListener = kafka.NewListener(*kafkaListen, b, tcpServer.GroupCoordinator(), config)
+		if err := kafkaListener.Listen(); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("📡 Kafka协议监听地址: %s\n", kafkaListener.Addr())
+		go func() {
+			if err := kafkaListener.Serve(); err != nil {
+				log.Printf("Kafka listener错误: %v\n", err)
+			}
+		}()
+	}
+
 	// 等待停止信号
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
 	fmt.Printf("\n🛑 正在停止服务器...\n")
+	if kafkaListener != nil {
+		kafkaListener.Stop()
+	}
 	if err := tcpServer.Stop(); err != nil {
 		log.Printf("停止服务器时出错: %v\n", err)
+	} else if err := b.Close(); err != nil {
+		log.Printf("关闭存储引擎时出错: %v\n", err)
 	} else {
 		fmt.Printf("✅ 服务器已安全停止\n")
 	}
 }
+
+// newBroker 按-broker参数创建Broker的实现
+func newBroker(kind, dataDir string, memoryMaxBytes int64, memoryFullPolicy string, segmentBytes int64, remoteStorageDir string) (broker.Broker, error) {
+	switch kind {
+	case "memory":
+		policy, err := broker.ParseMemoryFullPolicy(memoryFullPolicy)
+		if err != nil {
+			return nil, err
+		}
+		memoryConfig := broker.MemoryConfig{
+			MaxBytes:   memoryMaxBytes,
+			FullPolicy: policy,
+		}
+		if dataDir == "" {
+			return broker.NewMemoryBrokerWithConfig(memoryConfig), nil
+		}
+		memoryBroker, err := broker.OpenMemoryBroker(dataDir, memoryConfig)
+		if err != nil {
+			return nil, err
+		}
+		return memoryBroker, nil
+	case "disk":
+		if dataDir == "" {
+			return nil, fmt.Errorf("-broker disk requires -data-dir")
+		}
+		if segmentBytes > storage.MaxSegmentBytes {
+			return nil, fmt.Errorf("-segment-bytes %d exceeds maximum %d", segmentBytes, storage.MaxSegmentBytes)
+		}
+		config := storage.LogConfig{SegmentBytes: segmentBytes}
+		if remoteStorageDir != "" {
+			remote, err := storage.NewLocalRemoteStorage(remoteStorageDir)
+			if err != nil {
+				return nil, err
+			}
+			config.Remote = remote
+		}
+		diskBroker, err := broker.NewDiskBroker(dataDir, config)
+		if err != nil {
+			return nil, err
+		}
+		return diskBroker, nil
+	default:
+		return nil, fmt.Errorf("invalid -broker %q: must be memory or disk", kind)
+	}
+}
+
+// kafkaConfig 解析-kafka-advertised，为空时由Listener使用监听地址
+func kafkaConfig(advertised string, autoCreate bool) (kafka.Config, error) {
+	config := kafka.Config{AutoCreateTopics: autoCreate}
+	if advertised == "" {
+		return config, nil
+	}
+	host, portText, err := net.SplitHostPort(advertised)
+	if err != nil {
+		return config, fmt.Errorf("invalid -kafka-advertised %q: %w", advertised, err)
+	}
+	port, err := strconv.ParseInt(portText, 10, 32)
+	if err != nil {
+		return config, fmt.Errorf("invalid -kafka-advertised %q: %w", advertised, err)
+	}
+	config.AdvertisedHost = host
+	config.AdvertisedPort = int32(port)
+	return config, nil
+}
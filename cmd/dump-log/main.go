@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/kafka-from-scratch/internal/common"
+	"github.com/kafka-from-scratch/internal/storage"
+)
+
+// dump-log 不启动Broker，直接读取一个分区的数据目录，打印其中的消息并检查数据和索引
+//
+//	go run ./cmd/dump-log data/orders-0
+//	go run ./cmd/dump-log -from-offset 100 -to-offset 200 -encoding hex data/orders-0
+//	go run ./cmd/dump-log -from-time 2024-05-01T10:00:00Z -records=false data/orders-0
+//
+// 发现数据损坏或者索引和数据不一致时退出码为1
+func main() {
+	fromOffset := flag.Int64("from-offset", 0, "只打印offset >= 这个值的消息")
+	toOffset := flag.Int64("to-offset", -1, "只打印offset < 这个值的消息，-1表示不限制")
+	fromTime := flag.String("from-time", "", "只打印时间戳 >= 这个时间的消息，RFC3339或Unix毫秒")
+	toTime := flag.String("to-time", "", "只打印时间戳 < 这个时间的消息，RFC3339或Unix毫秒")
+	encoding := flag.String("encoding", "auto", "key、value和header的显示方式: auto 是UTF-8文本时显示文本否则显示hex, utf8, hex")
+	printRecords := flag.Bool("records", true, "打印每条消息，为false时只打印batch和检查结果")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: dump-log [flags] <partition-dir>\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	filter := recordFilter{fromOffset: *fromOffset, toOffset: *toOffset}
+	var err error
+	if filter.fromTime, err = parseTime(*fromTime); err != nil {
+		log.Fatalf("❌ -from-time: %v", err)
+	}
+	if filter.toTime, err = parseTime(*toTime); err != nil {
+		log.Fatalf("❌ -to-time: %v", err)
+	}
+	format, err := bytesFormatter(*encoding)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+
+	dir := flag.Arg(0)
+	fmt.Printf("Dumping %s\n", dir)
+	// 读取失败时InspectLog会把它报告为损坏
+	logStartOffset, _ := storage.ReadLogStartOffset(dir)
+	segment := int64(-1)
+	report, err := storage.InspectLog(dir, func(info storage.BatchInfo) error {
+		batch := info.Batch
+		if !filter.overlaps(batch.BaseOffset(), batch.LastOffset(), batch.MaxTimestamp()) {
+			return nil
+		}
+		matched := make([]*common.Message, 0, len(info.Messages))
+		for _, message := range info.Messages {
+			if filter.matches(message) {
+				matched = append(matched, message)
+			}
+		}
+		// 损坏的batch没有解码出消息，也要打印出来
+		if len(matched) == 0 && info.Err == nil {
+			return nil
+		}
+		if info.SegmentBaseOffset != segment {
+			segment = info.SegmentBaseOffset
+			fmt.Printf("\nSegment %020d.log\n", segment)
+		}
+		checksum := "ok"
+		if info.Err != nil {
+			checksum = "CORRUPT: " + info.Err.Error()
+		}
+		fmt.Printf("batch position: %d offsets: %d-%d count: %d size: %d maxTimestamp: %s checksum: %s\n",
+			info.Position, batch.BaseOffset(), batch.LastOffset(), batch.RecordCount(), batch.Size(),
+			formatTimestamp(time.UnixMilli(batch.MaxTimestamp())), checksum)
+		if !*printRecords {
+			return nil
+		}
+		for _, message := range matched {
+			line := fmt.Sprintf("| offset: %d timestamp: %s key: %s value: %s headers: %s checksum: %s",
+				message.Offset, formatTimestamp(message.Timestamp), format(message.Key), format(message.Value),
+				formatHeaders(message.Headers, format), checksum)
+			// 早于log start offset的消息已经被DeleteRecords删除，只是所在的segment还没有删掉
+			if message.Offset < logStartOffset {
+				line += " (deleted)"
+			}
+			fmt.Println(line)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+
+	printReport(report)
+	if report.Corrupt() {
+		os.Exit(1)
+	}
+}
+
+func printReport(report *storage.LogReport) {
+	fmt.Printf("\nSummary of %s (log start offset %d)\n", report.Dir, report.LogStartOffset)
+	for _, segment := range report.Segments {
+		fmt.Printf("segment %d: %d bytes, %d batches, %d records, next offset %d, %d index entries, %d time index entries\n",
+			segment.BaseOffset, segment.Size, segment.Batches, segment.Records, segment.NextOffset,
+			segment.IndexEntries, segment.TimeIndexEntries)
+		for _, problem := range segment.Problems {
+			fmt.Printf("  ❌ %s\n", problem)
+		}
+	}
+	for _, problem := range report.Problems {
+		fmt.Printf("❌ %s\n", problem)
+	}
+	if report.Corrupt() {
+		fmt.Printf("❌ %s is corrupt\n", report.Dir)
+	} else {
+		fmt.Printf("✅ no corruption found\n")
+	}
+}
+
+// recordFilter 按offset范围[fromOffset, toOffset)和时间范围[fromTime, toTime)过滤，零值表示不限制
+type recordFilter struct {
+	fromOffset, toOffset int64
+	fromTime, toTime     time.Time
+}
+
+// overlaps 只看batch头部判断其中有没有可能匹配的消息，没有时整个batch都不打印
+func (f recordFilter) overlaps(baseOffset, lastOffset, maxTimestamp int64) bool {
+	if lastOffset < f.fromOffset || (f.toOffset >= 0 && baseOffset >= f.toOffset) {
+		return false
+	}
+	return f.fromTime.IsZero() || maxTimestamp >= f.fromTime.UnixMilli()
+}
+
+func (f recordFilter) matches(message *common.Message) bool {
+	if message.Offset < f.fromOffset || (f.toOffset >= 0 && message.Offset >= f.toOffset) {
+		return false
+	}
+	if !f.fromTime.IsZero() && message.Timestamp.Before(f.fromTime) {
+		return false
+	}
+	if !f.toTime.IsZero() && !message.Timestamp.Before(f.toTime) {
+		return false
+	}
+	return true
+}
+
+// parseTime 解析RFC3339时间或Unix毫秒时间戳，空字符串表示不限制
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.UnixMilli(ms), nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+func formatTimestamp(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// bytesFormatter 返回key、value的显示函数，nil显示为null
+func bytesFormatter(encoding string) (func([]byte) string, error) {
+	switch encoding {
+	case "auto":
+		return func(b []byte) string {
+			if b == nil {
+				return "null"
+			}
+			if utf8.Valid(b) {
+				return strconv.Quote(string(b))
+			}
+			return "0x" + hex.EncodeToString(b)
+		}, nil
+	case "utf8":
+		return func(b []byte) string {
+			if b == nil {
+				return "null"
+			}
+			return strconv.Quote(string(b))
+		}, nil
+	case "hex":
+		return func(b []byte) string {
+			if b == nil {
+				return "null"
+			}
+			return "0x" + hex.EncodeToString(b)
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid encoding %q: must be auto, utf8 or hex", encoding)
+	}
+}
+
+// formatHeaders 按key排序，保证同样的数据每次输出都一样
+func formatHeaders(headers map[string][]byte, format func([]byte) string) string {
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, format([]byte(key))+"="+format(headers[key]))
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
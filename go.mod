@@ -1,5 +1,3 @@
 module github.com/kafka-from-scratch
 
 go 1.22.1
-
-require github.com/google/uuid v1.6.0 // indirect
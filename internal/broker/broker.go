@@ -0,0 +1,84 @@
+package broker
+
+import (
+	"time"
+
+	"github.com/kafka-from-scratch/internal/common"
+	"github.com/kafka-from-scratch/internal/record"
+	"github.com/kafka-from-scratch/internal/snapshot"
+)
+
+// Broker Server和GroupCoordinator通过它访问Topic和消息，不关心消息存在哪里
+// MemoryBroker和DiskBroker是它的两种实现，cmd/broker用-broker参数选择
+type Broker interface {
+	// CreateTopic 使用默认配置创建Topic，已经存在时直接返回
+	CreateTopic(name string, partitions int32) error
+
+	// CreateTopicWithConfig 使用指定的Topic配置创建Topic，已经存在时直接返回
+	CreateTopicWithConfig(name string, partitions int32, config common.TopicConfig) error
+
+	// ListTopics 返回所有Topic的名字，顺序不固定
+	ListTopics() []string
+
+	// GetPartitionCount 返回Topic的分区数，Topic不存在时返回错误
+	GetPartitionCount(topicName string) (int32, error)
+
+	// ProduceMessage 根据消息的Key选择分区并追加，返回分区ID和消息的offset
+	ProduceMessage(topicName string, message *common.Message) (int32, int64, error)
+
+	// ProduceBatch 把Producer发来的batch整个写入同一个分区，返回分区ID和第一条消息的offset
+	ProduceBatch(topicName string, batch record.Batch) (int32, int64, error)
+
+	// ProduceBatchToPartition 和ProduceBatch一样，但是写入调用方选择的分区，例如Kafka客户端自己选择分区
+	ProduceBatchToPartition(topicName string, partitionId int32, batch record.Batch) (int64, error)
+
+	// PartitionForKey 返回ProduceMessage会为key选择的分区
+	PartitionForKey(topicName string, key []byte) (int32, error)
+
+	// ConsumeMessages 从offset开始读取最多maxMessages条消息
+	// offset早于log start offset时返回common.ErrOffsetOutOfRange，读到末尾时返回空列表
+	ConsumeMessages(topicName string, partitionId int32, offset int64, maxMessages int) ([]*common.Message, error)
+
+	// FetchRecords 和ConsumeMessages一样，但返回编码好的batch数据，第一个batch里早于offset的消息由消费方跳过
+	// 返回的Records发送完之后要Close
+	FetchRecords(topicName string, partitionId int32, offset int64, maxMessages int) (record.Records, error)
+
+	// Appended 返回一个channel，分区之后追加了消息时关闭，长轮询的Consume用它等待新消息
+	// 先拿到channel再FetchRecords，两者之间追加的消息不会错过
+	Appended(topicName string, partitionId int32) (<-chan struct{}, error)
+
+	// GetEarliestOffset 返回分区的log start offset
+	GetEarliestOffset(topicName string, partitionId int32) (int64, error)
+
+	// GetLatestOffset 返回分区下一条消息将使用的offset
+	GetLatestOffset(topicName string, partitionId int32) (int64, error)
+
+	// GetOffsetForTimestamp 返回分区中第一条时间戳 >= t 的消息的offset，都早于t时返回最新offset
+	GetOffsetForTimestamp(topicName string, partitionId int32, t time.Time) (int64, error)
+
+	// DeleteRecords 删除分区中offset之前的所有消息，返回新的log start offset
+	// offset为DeleteRecordsToLatest时清空分区
+	DeleteRecords(topicName string, partitionId int32, offset int64) (int64, error)
+
+	// Close 停止后台任务并关闭所有文件，之后不能再使用
+	Close() error
+}
+
+// SnapshotBroker 支持整体快照和恢复的Broker，每种存储引擎的Topic都包括在快照中
+type SnapshotBroker interface {
+	Broker
+
+	// Snapshot 返回所有Topic及其分区中全部消息的快照，读取任何一个分区失败时返回错误
+	Snapshot() ([]*snapshot.Topic, error)
+
+	// Restore 用快照中的Topic替换或创建Topic，force为false时任何一个Topic已经存在就整个拒绝
+	Restore(topics []*snapshot.Topic, force bool) error
+}
+
+// DeleteRecordsToLatest 作为DeleteRecords的offset时表示删除到最新offset，和Kafka的DeleteRecords一样用-1
+const DeleteRecordsToLatest int64 = -1
+
+var (
+	_ SnapshotBroker = (*MemoryBroker)(nil)
+	_ SnapshotBroker = (*DiskBroker)(nil)
+)
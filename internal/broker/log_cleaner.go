@@ -0,0 +1,43 @@
+package broker
+
+import (
+	"sync"
+	"time"
+)
+
+// RetentionCheckInterval 后台检查保留策略的间隔，和Kafka的log.retention.check.interval.ms默认值一致
+const RetentionCheckInterval = 5 * time.Minute
+
+// logCleaner 后台定期执行清理函数的goroutine
+type logCleaner struct {
+	ticker   *time.Ticker
+	stopChan chan struct{}
+	stopOnce sync.Once
+}
+
+// startLogCleaner 每隔interval调用一次clean，直到stop被调用
+func startLogCleaner(interval time.Duration, clean func()) *logCleaner {
+	c := &logCleaner{
+		ticker:   time.NewTicker(interval),
+		stopChan: make(chan struct{}),
+	}
+	go func() {
+		for {
+			select {
+			case <-c.ticker.C:
+				clean()
+			case <-c.stopChan:
+				return
+			}
+		}
+	}()
+	return c
+}
+
+// stop 停止后台goroutine，Broker的Close可能被调用多次，重复调用什么都不做
+func (c *logCleaner) stop() {
+	c.stopOnce.Do(func() {
+		c.ticker.Stop()
+		close(c.stopChan)
+	})
+}
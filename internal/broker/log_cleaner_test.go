@@ -0,0 +1,28 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/kafka-from-scratch/internal/storage"
+)
+
+func TestCloseTwice(t *testing.T) {
+	memoryBroker := NewMemoryBroker()
+	if err := memoryBroker.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := memoryBroker.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	diskBroker, err := NewDiskBroker(t.TempDir(), storage.LogConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := diskBroker.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := diskBroker.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
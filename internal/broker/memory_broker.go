@@ -1,21 +1,169 @@
 package broker
 
 import (
-	"errors"
+	"fmt"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/kafka-from-scratch/internal/common"
+	"github.com/kafka-from-scratch/internal/record"
+	"github.com/kafka-from-scratch/internal/snapshot"
+	"github.com/kafka-from-scratch/internal/storage"
 )
 
 // MemoryBroker 是我们第一阶段的内存版消息代理
+// 每个Topic可以用storage.engine选择分区的存储引擎，默认是内存；segmented和file引擎的数据保存在dataDir下
 type MemoryBroker struct {
-	topics map[string]*common.Topic
-	mu     sync.RWMutex
+	topics   map[string]*common.Topic
+	config   MemoryConfig
+	metadata *metadataStore // nil表示Topic不持久化
+	dataDir  string         // 为空时只能创建memory引擎的Topic
+	mu       sync.RWMutex
+
+	cleaner *logCleaner // 后台按cleanup.policy清理或压缩旧消息
+}
+
+// MemoryConfig 内存版Broker的内存预算
+// 消息占用的内存按Message.Size计算（key、value和headers的字节数），和retention.bytes一致
+type MemoryConfig struct {
+	// MaxBytes 所有Topic的消息最多占用的字节数，<=0表示不限制
+	// 单个Topic的预算用Topic配置memory.max.bytes设置
+	MaxBytes int64
+
+	// FullPolicy 写入会超出全局或Topic预算时的处理方式
+	FullPolicy MemoryFullPolicy
+}
+
+// MemoryFullPolicy 内存预算用完时的处理方式
+type MemoryFullPolicy int
+
+const (
+	// MemoryFullEvict 像环形缓冲区一样删除最旧的消息，分区的log start offset随之前进
+	MemoryFullEvict MemoryFullPolicy = iota
+
+	// MemoryFullReject 拒绝写入，返回可重试的common.ErrBrokerFull
+	MemoryFullReject
+)
+
+// ParseMemoryFullPolicy 解析命令行中的 evict / reject
+func ParseMemoryFullPolicy(s string) (MemoryFullPolicy, error) {
+	switch s {
+	case "evict":
+		return MemoryFullEvict, nil
+	case "reject":
+		return MemoryFullReject, nil
+	default:
+		return 0, fmt.Errorf("invalid memory full policy %q: must be evict or reject", s)
+	}
+}
+
+// PartitionMemoryUsage 一个分区当前占用的内存
+type PartitionMemoryUsage struct {
+	Topic       string
+	Partition   int32
+	Bytes       int64
+	Messages    int
+	StartOffset int64
 }
 
+// NewMemoryBroker 创建不限制内存的内存版Broker
 func NewMemoryBroker() *MemoryBroker {
-	return &MemoryBroker{
+	return NewMemoryBrokerWithConfig(MemoryConfig{})
+}
+
+// NewMemoryBrokerWithConfig 创建有内存预算的内存版Broker，适合长时间运行的压测
+func NewMemoryBrokerWithConfig(config MemoryConfig) *MemoryBroker {
+	b := &MemoryBroker{
 		topics: make(map[string]*common.Topic),
+		config: config,
+	}
+	b.cleaner = startLogCleaner(RetentionCheckInterval, func() {
+		b.EnforceRetention(time.Now())
+		b.CompactLogs(time.Now())
+	})
+	return b
+}
+
+// OpenMemoryBroker 创建内存版Broker，Topic的名字、分区数和配置保存在dataDir下，重启后自动恢复
+// memory引擎的消息只在内存中，重启后这些分区都是空的，offset从0开始；segmented和file引擎的分区重新打开dataDir中的数据
+func OpenMemoryBroker(dataDir string, config MemoryConfig) (*MemoryBroker, error) {
+	metadata, err := openMetadataStore(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	b := NewMemoryBrokerWithConfig(config)
+	b.metadata = metadata
+	b.dataDir = dataDir
+	for _, name := range metadata.names() {
+		partitions, topicConfig, _, err := metadata.get(name)
+		var topic *common.Topic
+		if err == nil {
+			topic, err = b.openTopic(name, partitions, topicConfig)
+		}
+		if err != nil {
+			b.Close()
+			return nil, err
+		}
+		b.topics[name] = topic
+		fmt.Printf("📂 Loaded topic %s with %d partitions\n", name, partitions)
+	}
+	return b, nil
+}
+
+// fileStoreSuffix file引擎的分区文件 <topic>-<partition>.store
+const fileStoreSuffix = ".store"
+
+// openTopic 按Topic配置的storage.engine为每个分区创建或打开存储引擎
+// segmented引擎的分区是dataDir下的<topic>-<partition>目录，和DiskBroker一样；file引擎是<topic>-<partition>.store文件
+func (b *MemoryBroker) openTopic(name string, partitions int32, config common.TopicConfig) (*common.Topic, error) {
+	if config.StorageEngine == "" || config.StorageEngine == common.StorageEngineMemory {
+		return common.NewTopicWithConfig(name, partitions, config), nil
+	}
+	if b.dataDir == "" {
+		return nil, fmt.Errorf("%w: topic %s uses %s=%s but the memory broker has no data directory",
+			common.ErrInvalidConfig, name, common.ConfigStorageEngine, config.StorageEngine)
+	}
+	if err := validateTopicName(name); err != nil {
+		return nil, err
+	}
+	if partitions <= 0 {
+		partitions = 1
+	}
+
+	stores := make([]common.PartitionStore, 0, partitions)
+	for i := int32(0); i < partitions; i++ {
+		store, err := b.openPartitionStore(name, i, config)
+		if err != nil {
+			for _, store := range stores {
+				store.Close()
+			}
+			return nil, fmt.Errorf("open partition %d of topic %s: %w", i, name, err)
+		}
+		stores = append(stores, store)
+	}
+	return common.NewTopicWithStores(name, config, stores), nil
+}
+
+func (b *MemoryBroker) openPartitionStore(name string, partition int32, config common.TopicConfig) (common.PartitionStore, error) {
+	path := partitionPath(b.dataDir, name, partition, config.StorageEngine)
+	switch config.StorageEngine {
+	case common.StorageEngineSegmented:
+		log, err := storage.OpenLog(path, storage.LogConfig{Flush: flushPolicy(config)})
+		if err != nil {
+			return nil, err
+		}
+		return log, nil
+	case common.StorageEngineFile:
+		// 单文件存储没有后台flush，配置了flush.messages或flush.ms就每次写入都fsync
+		store, err := storage.OpenFileStore(path, config.FlushMessages > 0 || config.FlushMs >= 0)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown storage engine %q", common.ErrInvalidConfig, config.StorageEngine)
 	}
 }
 
@@ -27,11 +175,31 @@ func NewMemoryBroker() *MemoryBroker {
 // 3. 将Topic存储到broker的topics map中
 // 4. 注意并发安全（使用读写锁）
 func (b *MemoryBroker) CreateTopic(name string, partitions int32) error {
+	return b.CreateTopicWithConfig(name, partitions, common.DefaultTopicConfig())
+}
+
+// CreateTopicWithConfig 使用指定的Topic配置创建Topic
+func (b *MemoryBroker) CreateTopicWithConfig(name string, partitions int32, config common.TopicConfig) error {
 	// TODO: 在这里实现Topic创建逻辑
+	if config.RemoteStorageEnable {
+		// 内存里的消息没有segment可以上传
+		return fmt.Errorf("%w: topic %s enables %s but the memory broker has no remote storage", common.ErrInvalidConfig, name, common.ConfigRemoteStorageEnable)
+	}
 	b.mu.Lock()
 	defer b.mu.Unlock()
 	if _, exists := b.topics[name]; !exists {
-		b.topics[name] = common.NewTopic(name, partitions)
+		topic, err := b.openTopic(name, partitions, config)
+		if err != nil {
+			return err
+		}
+		// 先写元数据，写入失败时Topic不会只存在于内存中
+		if b.metadata != nil {
+			if err := b.metadata.put(name, int32(len(topic.Partitions)), config); err != nil {
+				topic.Close()
+				return err
+			}
+		}
+		b.topics[name] = topic
 	} else {
 		// 疑问2， 如果已经有了怎么处理呢？
 	}
@@ -52,7 +220,7 @@ func (b *MemoryBroker) GetTopic(name string) (*common.Topic, error) {
 		return t, nil
 	}
 	// 是不是应该有个统一的错误处理
-	return nil, errors.New("not found")
+	return nil, fmt.Errorf("%w: %s", common.ErrUnknownTopic, name)
 }
 
 // TODO: 你来实现这个方法！
@@ -63,15 +231,130 @@ func (b *MemoryBroker) GetTopic(name string) (*common.Topic, error) {
 // 3. 返回分区ID和offset
 func (b *MemoryBroker) ProduceMessage(topicName string, message *common.Message) (int32, int64, error) {
 	// TODO: 在这里实现消息生产逻辑
+	return b.produce(topicName, []*common.Message{message}, func(topic *common.Topic) (int32, common.PartitionStore, error) {
+		partitionID, partition := topic.GetPartitionForKey(message.Key)
+		return partitionID, partition, nil
+	})
+}
+
+// ProduceBatch 解码Producer发来的batch，整个batch写入同一个分区，按第一条消息的Key选择
+// PartitionStore按消息追加，所以这里要解码；返回分区ID和batch第一条消息的offset
+func (b *MemoryBroker) ProduceBatch(topicName string, batch record.Batch) (int32, int64, error) {
+	if err := batch.Validate(); err != nil {
+		return 0, 0, err
+	}
+	messages, err := batch.Messages()
+	if err != nil {
+		return 0, 0, err
+	}
+	return b.produce(topicName, messages, func(topic *common.Topic) (int32, common.PartitionStore, error) {
+		partitionID, partition := topic.GetPartitionForKey(messages[0].Key)
+		return partitionID, partition, nil
+	})
+}
+
+// ProduceBatchToPartition 和ProduceBatch一样，但是写入指定的分区
+func (b *MemoryBroker) ProduceBatchToPartition(topicName string, partitionId int32, batch record.Batch) (int64, error) {
+	if err := batch.Validate(); err != nil {
+		return 0, err
+	}
+	messages, err := batch.Messages()
+	if err != nil {
+		return 0, err
+	}
+	_, offset, err := b.produce(topicName, messages, func(topic *common.Topic) (int32, common.PartitionStore, error) {
+		partition, err := topic.GetPartition(partitionId)
+		return partitionId, partition, err
+	})
+	return offset, err
+}
+
+// PartitionForKey 返回ProduceMessage会为key选择的分区
+func (b *MemoryBroker) PartitionForKey(topicName string, key []byte) (int32, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	topic, ok := b.topics[topicName]
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", common.ErrUnknownTopic, topicName)
+	}
+	return topic.PartitionIDForKey(key), nil
+}
+
+// produce 用pick选择Topic的分区，把messages一次写入，返回分区ID和第一条消息的offset
+// 只有memory引擎的分区在写入时持有写锁，这样检查内存预算和写入之间不会有别的写入；
+// 磁盘存储引擎的分区自己保证并发写入的顺序，写入时不持有Broker的锁，
+// fsync不会挡住其他Topic和分区的请求，同一个分区并发的写入也能一起fsync
+func (b *MemoryBroker) produce(topicName string, messages []*common.Message, pick func(topic *common.Topic) (int32, common.PartitionStore, error)) (int32, int64, error) {
+	b.mu.RLock()
+	partitionID, partition, err := b.pickPartition(topicName, pick)
+	b.mu.RUnlock()
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, ok := partition.(*common.Partition); !ok {
+		offset, err := partition.Append(messages...)
+		if err != nil {
+			return 0, 0, err
+		}
+		return partitionID, offset, nil
+	}
+
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	// 释放读锁之后Topic可能被Restore替换了，要重新选择分区
+	topic := b.topics[topicName]
+	partitionID, partition, err = b.pickPartition(topicName, pick)
+	if err != nil {
+		return 0, 0, err
+	}
+	offset, err := b.appendBatch(topic, partition, messages)
+	if err != nil {
+		return 0, 0, err
+	}
+	return partitionID, offset, nil
+}
+
+// pickPartition 找到Topic并用pick选择分区，调用方需要持有锁
+func (b *MemoryBroker) pickPartition(topicName string, pick func(topic *common.Topic) (int32, common.PartitionStore, error)) (int32, common.PartitionStore, error) {
 	topic, ok := b.topics[topicName]
 	if !ok {
-		return 0, 0, errors.New("topic not found")
+		return 0, nil, fmt.Errorf("%w: %s", common.ErrUnknownTopic, topicName)
+	}
+	return pick(topic)
+}
+
+// appendBatch 把一个batch的消息写入partition，返回第一条消息的offset，调用方需要持有写锁
+func (b *MemoryBroker) appendBatch(topic *common.Topic, partition common.PartitionStore, messages []*common.Message) (int64, error) {
+	var size int64
+	for _, message := range messages {
+		size += message.Size()
+	}
+	// 整个batch要么都写入要么都不写入
+	if err := b.reserve(topic, partition, size); err != nil {
+		return 0, err
+	}
+	// 一次Append写入，batch中的消息在分区中是连续的
+	return partition.Append(messages...)
+}
+
+// FetchRecords 读取最多maxMessages条消息并编码成一个batch，分区中没有新消息时返回空数据
+// segmented引擎的分区直接返回文件中的batch，不需要解码再编码
+func (b *MemoryBroker) FetchRecords(topicName string, partitionId int32, offset int64, maxMessages int) (record.Records, error) {
+	partition, err := b.getPartition(topicName, partitionId)
+	if err != nil {
+		return nil, err
+	}
+	if log, ok := partition.(*storage.Log); ok {
+		return log.ReadRecords(offset, maxMessages)
+	}
+	messages, err := partition.Read(offset, maxMessages)
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return record.MemoryRecords{}, nil
 	}
-	partition := topic.GetPartitionForKey(message.Key)
-	partition.Append(message)
-	return partition.ID, message.Offset, nil
+	return record.MemoryRecords(record.Encode(messages)), nil
 }
 
 // TODO: 你来实现这个方法！
@@ -83,18 +366,459 @@ func (b *MemoryBroker) ProduceMessage(topicName string, message *common.Message)
 // 4. maxMessages参数控制一次最多获取多少条消息
 func (b *MemoryBroker) ConsumeMessages(topicName string, partitionId int32, offset int64, maxMessages int) ([]*common.Message, error) {
 	// TODO: 在这里实现消息消费逻辑
-	b.mu.Lock()
-	defer b.mu.Unlock()
+	// 只在找分区时持有读锁，读磁盘存储引擎的分区时不挡住别的请求
+	partition, err := b.getPartition(topicName, partitionId)
+	if err != nil {
+		return nil, err
+	}
+	// 疑问3， 我没理解， 这里只是获取了一份message ， 真正的消息还在 partition.Messages 里面， 怎么算消费了呢？
+	return partition.Read(offset, maxMessages)
+}
+
+// Appended 返回分区下一次追加消息时关闭的channel
+// Restore替换了Topic之后旧分区不会再追加，等待者只能等到超时
+func (b *MemoryBroker) Appended(topicName string, partitionId int32) (<-chan struct{}, error) {
+	partition, err := b.getPartition(topicName, partitionId)
+	if err != nil {
+		return nil, err
+	}
+	return partition.Appended(), nil
+}
+
+// getPartition 找到Topic的分区，不存在时返回错误
+func (b *MemoryBroker) getPartition(topicName string, partitionId int32) (common.PartitionStore, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 	topic, ok := b.topics[topicName]
 	if !ok {
-		return nil, errors.New("topic not found")
+		return nil, fmt.Errorf("%w: %s", common.ErrUnknownTopic, topicName)
 	}
 	partition, err := topic.GetPartition(partitionId)
 	if err != nil {
-		return nil, errors.New("partition not found")
+		return nil, fmt.Errorf("%w: %s-%d", common.ErrUnknownPartition, topicName, partitionId)
 	}
-	// 疑问3， 我没理解， 这里只是获取了一份message ， 真正的消息还在 partition.Messages 里面， 怎么算消费了呢？
-	return partition.GetMessages(offset, maxMessages)
+	return partition, nil
+}
+
+// timestampIndexedStore 能按时间戳查找offset的磁盘存储引擎，storage.Log和storage.FileStore都实现了它
+type timestampIndexedStore interface {
+	OffsetForTimestamp(t time.Time) (int64, error)
+}
+
+// GetOffsetForTimestamp 返回指定分区中第一条时间戳 >= t 的消息的offset
+func (b *MemoryBroker) GetOffsetForTimestamp(topicName string, partitionId int32, t time.Time) (int64, error) {
+	partition, err := b.getPartition(topicName, partitionId)
+	if err != nil {
+		return 0, err
+	}
+	switch p := partition.(type) {
+	case *common.Partition:
+		return p.GetOffsetForTimestamp(t), nil
+	case timestampIndexedStore:
+		return p.OffsetForTimestamp(t)
+	default:
+		return 0, fmt.Errorf("partition %d of topic %s does not support lookup by timestamp", partitionId, topicName)
+	}
+}
+
+// GetPartitionCount 返回Topic的分区数量
+func (b *MemoryBroker) GetPartitionCount(topicName string) (int32, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	topic, ok := b.topics[topicName]
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", common.ErrUnknownTopic, topicName)
+	}
+	return topic.GetPartitionCount(), nil
+}
+
+// GetLatestOffset 返回分区下一条消息将使用的offset
+func (b *MemoryBroker) GetLatestOffset(topicName string, partitionId int32) (int64, error) {
+	partition, err := b.getPartition(topicName, partitionId)
+	if err != nil {
+		return 0, err
+	}
+	return partition.LatestOffset(), nil
+}
+
+// GetEarliestOffset 返回分区的log start offset，更早的消息已经被清理
+func (b *MemoryBroker) GetEarliestOffset(topicName string, partitionId int32) (int64, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	topic, ok := b.topics[topicName]
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", common.ErrUnknownTopic, topicName)
+	}
+	partition, err := topic.GetPartition(partitionId)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s-%d", common.ErrUnknownPartition, topicName, partitionId)
+	}
+	return partition.EarliestOffset(), nil
+}
+
+// DeleteRecords 删除指定分区中offset之前的所有消息，返回新的log start offset（low watermark）
+// offset为DeleteRecordsToLatest时清空分区
+func (b *MemoryBroker) DeleteRecords(topicName string, partitionId int32, offset int64) (int64, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	topic, ok := b.topics[topicName]
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", common.ErrUnknownTopic, topicName)
+	}
+	partition, err := topic.GetPartition(partitionId)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s-%d", common.ErrUnknownPartition, topicName, partitionId)
+	}
+	if offset == DeleteRecordsToLatest {
+		offset = partition.LatestOffset()
+	}
+	lowWatermark, err := partition.DeleteRecordsBefore(offset)
+	if err != nil {
+		return 0, err
+	}
+	fmt.Printf("🗑️ Deleted records before offset %d from %s-%d\n", lowWatermark, topicName, partitionId)
+	return lowWatermark, nil
+}
+
+// EnforceRetention 按每个Topic的retention.ms和retention.bytes清理所有分区的旧消息
+// 只处理cleanup.policy包含delete的Topic，后台清理goroutine会定期调用它
+func (b *MemoryBroker) EnforceRetention(now time.Time) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for name, topic := range b.topics {
+		if !topic.Config.ShouldDelete() {
+			continue
+		}
+		for i, partition := range topic.Partitions {
+			applyRetention(name, int32(i), partition, topic.Config, now)
+		}
+	}
+}
+
+// applyRetention 按存储引擎各自的粒度清理：内存分区按消息，分段日志按segment，单文件存储按batch
+func applyRetention(name string, id int32, partition common.PartitionStore, config common.TopicConfig, now time.Time) {
+	var deleted int
+	var unit string
+	var err error
+	switch p := partition.(type) {
+	case *common.Partition:
+		deleted, unit = p.ApplyRetention(config.RetentionMs, config.RetentionBytes, now), "messages"
+	case *storage.Log:
+		deleted, err = p.DeleteOldSegments(config.RetentionMs, config.RetentionBytes, now)
+		unit = "segments"
+	case *storage.FileStore:
+		deleted, err = p.ApplyRetention(config.RetentionMs, config.RetentionBytes, now)
+		unit = "batches"
+	}
+	if err != nil {
+		fmt.Printf("❌ Failed to apply retention to %s-%d: %v\n", name, id, err)
+	}
+	if deleted > 0 {
+		fmt.Printf("🧹 Deleted %d %s from %s-%d, log start offset is now %d\n",
+			deleted, unit, name, id, partition.EarliestOffset())
+	}
+}
+
+// CompactLogs 对cleanup.policy包含compact的Topic做key压缩，后台清理goroutine会定期调用它
+func (b *MemoryBroker) CompactLogs(now time.Time) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for name, topic := range b.topics {
+		if !topic.Config.ShouldCompact() {
+			continue
+		}
+		for i, partition := range topic.Partitions {
+			// file引擎不能compact，ParseTopicConfig已经拒绝了这种配置
+			var removed int
+			var err error
+			switch p := partition.(type) {
+			case *common.Partition:
+				removed = p.Compact(topic.Config.DeleteRetentionMs, now)
+			case *storage.Log:
+				removed, err = p.Compact(topic.Config.DeleteRetentionMs, now)
+			}
+			if err != nil {
+				fmt.Printf("❌ Failed to compact %s-%d: %v\n", name, i, err)
+				continue
+			}
+			if removed > 0 {
+				fmt.Printf("🗜️ Compacted %s-%d, removed %d messages\n", name, i, removed)
+			}
+		}
+	}
+}
+
+// reserve 在写入partition之前检查全局和Topic的内存预算，需要时删除旧消息腾出size字节
+// 调用方需要持有写锁，这样检查和写入之间不会有别的写入
+// 只有memory引擎的分区占用内存，写入磁盘存储引擎的分区不受预算限制
+func (b *MemoryBroker) reserve(topic *common.Topic, partition common.PartitionStore, size int64) error {
+	if _, ok := partition.(*common.Partition); !ok {
+		return nil
+	}
+	topicLimit := topic.Config.MemoryMaxBytes
+	globalLimit := b.config.MaxBytes
+	if (topicLimit >= 0 && size > topicLimit) || (globalLimit > 0 && size > globalLimit) {
+		// 删除所有消息也放不下，重试也没有用
+		return fmt.Errorf("%w: %d bytes of messages exceed the memory budget of topic %s", common.ErrRecordTooLarge, size, topic.Name)
+	}
+
+	for {
+		// 先满足Topic预算，再满足全局预算；淘汰范围分别是这个Topic和所有Topic
+		var scope []*common.Topic
+		var need int64
+		if topicLimit >= 0 {
+			if used := topicMemoryUsage(topic); used+size > topicLimit {
+				scope, need = []*common.Topic{topic}, used+size-topicLimit
+			}
+		}
+		if scope == nil && globalLimit > 0 {
+			var used int64
+			for _, t := range b.topics {
+				used += topicMemoryUsage(t)
+			}
+			if used+size > globalLimit {
+				scope, need = b.topicList(), used+size-globalLimit
+			}
+		}
+		if scope == nil {
+			return nil
+		}
+
+		if b.config.FullPolicy == MemoryFullReject {
+			return fmt.Errorf("%w: topic %s needs %d more bytes", common.ErrBrokerFull, topic.Name, need)
+		}
+		victim := evictionVictim(scope, partition)
+		if victim == nil {
+			return fmt.Errorf("%w: nothing left to evict for topic %s", common.ErrBrokerFull, topic.Name)
+		}
+		victim.EvictBytes(need)
+	}
+}
+
+// evictionVictim 选择要删除旧消息的分区：优先是正在写入的分区，这样每个分区都像一个环形缓冲区；
+// 它已经空了的话，选范围内占用内存最多的分区
+func evictionVictim(scope []*common.Topic, target common.PartitionStore) *common.Partition {
+	var victim *common.Partition
+	var victimSize int64
+	for _, topic := range scope {
+		for _, partition := range memoryPartitions(topic) {
+			size := partition.GetSize()
+			if common.PartitionStore(partition) == target && size > 0 {
+				return partition
+			}
+			if size > victimSize {
+				victim, victimSize = partition, size
+			}
+		}
+	}
+	return victim
+}
+
+func topicMemoryUsage(topic *common.Topic) int64 {
+	var used int64
+	for _, partition := range memoryPartitions(topic) {
+		used += partition.GetSize()
+	}
+	return used
+}
+
+// memoryPartitions 返回Topic中memory引擎的分区，其他引擎的Topic返回空
+func memoryPartitions(topic *common.Topic) []*common.Partition {
+	partitions := make([]*common.Partition, 0, len(topic.Partitions))
+	for _, store := range topic.Partitions {
+		if partition, ok := store.(*common.Partition); ok {
+			partitions = append(partitions, partition)
+		}
+	}
+	return partitions
+}
+
+// topicList 调用方需要持有锁
+func (b *MemoryBroker) topicList() []*common.Topic {
+	topics := make([]*common.Topic, 0, len(b.topics))
+	for _, topic := range b.topics {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// MemoryUsage 返回memory引擎的每个分区当前占用的内存，按Topic名和分区ID排序
+func (b *MemoryBroker) MemoryUsage() []PartitionMemoryUsage {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	usage := make([]PartitionMemoryUsage, 0)
+	for name, topic := range b.topics {
+		for _, partition := range memoryPartitions(topic) {
+			usage = append(usage, PartitionMemoryUsage{
+				Topic:       name,
+				Partition:   partition.ID,
+				Bytes:       partition.GetSize(),
+				Messages:    partition.GetMessageCount(),
+				StartOffset: partition.EarliestOffset(),
+			})
+		}
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].Topic != usage[j].Topic {
+			return usage[i].Topic < usage[j].Topic
+		}
+		return usage[i].Partition < usage[j].Partition
+	})
+	return usage
+}
+
+// Snapshot 返回所有Topic及其分区中全部消息的快照，按Topic名排序
+// memory引擎的分区复制消息列表，消息本身写入后不会再被修改，不需要深拷贝；segmented和file引擎的分区从磁盘读出全部消息
+func (b *MemoryBroker) Snapshot() ([]*snapshot.Topic, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	topics := make([]*snapshot.Topic, 0, len(b.topics))
+	for _, topic := range b.topicList() {
+		st, err := snapshotTopic(topic.Name, topic.Config, topic.Partitions)
+		if err != nil {
+			return nil, err
+		}
+		topics = append(topics, st)
+	}
+	sort.Slice(topics, func(i, j int) bool { return topics[i].Name < topics[j].Name })
+	return topics, nil
+}
+
+// Restore 用快照中的Topic替换或创建Topic，分区中的消息和offset与快照完全一致
+// 任何一个Topic已经存在时，force为false就整个拒绝，不做任何修改；force为true时替换掉已有的Topic
+// segmented和file引擎的分区先写到暂存位置，元数据保存之后才替换掉已有的数据
+func (b *MemoryBroker) Restore(topics []*snapshot.Topic, force bool) error {
+	restored := make(map[string]*snapshot.Topic, len(topics))
+	memoryTopics := make(map[string]*common.Topic)
+	staged := make(map[string]*stagedTopic)
+	discard := func() {
+		for _, s := range staged {
+			s.discard()
+		}
+	}
+	for _, st := range topics {
+		if _, dup := restored[st.Name]; dup {
+			discard()
+			return fmt.Errorf("topic %s appears more than once in snapshot", st.Name)
+		}
+		restored[st.Name] = st
+		topic, stage, err := b.prepareRestore(st)
+		if err != nil {
+			discard()
+			return err
+		}
+		if stage != nil {
+			staged[st.Name] = stage
+		} else {
+			memoryTopics[st.Name] = topic
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for name := range restored {
+		if _, exists := b.topics[name]; exists && !force {
+			discard()
+			return fmt.Errorf("%w: %s, restore with force to overwrite it", common.ErrTopicAlreadyExists, name)
+		}
+	}
+	// 所有Topic的元数据一次写入，失败时一个Topic都不替换，不会只恢复了一部分
+	if b.metadata != nil {
+		entries := make([]*topicMetadata, 0, len(restored))
+		for name, st := range restored {
+			entries = append(entries, &topicMetadata{Name: name, Partitions: int32(len(st.Partitions)), Configs: st.Config.Configs()})
+		}
+		if err := b.metadata.putAll(entries); err != nil {
+			discard()
+			return err
+		}
+	}
+
+	var firstErr error
+	for name, st := range restored {
+		if existing, exists := b.topics[name]; exists {
+			delete(b.topics, name)
+			if err := existing.Close(); err != nil {
+				fmt.Printf("❌ Failed to close replaced topic %s: %v\n", name, err)
+			}
+			if len(memoryPartitions(existing)) != len(existing.Partitions) {
+				if err := removePartitionData(b.dataDir, name, len(existing.Partitions), existing.Config.StorageEngine); err != nil && firstErr == nil {
+					firstErr = fmt.Errorf("remove replaced topic %s: %w", name, err)
+				}
+			}
+		}
+		topic, ok := memoryTopics[name]
+		if !ok {
+			// 元数据已经保存，这里失败时重启后会打开已经改名过去的数据
+			var err error
+			if err = staged[name].install(); err == nil {
+				topic, err = b.openTopic(name, int32(len(st.Partitions)), st.Config)
+			}
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("restore topic %s: %w", name, err)
+				}
+				continue
+			}
+		}
+		b.topics[name] = topic
+	}
+	return firstErr
+}
+
+// prepareRestore 检查快照中的Topic能否恢复到这个Broker
+// memory引擎直接在内存中重建分区；segmented和file引擎写到暂存位置，返回stagedTopic
+func (b *MemoryBroker) prepareRestore(st *snapshot.Topic) (*common.Topic, *stagedTopic, error) {
+	if st.Config.RemoteStorageEnable {
+		return nil, nil, fmt.Errorf("topic %s enables %s but the memory broker has no remote storage", st.Name, common.ConfigRemoteStorageEnable)
+	}
+	if len(st.Partitions) == 0 {
+		return nil, nil, fmt.Errorf("topic %s has no partitions in snapshot", st.Name)
+	}
+
+	switch st.Config.StorageEngine {
+	case "", common.StorageEngineMemory:
+		topic := common.NewTopicWithConfig(st.Name, int32(len(st.Partitions)), st.Config)
+		for i, sp := range st.Partitions {
+			partition, err := common.RestorePartition(int32(i), sp.Messages, sp.StartOffset, sp.NextOffset)
+			if err != nil {
+				return nil, nil, fmt.Errorf("topic %s: %w", st.Name, err)
+			}
+			topic.Partitions[i] = partition
+		}
+		return topic, nil, nil
+	case common.StorageEngineSegmented, common.StorageEngineFile:
+		if b.dataDir == "" {
+			return nil, nil, fmt.Errorf("%w: topic %s uses %s=%s but the memory broker has no data directory",
+				common.ErrInvalidConfig, st.Name, common.ConfigStorageEngine, st.Config.StorageEngine)
+		}
+		if err := validateTopicName(st.Name); err != nil {
+			return nil, nil, err
+		}
+		staged, err := stageTopic(b.dataDir, st)
+		return nil, staged, err
+	default:
+		return nil, nil, fmt.Errorf("%w: unknown storage engine %q", common.ErrInvalidConfig, st.Config.StorageEngine)
+	}
+}
+
+// Close 停止后台清理goroutine，并关闭所有分区的存储引擎
+func (b *MemoryBroker) Close() error {
+	b.cleaner.stop()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var firstErr error
+	for _, topic := range b.topics {
+		if err := topic.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
 }
 
 // 这个方法我先给你实现，作为参考
@@ -0,0 +1,159 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/kafka-from-scratch/internal/common"
+)
+
+// MetadataFileName 数据目录下保存Topic元数据的文件
+const MetadataFileName = "topics.json"
+
+// metadataVersion 元数据文件格式的版本，格式不兼容地改变时加一
+const metadataVersion = 1
+
+// topicMetadata 一个Topic的元数据。配置按Kafka的配置项名字保存，新增的配置项在旧文件中不存在时使用默认值
+type topicMetadata struct {
+	Name       string            `json:"name"`
+	Partitions int32             `json:"partitions"`
+	Configs    map[string]string `json:"configs"`
+}
+
+type metadataFile struct {
+	Version int              `json:"version"`
+	Topics  []*topicMetadata `json:"topics"`
+}
+
+// metadataStore 把所有Topic的名字、分区数和配置保存在数据目录下的topics.json中，Broker重启后据此恢复Topic
+// 每次修改都重写整个文件：先写临时文件并fsync，再rename替换，崩溃时文件要么是旧的要么是新的
+// 调用方需要持有Broker的写锁
+type metadataStore struct {
+	path   string
+	topics map[string]*topicMetadata
+}
+
+// openMetadataStore 加载dir下的元数据文件，文件不存在时从空开始
+func openMetadataStore(dir string) (*metadataStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create data dir: %w", err)
+	}
+	s := &metadataStore{
+		path:   filepath.Join(dir, MetadataFileName),
+		topics: make(map[string]*topicMetadata),
+	}
+
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read topic metadata: %w", err)
+	}
+	var file metadataFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse topic metadata %s: %w", s.path, err)
+	}
+	if file.Version != metadataVersion {
+		return nil, fmt.Errorf("topic metadata %s has unsupported version %d", s.path, file.Version)
+	}
+	for _, topic := range file.Topics {
+		s.topics[topic.Name] = topic
+	}
+	return s, nil
+}
+
+// get 返回Topic保存的分区数和配置
+func (s *metadataStore) get(name string) (int32, common.TopicConfig, bool, error) {
+	topic, ok := s.topics[name]
+	if !ok {
+		return 0, common.TopicConfig{}, false, nil
+	}
+	config, err := common.ParseTopicConfig(topic.Configs)
+	if err != nil {
+		return 0, common.TopicConfig{}, false, fmt.Errorf("topic %s in %s: %w", name, s.path, err)
+	}
+	return topic.Partitions, config, true, nil
+}
+
+// names 按名字排序返回所有Topic
+func (s *metadataStore) names() []string {
+	names := make([]string, 0, len(s.topics))
+	for name := range s.topics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// put 保存Topic的元数据并立即写入磁盘，写入失败时内存中的内容不变
+func (s *metadataStore) put(name string, partitions int32, config common.TopicConfig) error {
+	return s.putAll([]*topicMetadata{{Name: name, Partitions: partitions, Configs: config.Configs()}})
+}
+
+// putAll 和put一样，但是一次保存多个Topic，只写一次文件，要么全部保存要么都不保存
+func (s *metadataStore) putAll(topics []*topicMetadata) error {
+	previous := make(map[string]*topicMetadata, len(topics))
+	for _, topic := range topics {
+		if _, seen := previous[topic.Name]; !seen {
+			previous[topic.Name] = s.topics[topic.Name]
+		}
+		s.topics[topic.Name] = topic
+	}
+	if err := s.save(); err != nil {
+		for name, topic := range previous {
+			if topic != nil {
+				s.topics[name] = topic
+			} else {
+				delete(s.topics, name)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *metadataStore) save() error {
+	file := metadataFile{Version: metadataVersion, Topics: make([]*topicMetadata, 0, len(s.topics))}
+	for _, name := range s.names() {
+		file.Topics = append(file.Topics, s.topics[name])
+	}
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("write topic metadata: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("write topic metadata: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("write topic metadata: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("write topic metadata: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("write topic metadata: %w", err)
+	}
+	// rename本身也要落盘，否则崩溃后目录里可能还是旧文件
+	return syncDir(filepath.Dir(s.path))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,134 @@
+package broker
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/kafka-from-scratch/internal/common"
+	"github.com/kafka-from-scratch/internal/snapshot"
+	"github.com/kafka-from-scratch/internal/storage"
+)
+
+// snapshotReadMessages 从磁盘引擎读取快照时每次读取的消息数
+const snapshotReadMessages = 1000
+
+// restoreSuffix 恢复快照时磁盘引擎的分区先写到 <分区路径>.restore，确定要替换之后再改名到分区路径
+// 目录名不是 <topic>-<partition> 的格式，写到一半崩溃时留下的暂存目录不会被当作分区加载
+const restoreSuffix = ".restore"
+
+// snapshotPartition 读出一个分区的全部消息
+// memory引擎在分区的锁内复制消息列表；其他引擎通过PartitionStore从log start offset读到开始读取时的最新offset，
+// 读取期间新追加的消息不在快照里
+func snapshotPartition(store common.PartitionStore) (*snapshot.Partition, error) {
+	if partition, ok := store.(*common.Partition); ok {
+		messages, startOffset, nextOffset := partition.Snapshot()
+		return &snapshot.Partition{StartOffset: startOffset, NextOffset: nextOffset, Messages: messages}, nil
+	}
+
+	nextOffset := store.LatestOffset()
+	startOffset := min(store.EarliestOffset(), nextOffset)
+	messages := make([]*common.Message, 0)
+	for offset := startOffset; offset < nextOffset; {
+		read, err := store.Read(offset, snapshotReadMessages)
+		if err != nil {
+			return nil, err
+		}
+		// compact过的分区末尾可能没有消息
+		if len(read) == 0 {
+			break
+		}
+		for _, message := range read {
+			if message.Offset < nextOffset {
+				messages = append(messages, message)
+			}
+		}
+		offset = read[len(read)-1].Offset + 1
+	}
+	return &snapshot.Partition{StartOffset: startOffset, NextOffset: nextOffset, Messages: messages}, nil
+}
+
+// snapshotTopic 读出Topic所有分区的快照
+func snapshotTopic(name string, config common.TopicConfig, stores []common.PartitionStore) (*snapshot.Topic, error) {
+	st := &snapshot.Topic{
+		Name:       name,
+		Config:     config,
+		Partitions: make([]*snapshot.Partition, 0, len(stores)),
+	}
+	for i, store := range stores {
+		sp, err := snapshotPartition(store)
+		if err != nil {
+			return nil, fmt.Errorf("snapshot partition %d of topic %s: %w", i, name, err)
+		}
+		st.Partitions = append(st.Partitions, sp)
+	}
+	return st, nil
+}
+
+// partitionPath segmented引擎的分区是dataDir下的<topic>-<partition>目录，file引擎是<topic>-<partition>.store文件
+func partitionPath(dataDir, topic string, partition int32, engine string) string {
+	path := filepath.Join(dataDir, partitionDirName(topic, partition))
+	if engine == common.StorageEngineFile {
+		path += fileStoreSuffix
+	}
+	return path
+}
+
+// stagedTopic 已经写到暂存位置的Topic，paths[i]是第i个分区的最终路径
+type stagedTopic struct {
+	paths []string
+}
+
+// stageTopic 把快照中segmented或file引擎的Topic写到暂存位置，不影响同名Topic现在的数据
+func stageTopic(dataDir string, st *snapshot.Topic) (*stagedTopic, error) {
+	staged := &stagedTopic{}
+	for i, sp := range st.Partitions {
+		path := partitionPath(dataDir, st.Name, int32(i), st.Config.StorageEngine)
+		staged.paths = append(staged.paths, path)
+
+		var err error
+		if st.Config.StorageEngine == common.StorageEngineFile {
+			err = storage.RestoreFileStore(path+restoreSuffix, sp.Messages, sp.StartOffset, sp.NextOffset)
+		} else {
+			err = storage.RestoreLog(path+restoreSuffix, sp.Messages, sp.StartOffset, sp.NextOffset)
+		}
+		if err != nil {
+			staged.discard()
+			return nil, fmt.Errorf("topic %s partition %d: %w", st.Name, i, err)
+		}
+	}
+	return staged, nil
+}
+
+// install 删除分区路径上的旧数据，把暂存的分区改名过去
+func (s *stagedTopic) install() error {
+	for _, path := range s.paths {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+		if err := os.Rename(path+restoreSuffix, path); err != nil {
+			return err
+		}
+	}
+	if len(s.paths) > 0 {
+		return syncDir(filepath.Dir(s.paths[0]))
+	}
+	return nil
+}
+
+// discard 删除暂存的数据，不再恢复这个Topic
+func (s *stagedTopic) discard() {
+	for _, path := range s.paths {
+		os.RemoveAll(path + restoreSuffix)
+	}
+}
+
+// removePartitionData 删除被快照替换掉的Topic在dataDir中的数据，Topic必须已经关闭
+func removePartitionData(dataDir, topic string, partitions int, engine string) error {
+	for i := 0; i < partitions; i++ {
+		if err := os.RemoveAll(partitionPath(dataDir, topic, int32(i), engine)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
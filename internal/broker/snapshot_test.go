@@ -0,0 +1,142 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/kafka-from-scratch/internal/common"
+	"github.com/kafka-from-scratch/internal/record"
+	"github.com/kafka-from-scratch/internal/storage"
+)
+
+// fillSnapshotTopics 每种存储引擎一个Topic，删掉开头的消息，log start offset不是0
+func fillSnapshotTopics(t *testing.T, b *MemoryBroker) {
+	t.Helper()
+	for _, engine := range []string{common.StorageEngineMemory, common.StorageEngineSegmented, common.StorageEngineFile} {
+		config := common.DefaultTopicConfig()
+		config.StorageEngine = engine
+		if err := b.CreateTopicWithConfig(engine, 2, config); err != nil {
+			t.Fatal(err)
+		}
+		for partition := int32(0); partition < 2; partition++ {
+			for i := 0; i < 20; i++ {
+				message := &common.Message{Key: []byte(fmt.Sprintf("k%d", i)), Value: []byte(fmt.Sprintf("%s-%d-%d", engine, partition, i))}
+				if _, err := b.ProduceBatchToPartition(engine, partition, record.Build([]*common.Message{message})); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := b.DeleteRecords(engine, partition, 5); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// checkSnapshotTopics 每个分区都是offset 5到19的消息，之后追加的消息从20开始
+func checkSnapshotTopics(t *testing.T, b Broker, engines ...string) {
+	t.Helper()
+	for _, engine := range engines {
+		for partition := int32(0); partition < 2; partition++ {
+			earliest, err := b.GetEarliestOffset(engine, partition)
+			if err != nil || earliest != 5 {
+				t.Fatalf("%s-%d: earliest offset (%d, %v), want 5", engine, partition, earliest, err)
+			}
+			latest, err := b.GetLatestOffset(engine, partition)
+			if err != nil || latest != 20 {
+				t.Fatalf("%s-%d: latest offset (%d, %v), want 20", engine, partition, latest, err)
+			}
+			messages, err := b.ConsumeMessages(engine, partition, 5, 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(messages) != 15 {
+				t.Fatalf("%s-%d: got %d messages, want 15", engine, partition, len(messages))
+			}
+			for i, message := range messages {
+				want := fmt.Sprintf("%s-%d-%d", engine, partition, i+5)
+				if message.Offset != int64(i+5) || string(message.Value) != want {
+					t.Fatalf("%s-%d: message %d is (%d, %q), want (%d, %q)", engine, partition, i, message.Offset, message.Value, i+5, want)
+				}
+			}
+		}
+	}
+}
+
+func TestSnapshotIncludesEveryEngine(t *testing.T) {
+	source, err := OpenMemoryBroker(t.TempDir(), MemoryConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	fillSnapshotTopics(t, source)
+
+	topics, err := source.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(topics) != 3 {
+		t.Fatalf("snapshot has %d topics, want 3", len(topics))
+	}
+	engines := []string{common.StorageEngineFile, common.StorageEngineMemory, common.StorageEngineSegmented}
+
+	t.Run("memory broker", func(t *testing.T) {
+		dataDir := t.TempDir()
+		target, err := OpenMemoryBroker(dataDir, MemoryConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := target.Restore(topics, false); err != nil {
+			t.Fatal(err)
+		}
+		checkSnapshotTopics(t, target, engines...)
+		if err := target.Restore(topics, false); !errors.Is(err, common.ErrTopicAlreadyExists) {
+			t.Fatalf("restore without force: got %v, want ErrTopicAlreadyExists", err)
+		}
+		if err := target.Restore(topics, true); err != nil {
+			t.Fatal(err)
+		}
+		checkSnapshotTopics(t, target, engines...)
+		target.Close()
+
+		// segmented和file引擎的数据在重启之后还在
+		reopened, err := OpenMemoryBroker(dataDir, MemoryConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reopened.Close()
+		checkSnapshotTopics(t, reopened, common.StorageEngineSegmented, common.StorageEngineFile)
+	})
+
+	t.Run("disk broker", func(t *testing.T) {
+		dataDir := t.TempDir()
+		target, err := NewDiskBroker(dataDir, storage.LogConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := target.Restore(topics, false); err != nil {
+			t.Fatal(err)
+		}
+		checkSnapshotTopics(t, target, engines...)
+		if err := target.Restore(topics, true); err != nil {
+			t.Fatal(err)
+		}
+		checkSnapshotTopics(t, target, engines...)
+
+		again, err := target.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(again) != 3 {
+			t.Fatalf("disk broker snapshot has %d topics, want 3", len(again))
+		}
+		target.Close()
+
+		reopened, err := NewDiskBroker(dataDir, storage.LogConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reopened.Close()
+		checkSnapshotTopics(t, reopened, engines...)
+	})
+}
@@ -0,0 +1,46 @@
+package common
+
+import "errors"
+
+// ErrOffsetOutOfRange 请求的offset已经不在分区中了（例如早于log start offset，数据已被清理）
+var ErrOffsetOutOfRange = errors.New("offset out of range")
+
+// ErrCorruptMessage 消息的校验和不匹配或者格式错误，数据已经损坏
+var ErrCorruptMessage = errors.New("corrupt message")
+
+// ErrBrokerFull Broker的内存预算已经用完，拒绝了这次写入
+// 这是可重试的错误：消息被retention清理或预算调大之后，Producer可以重新发送
+var ErrBrokerFull = errors.New("broker full")
+
+// ErrUnknownTopic Topic不存在
+var ErrUnknownTopic = errors.New("topic not found")
+
+// ErrUnknownPartition Topic存在，但是没有这个分区
+var ErrUnknownPartition = errors.New("partition not found")
+
+// ErrTopicAlreadyExists 恢复快照时Topic已经存在
+var ErrTopicAlreadyExists = errors.New("topic already exists")
+
+// ErrInvalidTopic topic名不合法
+var ErrInvalidTopic = errors.New("invalid topic name")
+
+// ErrInvalidConfig Topic配置不合法，或者这个Broker不支持
+var ErrInvalidConfig = errors.New("invalid topic config")
+
+// ErrRecordTooLarge 消息比Topic或Broker允许的最大值还大，重试也不会成功
+var ErrRecordTooLarge = errors.New("record too large")
+
+// ErrUnknownGroup Consumer Group不存在，需要重新JoinGroup
+var ErrUnknownGroup = errors.New("unknown group")
+
+// ErrUnknownMember Group中没有这个Consumer，需要重新JoinGroup
+var ErrUnknownMember = errors.New("unknown member")
+
+// ErrIllegalGeneration 请求中的Generation已经过期，Group发生过Rebalance，需要重新JoinGroup
+var ErrIllegalGeneration = errors.New("illegal generation")
+
+// ErrRebalanceInProgress Group正在Rebalance，稍后重试
+var ErrRebalanceInProgress = errors.New("rebalance in progress")
+
+// ErrNotCoordinator 这个Broker不是Group的协调者，或者协调者已经停止
+var ErrNotCoordinator = errors.New("not coordinator")
@@ -7,7 +7,7 @@ import (
 type Message struct {
 	Key       []byte            
 	Value     []byte            
-	Headers   map[string]string 
+	Headers   map[string][]byte // header的value和Key、Value一样是任意字节，nil和空的[]byte{}不同
 	Timestamp time.Time         
 	Offset    int64             
 }
@@ -16,23 +16,38 @@ func NewMessage(key, value []byte) *Message {
 	return &Message{
 		Key:       key,
 		Value:     value,
-		Headers:   make(map[string]string),
+		Headers:   make(map[string][]byte),
 		Timestamp: time.Now(),
 		Offset:    -1, 
 	}
 }
 
-func (m *Message) SetHeader(key, value string) {
+// IsTombstone value为nil的消息是tombstone，在compact模式的Topic中表示删除这个key
+// 注意nil和空的[]byte{}是不同的：后者是一个合法的空值
+func (m *Message) IsTombstone() bool {
+	return m.Value == nil
+}
+
+func (m *Message) SetHeader(key string, value []byte) {
 	if m.Headers == nil {
-		m.Headers = make(map[string]string)
+		m.Headers = make(map[string][]byte)
 	}
 	m.Headers[key] = value
 }
 
-func (m *Message) GetHeader(key string) (string, bool) {
+func (m *Message) GetHeader(key string) ([]byte, bool) {
 	if m.Headers == nil {
-		return "", false
+		return nil, false
 	}
 	value, exists := m.Headers[key]
 	return value, exists
-}
\ No newline at end of file
+}
+
+// Size 消息占用的大致字节数（key + value + headers），用于按大小做保留策略
+func (m *Message) Size() int64 {
+	size := int64(len(m.Key) + len(m.Value))
+	for k, v := range m.Headers {
+		size += int64(len(k) + len(v))
+	}
+	return size
+}
@@ -1,13 +1,34 @@
 package common
 
 import (
+	"fmt"
+	"sort"
 	"sync"
+	"time"
 )
 
 type Partition struct {
 	ID       int32
 	Messages []*Message
 	mu       sync.RWMutex
+
+	// startOffset 是log start offset，旧消息被清理后它会变大
+	// nextOffset 是下一条消息的offset
+	// compact之后Messages中的offset不再连续，只保证递增，所以要按offset二分查找而不是直接当下标用
+	startOffset int64
+	nextOffset  int64
+	size        int64 // 所有消息的Size之和
+
+	// timeIndex 只在最大时间戳变大时记录一项，所以即使消息时间戳乱序也是有序的，可以二分查找
+	timeIndex []timeIndexEntry
+
+	appended AppendNotifier
+}
+
+// timeIndexEntry 表示从offset这条消息开始，分区中出现过的最大时间戳变成了timestamp
+type timeIndexEntry struct {
+	timestamp time.Time
+	offset    int64
 }
 
 func NewPartition(id int32) *Partition {
@@ -17,41 +38,284 @@ func NewPartition(id int32) *Partition {
 	}
 }
 
-func (p *Partition) Append(message *Message) int64 {
+// RestorePartition 用快照中的消息重建分区，消息的offset保持不变
+// messages必须按offset递增并且都在[startOffset, nextOffset)范围内
+func RestorePartition(id int32, messages []*Message, startOffset, nextOffset int64) (*Partition, error) {
+	if startOffset < 0 || nextOffset < startOffset {
+		return nil, fmt.Errorf("partition %d: invalid offset range [%d, %d)", id, startOffset, nextOffset)
+	}
+	p := NewPartition(id)
+	p.startOffset = startOffset
+	p.nextOffset = nextOffset
+	for i, message := range messages {
+		if message.Offset < startOffset || message.Offset >= nextOffset || (i > 0 && message.Offset <= messages[i-1].Offset) {
+			return nil, fmt.Errorf("partition %d: message offset %d out of order or outside [%d, %d)", id, message.Offset, startOffset, nextOffset)
+		}
+		p.add(message)
+	}
+	return p, nil
+}
+
+// Append 为消息分配连续的offset并追加到末尾，返回第一条消息的offset
+// 内存中追加不会失败，error只是为了实现PartitionStore
+func (p *Partition) Append(messages ...*Message) (int64, error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	offset := int64(len(p.Messages))
-	message.Offset = offset
+	first := p.nextOffset
+	for _, message := range messages {
+		message.Offset = p.nextOffset
+		p.nextOffset++
+		p.add(message)
+	}
+	if len(messages) > 0 {
+		p.appended.Notify()
+	}
+
+	return first, nil
+}
+
+// Appended 返回下一次Append时关闭的channel
+func (p *Partition) Appended() <-chan struct{} {
+	return p.appended.Wait()
+}
+
+// add 把已经分配好offset的消息加到末尾，调用方需要持有锁
+func (p *Partition) add(message *Message) {
 	p.Messages = append(p.Messages, message)
+	p.size += message.Size()
+	if n := len(p.timeIndex); n == 0 || message.Timestamp.After(p.timeIndex[n-1].timestamp) {
+		p.timeIndex = append(p.timeIndex, timeIndexEntry{timestamp: message.Timestamp, offset: message.Offset})
+	}
+}
 
-	return offset
+// Snapshot 返回分区中所有消息以及log start offset和下一条消息的offset，用于Broker快照
+func (p *Partition) Snapshot() ([]*Message, int64, int64) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	messages := make([]*Message, len(p.Messages))
+	copy(messages, p.Messages)
+	return messages, p.startOffset, p.nextOffset
 }
 
-func (p *Partition) GetMessages(startOffset int64, maxMessages int) ([]*Message, error) {
+func (p *Partition) Read(startOffset int64, maxMessages int) ([]*Message, error) {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 
-	if startOffset < 0 || startOffset >= int64(len(p.Messages)) {
+	// 早于log start offset的消息已经被清理了，要明确告诉调用方，而不是返回空列表
+	if startOffset < p.startOffset {
+		return nil, fmt.Errorf("%w: offset %d is before log start offset %d", ErrOffsetOutOfRange, startOffset, p.startOffset)
+	}
+
+	start := p.indexOf(startOffset)
+	if start >= len(p.Messages) {
 		return []*Message{}, nil
 	}
 
-	endOffset := startOffset + int64(maxMessages)
-	if endOffset > int64(len(p.Messages)) {
-		endOffset = int64(len(p.Messages))
+	end := start + maxMessages
+	if end > len(p.Messages) {
+		end = len(p.Messages)
 	}
 
-	messages := make([]*Message, endOffset-startOffset)
-	// 疑问1 这里是 深拷贝的意思吗？ 意思是 GetMessages 希望获取从start 到 end 这一段的所有消息
+	messages := make([]*Message, end-start)
+	// 疑问1 这里是 深拷贝的意思吗？ 意思是 Read 希望获取从start 到 end 这一段的所有消息
 	// 但是 希望后续获得这些消息的对象 如果修改了消息， 不会改到p.Messages 里面的内容？
-	copy(messages, p.Messages[startOffset:endOffset])
+	copy(messages, p.Messages[start:end])
 
 	return messages, nil
 }
 
-func (p *Partition) GetLatestOffset() int64 {
+func (p *Partition) LatestOffset() int64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.nextOffset
+}
+
+// indexOf 返回Messages中第一条offset >= offset的消息的下标，调用方需要持有锁
+func (p *Partition) indexOf(offset int64) int {
+	return sort.Search(len(p.Messages), func(i int) bool {
+		return p.Messages[i].Offset >= offset
+	})
+}
+
+// EarliestOffset 返回log start offset，也就是分区中还保留着的最早一条消息的offset
+func (p *Partition) EarliestOffset() int64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.startOffset
+}
+
+// GetSize 返回分区中所有消息占用的字节数
+func (p *Partition) GetSize() int64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.size
+}
+
+// GetMessageCount 返回分区中还保留着的消息数
+func (p *Partition) GetMessageCount() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return len(p.Messages)
+}
+
+// ApplyRetention 从最旧的消息开始，删除早于retentionMs或超出retentionBytes的部分
+// 参数为-1表示不按该维度清理，返回删除的消息数
+func (p *Partition) ApplyRetention(retentionMs, retentionBytes int64, now time.Time) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n := 0
+	size := p.size
+	for n < len(p.Messages) {
+		message := p.Messages[n]
+		expired := retentionMs >= 0 && now.Sub(message.Timestamp) > time.Duration(retentionMs)*time.Millisecond
+		oversized := retentionBytes >= 0 && size > retentionBytes
+		if !expired && !oversized {
+			break
+		}
+		size -= message.Size()
+		n++
+	}
+
+	p.truncateHead(n)
+	return n
+}
+
+// EvictBytes 像环形缓冲区一样从最旧的消息开始删除，直到腾出至少bytes字节或分区为空
+// log start offset随之前进，返回删除的消息数和腾出的字节数
+func (p *Partition) EvictBytes(bytes int64) (int, int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n := 0
+	var freed int64
+	for n < len(p.Messages) && freed < bytes {
+		freed += p.Messages[n].Size()
+		n++
+	}
+
+	p.truncateHead(n)
+	return n, freed
+}
+
+// DeleteRecordsBefore 删除offset之前的所有消息，log start offset前进到offset，返回新的log start offset
+// offset已经不大于log start offset时什么都不做；offset为负数或大于最新offset时返回ErrOffsetOutOfRange
+func (p *Partition) DeleteRecordsBefore(offset int64) (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if offset < 0 || offset > p.nextOffset {
+		return 0, fmt.Errorf("%w: offset %d is not in [0, %d]", ErrOffsetOutOfRange, offset, p.nextOffset)
+	}
+	if offset <= p.startOffset {
+		return p.startOffset, nil
+	}
+	p.truncateHead(p.indexOf(offset))
+	// compact过的分区中offset处可能没有消息，log start offset仍然是请求的offset，和Kafka一致
+	p.startOffset = offset
+	return offset, nil
+}
+
+// truncateHead 删除最旧的n条消息，log start offset随之前进
+func (p *Partition) truncateHead(n int) {
+	if n <= 0 {
+		return
+	}
+	for _, message := range p.Messages[:n] {
+		p.size -= message.Size()
+	}
+	// 清掉底层数组对被删除消息的引用，它们才能被GC回收
+	// 不拷贝剩下的消息：内存满了之后每次写入都要删除旧消息，每次都拷贝整个分区太慢
+	// 底层数组前面空出来的部分在下一次append扩容时释放
+	clear(p.Messages[:n])
+	p.Messages = p.Messages[n:]
+	if len(p.Messages) > 0 {
+		p.startOffset = p.Messages[0].Offset
+	} else {
+		p.startOffset = p.nextOffset
+	}
+
+	i := sort.Search(len(p.timeIndex), func(i int) bool {
+		return p.timeIndex[i].offset >= p.startOffset
+	})
+	p.timeIndex = p.timeIndex[i:]
+}
+
+// Close 内存分区没有需要释放的资源，只是为了实现PartitionStore
+func (p *Partition) Close() error {
+	return nil
+}
+
+// GetOffsetForTimestamp 返回第一条时间戳 >= t 的消息的offset
+// 所有消息都早于t时返回最新offset，也就是从下一条新消息开始消费
+func (p *Partition) GetOffsetForTimestamp(t time.Time) int64 {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 
-	return int64(len(p.Messages))
+	i := sort.Search(len(p.timeIndex), func(i int) bool {
+		return !p.timeIndex[i].timestamp.Before(t)
+	})
+	if i > 0 {
+		if i == len(p.timeIndex) {
+			return p.nextOffset
+		}
+		return p.timeIndex[i].offset
+	}
+
+	// 清理旧消息时，被删消息对应的索引项也删掉了
+	// 第一个索引项之前剩下的消息时间戳不确定，需要逐条检查
+	end := p.nextOffset
+	if len(p.timeIndex) > 0 {
+		end = p.timeIndex[0].offset
+	}
+	for _, message := range p.Messages[:p.indexOf(end)] {
+		if !message.Timestamp.Before(t) {
+			return message.Offset
+		}
+	}
+	return end
+}
+
+// Compact 每个key只保留offset最大的那条消息，其余消息被删除，保留下来的消息offset不变
+// 超过deleteRetentionMs的tombstone也会被删除；没有key的消息无法判断新旧，原样保留
+// 返回删除的消息数
+func (p *Partition) Compact(deleteRetentionMs int64, now time.Time) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	latest := make(map[string]int64)
+	for _, message := range p.Messages {
+		if message.Key != nil {
+			latest[string(message.Key)] = message.Offset
+		}
+	}
+
+	kept := make([]*Message, 0, len(latest))
+	for _, message := range p.Messages {
+		if message.Key != nil {
+			if latest[string(message.Key)] != message.Offset {
+				continue
+			}
+			if message.IsTombstone() && now.Sub(message.Timestamp) > time.Duration(deleteRetentionMs)*time.Millisecond {
+				continue
+			}
+		}
+		kept = append(kept, message)
+	}
+
+	// 时间索引中可能有指向被删除消息的项，按保留下来的消息重建，SeekToTimestamp才不会返回已经不存在的offset
+	removed := len(p.Messages) - len(kept)
+	p.Messages = make([]*Message, 0, len(kept))
+	p.size = 0
+	p.timeIndex = nil
+	for _, message := range kept {
+		p.add(message)
+	}
+	return removed
 }
@@ -0,0 +1,69 @@
+package common
+
+import "sync"
+
+// PartitionStore 一个分区的消息存储引擎，Topic的每个分区都是一个PartitionStore
+// 现在有三种实现：内存中的Partition、storage.Log分段日志和storage.FileStore单文件存储，
+// 它们的行为必须完全一致，见internal/storetest
+type PartitionStore interface {
+	// Append 按顺序为消息分配连续的offset（写回每条消息的Offset字段）并追加到末尾，返回第一条消息的offset
+	// 多条消息要么全部写入要么都不写入；没有消息时什么都不做，返回LatestOffset
+	Append(messages ...*Message) (int64, error)
+
+	// Read 从offset开始读取最多maxMessages条消息
+	// offset早于log start offset时返回ErrOffsetOutOfRange，读到末尾时返回空列表
+	Read(offset int64, maxMessages int) ([]*Message, error)
+
+	// LatestOffset 返回下一条消息将要使用的offset
+	LatestOffset() int64
+
+	// EarliestOffset 返回log start offset，更早的消息已经被清理
+	EarliestOffset() int64
+
+	// DeleteRecordsBefore 截掉offset之前的所有消息，log start offset前进到offset，返回新的log start offset
+	// offset已经不大于log start offset时什么都不做；offset为负数或大于LatestOffset时返回ErrOffsetOutOfRange
+	DeleteRecordsBefore(offset int64) (int64, error)
+
+	// Appended 返回一个channel，之后第一次追加消息时关闭，长轮询的Consume用它等待新消息而不用轮询
+	// 要先拿到channel再读取，读取之后才追加的消息一定会关闭它
+	Appended() <-chan struct{}
+
+	// Close 释放引擎持有的文件等资源，之后不能再使用
+	Close() error
+}
+
+// AppendNotifier 存储引擎用它实现Appended：追加的消息可以读到之后调用Notify，零值可以直接使用
+// 等待者共用同一个channel，Notify关闭它就唤醒了所有等待者，下一次Wait再创建新的
+type AppendNotifier struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+// Wait 返回下一次Notify时关闭的channel
+func (n *AppendNotifier) Wait() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.ch == nil {
+		n.ch = make(chan struct{})
+	}
+	return n.ch
+}
+
+// Notify 唤醒所有等待者，没有等待者时什么都不做
+func (n *AppendNotifier) Notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.ch != nil {
+		close(n.ch)
+		n.ch = nil
+	}
+}
+
+// storage.engine 的取值，决定Topic的分区用哪种PartitionStore
+const (
+	StorageEngineMemory    = "memory"    // 消息保存在内存中的Partition里，重启后丢失
+	StorageEngineSegmented = "segmented" // storage.Log：每个分区一个目录，按segment滚动，有稀疏索引
+	StorageEngineFile      = "file"      // storage.FileStore：每个分区一个文件，适合消息量不大的嵌入式场景
+)
@@ -0,0 +1,38 @@
+package common_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kafka-from-scratch/internal/common"
+	"github.com/kafka-from-scratch/internal/storetest"
+)
+
+func TestPartitionStore(t *testing.T) {
+	storetest.Run(t, storetest.Engine{
+		Open: func(dir string) (common.PartitionStore, error) {
+			return common.NewPartition(0), nil
+		},
+	})
+}
+
+func TestCompactRebuildsTimeIndex(t *testing.T) {
+	p := common.NewPartition(0)
+	base := time.UnixMilli(1700000000000)
+	for i, key := range []string{"a", "a", "b"} {
+		message := &common.Message{Key: []byte(key), Value: []byte("v"), Timestamp: base.Add(time.Duration(i) * time.Second)}
+		if _, err := p.Append(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if removed := p.Compact(0, base); removed != 1 {
+		t.Fatalf("compact removed %d messages, want 1", removed)
+	}
+	// offset 0被删掉了，最早的消息是offset 1
+	if offset := p.GetOffsetForTimestamp(base.Add(-time.Second)); offset != 1 {
+		t.Fatalf("offset for timestamp before all messages is %d, want 1", offset)
+	}
+	if offset := p.GetOffsetForTimestamp(base.Add(2 * time.Second)); offset != 2 {
+		t.Fatalf("offset for the last timestamp is %d, want 2", offset)
+	}
+}
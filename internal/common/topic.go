@@ -2,38 +2,50 @@ package common
 
 import (
 	"fmt"
-	"hash/maphash"
+	"hash/fnv"
 	"sync"
 )
 
 type Topic struct {
 	Name       string
-	Partitions []*Partition
+	Partitions []PartitionStore // 下标就是分区ID
+	Config     TopicConfig
 	mu         sync.RWMutex
 }
 
 func NewTopic(name string, numPartitions int32) *Topic {
+	return NewTopicWithConfig(name, numPartitions, DefaultTopicConfig())
+}
+
+// NewTopicWithConfig 使用指定的Topic配置创建Topic
+func NewTopicWithConfig(name string, numPartitions int32, config TopicConfig) *Topic {
 	if numPartitions <= 0 {
 		numPartitions = 1
 	}
 
-	partitions := make([]*Partition, numPartitions)
+	partitions := make([]PartitionStore, numPartitions)
 	for i := int32(0); i < numPartitions; i++ {
 		partitions[i] = NewPartition(i)
 	}
 
+	return NewTopicWithStores(name, config, partitions)
+}
+
+// NewTopicWithStores 用已经打开的存储引擎创建Topic，stores[i]是分区i
+func NewTopicWithStores(name string, config TopicConfig, stores []PartitionStore) *Topic {
 	return &Topic{
 		Name:       name,
-		Partitions: partitions,
+		Partitions: stores,
+		Config:     config,
 	}
 }
 
-func (t *Topic) GetPartition(partitionID int32) (*Partition, error) {
+func (t *Topic) GetPartition(partitionID int32) (PartitionStore, error) {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
 
 	if partitionID < 0 || partitionID >= int32(len(t.Partitions)) {
-		return nil, fmt.Errorf("partition %d does not exist in topic %s", partitionID, t.Name)
+		return nil, fmt.Errorf("%w: %d does not exist in topic %s", ErrUnknownPartition, partitionID, t.Name)
 	}
 
 	return t.Partitions[partitionID], nil
@@ -46,17 +58,23 @@ func (t *Topic) GetPartition(partitionID int32) (*Partition, error) {
 // 2. 使用hash函数计算key的哈希值
 // 3. 用哈希值对分区数量取模，得到分区ID
 // 4. 注意处理负数情况
-func (t *Topic) GetPartitionForKey(key []byte) *Partition {
+// 返回分区ID和分区
+func (t *Topic) GetPartitionForKey(key []byte) (int32, PartitionStore) {
 	// TODO: 在这里实现分区选择逻辑
+	index := t.PartitionIDForKey(key)
+	return index, t.Partitions[index]
+}
+
+// PartitionIDForKey 和GetPartitionForKey选择同一个分区，只返回分区ID
+// 和DiskBroker一样用FNV哈希：零值的maphash.Hash每次都用新的随机种子，同一个key会落到不同的分区
+func (t *Topic) PartitionIDForKey(key []byte) int32 {
 	if len(key) <= 0 {
-		return t.Partitions[0]
+		return 0
 	}
 	count := t.GetPartitionCount()
-	var h maphash.Hash
-	h.WriteString(string(key))
-	index := h.Sum64() % uint64(count)
-	fmt.Printf("index ========= %d\n", index)
-	return t.Partitions[index]
+	h := fnv.New32a()
+	h.Write(key)
+	return int32(h.Sum32() % uint32(count))
 }
 
 func (t *Topic) GetPartitionCount() int32 {
@@ -74,7 +92,24 @@ func (t *Topic) GetPartitionCount() int32 {
 // 3. 返回分区ID和消息的offset
 func (t *Topic) ProduceMessage(message *Message) (int32, int64, error) {
 	// TODO: 在这里实现消息生产逻辑
-	partition := t.GetPartitionForKey(message.Key)
-	partition.Append(message)
-	return partition.ID, message.Offset, nil
+	partitionID, partition := t.GetPartitionForKey(message.Key)
+	offset, err := partition.Append(message)
+	if err != nil {
+		return 0, 0, err
+	}
+	return partitionID, offset, nil
+}
+
+// Close 关闭所有分区的存储引擎，返回遇到的第一个错误
+func (t *Topic) Close() error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var firstErr error
+	for _, partition := range t.Partitions {
+		if err := partition.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
 }
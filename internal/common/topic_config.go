@@ -0,0 +1,278 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Topic配置项的名字，和Kafka的topic config保持一致
+const (
+	ConfigRetentionMs       = "retention.ms"
+	ConfigRetentionBytes    = "retention.bytes"
+	ConfigCleanupPolicy     = "cleanup.policy"
+	ConfigDeleteRetentionMs = "delete.retention.ms"
+	ConfigFlushMessages     = "flush.messages"
+	ConfigFlushMs           = "flush.ms"
+
+	ConfigRemoteStorageEnable = "remote.storage.enable"
+	ConfigLocalRetentionMs    = "local.retention.ms"
+	ConfigLocalRetentionBytes = "local.retention.bytes"
+
+	ConfigMemoryMaxBytes = "memory.max.bytes"
+
+	ConfigStorageEngine = "storage.engine"
+)
+
+// cleanup.policy 的取值
+const (
+	CleanupPolicyDelete        = "delete"         // 按retention.ms/retention.bytes删除旧消息
+	CleanupPolicyCompact       = "compact"        // 每个key只保留最新的一条
+	CleanupPolicyCompactDelete = "compact,delete" // 两者都做
+)
+
+const (
+	// DefaultRetentionMs 默认保留7天，和Kafka一致
+	DefaultRetentionMs = int64(7 * 24 * time.Hour / time.Millisecond)
+
+	// DefaultDeleteRetentionMs tombstone默认保留1天，和Kafka一致
+	DefaultDeleteRetentionMs = int64(24 * time.Hour / time.Millisecond)
+
+	// LocalRetentionSameAsTotal local.retention.*的默认值，表示和retention.*相同，和Kafka一致
+	LocalRetentionSameAsTotal = -2
+)
+
+// TopicConfig Topic级别的配置
+type TopicConfig struct {
+	// RetentionMs 消息保留时间(毫秒)，超过这个时间的消息会被后台清理，-1表示不限制
+	RetentionMs int64
+
+	// RetentionBytes 每个分区最多保留的字节数，超出的最旧消息会被清理，-1表示不限制
+	RetentionBytes int64
+
+	// CleanupPolicy 旧消息的清理方式，见CleanupPolicyXxx
+	CleanupPolicy string
+
+	// DeleteRetentionMs compact模式下tombstone(value为nil的消息)至少保留多久才会被删除
+	// 保证消费者有足够的时间看到这个删除
+	DeleteRetentionMs int64
+
+	// FlushMessages 和 FlushMs 决定消息什么时候fsync到磁盘，以及Producer什么时候收到确认:
+	//   FlushMessages = 1:                 每条消息fsync之后才确认，并发写入同一分区时共用一次fsync
+	//   FlushMessages > 1 或 FlushMs >= 0: 攒够FlushMessages条或每隔FlushMs毫秒fsync一次，消息被fsync之后才确认
+	//   都为-1:                            交给操作系统的page cache，写入后立即确认（默认）
+	FlushMessages int64
+	FlushMs       int64
+
+	// RemoteStorageEnable 是否开启分层存储：只读segment上传到Broker配置的远程存储，
+	// 本地只按LocalRetentionMs/LocalRetentionBytes保留，retention.ms/retention.bytes是远程加本地的总保留策略
+	RemoteStorageEnable bool
+
+	// LocalRetentionMs 和 LocalRetentionBytes 开启分层存储时本地磁盘的保留策略，不能超过总的保留策略
+	// LocalRetentionSameAsTotal(-2)表示和retention.ms/retention.bytes相同
+	LocalRetentionMs    int64
+	LocalRetentionBytes int64
+
+	// MemoryMaxBytes 内存版Broker中这个Topic所有分区的消息最多占用的字节数(按Message.Size计算)，-1表示不限制
+	// 超出时的处理方式由Broker的MemoryConfig.FullPolicy决定；磁盘版Broker忽略这个配置
+	MemoryMaxBytes int64
+
+	// StorageEngine 分区使用的存储引擎，见StorageEngineXxx，只能在创建Topic时指定
+	// 为空表示使用Broker自己的引擎：内存版Broker是memory，磁盘版Broker是segmented
+	StorageEngine string
+}
+
+// DefaultTopicConfig 返回默认的Topic配置
+func DefaultTopicConfig() TopicConfig {
+	return TopicConfig{
+		RetentionMs:       DefaultRetentionMs,
+		RetentionBytes:    -1,
+		CleanupPolicy:     CleanupPolicyDelete,
+		DeleteRetentionMs: DefaultDeleteRetentionMs,
+		FlushMessages:     -1,
+		FlushMs:           -1,
+
+		LocalRetentionMs:    LocalRetentionSameAsTotal,
+		LocalRetentionBytes: LocalRetentionSameAsTotal,
+
+		MemoryMaxBytes: -1,
+	}
+}
+
+// ShouldDelete 是否按retention.ms/retention.bytes删除旧消息
+func (c TopicConfig) ShouldDelete() bool {
+	return c.CleanupPolicy == CleanupPolicyDelete || c.CleanupPolicy == CleanupPolicyCompactDelete
+}
+
+// ShouldCompact 是否按key压缩
+func (c TopicConfig) ShouldCompact() bool {
+	return c.CleanupPolicy == CleanupPolicyCompact || c.CleanupPolicy == CleanupPolicyCompactDelete
+}
+
+// LocalRetention 返回开启分层存储时本地实际使用的retention.ms和retention.bytes
+func (c TopicConfig) LocalRetention() (int64, int64) {
+	retentionMs, retentionBytes := c.LocalRetentionMs, c.LocalRetentionBytes
+	if retentionMs == LocalRetentionSameAsTotal {
+		retentionMs = c.RetentionMs
+	}
+	if retentionBytes == LocalRetentionSameAsTotal {
+		retentionBytes = c.RetentionBytes
+	}
+	return retentionMs, retentionBytes
+}
+
+// Configs 把TopicConfig转换回 "retention.ms" -> "3600000" 这样的配置项，ParseTopicConfig的逆操作
+// 没有指定storage.engine时不输出这一项
+func (c TopicConfig) Configs() map[string]string {
+	configs := map[string]string{
+		ConfigRetentionMs:         strconv.FormatInt(c.RetentionMs, 10),
+		ConfigRetentionBytes:      strconv.FormatInt(c.RetentionBytes, 10),
+		ConfigCleanupPolicy:       c.CleanupPolicy,
+		ConfigDeleteRetentionMs:   strconv.FormatInt(c.DeleteRetentionMs, 10),
+		ConfigFlushMessages:       strconv.FormatInt(c.FlushMessages, 10),
+		ConfigFlushMs:             strconv.FormatInt(c.FlushMs, 10),
+		ConfigRemoteStorageEnable: strconv.FormatBool(c.RemoteStorageEnable),
+		ConfigLocalRetentionMs:    strconv.FormatInt(c.LocalRetentionMs, 10),
+		ConfigLocalRetentionBytes: strconv.FormatInt(c.LocalRetentionBytes, 10),
+		ConfigMemoryMaxBytes:      strconv.FormatInt(c.MemoryMaxBytes, 10),
+	}
+	if c.StorageEngine != "" {
+		configs[ConfigStorageEngine] = c.StorageEngine
+	}
+	return configs
+}
+
+// ParseTopicConfig 把 "retention.ms" -> "3600000" 这样的配置项解析成TopicConfig
+// 没有出现的配置项使用默认值，不认识的配置项返回错误
+func ParseTopicConfig(configs map[string]string) (TopicConfig, error) {
+	config := DefaultTopicConfig()
+	for name, value := range configs {
+		switch name {
+		case ConfigRetentionMs:
+			v, err := parseConfigInt(name, value)
+			if err != nil {
+				return config, err
+			}
+			config.RetentionMs = v
+		case ConfigRetentionBytes:
+			v, err := parseConfigInt(name, value)
+			if err != nil {
+				return config, err
+			}
+			config.RetentionBytes = v
+		case ConfigCleanupPolicy:
+			switch value {
+			case CleanupPolicyDelete, CleanupPolicyCompact, CleanupPolicyCompactDelete:
+				config.CleanupPolicy = value
+			case "delete,compact":
+				config.CleanupPolicy = CleanupPolicyCompactDelete
+			default:
+				return config, fmt.Errorf("invalid value %q for topic config %s", value, name)
+			}
+		case ConfigDeleteRetentionMs:
+			v, err := parseConfigInt(name, value)
+			if err != nil {
+				return config, err
+			}
+			config.DeleteRetentionMs = v
+		case ConfigFlushMessages:
+			v, err := parseConfigInt(name, value)
+			if err != nil {
+				return config, err
+			}
+			if v == 0 {
+				return config, fmt.Errorf("invalid value %q for topic config %s: must be -1 or >= 1", value, name)
+			}
+			config.FlushMessages = v
+		case ConfigFlushMs:
+			v, err := parseConfigInt(name, value)
+			if err != nil {
+				return config, err
+			}
+			config.FlushMs = v
+		case ConfigRemoteStorageEnable:
+			v, err := strconv.ParseBool(value)
+			if err != nil {
+				return config, fmt.Errorf("invalid value %q for topic config %s: %w", value, name, err)
+			}
+			config.RemoteStorageEnable = v
+		case ConfigLocalRetentionMs, ConfigLocalRetentionBytes:
+			v, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return config, fmt.Errorf("invalid value %q for topic config %s: %w", value, name, err)
+			}
+			if v < LocalRetentionSameAsTotal {
+				return config, fmt.Errorf("invalid value %q for topic config %s: must be >= %d", value, name, LocalRetentionSameAsTotal)
+			}
+			if name == ConfigLocalRetentionMs {
+				config.LocalRetentionMs = v
+			} else {
+				config.LocalRetentionBytes = v
+			}
+		case ConfigMemoryMaxBytes:
+			v, err := parseConfigInt(name, value)
+			if err != nil {
+				return config, err
+			}
+			config.MemoryMaxBytes = v
+		case ConfigStorageEngine:
+			switch value {
+			case StorageEngineMemory, StorageEngineSegmented, StorageEngineFile:
+				config.StorageEngine = value
+			default:
+				return config, fmt.Errorf("invalid value %q for topic config %s: must be %s, %s or %s",
+					value, name, StorageEngineMemory, StorageEngineSegmented, StorageEngineFile)
+			}
+		default:
+			return config, fmt.Errorf("unknown topic config %q", name)
+		}
+	}
+
+	// 只按条数攒批的话，流量小的时候消息可能永远等不到fsync，Producer会一直收不到确认
+	if config.FlushMessages > 1 && config.FlushMs < 0 {
+		return config, fmt.Errorf("topic config %s > 1 requires %s to be set", ConfigFlushMessages, ConfigFlushMs)
+	}
+
+	// 单文件存储只支持截掉开头的消息，没法在中间删除
+	if config.StorageEngine == StorageEngineFile && config.ShouldCompact() {
+		return config, fmt.Errorf("topic config %s=%s cannot be used with %s=%s", ConfigStorageEngine, config.StorageEngine, ConfigCleanupPolicy, config.CleanupPolicy)
+	}
+
+	if config.RemoteStorageEnable {
+		// 只有分段日志有可以上传的只读segment
+		if config.StorageEngine != "" && config.StorageEngine != StorageEngineSegmented {
+			return config, fmt.Errorf("topic config %s=true cannot be used with %s=%s", ConfigRemoteStorageEnable, ConfigStorageEngine, config.StorageEngine)
+		}
+		// compact会改写只读segment，已经上传的副本就和本地不一致了
+		if config.ShouldCompact() {
+			return config, fmt.Errorf("topic config %s=true cannot be used with %s=%s", ConfigRemoteStorageEnable, ConfigCleanupPolicy, config.CleanupPolicy)
+		}
+		localMs, localBytes := config.LocalRetention()
+		if err := checkLocalRetention(ConfigLocalRetentionMs, localMs, ConfigRetentionMs, config.RetentionMs); err != nil {
+			return config, err
+		}
+		if err := checkLocalRetention(ConfigLocalRetentionBytes, localBytes, ConfigRetentionBytes, config.RetentionBytes); err != nil {
+			return config, err
+		}
+	}
+	return config, nil
+}
+
+// checkLocalRetention 本地保留的数据不能比总共保留的多，-1表示不限制
+func checkLocalRetention(localName string, local int64, totalName string, total int64) error {
+	if total >= 0 && (local < 0 || local > total) {
+		return fmt.Errorf("topic config %s=%d must not exceed %s=%d", localName, local, totalName, total)
+	}
+	return nil
+}
+
+func parseConfigInt(name, value string) (int64, error) {
+	v, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q for topic config %s: %w", value, name, err)
+	}
+	if v < -1 {
+		return 0, fmt.Errorf("invalid value %q for topic config %s: must be >= -1", value, name)
+	}
+	return v, nil
+}
@@ -2,10 +2,12 @@ package coordinator
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/kafka-from-scratch/internal/broker"
+	"github.com/kafka-from-scratch/internal/common"
 	"github.com/kafka-from-scratch/internal/protocol"
 )
 
@@ -59,7 +61,7 @@ type ConsumerGroup struct {
 // GroupCoordinator 管理所有Consumer Group的协调器
 type GroupCoordinator struct {
 	groups map[string]*ConsumerGroup // groupId -> group
-	broker *broker.MemoryBroker      // 访问Topic和分区信息
+	broker broker.Broker             // 访问Topic和分区信息
 	mutex  sync.RWMutex
 
 	// 心跳检测
@@ -70,7 +72,7 @@ type GroupCoordinator struct {
 // ==================== 构造函数 ====================
 
 // NewGroupCoordinator 创建新的Group Coordinator
-func NewGroupCoordinator(broker *broker.MemoryBroker) *GroupCoordinator {
+func NewGroupCoordinator(broker broker.Broker) *GroupCoordinator {
 	gc := &GroupCoordinator{
 		groups:   make(map[string]*ConsumerGroup),
 		broker:   broker,
@@ -129,49 +131,86 @@ func (gc *GroupCoordinator) HandleJoinGroup(req *protocol.JoinGroupRequest) (*pr
 	// 获取或创建group
 	group := gc.getOrCreateGroup(req.GroupId)
 
-	// TODO: 实现具体逻辑
-	resp := &protocol.JoinGroupResponse{
-		ConsumerId: req.ConsumerId,
-		LeaderId:   group.LeaderId,
-		Generation: group.Generation,
+	sessionTimeout := int64(req.SessionTimeout)
+	if sessionTimeout <= 0 {
+		sessionTimeout = SessionTimeout
+	}
+	if member, exists := group.Members[req.ConsumerId]; exists {
+		// 已经在Group中，例如Generation过期之后重新JoinGroup，订阅没有变化时不需要Rebalance，返回当前的Generation
+		member.LastHeartbeat = time.Now()
+		member.SessionTimeout = sessionTimeout
+		if sameTopics(member.Topics, req.Topics) {
+			return joinGroupResponse(group, req.ConsumerId), nil
+		}
+		member.Topics = req.Topics
+	} else {
+		// 如果不存在， 证明这是第一个进入ConsumerGroup的 Consumer， 那么他应该是Leader 也是member?
+		group.Members[req.ConsumerId] = &GroupMember{
+			ConsumerId:     req.ConsumerId,
+			ClientId:       req.ClientId, // 客户端自己起的名字，只用来在日志里区分是哪个客户端
+			Topics:         req.Topics,
+			LastHeartbeat:  time.Now(),
+			SessionTimeout: sessionTimeout,
+		}
 	}
 
+	// 下面这个 操作真费劲， 为啥不直接用map 来管理Topics 这种array呢？
+	group.Topics = subscribedTopics(group)
+
+	// 我们不做增量判断rebalance 吧， 只要加入consumer 就一定rebalance
+	// 分区在Coordinator这里分配，Rebalance在持有锁时同步完成，返回的就是新的Generation
+	if err := gc.performRebalance(group); err != nil {
+		return nil, err
+	}
+	return joinGroupResponse(group, req.ConsumerId), nil
+}
+
+// joinGroupResponse 返回Group当前的Generation、Leader和按ID排序的成员列表
+func joinGroupResponse(group *ConsumerGroup, consumerId string) *protocol.JoinGroupResponse {
 	members := make([]string, 0, len(group.Members))
 	for memberId := range group.Members {
 		members = append(members, memberId)
 	}
-	resp.Members = members
-	if _, exists := group.Members[req.ConsumerId]; exists {
-		return resp, nil
+	sort.Strings(members)
+	return &protocol.JoinGroupResponse{
+		ConsumerId: consumerId,
+		LeaderId:   group.LeaderId,
+		Generation: group.Generation,
+		Members:    members,
 	}
-	// 如果不存在， 证明这是第一个进入ConsumerGroup的 Consumer， 那么他应该是Leader 也是member?
-	resp.Members = append(resp.Members, req.ConsumerId)
+}
 
-	group.Members[req.ConsumerId] = &GroupMember{
-		ConsumerId: req.ConsumerId,
-		// ClientId: , // 啥事clientId ？ 不懂
-		Topics:         make([]string, 0),
-		LastHeartbeat:  time.Now(),
-		SessionTimeout: SessionTimeout,
+// sameTopics 两个订阅列表是否包含同样的Topic，不考虑顺序
+func sameTopics(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
 	}
-
-	// 下面这个 操作真费劲， 为啥不直接用map 来管理Topics 这种array呢？
-	reqTopicSet := make(map[string]struct{})
-	needToAppend := make(map[string]struct{})
-	for _, t := range req.Topics {
-		reqTopicSet[t] = struct{}{}
+	set := make(map[string]struct{}, len(a))
+	for _, topic := range a {
+		set[topic] = struct{}{}
 	}
-	for _, topic := range group.Topics {
-		if _, exists := reqTopicSet[topic]; !exists {
-			needToAppend[topic] = struct{}{}
+	for _, topic := range b {
+		if _, ok := set[topic]; !ok {
+			return false
 		}
 	}
-	for topic, _ := range needToAppend {
-		group.Topics = append(group.Topics, topic)
+	return true
+}
+
+// subscribedTopics 所有成员订阅的Topic的并集，排好序
+func subscribedTopics(group *ConsumerGroup) []string {
+	set := make(map[string]struct{})
+	for _, member := range group.Members {
+		for _, topic := range member.Topics {
+			set[topic] = struct{}{}
+		}
 	}
-	// 我们不做增量判断rebalance 吧， 只要加入consumer 就一定rebalance
-	go gc.performRebalance(group)
-	return resp, nil
+	topics := make([]string, 0, len(set))
+	for topic := range set {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
 }
 
 // ==================== 🤔 考察题2: Rebalance触发时机 ====================
@@ -191,7 +230,7 @@ func (gc *GroupCoordinator) HandleSyncGroup(req *protocol.SyncGroupRequest) (*pr
 
 	group, exists := gc.groups[req.GroupId]
 	if !exists {
-		return nil, fmt.Errorf("unknown group: %s", req.GroupId)
+		return nil, fmt.Errorf("%w: %s", common.ErrUnknownGroup, req.GroupId)
 	}
 
 	// TODO: 你来实现SyncGroup的逻辑
@@ -209,18 +248,50 @@ func (gc *GroupCoordinator) HandleSyncGroup(req *protocol.SyncGroupRequest) (*pr
 	resp := &protocol.SyncGroupResponse{
 		Assignment: make([]protocol.Assignment, 0),
 	}
-	// TODO: 实现具体逻辑
+	if _, exists := group.Members[req.ConsumerId]; !exists {
+		return nil, fmt.Errorf("%w: %s", common.ErrUnknownMember, req.ConsumerId)
+	}
 	if req.Generation != group.Generation {
-		return nil, fmt.Errorf("please rejoin the group")
+		return nil, fmt.Errorf("%w: please rejoin the group", common.ErrIllegalGeneration)
 	}
 	if group.State != StateStable {
 		// return resp, nil 是不是简单返回错误让客户端重试就行? 这里因为
-		return nil, fmt.Errorf("rebalanceing please wait")
+		return nil, fmt.Errorf("%w: please wait", common.ErrRebalanceInProgress)
 	}
-	resp.Assignment = group.Assignment[req.ConsumerId]
+	resp.Assignment = append(resp.Assignment, group.Assignment[req.ConsumerId]...)
 	return resp, nil
 }
 
+// HandleLeaveGroup 处理Consumer主动离开Group的请求，剩下的成员重新分配分区
+func (gc *GroupCoordinator) HandleLeaveGroup(req *protocol.LeaveGroupRequest) (*protocol.LeaveGroupResponse, error) {
+	gc.mutex.Lock()
+	defer gc.mutex.Unlock()
+
+	fmt.Printf("👋 Handling LeaveGroup: groupId=%s, consumerId=%s\n", req.GroupId, req.ConsumerId)
+
+	group, exists := gc.groups[req.GroupId]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", common.ErrUnknownGroup, req.GroupId)
+	}
+	if _, exists := group.Members[req.ConsumerId]; !exists {
+		return nil, fmt.Errorf("%w: %s", common.ErrUnknownMember, req.ConsumerId)
+	}
+	if err := gc.removeMembers(group, req.ConsumerId); err != nil {
+		return nil, err
+	}
+	return &protocol.LeaveGroupResponse{}, nil
+}
+
+// removeMembers 移除成员之后Rebalance，提交过的offset保留在Group中，之后加入的成员从这些offset继续消费
+func (gc *GroupCoordinator) removeMembers(group *ConsumerGroup, consumerIds ...string) error {
+	for _, consumerId := range consumerIds {
+		delete(group.Members, consumerId)
+		delete(group.Assignment, consumerId)
+	}
+	group.Topics = subscribedTopics(group)
+	return gc.performRebalance(group)
+}
+
 // ==================== 🤔 考察题3: Generation机制设计 ====================
 // 问题: 为什么需要Generation机制？如果没有Generation会发生什么？
 // 场景: Consumer-A正在处理消息，此时发生Rebalance，Consumer-A的分区被分配给了Consumer-B
@@ -245,19 +316,19 @@ func (gc *GroupCoordinator) HandleHeartbeat(req *protocol.HeartbeatRequest) (*pr
 	// TODO: 实现具体逻辑
 	if _, exists := gc.groups[req.GroupId]; !exists {
 		// 如果组都还不存在 应该joinGroup
-		return nil, fmt.Errorf("please rejoin the group")
+		return nil, fmt.Errorf("%w: %s, please rejoin the group", common.ErrUnknownGroup, req.GroupId)
 	}
 	group := gc.groups[req.GroupId]
 	if req.Generation != group.Generation {
 		// 我不理解  这个协议这里为什么要通知Consumer 进行rebalance? consumer 怎么进行rebalance , rebalance 不应该是 coordinator 把 这个group 的这个topic 的这些 partition rebalance 给所有这个组的consumer吗?
 		// consumer 需要做什么? 他们等待rebalance 结果就行吧,
 		// return
-		return nil, fmt.Errorf("please rejoin the group")
+		return nil, fmt.Errorf("%w: please rejoin the group", common.ErrIllegalGeneration)
 	}
 
 	member, exists := group.Members[req.ConsumerId]
 	if !exists {
-		return nil, fmt.Errorf("consumer not found")
+		return nil, fmt.Errorf("%w: %s", common.ErrUnknownMember, req.ConsumerId)
 	}
 	member.LastHeartbeat = time.Now()
 	return &protocol.HeartbeatResponse{
@@ -283,7 +354,6 @@ func (gc *GroupCoordinator) HandleCommitOffset(req *protocol.CommitOffsetRequest
 	gc.mutex.Lock()
 	defer gc.mutex.Unlock()
 
-	// TODO: 你来实现CommitOffset逻辑
 	// 提示流程:
 	// 1. 验证Group、Member、Generation
 	// 2. 验证Consumer是否拥有要提交offset的分区
@@ -293,8 +363,35 @@ func (gc *GroupCoordinator) HandleCommitOffset(req *protocol.CommitOffsetRequest
 	fmt.Printf("📌 Handling CommitOffset: groupId=%s, consumerId=%s, offsets=%v\n",
 		req.GroupId, req.ConsumerId, req.Offsets)
 
-	// TODO: 实现具体逻辑
-	panic("TODO: 实现CommitOffset逻辑")
+	group, exists := gc.groups[req.GroupId]
+	if req.ConsumerId == "" && req.Generation < 0 {
+		// 不加入Group、自己指定分区的Consumer用Generation -1提交，和Kafka一样只允许提交到没有成员的Group
+		group = gc.getOrCreateGroup(req.GroupId)
+		if len(group.Members) > 0 {
+			return nil, fmt.Errorf("%w: group %s has members, commit with a member id and generation", common.ErrUnknownMember, req.GroupId)
+		}
+	} else {
+		// 和上面梳理的一样，只检查成员和Generation，不检查分区是不是分配给了这个成员
+		if !exists {
+			return nil, fmt.Errorf("%w: %s", common.ErrUnknownGroup, req.GroupId)
+		}
+		if _, exists := group.Members[req.ConsumerId]; !exists {
+			return nil, fmt.Errorf("%w: %s", common.ErrUnknownMember, req.ConsumerId)
+		}
+		if req.Generation != group.Generation {
+			return nil, fmt.Errorf("%w: please rejoin the group", common.ErrIllegalGeneration)
+		}
+	}
+
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+	for _, o := range req.Offsets {
+		if group.Offsets[o.Topic] == nil {
+			group.Offsets[o.Topic] = make(map[int32]int64)
+		}
+		group.Offsets[o.Topic][o.PartitionId] = o.Offset
+	}
+	return &protocol.CommitOffsetResponse{}, nil
 }
 
 // HandleGetOffset 处理获取offset请求
@@ -302,14 +399,19 @@ func (gc *GroupCoordinator) HandleGetOffset(req *protocol.GetOffsetRequest) (*pr
 	gc.mutex.RLock()
 	defer gc.mutex.RUnlock()
 
-	// TODO: 你来实现GetOffset逻辑
-	// 提示: 从group.Offsets中查找对应的offset，如果不存在返回0
-
 	fmt.Printf("📍 Handling GetOffset: groupId=%s, topic=%s, partition=%d\n",
 		req.GroupId, req.Topic, req.PartitionId)
 
-	// TODO: 实现具体逻辑
-	panic("TODO: 实现GetOffset逻辑")
+	// 没有提交过时返回-1而不是0：0是合法的offset，Consumer要靠-1判断是从头还是从最新位置开始，和Kafka的OffsetFetch一样
+	resp := &protocol.GetOffsetResponse{Offset: -1}
+	if group, exists := gc.groups[req.GroupId]; exists {
+		group.mutex.RLock()
+		if offset, ok := group.Offsets[req.Topic][req.PartitionId]; ok {
+			resp.Offset = offset
+		}
+		group.mutex.RUnlock()
+	}
+	return resp, nil
 }
 
 // ==================== 🤔 考察题5: Rebalance算法选择 ====================
@@ -324,7 +426,6 @@ func (gc *GroupCoordinator) performRebalance(group *ConsumerGroup) error {
 	fmt.Printf("🔄 Starting rebalance for group %s, generation %d -> %d\n",
 		group.GroupId, group.Generation, group.Generation+1)
 
-	// TODO: 你来实现Rebalance算法
 	// 提示流程:
 	// 1. 收集所有需要分配的分区（来自group.Topics）
 	// 2. 使用Round Robin算法分配分区给Members
@@ -332,11 +433,59 @@ func (gc *GroupCoordinator) performRebalance(group *ConsumerGroup) error {
 	// 4. 增加group.Generation
 	// 5. 设置group.State = StateStable
 
+	// 调用方持有gc.mutex，分配是同步完成的，中间状态别人看不到
+	group.State = StateRebalancing
+
 	// 增加generation
 	group.Generation++
 
-	// TODO: 实现分区分配算法
-	panic("TODO: 实现Rebalance算法")
+	memberIds := make([]string, 0, len(group.Members))
+	for memberId := range group.Members {
+		memberIds = append(memberIds, memberId)
+	}
+	sort.Strings(memberIds)
+
+	// 所有Topic的分区排成一列，依次分给订阅了这个Topic的成员，和Kafka的RoundRobinAssignor一样
+	// 订阅不同Topic的成员只会分到自己订阅的Topic的分区
+	assignment := make(map[string][]protocol.Assignment, len(memberIds))
+	next := 0
+	for _, topic := range group.Topics {
+		var subscribers []string
+		for _, memberId := range memberIds {
+			for _, t := range group.Members[memberId].Topics {
+				if t == topic {
+					subscribers = append(subscribers, memberId)
+					break
+				}
+			}
+		}
+		if len(subscribers) == 0 {
+			continue
+		}
+		partitions, err := gc.getTopicPartitions(topic)
+		if err != nil {
+			// Topic还不存在时先跳过，成员在Topic创建之后重新JoinGroup时再分配
+			fmt.Printf("⚠️ Skipping topic %s in rebalance of group %s: %v\n", topic, group.GroupId, err)
+			continue
+		}
+		for _, partition := range partitions {
+			memberId := subscribers[next%len(subscribers)]
+			assignment[memberId] = append(assignment[memberId], partition)
+			next++
+		}
+	}
+	group.Assignment = assignment
+
+	if _, exists := group.Members[group.LeaderId]; !exists {
+		group.LeaderId = ""
+		if len(memberIds) > 0 {
+			group.LeaderId = memberIds[0]
+		}
+	}
+	group.State = StateStable
+	fmt.Printf("✅ Rebalance of group %s finished: generation %d, %d members\n",
+		group.GroupId, group.Generation, len(memberIds))
+	return nil
 }
 
 // ==================== 辅助方法 ====================
@@ -365,15 +514,22 @@ func (gc *GroupCoordinator) getOrCreateGroup(groupId string) *ConsumerGroup {
 func (gc *GroupCoordinator) getTopicPartitions(topicName string) ([]protocol.Assignment, error) {
 	// TODO: 你来实现这个方法
 	// 提示:
-	// 1. 通过gc.broker.GetTopic(topicName)获取topic
+	// 1. 通过gc.broker.GetPartitionCount(topicName)获取topic的分区数
 	// 2. 遍历topic的所有分区
 	// 3. 创建Assignment列表返回
 	// 4. 如果topic不存在，返回适当的错误
 
 	fmt.Printf("🔍 Getting partitions for topic: %s\n", topicName)
 
-	// TODO: 实现获取分区信息的逻辑
-	panic("TODO: 实现getTopicPartitions方法")
+	count, err := gc.broker.GetPartitionCount(topicName)
+	if err != nil {
+		return nil, err
+	}
+	partitions := make([]protocol.Assignment, count)
+	for i := range partitions {
+		partitions[i] = protocol.Assignment{Topic: topicName, PartitionId: int32(i)}
+	}
+	return partitions, nil
 }
 
 // checkDeadMembers 检查超时的成员
@@ -388,21 +544,62 @@ func (gc *GroupCoordinator) checkDeadMembers() {
 	// 3. 移除超时成员并触发Rebalance
 
 	fmt.Println("⏰ Checking for dead members...")
-	for groupId, group := range gc.groups {
-		needRebalance := false
-		for _, member := range group.Members {
+	for _, group := range gc.groups {
+		var dead []string
+		for consumerId, member := range group.Members {
 			if time.Now().Before(member.LastHeartbeat.Add(time.Duration(member.SessionTimeout) * time.Millisecond)) {
 				continue
 			}
-			needRebalance = true
 			// 怎么移除member呢？ 直接写成nil？
-			gc.groups[groupId] = nil
+			// 从Members中删掉就行，Group本身要留着，里面还有提交过的offset
+			dead = append(dead, consumerId)
+		}
+		if len(dead) > 0 {
+			fmt.Printf("💀 Removing dead members from group %s: %v\n", group.GroupId, dead)
+			gc.removeMembers(group, dead...)
 		}
-		if needRebalance {
-			gc.performRebalance(group)
+	}
+
+}
+
+// CommittedOffsets 返回所有Group提交的offset的副本: group -> topic -> partition -> offset，用于Broker快照
+func (gc *GroupCoordinator) CommittedOffsets() map[string]map[string]map[int32]int64 {
+	gc.mutex.RLock()
+	defer gc.mutex.RUnlock()
+
+	offsets := make(map[string]map[string]map[int32]int64)
+	for groupId, group := range gc.groups {
+		group.mutex.RLock()
+		for topic, partitions := range group.Offsets {
+			if offsets[groupId] == nil {
+				offsets[groupId] = make(map[string]map[int32]int64)
+			}
+			offsets[groupId][topic] = make(map[int32]int64, len(partitions))
+			for partition, offset := range partitions {
+				offsets[groupId][topic][partition] = offset
+			}
 		}
+		group.mutex.RUnlock()
 	}
+	return offsets
+}
 
+// RestoreCommittedOffsets 写入快照中的offset，Group不存在时创建，同一Group同一Topic已有的offset被整个替换
+func (gc *GroupCoordinator) RestoreCommittedOffsets(offsets map[string]map[string]map[int32]int64) {
+	gc.mutex.Lock()
+	defer gc.mutex.Unlock()
+
+	for groupId, topics := range offsets {
+		group := gc.getOrCreateGroup(groupId)
+		group.mutex.Lock()
+		for topic, partitions := range topics {
+			group.Offsets[topic] = make(map[int32]int64, len(partitions))
+			for partition, offset := range partitions {
+				group.Offsets[topic][partition] = offset
+			}
+		}
+		group.mutex.Unlock()
+	}
 }
 
 // Stop 停止GroupCoordinator
@@ -0,0 +1,85 @@
+package kafka
+
+import "sort"
+
+// Kafka协议中的API key
+const (
+	apiKeyProduce         int16 = 0
+	apiKeyFetch           int16 = 1
+	apiKeyListOffsets     int16 = 2
+	apiKeyMetadata        int16 = 3
+	apiKeyOffsetCommit    int16 = 8
+	apiKeyOffsetFetch     int16 = 9
+	apiKeyFindCoordinator int16 = 10
+	apiKeyJoinGroup       int16 = 11
+	apiKeyHeartbeat       int16 = 12
+	apiKeyLeaveGroup      int16 = 13
+	apiKeySyncGroup       int16 = 14
+	apiKeyApiVersions     int16 = 18
+)
+
+// handler 解码请求体，把响应体写到w；返回noResponse为true时不发送响应（acks=0的Produce）
+// 返回错误表示请求解析不了，连接会被断开
+type handler func(l *Listener, req *request, w *writer) (noResponse bool, err error)
+
+// api 支持的API和版本范围，两端都包含
+// 最大版本都是最后一个非flexible的版本，再往上请求头和请求体都换成了compact编码；
+// 最小版本以下的老版本现在的客户端已经不再使用
+type api struct {
+	key        int16
+	name       string
+	minVersion int16
+	maxVersion int16
+	handle     handler
+}
+
+var apis = []*api{
+	{apiKeyProduce, "Produce", 3, 8, (*Listener).handleProduce},
+	{apiKeyFetch, "Fetch", 4, 11, (*Listener).handleFetch},
+	{apiKeyListOffsets, "ListOffsets", 1, 5, (*Listener).handleListOffsets},
+	{apiKeyMetadata, "Metadata", 0, 8, (*Listener).handleMetadata},
+	{apiKeyOffsetCommit, "OffsetCommit", 2, 7, (*Listener).handleOffsetCommit},
+	{apiKeyOffsetFetch, "OffsetFetch", 1, 5, (*Listener).handleOffsetFetch},
+	{apiKeyFindCoordinator, "FindCoordinator", 0, 2, (*Listener).handleFindCoordinator},
+	{apiKeyJoinGroup, "JoinGroup", 0, 5, (*Listener).handleJoinGroup},
+	{apiKeyHeartbeat, "Heartbeat", 0, 3, (*Listener).handleHeartbeat},
+	{apiKeyLeaveGroup, "LeaveGroup", 0, 3, (*Listener).handleLeaveGroup},
+	{apiKeySyncGroup, "SyncGroup", 0, 3, (*Listener).handleSyncGroup},
+	{apiKeyApiVersions, "ApiVersions", 0, 2, (*Listener).handleApiVersions},
+}
+
+// apisByKey 在init中填充；handleApiVersions要遍历它，直接用apis初始化会形成初始化循环
+var (
+	apisByKey  = make(map[int16]*api)
+	sortedKeys []int16
+)
+
+func init() {
+	for _, a := range apis {
+		apisByKey[a.key] = a
+		sortedKeys = append(sortedKeys, a.key)
+	}
+	sort.Slice(sortedKeys, func(i, j int) bool { return sortedKeys[i] < sortedKeys[j] })
+}
+
+// handleApiVersions ApiVersions v0-2的请求体是空的
+//
+//	响应: error_code int16, [api_key int16, min_version int16, max_version int16], throttle_time_ms int32 (v1+)
+func (l *Listener) handleApiVersions(req *request, w *writer) (bool, error) {
+	writeAPIVersions(w, errNone, req.apiVersion)
+	return false, nil
+}
+
+func writeAPIVersions(w *writer, errorCode int16, version int16) {
+	w.int16(errorCode)
+	w.arrayLength(len(sortedKeys))
+	for _, key := range sortedKeys {
+		a := apisByKey[key]
+		w.int16(a.key)
+		w.int16(a.minVersion)
+		w.int16(a.maxVersion)
+	}
+	if version >= 1 {
+		w.int32(0) // throttle_time_ms
+	}
+}
@@ -0,0 +1,189 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// 只实现了非flexible版本，所以只需要Kafka协议的这几种基本类型（整数都是大端序）:
+//
+//	STRING           int16长度 + UTF-8字节
+//	NULLABLE_STRING  同上，长度-1表示null
+//	BYTES            int32长度 + 字节
+//	NULLABLE_BYTES   同上，长度-1表示null
+//	ARRAY            int32元素个数 + 元素，个数-1表示null
+//
+// flexible版本（COMPACT_STRING、tagged fields等）都没有支持，见apis中每个API的版本范围
+
+// reader 按顺序解析请求体，出错后后续读取都返回零值，最后检查err
+type reader struct {
+	buf []byte
+	pos int
+	err error
+}
+
+func (r *reader) fail(what string) {
+	if r.err == nil {
+		r.err = fmt.Errorf("malformed request: truncated %s at byte %d", what, r.pos)
+	}
+}
+
+// take 返回接下来的n个字节，不够时返回nil
+func (r *reader) take(n int, what string) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.buf)-r.pos {
+		r.fail(what)
+		return nil
+	}
+	b := r.buf[r.pos : r.pos+n : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *reader) int8() int8 {
+	b := r.take(1, "int8")
+	if b == nil {
+		return 0
+	}
+	return int8(b[0])
+}
+
+func (r *reader) bool() bool {
+	return r.int8() != 0
+}
+
+func (r *reader) int16() int16 {
+	b := r.take(2, "int16")
+	if b == nil {
+		return 0
+	}
+	return int16(binary.BigEndian.Uint16(b))
+}
+
+func (r *reader) int32() int32 {
+	b := r.take(4, "int32")
+	if b == nil {
+		return 0
+	}
+	return int32(binary.BigEndian.Uint32(b))
+}
+
+func (r *reader) int64() int64 {
+	b := r.take(8, "int64")
+	if b == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+func (r *reader) string() string {
+	s, _ := r.nullableString()
+	return s
+}
+
+// nullableString ok为false表示null
+func (r *reader) nullableString() (s string, ok bool) {
+	n := r.int16()
+	if n == -1 || r.err != nil {
+		return "", false
+	}
+	return string(r.take(int(n), "string")), true
+}
+
+// bytes null返回nil，空的BYTES返回长度为0的slice
+func (r *reader) bytes() []byte {
+	n := r.int32()
+	if n == -1 || r.err != nil {
+		return nil
+	}
+	return r.take(int(n), "bytes")
+}
+
+// arrayLength 数组的元素个数，null数组返回-1
+// 每个元素至少占一个字节，个数超过剩下的字节数说明数据是错的，避免按错误的个数分配内存
+func (r *reader) arrayLength() int {
+	n := r.int32()
+	if r.err != nil || n == -1 {
+		return -1
+	}
+	if n < -1 || int(n) > len(r.buf)-r.pos {
+		r.fail("array")
+		return -1
+	}
+	return int(n)
+}
+
+// int32Array 元素是INT32的数组，null数组返回nil
+func (r *reader) int32Array() []int32 {
+	n := r.arrayLength()
+	if n < 0 {
+		return nil
+	}
+	values := make([]int32, 0, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		values = append(values, r.int32())
+	}
+	return values
+}
+
+// writer 编码响应体
+type writer struct {
+	buf []byte
+}
+
+func (w *writer) int8(v int8) {
+	w.buf = append(w.buf, byte(v))
+}
+
+func (w *writer) bool(v bool) {
+	if v {
+		w.int8(1)
+	} else {
+		w.int8(0)
+	}
+}
+
+func (w *writer) int16(v int16) {
+	w.buf = binary.BigEndian.AppendUint16(w.buf, uint16(v))
+}
+
+func (w *writer) int32(v int32) {
+	w.buf = binary.BigEndian.AppendUint32(w.buf, uint32(v))
+}
+
+func (w *writer) int64(v int64) {
+	w.buf = binary.BigEndian.AppendUint64(w.buf, uint64(v))
+}
+
+func (w *writer) string(s string) {
+	w.int16(int16(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+// nullString 写入null的NULLABLE_STRING
+func (w *writer) nullString() {
+	w.int16(-1)
+}
+
+// bytes nil写成null
+func (w *writer) bytes(b []byte) {
+	if b == nil {
+		w.int32(-1)
+		return
+	}
+	w.int32(int32(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *writer) arrayLength(n int) {
+	w.int32(int32(n))
+}
+
+func (w *writer) int32Array(values []int32) {
+	w.arrayLength(len(values))
+	for _, v := range values {
+		w.int32(v)
+	}
+}
@@ -0,0 +1,77 @@
+package kafka
+
+import (
+	"errors"
+
+	"github.com/kafka-from-scratch/internal/common"
+	"github.com/kafka-from-scratch/internal/protocol"
+)
+
+// Kafka协议中的错误码，只列出了会返回的几种，编号见Kafka的protocol文档
+const (
+	errNone                      int16 = 0
+	errUnknownServerError        int16 = -1
+	errOffsetOutOfRange          int16 = 1
+	errCorruptMessage            int16 = 2
+	errUnknownTopicOrPartition   int16 = 3
+	errMessageTooLarge           int16 = 10
+	errNotCoordinator            int16 = 16
+	errInvalidTopic              int16 = 17
+	errIllegalGeneration         int16 = 22
+	errInconsistentGroupProtocol int16 = 23
+	errUnknownMemberID           int16 = 25
+	errRebalanceInProgress       int16 = 27
+	errUnsupportedVersion        int16 = 35
+	errTopicAlreadyExists        int16 = 36
+	errInvalidConfig             int16 = 40
+	errInvalidRequest            int16 = 42
+	errKafkaStorageError         int16 = 56
+)
+
+// errorCode 把Broker和GroupCoordinator返回的错误转换成Kafka的错误码
+// 先用protocol.ErrorCodeOf归类，和自己协议的错误响应使用同一套分类
+func errorCode(err error) int16 {
+	switch protocol.ErrorCodeOf(err) {
+	case protocol.ErrorCodeNone:
+		return errNone
+	case protocol.ErrorCodeUnknownTopic, protocol.ErrorCodeUnknownPartition:
+		return errUnknownTopicOrPartition
+	case protocol.ErrorCodeTopicAlreadyExists:
+		return errTopicAlreadyExists
+	case protocol.ErrorCodeInvalidTopic:
+		return errInvalidTopic
+	case protocol.ErrorCodeInvalidConfig:
+		return errInvalidConfig
+	case protocol.ErrorCodeOffsetOutOfRange:
+		return errOffsetOutOfRange
+	case protocol.ErrorCodeCorruptMessage:
+		return errCorruptMessage
+	case protocol.ErrorCodeRecordTooLarge:
+		return errMessageTooLarge
+	case protocol.ErrorCodeBrokerFull:
+		// Kafka客户端会重试KAFKA_STORAGE_ERROR，和BROKER_FULL可以重试一致
+		return errKafkaStorageError
+	case protocol.ErrorCodeUnknownGroup, protocol.ErrorCodeUnknownMember:
+		// 客户端收到UNKNOWN_MEMBER_ID会清空member id重新JoinGroup
+		return errUnknownMemberID
+	case protocol.ErrorCodeIllegalGeneration:
+		return errIllegalGeneration
+	case protocol.ErrorCodeRebalanceInProgress:
+		return errRebalanceInProgress
+	case protocol.ErrorCodeNotCoordinator:
+		return errNotCoordinator
+	default:
+		return errUnknownServerError
+	}
+}
+
+// groupErrorCode 和errorCode一样，但是把ILLEGAL_GENERATION换成REBALANCE_IN_PROGRESS
+// GroupCoordinator在JoinGroup时同步完成Rebalance，其他成员的Generation马上就过期了；
+// 对Kafka客户端来说这就是Rebalance进行中，收到REBALANCE_IN_PROGRESS会带着原来的member id重新JoinGroup，
+// 收到ILLEGAL_GENERATION则会丢掉member id，以新成员的身份加入，原来的成员要等到会话超时才被移除
+func groupErrorCode(err error) int16 {
+	if errors.Is(err, common.ErrIllegalGeneration) {
+		return errRebalanceInProgress
+	}
+	return errorCode(err)
+}
@@ -0,0 +1,359 @@
+package kafka
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/kafka-from-scratch/internal/common"
+	"github.com/kafka-from-scratch/internal/record"
+)
+
+// fetchMaxMessages 每个分区一次最多读取的消息数，之后再按partition_max_bytes和max_bytes截断
+const fetchMaxMessages = 500
+
+// fetchMaxWait Fetch最多等待的时间，max_wait_ms更大时按它处理
+// 等待时不读这个连接上的数据，客户端断开了也要等到超时才发现，所以不能完全听客户端的
+const fetchMaxWait = 30 * time.Second
+
+// handleFetch Fetch v4-11，返回的records是分区中原样的RecordBatch
+//
+//	请求: replica_id int32, max_wait_ms int32, min_bytes int32, max_bytes int32, isolation_level int8,
+//	      session_id int32 (v7+), session_epoch int32 (v7+),
+//	      topics [topic string, partitions [partition int32, current_leader_epoch int32 (v9+), fetch_offset int64,
+//	                                        log_start_offset int64 (v5+), partition_max_bytes int32]],
+//	      forgotten_topics_data [topic string, partitions [int32]] (v7+), rack_id string (v11+)
+//	响应: throttle_time_ms int32, error_code int16 (v7+), session_id int32 (v7+),
+//	      responses [topic string,
+//	                 partitions [partition_index int32, error_code int16, high_watermark int64, last_stable_offset int64,
+//	                             log_start_offset int64 (v5+), aborted_transactions [producer_id int64, first_offset int64],
+//	                             preferred_read_replica int32 (v11+), records nullable_bytes]]
+//
+// 响应中的session_id总是0，表示不建立fetch session，客户端之后每次都发送完整的请求
+func (l *Listener) handleFetch(req *request, w *writer) (bool, error) {
+	r, version := req.body, req.apiVersion
+
+	r.int32() // replica_id
+	maxWaitMs := r.int32()
+	minBytes := int(r.int32())
+	maxBytes := int(r.int32())
+	r.int8() // isolation_level，没有事务，READ_COMMITTED和READ_UNCOMMITTED一样
+	if version >= 7 {
+		r.int32() // session_id
+		r.int32() // session_epoch
+	}
+
+	type fetchPartition struct {
+		index       int32
+		fetchOffset int64
+		maxBytes    int
+	}
+	type fetchTopic struct {
+		name       string
+		partitions []fetchPartition
+	}
+	var topics []fetchTopic
+	topicCount := r.arrayLength()
+	for i := 0; i < topicCount && r.err == nil; i++ {
+		topic := fetchTopic{name: r.string()}
+		partitionCount := r.arrayLength()
+		for j := 0; j < partitionCount && r.err == nil; j++ {
+			p := fetchPartition{index: r.int32()}
+			if version >= 9 {
+				r.int32() // current_leader_epoch
+			}
+			p.fetchOffset = r.int64()
+			if version >= 5 {
+				r.int64() // log_start_offset，只有follower使用
+			}
+			p.maxBytes = int(r.int32())
+			topic.partitions = append(topic.partitions, p)
+		}
+		topics = append(topics, topic)
+	}
+	if version >= 7 {
+		// 没有fetch session，不需要处理forgotten_topics_data
+		forgottenCount := r.arrayLength()
+		for i := 0; i < forgottenCount && r.err == nil; i++ {
+			r.string()
+			r.int32Array()
+		}
+	}
+	if version >= 11 {
+		r.string() // rack_id
+	}
+	if r.err != nil {
+		return false, r.err
+	}
+
+	// 数据不到min_bytes时等任意一个分区追加了新消息再重新读取，最多等max_wait_ms（不超过fetchMaxWait），超时时返回最后一次读到的数据
+	// 这个连接上的请求是依次处理的，等待时不处理后面的请求，和Kafka一样
+	var results [][]fetchResult
+	var timer *time.Timer
+	for {
+		// 先拿到channel再读取，读取之后追加的消息不会错过
+		var appended []<-chan struct{}
+		if maxWaitMs > 0 {
+			for _, topic := range topics {
+				for _, p := range topic.partitions {
+					if ch, err := l.broker.Appended(topic.name, p.index); err == nil {
+						appended = append(appended, ch)
+					}
+				}
+			}
+		}
+
+		size, failed := 0, false
+		results = results[:0]
+		remaining := maxBytes
+		for _, topic := range topics {
+			var partitions []fetchResult
+			for _, p := range topic.partitions {
+				result := l.fetch(topic.name, p.index, p.fetchOffset, p.maxBytes, remaining)
+				remaining -= len(result.records)
+				size += len(result.records)
+				failed = failed || result.err != nil
+				partitions = append(partitions, result)
+			}
+			results = append(results, partitions)
+		}
+		// 有分区出错时马上返回，让客户端尽快处理错误
+		if maxWaitMs <= 0 || size >= minBytes || failed || len(appended) == 0 {
+			break
+		}
+
+		if timer == nil {
+			timer = time.NewTimer(min(time.Duration(maxWaitMs)*time.Millisecond, fetchMaxWait))
+			defer timer.Stop()
+		}
+		if !waitAppended(appended, timer.C) {
+			break
+		}
+	}
+
+	w.int32(0) // throttle_time_ms
+	if version >= 7 {
+		w.int16(errNone)
+		w.int32(0) // session_id
+	}
+	w.arrayLength(len(topics))
+	for i, topic := range topics {
+		w.string(topic.name)
+		w.arrayLength(len(topic.partitions))
+		for j, p := range topic.partitions {
+			result := results[i][j]
+			if result.err != nil {
+				fmt.Printf("kafka fetch %s-%d failed: %v\n", topic.name, p.index, result.err)
+			}
+
+			w.int32(p.index)
+			w.int16(errorCode(result.err))
+			w.int64(result.highWatermark)
+			w.int64(result.highWatermark) // last_stable_offset，没有事务，和high_watermark一样
+			if version >= 5 {
+				w.int64(result.logStartOffset)
+			}
+			w.arrayLength(0) // aborted_transactions
+			if version >= 11 {
+				w.int32(-1) // preferred_read_replica
+			}
+			w.bytes(result.records)
+		}
+	}
+	return false, nil
+}
+
+// waitAppended 等到任意一个channel关闭时返回true，先超时返回false
+func waitAppended(appended []<-chan struct{}, timeout <-chan time.Time) bool {
+	if len(appended) == 1 {
+		select {
+		case <-appended[0]:
+			return true
+		case <-timeout:
+			return false
+		}
+	}
+
+	woken := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	for _, ch := range appended {
+		go func(ch <-chan struct{}) {
+			select {
+			case <-ch:
+				select {
+				case woken <- struct{}{}:
+				default:
+				}
+			case <-stop:
+			}
+		}(ch)
+	}
+	select {
+	case <-woken:
+		return true
+	case <-timeout:
+		return false
+	}
+}
+
+type fetchResult struct {
+	highWatermark  int64
+	logStartOffset int64
+	records        []byte
+	err            error
+}
+
+// fetch 读取一个分区从fetchOffset开始的batch
+// 和Kafka一样，不超过partitionMaxBytes和剩下的maxBytes，但是至少返回一个batch，这样比上限大的batch也能被消费
+// maxBytes已经用完时不返回数据
+func (l *Listener) fetch(topicName string, partitionId int32, fetchOffset int64, partitionMaxBytes, maxBytes int) fetchResult {
+	result := fetchResult{highWatermark: -1, logStartOffset: -1}
+	latest, err := l.broker.GetLatestOffset(topicName, partitionId)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	earliest, err := l.broker.GetEarliestOffset(topicName, partitionId)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	result.highWatermark, result.logStartOffset = latest, earliest
+	if fetchOffset > latest {
+		result.err = fmt.Errorf("%w: offset %d is after high watermark %d", common.ErrOffsetOutOfRange, fetchOffset, latest)
+		return result
+	}
+	if fetchOffset == latest || maxBytes <= 0 {
+		// 前面的分区已经用完了max_bytes
+		result.records = []byte{}
+		return result
+	}
+
+	records, err := l.broker.FetchRecords(topicName, partitionId, fetchOffset, fetchMaxMessages)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	defer records.Close()
+	var buf bytes.Buffer
+	if _, err := records.WriteTo(&buf); err != nil {
+		result.err = err
+		return result
+	}
+	batches, err := record.Split(buf.Bytes())
+	if err != nil {
+		result.err = err
+		return result
+	}
+
+	limit := partitionMaxBytes
+	if maxBytes < limit {
+		limit = maxBytes
+	}
+	size := 0
+	for i, batch := range batches {
+		if i > 0 && size+batch.Size() > limit {
+			break
+		}
+		size += batch.Size()
+	}
+	result.records = buf.Bytes()[:size]
+	return result
+}
+
+// handleListOffsets ListOffsets v1-5，timestamp为-1时查最新的offset，-2时查最早的offset
+//
+//	请求: replica_id int32, isolation_level int8 (v2+),
+//	      topics [name string, partitions [partition_index int32, current_leader_epoch int32 (v4+), timestamp int64]]
+//	响应: throttle_time_ms int32 (v2+),
+//	      topics [name string, partitions [partition_index int32, error_code int16, timestamp int64, offset int64,
+//	                                       leader_epoch int32 (v4+)]]
+func (l *Listener) handleListOffsets(req *request, w *writer) (bool, error) {
+	r, version := req.body, req.apiVersion
+
+	r.int32() // replica_id
+	if version >= 2 {
+		r.int8() // isolation_level
+	}
+
+	type listPartition struct {
+		index     int32
+		timestamp int64
+	}
+	type listTopic struct {
+		name       string
+		partitions []listPartition
+	}
+	var topics []listTopic
+	topicCount := r.arrayLength()
+	for i := 0; i < topicCount && r.err == nil; i++ {
+		topic := listTopic{name: r.string()}
+		partitionCount := r.arrayLength()
+		for j := 0; j < partitionCount && r.err == nil; j++ {
+			p := listPartition{index: r.int32()}
+			if version >= 4 {
+				r.int32() // current_leader_epoch
+			}
+			p.timestamp = r.int64()
+			topic.partitions = append(topic.partitions, p)
+		}
+		topics = append(topics, topic)
+	}
+	if r.err != nil {
+		return false, r.err
+	}
+
+	if version >= 2 {
+		w.int32(0) // throttle_time_ms
+	}
+	w.arrayLength(len(topics))
+	for _, topic := range topics {
+		w.string(topic.name)
+		w.arrayLength(len(topic.partitions))
+		for _, p := range topic.partitions {
+			timestamp, offset, err := l.listOffset(topic.name, p.index, p.timestamp)
+			w.int32(p.index)
+			w.int16(errorCode(err))
+			w.int64(timestamp)
+			w.int64(offset)
+			if version >= 4 {
+				w.int32(0) // leader_epoch
+			}
+		}
+	}
+	return false, nil
+}
+
+const (
+	listOffsetsLatest   int64 = -1
+	listOffsetsEarliest int64 = -2
+)
+
+// listOffset 返回找到的消息的时间戳和offset
+// 按时间戳查找时，和Kafka一样返回第一条时间戳 >= t 的消息，没有这样的消息时timestamp和offset都是-1
+func (l *Listener) listOffset(topicName string, partitionId int32, timestamp int64) (int64, int64, error) {
+	switch timestamp {
+	case listOffsetsLatest:
+		offset, err := l.broker.GetLatestOffset(topicName, partitionId)
+		return -1, offset, err
+	case listOffsetsEarliest:
+		offset, err := l.broker.GetEarliestOffset(topicName, partitionId)
+		return -1, offset, err
+	}
+
+	offset, err := l.broker.GetOffsetForTimestamp(topicName, partitionId, time.UnixMilli(timestamp))
+	if err != nil {
+		return -1, -1, err
+	}
+	// GetOffsetForTimestamp找不到时返回最新的offset，读出那条消息才知道是不是找到了，顺便拿到它的时间戳
+	messages, err := l.broker.ConsumeMessages(topicName, partitionId, offset, 1)
+	if err != nil && !errors.Is(err, common.ErrOffsetOutOfRange) {
+		return -1, -1, err
+	}
+	if len(messages) == 0 {
+		return -1, -1, nil
+	}
+	return messages[0].Timestamp.UnixMilli(), messages[0].Offset, nil
+}
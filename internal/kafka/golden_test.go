@@ -0,0 +1,183 @@
+package kafka_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kafka-from-scratch/internal/broker"
+	"github.com/kafka-from-scratch/internal/coordinator"
+	"github.com/kafka-from-scratch/internal/kafka"
+	"github.com/kafka-from-scratch/internal/storage"
+)
+
+// TestGolden 把testdata中的请求按文件名的顺序发送给Kafka协议的listener，检查响应和文件中的字节完全相同
+//
+// testdata中的每个文件是一次请求和响应，按Kafka协议文档中每个API的格式逐个字段写出来，
+// 不包括开头的int32长度；没有response的文件表示不应该有响应（acks=0的Produce）。
+// 前面的请求创建的Topic、写入的消息和Group后面的请求会用到，所有文件在同一个连接上依次发送。
+//
+// 内存版和磁盘版Broker的响应应该一样
+func TestGolden(t *testing.T) {
+	fixtures := loadFixtures(t)
+
+	diskBroker, err := broker.NewDiskBroker(t.TempDir(), storage.LogConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { diskBroker.Close() })
+
+	for _, target := range []struct {
+		name   string
+		broker broker.Broker
+	}{
+		{"memory", broker.NewMemoryBroker()},
+		{"disk", diskBroker},
+	} {
+		t.Run(target.name, func(t *testing.T) {
+			groups := coordinator.NewGroupCoordinator(target.broker)
+			defer groups.Stop()
+			// 响应中的地址是固定的，不受实际监听的端口影响
+			listener := kafka.NewListener("127.0.0.1:0", target.broker, groups, kafka.Config{
+				AdvertisedHost:   "localhost",
+				AdvertisedPort:   9092,
+				NodeID:           1,
+				AutoCreateTopics: true,
+			})
+			if err := listener.Listen(); err != nil {
+				t.Fatal(err)
+			}
+			go listener.Serve()
+			defer listener.Stop()
+
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+
+			// 一个用例失败之后连接上的状态就不确定了，后面的用例不再运行
+			for _, f := range fixtures {
+				ok := t.Run(f.name, func(t *testing.T) {
+					if err := roundTrip(conn, r, f); err != nil {
+						t.Fatal(err)
+					}
+				})
+				if !ok {
+					return
+				}
+			}
+		})
+	}
+}
+
+type fixture struct {
+	name     string
+	request  []byte
+	response []byte // nil表示不应该有响应
+}
+
+func loadFixtures(t *testing.T) []*fixture {
+	entries, err := os.ReadDir("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fixtures []*fixture
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".txt" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join("testdata", entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := parseFixture(entry.Name(), string(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fixtures = append(fixtures, f)
+	}
+	if len(fixtures) == 0 {
+		t.Fatal("no fixtures in testdata")
+	}
+	return fixtures
+}
+
+// parseFixture 解析 "request:" 和 "response:" 后面的十六进制字节，#之后是注释
+func parseFixture(name, text string) (*fixture, error) {
+	f := &fixture{name: strings.TrimSuffix(name, ".txt")}
+	var section *[]byte
+	for i, line := range strings.Split(text, "\n") {
+		if j := strings.Index(line, "#"); j >= 0 {
+			line = line[:j]
+		}
+		line = strings.TrimSpace(line)
+		switch line {
+		case "":
+			continue
+		case "request:":
+			section = &f.request
+			continue
+		case "response:":
+			f.response = []byte{}
+			section = &f.response
+			continue
+		}
+		if section == nil {
+			return nil, fmt.Errorf("%s:%d: bytes before request:", name, i+1)
+		}
+		b, err := hex.DecodeString(strings.Join(strings.Fields(line), ""))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", name, i+1, err)
+		}
+		*section = append(*section, b...)
+	}
+	if len(f.request) == 0 {
+		return nil, fmt.Errorf("%s: no request", name)
+	}
+	return f, nil
+}
+
+func roundTrip(conn net.Conn, r *bufio.Reader, f *fixture) error {
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(f.request)))
+	if _, err := conn.Write(append(frame, f.request...)); err != nil {
+		return err
+	}
+	if f.response == nil {
+		// 下一个用例的响应中的correlation id会证明这里确实没有响应
+		return nil
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return fmt.Errorf("read response: %w", err)
+	}
+	got := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(r, got); err != nil {
+		return fmt.Errorf("read response: %w", err)
+	}
+	if !bytes.Equal(got, f.response) {
+		return fmt.Errorf("response mismatch at byte %d\n   want %s\n   got  %s", mismatch(got, f.response), hex.EncodeToString(f.response), hex.EncodeToString(got))
+	}
+	return nil
+}
+
+// mismatch 第一个不同的字节的位置
+func mismatch(a, b []byte) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
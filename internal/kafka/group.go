@@ -0,0 +1,410 @@
+package kafka
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+
+	"github.com/kafka-from-scratch/internal/protocol"
+)
+
+// consumerProtocolType JoinGroup中Consumer使用的protocol_type，只有它的metadata和assignment格式是已知的
+const consumerProtocolType = "consumer"
+
+// eagerAssignors 客户端提供多个assignor时优先选择的名字
+// 分区其实由GroupCoordinator分配，只是要选一个eager的协议，客户端才会在每次Rebalance时放弃全部分区再用新的分配，
+// cooperative协议的客户端只放弃被明确收回的分区，和GroupCoordinator的做法不一致
+var eagerAssignors = []string{"range", "roundrobin", "sticky"}
+
+// handleJoinGroup JoinGroup v0-5
+//
+//	请求: group_id string, session_timeout_ms int32, rebalance_timeout_ms int32 (v1+), member_id string,
+//	      group_instance_id nullable_string (v5+), protocol_type string, protocols [name string, metadata bytes]
+//	响应: throttle_time_ms int32 (v2+), error_code int16, generation_id int32, protocol_name string,
+//	      leader string, member_id string, members [member_id string, group_instance_id nullable_string (v5+), metadata bytes]
+//
+// 协议的metadata是ConsumerProtocolSubscription: version int16, topics [string], 后面的字段不需要
+// 响应中的leader总是空的，成员列表也是空的：所有客户端都是follower，在SyncGroup中拿到GroupCoordinator分配好的分区
+func (l *Listener) handleJoinGroup(req *request, w *writer) (bool, error) {
+	r, version := req.body, req.apiVersion
+
+	groupID := r.string()
+	sessionTimeout := r.int32()
+	if version >= 1 {
+		r.int32() // rebalance_timeout_ms，Rebalance是同步完成的
+	}
+	memberID := r.string()
+	if version >= 5 {
+		r.nullableString() // group_instance_id，不支持static membership，和普通成员一样处理
+	}
+	protocolType := r.string()
+	protocols := make(map[string][]byte)
+	var protocolNames []string
+	protocolCount := r.arrayLength()
+	for i := 0; i < protocolCount && r.err == nil; i++ {
+		name := r.string()
+		protocols[name] = r.bytes()
+		protocolNames = append(protocolNames, name)
+	}
+	if r.err != nil {
+		return false, r.err
+	}
+
+	writeResponse := func(errorCode int16, generation int32, protocolName, memberID string) {
+		if version >= 2 {
+			w.int32(0) // throttle_time_ms
+		}
+		w.int16(errorCode)
+		w.int32(generation)
+		w.string(protocolName)
+		w.string("") // leader
+		w.string(memberID)
+		w.arrayLength(0) // members
+	}
+
+	protocolName := chooseProtocol(protocolNames)
+	var topics []string
+	if protocolType == consumerProtocolType && protocolName != "" {
+		topics = decodeSubscription(protocols[protocolName])
+	}
+	if topics == nil {
+		writeResponse(errInconsistentGroupProtocol, -1, "", memberID)
+		return false, nil
+	}
+
+	if memberID == "" {
+		memberID = newMemberID(req.clientID)
+	}
+	resp, err := l.groups.HandleJoinGroup(&protocol.JoinGroupRequest{
+		GroupId:        groupID,
+		ConsumerId:     memberID,
+		ClientId:       req.clientID,
+		Topics:         topics,
+		SessionTimeout: sessionTimeout,
+	})
+	if err != nil {
+		writeResponse(groupErrorCode(err), -1, "", memberID)
+		return false, nil
+	}
+	writeResponse(errNone, resp.Generation, protocolName, memberID)
+	return false, nil
+}
+
+// chooseProtocol 优先选择eagerAssignors中的协议，都没有时选择客户端的第一个
+func chooseProtocol(names []string) string {
+	for _, preferred := range eagerAssignors {
+		for _, name := range names {
+			if name == preferred {
+				return name
+			}
+		}
+	}
+	if len(names) > 0 {
+		return names[0]
+	}
+	return ""
+}
+
+// decodeSubscription 解析ConsumerProtocolSubscription中订阅的Topic，格式不对时返回nil
+func decodeSubscription(metadata []byte) []string {
+	r := &reader{buf: metadata}
+	r.int16() // version，各个版本的开头都是topics
+	n := r.arrayLength()
+	topics := make([]string, 0, max(n, 0))
+	for i := 0; i < n && r.err == nil; i++ {
+		topics = append(topics, r.string())
+	}
+	if r.err != nil || n < 0 {
+		return nil
+	}
+	return topics
+}
+
+// newMemberID 和Kafka一样用client id加上随机的后缀作为新成员的ID
+func newMemberID(clientID string) string {
+	var suffix [8]byte
+	rand.Read(suffix[:])
+	return clientID + "-" + hex.EncodeToString(suffix[:])
+}
+
+// handleSyncGroup SyncGroup v0-3，忽略请求中的分配，返回GroupCoordinator分配的分区
+//
+//	请求: group_id string, generation_id int32, member_id string, group_instance_id nullable_string (v3+),
+//	      assignments [member_id string, assignment bytes]
+//	响应: throttle_time_ms int32 (v1+), error_code int16, assignment bytes
+//
+// assignment是ConsumerProtocolAssignment v0: version int16, assigned_partitions [topic string, partitions [int32]],
+// user_data nullable_bytes
+func (l *Listener) handleSyncGroup(req *request, w *writer) (bool, error) {
+	r, version := req.body, req.apiVersion
+
+	groupID := r.string()
+	generation := r.int32()
+	memberID := r.string()
+	if version >= 3 {
+		r.nullableString() // group_instance_id
+	}
+	assignmentCount := r.arrayLength()
+	for i := 0; i < assignmentCount && r.err == nil; i++ {
+		r.string()
+		r.bytes()
+	}
+	if r.err != nil {
+		return false, r.err
+	}
+
+	if version >= 1 {
+		w.int32(0) // throttle_time_ms
+	}
+	resp, err := l.groups.HandleSyncGroup(&protocol.SyncGroupRequest{
+		GroupId:    groupID,
+		ConsumerId: memberID,
+		Generation: generation,
+	})
+	if err != nil {
+		w.int16(groupErrorCode(err))
+		w.bytes([]byte{})
+		return false, nil
+	}
+	w.int16(errNone)
+	w.bytes(encodeAssignment(resp.Assignment))
+	return false, nil
+}
+
+// encodeAssignment 编码ConsumerProtocolAssignment v0，Topic和分区都排好序
+func encodeAssignment(assignment []protocol.Assignment) []byte {
+	partitions := make(map[string][]int32)
+	var topics []string
+	for _, a := range assignment {
+		if _, ok := partitions[a.Topic]; !ok {
+			topics = append(topics, a.Topic)
+		}
+		partitions[a.Topic] = append(partitions[a.Topic], a.PartitionId)
+	}
+	sort.Strings(topics)
+
+	w := &writer{}
+	w.int16(0) // version
+	w.arrayLength(len(topics))
+	for _, topic := range topics {
+		ids := partitions[topic]
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		w.string(topic)
+		w.int32Array(ids)
+	}
+	w.bytes(nil) // user_data
+	return w.buf
+}
+
+// handleHeartbeat Heartbeat v0-3
+//
+//	请求: group_id string, generation_id int32, member_id string, group_instance_id nullable_string (v3+)
+//	响应: throttle_time_ms int32 (v1+), error_code int16
+func (l *Listener) handleHeartbeat(req *request, w *writer) (bool, error) {
+	r, version := req.body, req.apiVersion
+
+	groupID := r.string()
+	generation := r.int32()
+	memberID := r.string()
+	if version >= 3 {
+		r.nullableString() // group_instance_id
+	}
+	if r.err != nil {
+		return false, r.err
+	}
+
+	_, err := l.groups.HandleHeartbeat(&protocol.HeartbeatRequest{
+		GroupId:    groupID,
+		ConsumerId: memberID,
+		Generation: generation,
+	})
+	if version >= 1 {
+		w.int32(0) // throttle_time_ms
+	}
+	w.int16(groupErrorCode(err))
+	return false, nil
+}
+
+// handleLeaveGroup LeaveGroup v0-3
+//
+//	请求: group_id string, member_id string (v0-2), members [member_id string, group_instance_id nullable_string] (v3+)
+//	响应: throttle_time_ms int32 (v1+), error_code int16,
+//	      members [member_id string, group_instance_id nullable_string, error_code int16] (v3+)
+func (l *Listener) handleLeaveGroup(req *request, w *writer) (bool, error) {
+	r, version := req.body, req.apiVersion
+
+	groupID := r.string()
+	var memberIDs []string
+	if version >= 3 {
+		n := r.arrayLength()
+		for i := 0; i < n && r.err == nil; i++ {
+			memberIDs = append(memberIDs, r.string())
+			r.nullableString() // group_instance_id
+		}
+	} else {
+		memberIDs = append(memberIDs, r.string())
+	}
+	if r.err != nil {
+		return false, r.err
+	}
+
+	errorCodes := make([]int16, len(memberIDs))
+	for i, memberID := range memberIDs {
+		_, err := l.groups.HandleLeaveGroup(&protocol.LeaveGroupRequest{
+			GroupId:    groupID,
+			ConsumerId: memberID,
+		})
+		errorCodes[i] = groupErrorCode(err)
+	}
+
+	if version >= 1 {
+		w.int32(0) // throttle_time_ms
+	}
+	if version < 3 {
+		w.int16(errorCodes[0])
+		return false, nil
+	}
+	// v3开始顶层的error_code只表示整个请求的错误，每个成员的结果在members中
+	w.int16(errNone)
+	w.arrayLength(len(memberIDs))
+	for i, memberID := range memberIDs {
+		w.string(memberID)
+		w.nullString()
+		w.int16(errorCodes[i])
+	}
+	return false, nil
+}
+
+// handleOffsetCommit OffsetCommit v2-7，generation_id为-1、member_id为空时是不加入Group的提交
+//
+//	请求: group_id string, generation_id int32, member_id string, retention_time_ms int64 (v2-4),
+//	      group_instance_id nullable_string (v7+),
+//	      topics [name string, partitions [partition_index int32, committed_offset int64,
+//	                                       committed_leader_epoch int32 (v6+), committed_metadata nullable_string]]
+//	响应: throttle_time_ms int32 (v3+), topics [name string, partitions [partition_index int32, error_code int16]]
+func (l *Listener) handleOffsetCommit(req *request, w *writer) (bool, error) {
+	r, version := req.body, req.apiVersion
+
+	commit := &protocol.CommitOffsetRequest{
+		GroupId:    r.string(),
+		Generation: r.int32(),
+		ConsumerId: r.string(),
+	}
+	if version <= 4 {
+		r.int64() // retention_time_ms，offset一直保留
+	}
+	if version >= 7 {
+		r.nullableString() // group_instance_id
+	}
+	topicCount := r.arrayLength()
+	for i := 0; i < topicCount && r.err == nil; i++ {
+		name := r.string()
+		partitionCount := r.arrayLength()
+		for j := 0; j < partitionCount && r.err == nil; j++ {
+			offset := protocol.TopicPartitionOffset{Topic: name, PartitionId: r.int32(), Offset: r.int64()}
+			if version >= 6 {
+				r.int32() // committed_leader_epoch
+			}
+			r.nullableString() // committed_metadata，不保存
+			commit.Offsets = append(commit.Offsets, offset)
+		}
+	}
+	if r.err != nil {
+		return false, r.err
+	}
+
+	// 所有分区在一次HandleCommitOffset中提交，结果也一样
+	_, err := l.groups.HandleCommitOffset(commit)
+	code := groupErrorCode(err)
+
+	if version >= 3 {
+		w.int32(0) // throttle_time_ms
+	}
+	// 按请求中的顺序回复，同一个Topic的分区是连续的
+	var topics []string
+	partitions := make(map[string][]int32)
+	for _, o := range commit.Offsets {
+		if _, ok := partitions[o.Topic]; !ok {
+			topics = append(topics, o.Topic)
+		}
+		partitions[o.Topic] = append(partitions[o.Topic], o.PartitionId)
+	}
+	w.arrayLength(len(topics))
+	for _, topic := range topics {
+		w.string(topic)
+		w.arrayLength(len(partitions[topic]))
+		for _, partition := range partitions[topic] {
+			w.int32(partition)
+			w.int16(code)
+		}
+	}
+	return false, nil
+}
+
+// handleOffsetFetch OffsetFetch v1-5，没有提交过的分区返回-1
+//
+//	请求: group_id string, topics [name string, partition_indexes [int32]] (v2+可以是null，表示所有提交过的分区)
+//	响应: throttle_time_ms int32 (v3+),
+//	      topics [name string, partitions [partition_index int32, committed_offset int64,
+//	                                       committed_leader_epoch int32 (v5+), metadata nullable_string, error_code int16]],
+//	      error_code int16 (v2+)
+func (l *Listener) handleOffsetFetch(req *request, w *writer) (bool, error) {
+	r, version := req.body, req.apiVersion
+
+	groupID := r.string()
+	type fetchTopic struct {
+		name       string
+		partitions []int32
+	}
+	var topics []fetchTopic
+	topicCount := r.arrayLength()
+	for i := 0; i < topicCount && r.err == nil; i++ {
+		topics = append(topics, fetchTopic{name: r.string(), partitions: r.int32Array()})
+	}
+	if r.err != nil {
+		return false, r.err
+	}
+	if topicCount < 0 {
+		committed := l.groups.CommittedOffsets()[groupID]
+		for name, offsets := range committed {
+			topic := fetchTopic{name: name}
+			for partition := range offsets {
+				topic.partitions = append(topic.partitions, partition)
+			}
+			sort.Slice(topic.partitions, func(i, j int) bool { return topic.partitions[i] < topic.partitions[j] })
+			topics = append(topics, topic)
+		}
+		sort.Slice(topics, func(i, j int) bool { return topics[i].name < topics[j].name })
+	}
+
+	if version >= 3 {
+		w.int32(0) // throttle_time_ms
+	}
+	w.arrayLength(len(topics))
+	for _, topic := range topics {
+		w.string(topic.name)
+		w.arrayLength(len(topic.partitions))
+		for _, partition := range topic.partitions {
+			resp, err := l.groups.HandleGetOffset(&protocol.GetOffsetRequest{
+				GroupId:     groupID,
+				Topic:       topic.name,
+				PartitionId: partition,
+			})
+			offset := int64(-1)
+			if err == nil {
+				offset = resp.Offset
+			}
+			w.int32(partition)
+			w.int64(offset)
+			if version >= 5 {
+				w.int32(-1) // committed_leader_epoch
+			}
+			w.string("") // metadata
+			w.int16(errorCode(err))
+		}
+	}
+	if version >= 2 {
+		w.int16(errNone)
+	}
+	return false, nil
+}
@@ -0,0 +1,227 @@
+// Package kafka 实现Kafka二进制协议的一个子集，本地开发时可以直接用Kafka的客户端库（Java、librdkafka、franz-go等）连接这个Broker
+//
+// 请求翻译成对broker.Broker和coordinator.GroupCoordinator的调用，和自己的协议（见wire包）访问的是同一份数据。
+// 支持的API和版本见apis，只有非flexible的版本；客户端用ApiVersions协商，会自动选择这些版本。
+//
+// 和真正的Kafka相比的限制:
+//   - 只有一个节点，Metadata中所有分区的leader都是自己，没有副本
+//   - batch不能压缩，也不支持幂等和事务：Producer要设置enable.idempotence=false、compression.type=none
+//   - Consumer Group的分区由GroupCoordinator分配，JoinGroup不返回成员列表，所有客户端都作为follower，客户端配置的assignor不起作用
+//   - 没有fetch session，每个Fetch请求都是完整的请求
+package kafka
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/kafka-from-scratch/internal/broker"
+	"github.com/kafka-from-scratch/internal/coordinator"
+)
+
+// maxRequestBytes 一个请求最多的字节数，和Kafka的socket.request.max.bytes默认值一样
+const maxRequestBytes = 100 << 20
+
+// clusterID Metadata v2之后返回的集群ID
+const clusterID = "kafka-from-scratch"
+
+// Config Listener的配置
+type Config struct {
+	// AdvertisedHost 和 AdvertisedPort 在Metadata和FindCoordinator中告诉客户端的地址，客户端之后都连接这个地址
+	// AdvertisedHost为空时使用监听的IP，监听所有地址时使用localhost；AdvertisedPort为0时使用监听的端口
+	AdvertisedHost string
+	AdvertisedPort int32
+
+	// NodeID Metadata中这个节点的ID
+	NodeID int32
+
+	// AutoCreateTopics Metadata请求的Topic不存在时自动创建，和Kafka的auto.create.topics.enable一样
+	// 自动创建的Topic有DefaultPartitions个分区，为0时是1
+	AutoCreateTopics  bool
+	DefaultPartitions int32
+}
+
+// Listener 接受Kafka客户端的连接
+type Listener struct {
+	address string
+	config  Config
+	broker  broker.Broker
+	groups  *coordinator.GroupCoordinator
+
+	listener net.Listener
+}
+
+// NewListener 创建Listener，groups应该和TCPServer共用同一个，两种客户端才能看到同样的Group和offset
+func NewListener(address string, b broker.Broker, groups *coordinator.GroupCoordinator, config Config) *Listener {
+	if config.DefaultPartitions <= 0 {
+		config.DefaultPartitions = 1
+	}
+	return &Listener{
+		address: address,
+		config:  config,
+		broker:  b,
+		groups:  groups,
+	}
+}
+
+// Listen 开始监听但还不接受连接，address的端口为0时由系统分配，用Addr查看实际的地址
+func (l *Listener) Listen() error {
+	listener, err := net.Listen("tcp", l.address)
+	if err != nil {
+		return fmt.Errorf("failed to start kafka listener: %w", err)
+	}
+	l.listener = listener
+	fmt.Printf("kafka listener listening %s\n", listener.Addr())
+	return nil
+}
+
+// Addr 实际监听的地址，Listen之后才有
+func (l *Listener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// Serve 接受连接直到Stop，每个连接一个goroutine
+func (l *Listener) Serve() error {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go l.handleConnection(conn)
+	}
+}
+
+// Stop 停止接受新的连接
+func (l *Listener) Stop() error {
+	if l.listener != nil {
+		return l.listener.Close()
+	}
+	return nil
+}
+
+// advertisedAddress Metadata和FindCoordinator中返回的地址
+func (l *Listener) advertisedAddress() (string, int32) {
+	host, port := l.config.AdvertisedHost, l.config.AdvertisedPort
+	if tcpAddr, ok := l.listener.Addr().(*net.TCPAddr); ok {
+		if host == "" && !tcpAddr.IP.IsUnspecified() {
+			host = tcpAddr.IP.String()
+		}
+		if port == 0 {
+			port = int32(tcpAddr.Port)
+		}
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	return host, port
+}
+
+// handleConnection 一个一个处理连接上的请求
+// Kafka客户端会连续发送多个请求，但要求响应按请求的顺序返回，所以不像TCPServer那样并发处理
+func (l *Listener) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	clientAddr := conn.RemoteAddr().String()
+	fmt.Printf("kafka client addr %s\n", clientAddr)
+
+	r := bufio.NewReader(conn)
+	for {
+		frame, err := readFrame(r)
+		if err != nil {
+			if err != io.EOF {
+				fmt.Printf("kafka read error %s: %v\n", clientAddr, err)
+			}
+			break
+		}
+		response, err := l.handleFrame(frame)
+		if err != nil {
+			// Kafka协议没有通用的错误响应，请求解析不了时只能断开连接
+			fmt.Printf("kafka bad request %s: %v\n", clientAddr, err)
+			break
+		}
+		if response == nil {
+			continue
+		}
+		if _, err := conn.Write(response); err != nil {
+			fmt.Printf("kafka reply error %s: %v\n", clientAddr, err)
+			break
+		}
+	}
+	fmt.Printf("kafka client disconnected %s\n", clientAddr)
+}
+
+// readFrame 读取一个请求: int32长度 + 请求头 + 请求体
+func readFrame(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := int32(binary.BigEndian.Uint32(size[:]))
+	if n < 0 || n > maxRequestBytes {
+		return nil, fmt.Errorf("invalid request size %d", n)
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return frame, nil
+}
+
+// request 解析好的请求头（request header v1），body是剩下的请求体
+type request struct {
+	apiKey        int16
+	apiVersion    int16
+	correlationID int32
+	clientID      string
+	body          *reader
+}
+
+// handleFrame 处理一个请求，返回包括长度在内的整个响应，不需要响应时返回nil
+func (l *Listener) handleFrame(frame []byte) ([]byte, error) {
+	r := &reader{buf: frame}
+	req := &request{
+		apiKey:        r.int16(),
+		apiVersion:    r.int16(),
+		correlationID: r.int32(),
+	}
+	req.clientID, _ = r.nullableString()
+	if r.err != nil {
+		return nil, r.err
+	}
+	req.body = r
+
+	// 前4个字节留给长度，后面是response header v0，只有correlation id
+	w := &writer{buf: make([]byte, 4, 256)}
+	w.int32(req.correlationID)
+
+	a := apisByKey[req.apiKey]
+	if a == nil {
+		return nil, fmt.Errorf("unsupported api key %d", req.apiKey)
+	}
+	if req.apiVersion < a.minVersion || req.apiVersion > a.maxVersion {
+		if req.apiKey != apiKeyApiVersions {
+			return nil, fmt.Errorf("unsupported %s version %d", a.name, req.apiVersion)
+		}
+		// 客户端先用自己最新的版本发送ApiVersions，Broker不支持时按v0的格式回复UNSUPPORTED_VERSION和支持的版本，
+		// 客户端再用双方都支持的版本重新发送
+		writeAPIVersions(w, errUnsupportedVersion, 0)
+	} else {
+		noResponse, err := a.handle(l, req, w)
+		if err != nil {
+			return nil, fmt.Errorf("%s v%d: %w", a.name, req.apiVersion, err)
+		}
+		if noResponse {
+			return nil, nil
+		}
+	}
+
+	binary.BigEndian.PutUint32(w.buf, uint32(len(w.buf)-4))
+	return w.buf, nil
+}
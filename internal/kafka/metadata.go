@@ -0,0 +1,155 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/kafka-from-scratch/internal/common"
+)
+
+// authorizedOperationsOmitted 客户端没有要求时返回的authorized_operations，和Kafka一样是INT32_MIN
+const authorizedOperationsOmitted int32 = math.MinInt32
+
+// handleMetadata Metadata v0-8
+//
+//	请求: topics [name string] (v1+可以是null，表示所有Topic；v0用空数组表示所有Topic),
+//	      allow_auto_topic_creation bool (v4+),
+//	      include_cluster_authorized_operations bool (v8+), include_topic_authorized_operations bool (v8+)
+//	响应: throttle_time_ms int32 (v3+),
+//	      brokers [node_id int32, host string, port int32, rack nullable_string (v1+)],
+//	      cluster_id nullable_string (v2+), controller_id int32 (v1+),
+//	      topics [error_code int16, name string, is_internal bool (v1+),
+//	              partitions [error_code int16, partition_index int32, leader_id int32, leader_epoch int32 (v7+),
+//	                          replica_nodes [int32], isr_nodes [int32], offline_replicas [int32] (v5+)],
+//	              topic_authorized_operations int32 (v8+)],
+//	      cluster_authorized_operations int32 (v8+)
+func (l *Listener) handleMetadata(req *request, w *writer) (bool, error) {
+	r, version := req.body, req.apiVersion
+
+	n := r.arrayLength()
+	var names []string
+	all := n < 0 || (version == 0 && n == 0)
+	for i := 0; i < n && r.err == nil; i++ {
+		names = append(names, r.string())
+	}
+	allowAutoCreate := true
+	if version >= 4 {
+		allowAutoCreate = r.bool()
+	}
+	if version >= 8 {
+		r.bool() // include_cluster_authorized_operations
+		r.bool() // include_topic_authorized_operations
+	}
+	if r.err != nil {
+		return false, r.err
+	}
+	if all {
+		names = l.broker.ListTopics()
+		sort.Strings(names)
+	}
+
+	if version >= 3 {
+		w.int32(0) // throttle_time_ms
+	}
+	host, port := l.advertisedAddress()
+	w.arrayLength(1)
+	w.int32(l.config.NodeID)
+	w.string(host)
+	w.int32(port)
+	if version >= 1 {
+		w.nullString() // rack
+	}
+	if version >= 2 {
+		w.string(clusterID)
+	}
+	if version >= 1 {
+		w.int32(l.config.NodeID) // controller_id
+	}
+
+	w.arrayLength(len(names))
+	for _, name := range names {
+		count, err := l.partitionCount(name, allowAutoCreate)
+		w.int16(errorCode(err))
+		w.string(name)
+		if version >= 1 {
+			w.bool(false) // is_internal
+		}
+		w.arrayLength(int(count))
+		for p := int32(0); p < count; p++ {
+			w.int16(errNone)
+			w.int32(p)
+			w.int32(l.config.NodeID) // leader_id
+			if version >= 7 {
+				w.int32(0) // leader_epoch
+			}
+			w.int32Array([]int32{l.config.NodeID}) // replica_nodes
+			w.int32Array([]int32{l.config.NodeID}) // isr_nodes
+			if version >= 5 {
+				w.int32Array(nil) // offline_replicas
+			}
+		}
+		if version >= 8 {
+			w.int32(authorizedOperationsOmitted)
+		}
+	}
+	if version >= 8 {
+		w.int32(authorizedOperationsOmitted)
+	}
+	return false, nil
+}
+
+// partitionCount Topic的分区数，Topic不存在并且允许自动创建时先创建，出错时返回0个分区
+func (l *Listener) partitionCount(name string, allowAutoCreate bool) (int32, error) {
+	count, err := l.broker.GetPartitionCount(name)
+	if err == nil || !errors.Is(err, common.ErrUnknownTopic) || !l.config.AutoCreateTopics || !allowAutoCreate {
+		return count, err
+	}
+	if err := l.broker.CreateTopic(name, l.config.DefaultPartitions); err != nil {
+		return 0, err
+	}
+	fmt.Printf("auto created topic %s with %d partitions\n", name, l.config.DefaultPartitions)
+	return l.broker.GetPartitionCount(name)
+}
+
+// handleFindCoordinator FindCoordinator v0-2，所有Group的coordinator都是这个节点
+//
+//	请求: key string, key_type int8 (v1+，0是Group，1是事务)
+//	响应: throttle_time_ms int32 (v1+), error_code int16, error_message nullable_string (v1+),
+//	      node_id int32, host string, port int32
+func (l *Listener) handleFindCoordinator(req *request, w *writer) (bool, error) {
+	r, version := req.body, req.apiVersion
+
+	r.string() // key
+	var keyType int8
+	if version >= 1 {
+		keyType = r.int8()
+	}
+	if r.err != nil {
+		return false, r.err
+	}
+
+	if version >= 1 {
+		w.int32(0) // throttle_time_ms
+	}
+	host, port := l.advertisedAddress()
+	if keyType != 0 {
+		w.int16(errInvalidRequest)
+		if version >= 1 {
+			w.string("transactions are not supported")
+		}
+		w.int32(-1)
+		w.string("")
+		w.int32(-1)
+		return false, nil
+	}
+	w.int16(errNone)
+	if version >= 1 {
+		w.nullString()
+	}
+	w.int32(l.config.NodeID)
+	w.string(host)
+	w.int32(port)
+	return false, nil
+}
@@ -0,0 +1,122 @@
+package kafka
+
+import (
+	"fmt"
+
+	"github.com/kafka-from-scratch/internal/common"
+	"github.com/kafka-from-scratch/internal/record"
+)
+
+// handleProduce Produce v3-8，records就是RecordBatch v2，和这个Broker自己的batch格式一样，原样写入客户端选择的分区
+//
+//	请求: transactional_id nullable_string, acks int16, timeout_ms int32,
+//	      topic_data [name string, partition_data [index int32, records nullable_bytes]]
+//	响应: responses [name string,
+//	                 partition_responses [index int32, error_code int16, base_offset int64, log_append_time_ms int64,
+//	                                      log_start_offset int64 (v5+),
+//	                                      record_errors [batch_index int32, batch_index_error_message nullable_string] (v8+),
+//	                                      error_message nullable_string (v8+)]],
+//	      throttle_time_ms int32
+func (l *Listener) handleProduce(req *request, w *writer) (bool, error) {
+	r, version := req.body, req.apiVersion
+
+	r.nullableString() // transactional_id
+	acks := r.int16()
+	r.int32() // timeout_ms，写入是同步完成的
+
+	type partitionResult struct {
+		index       int32
+		errorCode   int16
+		err         error
+		baseOffset  int64
+		startOffset int64
+	}
+	type topicResult struct {
+		name       string
+		partitions []partitionResult
+	}
+	var results []topicResult
+
+	topicCount := r.arrayLength()
+	for i := 0; i < topicCount && r.err == nil; i++ {
+		topic := topicResult{name: r.string()}
+		partitionCount := r.arrayLength()
+		for j := 0; j < partitionCount && r.err == nil; j++ {
+			index := r.int32()
+			records := r.bytes()
+			if r.err != nil {
+				break
+			}
+			result := partitionResult{index: index, baseOffset: -1, startOffset: -1}
+			result.baseOffset, result.err = l.produce(topic.name, index, records)
+			if result.err != nil {
+				result.baseOffset = -1
+				fmt.Printf("kafka produce %s-%d failed: %v\n", topic.name, index, result.err)
+			} else if start, err := l.broker.GetEarliestOffset(topic.name, index); err == nil {
+				result.startOffset = start
+			}
+			result.errorCode = errorCode(result.err)
+			topic.partitions = append(topic.partitions, result)
+		}
+		results = append(results, topic)
+	}
+	if r.err != nil {
+		return false, r.err
+	}
+	if acks == 0 {
+		return true, nil
+	}
+
+	w.arrayLength(len(results))
+	for _, topic := range results {
+		w.string(topic.name)
+		w.arrayLength(len(topic.partitions))
+		for _, p := range topic.partitions {
+			w.int32(p.index)
+			w.int16(p.errorCode)
+			w.int64(p.baseOffset)
+			w.int64(-1) // log_append_time_ms，时间戳用的是CreateTime
+			if version >= 5 {
+				w.int64(p.startOffset)
+			}
+			if version >= 8 {
+				w.arrayLength(0) // record_errors
+				if p.err != nil {
+					w.string(p.err.Error())
+				} else {
+					w.nullString()
+				}
+			}
+		}
+	}
+	w.int32(0) // throttle_time_ms
+	return false, nil
+}
+
+// produce 把records中的batch依次写入分区，返回第一个batch的offset
+// Kafka客户端每个分区一般只发送一个batch；有多个batch时前面的写入之后后面的失败，已经写入的不会撤销
+func (l *Listener) produce(topicName string, partitionId int32, records []byte) (int64, error) {
+	batches, err := record.Split(records)
+	if err != nil {
+		return 0, err
+	}
+	size := 0
+	for _, batch := range batches {
+		size += batch.Size()
+	}
+	if len(batches) == 0 || size != len(records) {
+		return 0, fmt.Errorf("%w: records do not contain complete batches", common.ErrCorruptMessage)
+	}
+
+	var baseOffset int64
+	for i, batch := range batches {
+		offset, err := l.broker.ProduceBatchToPartition(topicName, partitionId, batch)
+		if err != nil {
+			return 0, err
+		}
+		if i == 0 {
+			baseOffset = offset
+		}
+	}
+	return baseOffset, nil
+}
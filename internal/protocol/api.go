@@ -0,0 +1,80 @@
+package protocol
+
+import "sort"
+
+// API 一种请求在帧头中的编号、支持的版本，以及解码请求和响应时使用的数据结构
+type API struct {
+	Key  int16
+	Type RequestType
+
+	// MinVersion 和 MaxVersion 这个版本的代码能编码和解码的版本范围，两端都包含
+	// 请求结构体加了字段（见wire包的since tag）就要提升MaxVersion，不再支持老版本时提升MinVersion
+	MinVersion int16
+	MaxVersion int16
+
+	// NewRequest 和 NewResponse 返回指向空结构体的指针，解码时把帧体解码到里面
+	NewRequest  func() interface{}
+	NewResponse func() interface{}
+}
+
+// apis 帧头中的API key，一旦发布就不能修改，新的请求类型只能使用新的编号
+//
+// 版本历史:
+//
+//	v1: 错误响应带ErrorCode，DeleteRecordsResult也带ErrorCode；API_VERSIONS只有v0，客户端还不知道Broker的版本时就要发送
+//	v2: CONSUME带MaxWaitMs和MinBytes，支持长轮询
+//
+// 之后新加的请求类型从v1开始，错误响应一开始就带ErrorCode
+var apis = []*API{
+	{0, RequestTypeCreateTopic, 0, 1, func() interface{} { return &CreateTopicRequest{} }, func() interface{} { return &CreateTopicResponse{} }},
+	{1, RequestTypeProduce, 0, 1, func() interface{} { return &ProduceRequest{} }, func() interface{} { return &ProduceResponse{} }},
+	{2, RequestTypeConsume, 0, 2, func() interface{} { return &ConsumeRequest{} }, func() interface{} { return &ConsumeResponse{} }},
+	{3, RequestTypeSubscribe, 0, 1, func() interface{} { return &SubscribeRequest{} }, func() interface{} { return &SubscribeResponse{} }},
+	{4, RequestTypeSeek, 0, 1, func() interface{} { return &SeekRequest{} }, func() interface{} { return &SeekResponse{} }},
+	{5, RequestTypeOffsetForTime, 0, 1, func() interface{} { return &OffsetForTimeRequest{} }, func() interface{} { return &OffsetForTimeResponse{} }},
+	{6, RequestTypeProduceBatch, 1, 1, func() interface{} { return &ProduceBatchRequest{} }, func() interface{} { return &ProduceBatchResponse{} }},
+
+	{10, RequestTypeJoinGroup, 0, 1, func() interface{} { return &JoinGroupRequest{} }, func() interface{} { return &JoinGroupResponse{} }},
+	{11, RequestTypeLeaveGroup, 0, 1, func() interface{} { return &LeaveGroupRequest{} }, func() interface{} { return &LeaveGroupResponse{} }},
+	{12, RequestTypeSyncGroup, 0, 1, func() interface{} { return &SyncGroupRequest{} }, func() interface{} { return &SyncGroupResponse{} }},
+	{13, RequestTypeHeartbeat, 0, 1, func() interface{} { return &HeartbeatRequest{} }, func() interface{} { return &HeartbeatResponse{} }},
+	{14, RequestTypeCommitOffset, 0, 1, func() interface{} { return &CommitOffsetRequest{} }, func() interface{} { return &CommitOffsetResponse{} }},
+	{15, RequestTypeGetOffset, 0, 1, func() interface{} { return &GetOffsetRequest{} }, func() interface{} { return &GetOffsetResponse{} }},
+
+	{20, RequestTypeSnapshot, 0, 1, func() interface{} { return &SnapshotRequest{} }, func() interface{} { return &SnapshotResponse{} }},
+	{21, RequestTypeRestore, 0, 1, func() interface{} { return &RestoreRequest{} }, func() interface{} { return &RestoreResponse{} }},
+	{22, RequestTypeDeleteRecords, 0, 1, func() interface{} { return &DeleteRecordsRequest{} }, func() interface{} { return &DeleteRecordsResponse{} }},
+
+	// 和Kafka的ApiVersions一样是18
+	{18, RequestTypeAPIVersions, 0, 0, func() interface{} { return &APIVersionsRequest{} }, func() interface{} { return &APIVersionsResponse{} }},
+}
+
+var (
+	apisByKey  = make(map[int16]*API)
+	apisByType = make(map[RequestType]*API)
+)
+
+func init() {
+	for _, api := range apis {
+		apisByKey[api.Key] = api
+		apisByType[api.Type] = api
+	}
+}
+
+// APIByKey 根据帧头中的API key查找请求类型，不认识的key返回nil
+func APIByKey(key int16) *API {
+	return apisByKey[key]
+}
+
+// APIByType 根据请求类型查找API key，不认识的类型返回nil
+func APIByType(t RequestType) *API {
+	return apisByType[t]
+}
+
+// APIs 所有的请求类型，按API key排序
+func APIs() []*API {
+	sorted := make([]*API, len(apis))
+	copy(sorted, apis)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Key < sorted[j].Key })
+	return sorted
+}
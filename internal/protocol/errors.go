@@ -0,0 +1,135 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/kafka-from-scratch/internal/common"
+)
+
+// ErrorCode 错误响应的错误类型，客户端根据它判断出了什么错、能不能重试，不用去匹配Error中的文字
+// 编号一旦发布就不能修改，新的错误只能使用新的编号
+type ErrorCode int16
+
+const (
+	ErrorCodeNone    ErrorCode = 0
+	ErrorCodeUnknown ErrorCode = 1 // 没有归类的错误，具体原因只在Error中
+
+	// 请求本身的错误
+	ErrorCodeInvalidRequest     ErrorCode = 2 // 帧体解码失败或者API key不认识
+	ErrorCodeUnsupportedVersion ErrorCode = 3
+
+	// Topic和分区
+	ErrorCodeUnknownTopic       ErrorCode = 10
+	ErrorCodeUnknownPartition   ErrorCode = 11
+	ErrorCodeTopicAlreadyExists ErrorCode = 12
+	ErrorCodeInvalidTopic       ErrorCode = 13
+	ErrorCodeInvalidConfig      ErrorCode = 14
+	ErrorCodeOffsetOutOfRange   ErrorCode = 15
+	ErrorCodeCorruptMessage     ErrorCode = 16
+	ErrorCodeRecordTooLarge     ErrorCode = 17
+	ErrorCodeBrokerFull         ErrorCode = 18
+
+	// Consumer Group
+	ErrorCodeUnknownGroup        ErrorCode = 20
+	ErrorCodeUnknownMember       ErrorCode = 21
+	ErrorCodeIllegalGeneration   ErrorCode = 22
+	ErrorCodeRebalanceInProgress ErrorCode = 23
+	ErrorCodeNotCoordinator      ErrorCode = 24
+)
+
+// errorCodeInfo 每种错误的名字、是否可以重试，以及对应的common中的错误
+// Broker用errors.Is把处理请求时返回的错误归类，客户端收到之后还原成同一个错误
+type errorCodeInfo struct {
+	code      ErrorCode
+	name      string
+	retriable bool
+	err       error
+}
+
+var errorCodes = []errorCodeInfo{
+	{ErrorCodeNone, "NONE", false, nil},
+	{ErrorCodeUnknown, "UNKNOWN", false, nil},
+	{ErrorCodeInvalidRequest, "INVALID_REQUEST", false, nil},
+	{ErrorCodeUnsupportedVersion, "UNSUPPORTED_VERSION", false, nil},
+
+	{ErrorCodeUnknownTopic, "UNKNOWN_TOPIC", false, common.ErrUnknownTopic},
+	{ErrorCodeUnknownPartition, "UNKNOWN_PARTITION", false, common.ErrUnknownPartition},
+	{ErrorCodeTopicAlreadyExists, "TOPIC_ALREADY_EXISTS", false, common.ErrTopicAlreadyExists},
+	{ErrorCodeInvalidTopic, "INVALID_TOPIC", false, common.ErrInvalidTopic},
+	{ErrorCodeInvalidConfig, "INVALID_CONFIG", false, common.ErrInvalidConfig},
+	{ErrorCodeOffsetOutOfRange, "OFFSET_OUT_OF_RANGE", false, common.ErrOffsetOutOfRange},
+	{ErrorCodeCorruptMessage, "CORRUPT_MESSAGE", false, common.ErrCorruptMessage},
+	{ErrorCodeRecordTooLarge, "RECORD_TOO_LARGE", false, common.ErrRecordTooLarge},
+	// 旧消息被retention清理或者预算调大之后就能写入
+	{ErrorCodeBrokerFull, "BROKER_FULL", true, common.ErrBrokerFull},
+
+	// UnknownGroup、UnknownMember和IllegalGeneration要先重新JoinGroup，原样重试没有用
+	{ErrorCodeUnknownGroup, "UNKNOWN_GROUP", false, common.ErrUnknownGroup},
+	{ErrorCodeUnknownMember, "UNKNOWN_MEMBER", false, common.ErrUnknownMember},
+	{ErrorCodeIllegalGeneration, "ILLEGAL_GENERATION", false, common.ErrIllegalGeneration},
+	{ErrorCodeRebalanceInProgress, "REBALANCE_IN_PROGRESS", true, common.ErrRebalanceInProgress},
+	{ErrorCodeNotCoordinator, "NOT_COORDINATOR", true, common.ErrNotCoordinator},
+}
+
+func lookupErrorCode(c ErrorCode) (errorCodeInfo, bool) {
+	for _, info := range errorCodes {
+		if info.code == c {
+			return info, true
+		}
+	}
+	return errorCodeInfo{}, false
+}
+
+func (c ErrorCode) String() string {
+	if info, ok := lookupErrorCode(c); ok {
+		return info.name
+	}
+	return fmt.Sprintf("ERROR_CODE_%d", int16(c))
+}
+
+// Retriable 同样的请求稍后重试可能成功；不可重试的错误要先改请求或者先做别的操作（例如重新JoinGroup）
+func (c ErrorCode) Retriable() bool {
+	info, _ := lookupErrorCode(c)
+	return info.retriable
+}
+
+// ErrorCodeOf 把处理请求时返回的错误归类，err为nil时返回ErrorCodeNone，不认识的错误返回ErrorCodeUnknown
+func ErrorCodeOf(err error) ErrorCode {
+	if err == nil {
+		return ErrorCodeNone
+	}
+	for _, info := range errorCodes {
+		if info.err != nil && errors.Is(err, info.err) {
+			return info.code
+		}
+	}
+	return ErrorCodeUnknown
+}
+
+// ResponseError 错误响应在客户端的表示，可以用errors.Is和common中对应的错误比较
+type ResponseError struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *ResponseError) Error() string {
+	return e.Message
+}
+
+// Unwrap 返回Code对应的common中的错误，没有对应的错误时返回nil
+func (e *ResponseError) Unwrap() error {
+	info, _ := lookupErrorCode(e.Code)
+	return info.err
+}
+
+// Retriable 见ErrorCode.Retriable
+func (e *ResponseError) Retriable() bool {
+	return e.Code.Retriable()
+}
+
+// IsRetriable err中是否有可以重试的错误响应
+func IsRetriable(err error) bool {
+	var responseError *ResponseError
+	return errors.As(err, &responseError) && responseError.Retriable()
+}
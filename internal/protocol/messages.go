@@ -1,14 +1,18 @@
 package protocol
 
+import "github.com/kafka-from-scratch/internal/record"
+
 // RequestType 定义请求类型
 type RequestType string
 
 const (
-	RequestTypeCreateTopic RequestType = "CREATE_TOPIC"
-	RequestTypeProduce     RequestType = "PRODUCE"
-	RequestTypeConsume     RequestType = "CONSUME"
-	RequestTypeSubscribe   RequestType = "SUBSCRIBE"
-	RequestTypeSeek        RequestType = "SEEK"
+	RequestTypeCreateTopic   RequestType = "CREATE_TOPIC"
+	RequestTypeProduce       RequestType = "PRODUCE"
+	RequestTypeConsume       RequestType = "CONSUME"
+	RequestTypeSubscribe     RequestType = "SUBSCRIBE"
+	RequestTypeSeek          RequestType = "SEEK"
+	RequestTypeOffsetForTime RequestType = "OFFSET_FOR_TIME"
+	RequestTypeProduceBatch  RequestType = "PRODUCE_BATCH"
 	
 	// Consumer Group 协议
 	RequestTypeJoinGroup    RequestType = "JOIN_GROUP"
@@ -17,19 +21,49 @@ const (
 	RequestTypeHeartbeat    RequestType = "HEARTBEAT"
 	RequestTypeCommitOffset RequestType = "COMMIT_OFFSET"
 	RequestTypeGetOffset    RequestType = "GET_OFFSET"
+
+	// 管理协议
+	RequestTypeSnapshot      RequestType = "SNAPSHOT"
+	RequestTypeRestore       RequestType = "RESTORE"
+	RequestTypeDeleteRecords RequestType = "DELETE_RECORDS"
+
+	// 版本协商，客户端连接之后第一个发送
+	RequestTypeAPIVersions RequestType = "API_VERSIONS"
 )
 
 // Request 通用请求结构
+// Type、Version和RequestID在帧头中分别是API key、API version和correlation ID，Data是帧体，见wire包
 type Request struct {
 	Type      RequestType `json:"type"`
-	RequestID string      `json:"request_id"`
-	Data      interface{} `json:"data"`
+	Version   int16       `json:"version"`
+	RequestID int32       `json:"request_id"`
+	Data      interface{} `json:"data"` // 指向具体请求结构体的指针，例如*ProduceRequest
 }
 
-// Response 通用响应结构
+// Response 通用响应结构，Type、Version和RequestID和对应的请求相同
 type Response struct {
-	RequestID string      `json:"request_id"`
+	Type      RequestType `json:"type"`
+	Version   int16       `json:"version"`
+	RequestID int32       `json:"request_id"`
 	Success   bool        `json:"success"`
+	ErrorCode ErrorCode   `json:"error_code,omitempty"` // Success为false时的错误类型，v0的错误响应没有，客户端收到的是ErrorCodeNone
 	Error     string      `json:"error,omitempty"`
-	Data      interface{} `json:"data,omitempty"`
+	Data      interface{} `json:"data,omitempty"` // 指向具体响应结构体的指针，Success为false时为nil
+
+	// Records 放在帧的最后、紧跟在帧体之后原样发送的batch数据，不经过codec编码，长度由Data中的字段给出
+	// 目前CONSUME和SNAPSHOT的响应会带，见ConsumeResponse.RecordsSize和SnapshotResponse.ArchiveSize
+	Records record.Records `json:"-"`
+}
+
+// Err Success为true时返回nil，否则返回*ResponseError，可以用errors.Is和common中对应的错误比较
+// 没有ErrorCode的错误响应（v0或者Broker没有归类的错误）按ErrorCodeUnknown处理
+func (r *Response) Err() error {
+	if r.Success {
+		return nil
+	}
+	code := r.ErrorCode
+	if code == ErrorCodeNone {
+		code = ErrorCodeUnknown
+	}
+	return &ResponseError{Code: code, Message: r.Error}
 }
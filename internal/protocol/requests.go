@@ -7,8 +7,9 @@ package protocol
 type CreateTopicRequest struct {
 	// TODO: 你来定义字段
 	// 提示: 需要topic名称和分区数
-	TopicName    string `json:"topic_name"`
-	PartitionNum int32  `json:"partition_num"`
+	TopicName    string            `json:"topic_name"`
+	PartitionNum int32             `json:"partition_num"`
+	Configs      map[string]string `json:"configs,omitempty"` // Topic配置，例如 retention.ms
 }
 
 // ProduceRequest 生产消息请求
@@ -16,10 +17,20 @@ type ProduceRequest struct {
 	// TODO: 你来定义字段
 	// 提示: 需要topic名称、消息的key、value、headers
 
-	TopicName    string            `json:"topic_name"`
-	PartitionKey string            `json:"partition_key"`
-	Value        string            `json:"value"`
-	Headers      map[string]string `json:"headers"`
+	TopicName string `json:"topic_name"`
+	Records   []byte `json:"records"` // 编码好的RecordBatch（见record包），整个batch写入同一个分区，按第一条消息的key选择
+}
+
+// ProduceBatchRequest 一次发送多个Topic、多个分区的消息，Broker把发往同一个分区的消息写成一个batch，每个分区各自整个写入
+type ProduceBatchRequest struct {
+	Partitions []ProducePartitionData `json:"partitions"`
+}
+
+// ProducePartitionData 写入一个分区的batch
+type ProducePartitionData struct {
+	Topic       string `json:"topic"`
+	PartitionId int32  `json:"partition_id"` // 小于0时每条消息和ProduceRequest一样按自己的key选择分区
+	Records     []byte `json:"records"`      // 编码好的RecordBatch，只能有一个batch
 }
 
 // ConsumeRequest 消费消息请求
@@ -34,6 +45,11 @@ type ConsumeRequest struct {
 	Offset        int64  `json:"offset"`
 	MaxMessages   int    `json:"max_messages"`
 	ConsumerGroup string `json:"consumer_group"` // 预留字段 阶段5 在用
+
+	// 长轮询：读到的数据不到MinBytes字节时，Broker最多等MaxWaitMs毫秒，等分区追加了新消息再返回
+	// MaxWaitMs为0时马上返回，MinBytes为0时即使没有数据也马上返回，和Kafka的Fetch一样
+	MaxWaitMs int32 `json:"max_wait_ms,omitempty" since:"2"`
+	MinBytes  int32 `json:"min_bytes,omitempty" since:"2"`
 }
 
 // SubscribeRequest 订阅请求
@@ -52,6 +68,13 @@ type SeekRequest struct {
 	Offset      int64  `json:"offset"`
 }
 
+// OffsetForTimeRequest 按时间戳查找offset的请求
+type OffsetForTimeRequest struct {
+	Topic       string `json:"topic"`
+	PartitionId int32  `json:"partition_id"`
+	Timestamp   int64  `json:"timestamp"` // Unix毫秒时间戳
+}
+
 // ==================== Consumer Group 协议请求 ====================
 
 // JoinGroupRequest Consumer加入Group的请求
@@ -104,3 +127,25 @@ type TopicPartitionOffset struct {
 	PartitionId int32  `json:"partition_id"`
 	Offset      int64  `json:"offset"`
 }
+
+// ==================== 管理协议请求 ====================
+
+// SnapshotRequest 把整个Broker的状态（Topic、消息、Group提交的offset）打包成归档，格式见snapshot包
+type SnapshotRequest struct{}
+
+// RestoreRequest 把SNAPSHOT得到的归档恢复到这个Broker
+type RestoreRequest struct {
+	Archive []byte `json:"archive"`
+	Force   bool   `json:"force"` // 为false时只要有一个Topic已经存在就拒绝恢复
+}
+
+// DeleteRecordsRequest 删除每个分区中Offset之前的所有消息，Offset为-1表示删除到最新offset
+type DeleteRecordsRequest struct {
+	Partitions []TopicPartitionOffset `json:"partitions"`
+}
+
+// ==================== 版本协商 ====================
+
+// APIVersionsRequest 查询Broker支持的每种请求的版本范围
+// 只有v0并且永远不会改，任何版本的客户端都可以用它和任何版本的Broker协商
+type APIVersionsRequest struct{}
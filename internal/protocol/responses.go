@@ -20,20 +20,52 @@ type ProduceResponse struct {
 	Result      int8  `json:"result"` // 0 表示没问题
 }
 
+// ProduceBatchResponse 每个分区的结果，顺序是分区在请求中第一次出现的顺序
+// 请求中整个batch无法写入时（batch损坏、Topic不存在）也有一个结果，PartitionId和请求中一样
+type ProduceBatchResponse struct {
+	Partitions []ProduceBatchResult `json:"partitions"`
+}
+
+// ProduceBatchResult 一个分区的写入结果，Error不为空时这个分区的消息都没有写入
+type ProduceBatchResult struct {
+	Topic       string    `json:"topic"`
+	PartitionId int32     `json:"partition_id"` // 实际写入的分区，请求中小于0的消息是Broker按key选择的分区
+	BaseOffset  int64     `json:"base_offset"`  // 第一条消息的offset，后面的消息依次加一；失败时为-1
+	Error       string    `json:"error,omitempty"`
+	ErrorCode   ErrorCode `json:"error_code,omitempty"`
+}
+
+// Err 这个分区写入成功时返回nil，见Response.Err
+func (r *ProduceBatchResult) Err() error {
+	if r.Error == "" {
+		return nil
+	}
+	code := r.ErrorCode
+	if code == ErrorCodeNone {
+		code = ErrorCodeUnknown
+	}
+	return &ResponseError{Code: code, Message: r.Error}
+}
+
 // ConsumeResponse 消费消息响应
 type ConsumeResponse struct {
 	// TODO: 你来定义字段
 	// 提示: 需要返回消息列表
-	Messages []*NetworkMessage `json:"messages"`
-	Result   int8              `json:"result"` // 0 表示没问题
+	// RecordsSize 响应帧的最后是这么多字节首尾相接的RecordBatch，Broker直接从存储发送
+	// 第一个batch里可能有早于请求offset的消息，最后也可能多出几条，由Consumer跳过
+	RecordsSize int64 `json:"records_size"`
+	Result      int8  `json:"result"` // 0 表示没问题
 }
 
+// NetworkMessage Consumer从RecordBatch中解码出来的一条消息
+// Key、Value和header的value都是原始字节，nil和空的[]byte{}不同：Key为nil表示没有key，Value为nil表示tombstone
 type NetworkMessage struct {
-	Key       string            `json:"key,omitempty"`
-	Value     string            `json:"value"`
-	Headers   map[string]string `json:"headers,omitempty"`
+	Key       []byte            `json:"key,omitempty"`
+	Value     []byte            `json:"value"`
+	Headers   map[string][]byte `json:"headers,omitempty"`
 	Offset    int64             `json:"offset"`
 	Timestamp string            `json:"timestamp"`
+	Tombstone bool              `json:"tombstone,omitempty"` // true表示value为nil
 }
 
 // SubscribeResponse 订阅响应
@@ -50,6 +82,11 @@ type SeekResponse struct {
 	Result int8 `json:"result"` // 0 表示没问题
 }
 
+// OffsetForTimeResponse 按时间戳查找offset的响应
+type OffsetForTimeResponse struct {
+	Offset int64 `json:"offset"` // 第一条时间戳 >= 请求时间的消息的offset
+}
+
 // ==================== Consumer Group 协议响应 ====================
 
 // JoinGroupResponse Consumer加入Group的响应
@@ -88,5 +125,59 @@ type CommitOffsetResponse struct {
 
 // GetOffsetResponse 获取offset响应
 type GetOffsetResponse struct {
-	Offset int64 `json:"offset"`
+	Offset int64 `json:"offset"` // 没有提交过时为-1
+}
+
+// ==================== 管理协议响应 ====================
+
+// SnapshotResponse 响应帧的最后是ArchiveSize字节的归档
+type SnapshotResponse struct {
+	ArchiveSize int64 `json:"archive_size"`
+}
+
+// RestoreResponse 恢复的Topic和Consumer Group
+type RestoreResponse struct {
+	Topics []string `json:"topics"`
+	Groups []string `json:"groups"`
+}
+
+// DeleteRecordsResponse 每个分区的结果，顺序和请求一致
+type DeleteRecordsResponse struct {
+	Partitions []DeleteRecordsResult `json:"partitions"`
+}
+
+// DeleteRecordsResult 一个分区的删除结果，Error不为空时这个分区没有删除
+type DeleteRecordsResult struct {
+	Topic        string    `json:"topic"`
+	PartitionId  int32     `json:"partition_id"`
+	LowWatermark int64     `json:"low_watermark"` // 新的log start offset，之前的offset都不能再消费
+	Error        string    `json:"error,omitempty"`
+	ErrorCode    ErrorCode `json:"error_code,omitempty" since:"1"`
+}
+
+// Err 这个分区删除成功时返回nil，见Response.Err
+func (r *DeleteRecordsResult) Err() error {
+	if r.Error == "" {
+		return nil
+	}
+	code := r.ErrorCode
+	if code == ErrorCodeNone {
+		code = ErrorCodeUnknown
+	}
+	return &ResponseError{Code: code, Message: r.Error}
+}
+
+// ==================== 版本协商 ====================
+
+// APIVersionsResponse Broker支持的所有请求类型
+type APIVersionsResponse struct {
+	APIs []APIVersionRange `json:"apis"`
+}
+
+// APIVersionRange 一种请求支持的版本范围，两端都包含
+type APIVersionRange struct {
+	Key        int16       `json:"key"`
+	Type       RequestType `json:"type"`
+	MinVersion int16       `json:"min_version"`
+	MaxVersion int16       `json:"max_version"`
 }
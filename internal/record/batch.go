@@ -0,0 +1,333 @@
+package record
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"github.com/kafka-from-scratch/internal/common"
+)
+
+// 一个RecordBatch的格式（和Kafka的RecordBatch v2一致，整数都是大端序）:
+//
+//	baseOffset           int64  第一条记录的offset
+//	batchLength          int32  后面内容的字节数，不含baseOffset和batchLength自身
+//	partitionLeaderEpoch int32
+//	magic                int8   固定为2
+//	crc                  uint32 从attributes到batch末尾的CRC32-C
+//	attributes           int16  压缩方式等，目前固定为0
+//	lastOffsetDelta      int32  最后一条记录相对baseOffset的偏移
+//	baseTimestamp        int64  第一条记录的时间戳(Unix毫秒)
+//	maxTimestamp         int64  batch中最大的时间戳
+//	producerId           int64  幂等Producer使用，目前固定为-1
+//	producerEpoch        int16
+//	baseSequence         int32
+//	recordCount          int32
+//	records              见record.go
+//
+// crc不覆盖baseOffset，所以Broker分配offset时只需要改写前8个字节，不需要重新编码和计算校验和
+const (
+	Magic = 2
+
+	// LogOverhead baseOffset和batchLength，读取一个batch时先读这么多字节才知道整个batch有多长
+	LogOverhead = 12
+
+	// BatchHeaderSize 第一条记录之前的固定部分
+	BatchHeaderSize = 61
+
+	// MaxBatchSize 单个batch的上限，batchLength超过它说明读到的是垃圾数据，避免按错误的长度分配巨大的内存
+	MaxBatchSize = 64 << 20
+)
+
+const (
+	baseOffsetPos      = 0
+	batchLengthPos     = 8
+	leaderEpochPos     = 12
+	magicPos           = 16
+	crcPos             = 17
+	attributesPos      = 21
+	lastOffsetDeltaPos = 23
+	baseTimestampPos   = 27
+	maxTimestampPos    = 35
+	producerIdPos      = 43
+	producerEpochPos   = 51
+	baseSequencePos    = 53
+	recordCountPos     = 57
+)
+
+// ErrIncompleteBatch 数据在batch中途结束（例如写入过程中进程被杀掉）
+var ErrIncompleteBatch = errors.New("incomplete record batch")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Batch 一个编码好的RecordBatch，磁盘上和网络上使用的都是这份字节
+type Batch []byte
+
+// Build 把Producer要发送的消息编码成一个batch，offset从0开始连续编号，Broker写入时再分配真正的offset
+func Build(messages []*common.Message) Batch {
+	return encode(0, messages, func(i int, _ *common.Message) int64 { return int64(i) })
+}
+
+// Encode 按消息自身的Offset编码成一个batch，baseOffset是第一条消息的offset
+// compact之后offset可能不连续，offsetDelta会跳过被删掉的offset
+func Encode(messages []*common.Message) Batch {
+	if len(messages) == 0 {
+		return nil
+	}
+	baseOffset := messages[0].Offset
+	return encode(baseOffset, messages, func(_ int, message *common.Message) int64 { return message.Offset - baseOffset })
+}
+
+func encode(baseOffset int64, messages []*common.Message, offsetDelta func(i int, message *common.Message) int64) Batch {
+	var baseTimestamp, maxTimestamp int64 = -1, -1
+	if len(messages) > 0 {
+		baseTimestamp = messages[0].Timestamp.UnixMilli()
+		maxTimestamp = baseTimestamp
+	}
+
+	buf := make([]byte, BatchHeaderSize, BatchHeaderSize+estimateRecordsSize(messages))
+	var lastOffsetDelta int64
+	for i, message := range messages {
+		timestamp := message.Timestamp.UnixMilli()
+		if timestamp > maxTimestamp {
+			maxTimestamp = timestamp
+		}
+		lastOffsetDelta = offsetDelta(i, message)
+		buf = appendRecord(buf, lastOffsetDelta, timestamp-baseTimestamp, message)
+	}
+
+	binary.BigEndian.PutUint64(buf[baseOffsetPos:], uint64(baseOffset))
+	binary.BigEndian.PutUint32(buf[batchLengthPos:], uint32(len(buf)-LogOverhead))
+	binary.BigEndian.PutUint32(buf[leaderEpochPos:], uint32(0xffffffff))
+	buf[magicPos] = Magic
+	binary.BigEndian.PutUint16(buf[attributesPos:], 0)
+	binary.BigEndian.PutUint32(buf[lastOffsetDeltaPos:], uint32(lastOffsetDelta))
+	binary.BigEndian.PutUint64(buf[baseTimestampPos:], uint64(baseTimestamp))
+	binary.BigEndian.PutUint64(buf[maxTimestampPos:], uint64(maxTimestamp))
+	binary.BigEndian.PutUint64(buf[producerIdPos:], uint64(0xffffffffffffffff))
+	binary.BigEndian.PutUint16(buf[producerEpochPos:], uint16(0xffff))
+	binary.BigEndian.PutUint32(buf[baseSequencePos:], uint32(0xffffffff))
+	binary.BigEndian.PutUint32(buf[recordCountPos:], uint32(len(messages)))
+	binary.BigEndian.PutUint32(buf[crcPos:], crc32.Checksum(buf[attributesPos:], crcTable))
+	return buf
+}
+
+// ReadBatch 从r中读取一个完整的batch，只检查长度不校验CRC
+// r中没有更多数据时返回io.EOF；数据在batch中途结束时返回ErrIncompleteBatch
+func ReadBatch(r io.Reader) (Batch, error) {
+	var header [LogOverhead]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, ErrIncompleteBatch
+		}
+		return nil, err
+	}
+
+	size, err := BatchSize(header[:])
+	if err != nil {
+		return nil, err
+	}
+	batch := make(Batch, size)
+	copy(batch, header[:])
+	if _, err := io.ReadFull(r, batch[LogOverhead:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrIncompleteBatch
+		}
+		return nil, err
+	}
+	return batch, nil
+}
+
+// Split 把首尾相接的多个batch切分开，不拷贝数据
+// 末尾不完整的batch会被忽略：按字节数读取时，最后一个batch可能只读到了一部分
+func Split(data []byte) ([]Batch, error) {
+	batches := make([]Batch, 0)
+	for len(data) >= LogOverhead {
+		size, err := BatchSize(data)
+		if err != nil {
+			return nil, err
+		}
+		if size > len(data) {
+			break
+		}
+		batches = append(batches, Batch(data[:size:size]))
+		data = data[size:]
+	}
+	return batches, nil
+}
+
+// BatchSize 根据开头的baseOffset和batchLength算出整个batch的字节数，header至少要有LogOverhead个字节
+func BatchSize(header []byte) (int, error) {
+	length := int(int32(binary.BigEndian.Uint32(header[batchLengthPos:])))
+	if length < BatchHeaderSize-LogOverhead || length > MaxBatchSize {
+		return 0, fmt.Errorf("%w: invalid batch length %d", common.ErrCorruptMessage, length)
+	}
+	return LogOverhead + length, nil
+}
+
+// BaseOffset 第一条记录的offset
+func (b Batch) BaseOffset() int64 {
+	return int64(binary.BigEndian.Uint64(b[baseOffsetPos:]))
+}
+
+// SetBaseOffset 改写baseOffset，batch中每条记录的offset随之改变
+// crc不覆盖baseOffset，改写后batch仍然是有效的
+func (b Batch) SetBaseOffset(offset int64) {
+	binary.BigEndian.PutUint64(b[baseOffsetPos:], uint64(offset))
+}
+
+// LastOffset 最后一条记录的offset
+func (b Batch) LastOffset() int64 {
+	return b.BaseOffset() + int64(int32(binary.BigEndian.Uint32(b[lastOffsetDeltaPos:])))
+}
+
+// RecordCount batch中的记录数
+func (b Batch) RecordCount() int {
+	return int(int32(binary.BigEndian.Uint32(b[recordCountPos:])))
+}
+
+// MaxTimestamp batch中最大的时间戳(Unix毫秒)，空batch返回-1
+func (b Batch) MaxTimestamp() int64 {
+	return int64(binary.BigEndian.Uint64(b[maxTimestampPos:]))
+}
+
+// Size batch占用的总字节数
+func (b Batch) Size() int {
+	return len(b)
+}
+
+// Verify 检查batch的长度、magic和CRC，不一致时返回common.ErrCorruptMessage
+func (b Batch) Verify() error {
+	if len(b) < BatchHeaderSize {
+		return fmt.Errorf("%w: batch of %d bytes is shorter than header", common.ErrCorruptMessage, len(b))
+	}
+	if size, err := BatchSize(b); err != nil {
+		return err
+	} else if size != len(b) {
+		return fmt.Errorf("%w: batch length %d does not match %d bytes", common.ErrCorruptMessage, size, len(b))
+	}
+	if magic := b[magicPos]; magic != Magic {
+		return fmt.Errorf("%w: unsupported batch magic %d", common.ErrCorruptMessage, magic)
+	}
+	if attributes := binary.BigEndian.Uint16(b[attributesPos:]); attributes != 0 {
+		return fmt.Errorf("%w: unsupported batch attributes %#x", common.ErrCorruptMessage, attributes)
+	}
+	if crc := binary.BigEndian.Uint32(b[crcPos:]); crc != crc32.Checksum(b[attributesPos:], crcTable) {
+		return fmt.Errorf("%w: batch checksum mismatch", common.ErrCorruptMessage)
+	}
+	return nil
+}
+
+// Validate 检查Producer发来的batch：除了Verify之外，每条记录都要能解析，offsetDelta必须从0开始连续，
+// header中的maxTimestamp要等于按baseTimestamp和timestampDelta算出的最大时间戳，recordCount条记录之后不能还有字节
+// Broker写入前调用它，之后就可以原样把这份字节写到磁盘上
+func (b Batch) Validate() error {
+	if err := b.Verify(); err != nil {
+		return err
+	}
+	count := b.RecordCount()
+	if count <= 0 {
+		return fmt.Errorf("%w: batch has no records", common.ErrCorruptMessage)
+	}
+	if lastOffsetDelta := b.LastOffset() - b.BaseOffset(); lastOffsetDelta != int64(count-1) {
+		return fmt.Errorf("%w: last offset delta %d does not match %d records", common.ErrCorruptMessage, lastOffsetDelta, count)
+	}
+
+	i := 0
+	var maxTimestampDelta int64
+	end, err := b.forEachRecord(count, func(r *rawRecord) error {
+		if r.offsetDelta != int64(i) {
+			return fmt.Errorf("%w: record %d has offset delta %d", common.ErrCorruptMessage, i, r.offsetDelta)
+		}
+		if i == 0 || r.timestampDelta > maxTimestampDelta {
+			maxTimestampDelta = r.timestampDelta
+		}
+		i++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if end != len(b) {
+		return fmt.Errorf("%w: %d trailing bytes after %d records", common.ErrCorruptMessage, len(b)-end, count)
+	}
+	// 索引和按时间戳查找都用header中的maxTimestamp，它必须和记录一致
+	baseTimestamp := int64(binary.BigEndian.Uint64(b[baseTimestampPos:]))
+	if maxTimestamp := baseTimestamp + maxTimestampDelta; maxTimestamp != b.MaxTimestamp() {
+		return fmt.Errorf("%w: max timestamp %d does not match %d computed from records", common.ErrCorruptMessage, b.MaxTimestamp(), maxTimestamp)
+	}
+	return nil
+}
+
+// Messages 解码batch中的所有记录
+func (b Batch) Messages() ([]*common.Message, error) {
+	return b.decode(b.RecordCount())
+}
+
+// FirstKey 第一条记录的key，Broker用它为整个batch选择分区
+func (b Batch) FirstKey() ([]byte, error) {
+	messages, err := b.decode(1)
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, nil
+	}
+	return messages[0].Key, nil
+}
+
+// decode 解码前n条记录
+func (b Batch) decode(n int) ([]*common.Message, error) {
+	if len(b) < BatchHeaderSize {
+		return nil, fmt.Errorf("%w: batch of %d bytes is shorter than header", common.ErrCorruptMessage, len(b))
+	}
+	count := b.RecordCount()
+	if count < 0 {
+		return nil, fmt.Errorf("%w: invalid record count %d", common.ErrCorruptMessage, count)
+	}
+	if n > count {
+		n = count
+	}
+	baseOffset := b.BaseOffset()
+	baseTimestamp := int64(binary.BigEndian.Uint64(b[baseTimestampPos:]))
+
+	// 每条记录至少占几个字节，recordCount写错时不会按它分配巨大的内存
+	capacity := n
+	if maxRecords := len(b) - BatchHeaderSize; capacity > maxRecords {
+		capacity = maxRecords
+	}
+	messages := make([]*common.Message, 0, capacity)
+	_, err := b.forEachRecord(n, func(r *rawRecord) error {
+		messages = append(messages, r.message(baseOffset, baseTimestamp))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+func (r *rawRecord) message(baseOffset, baseTimestamp int64) *common.Message {
+	headers := make(map[string][]byte, len(r.headers))
+	for _, h := range r.headers {
+		headers[string(h.key)] = cloneBytes(h.value)
+	}
+	return &common.Message{
+		Key:       cloneBytes(r.key),
+		Value:     cloneBytes(r.value),
+		Headers:   headers,
+		Timestamp: time.UnixMilli(baseTimestamp + r.timestampDelta),
+		Offset:    baseOffset + r.offsetDelta,
+	}
+}
+
+// cloneBytes 拷贝一份，解码出的消息不引用batch的内存；保留nil和空slice的区别
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append(make([]byte, 0, len(b)), b...)
+}
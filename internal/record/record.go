@@ -0,0 +1,186 @@
+package record
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/kafka-from-scratch/internal/common"
+)
+
+// batch中每条记录的格式（和Kafka的Record v2一致）:
+//
+//	length         varint  后面内容的字节数
+//	attributes     int8    目前没有使用
+//	timestampDelta varlong 相对baseTimestamp
+//	offsetDelta    varint  相对baseOffset
+//	keyLength      varint  -1 表示 nil
+//	key            []byte
+//	valueLength    varint  -1 表示 nil
+//	value          []byte
+//	headerCount    varint  之后每个header为 keyLength varint | key | valueLength varint | value
+//
+// varint是zigzag编码的变长整数，和encoding/binary的PutVarint一致
+
+// rawRecord 解析出来的一条记录，key、value直接引用batch的内存
+type rawRecord struct {
+	timestampDelta int64
+	offsetDelta    int64
+	key            []byte
+	value          []byte
+	headers        []rawHeader
+}
+
+type rawHeader struct {
+	key   []byte
+	value []byte
+}
+
+// estimateRecordsSize 编码后记录部分大致的字节数，用来预分配buffer
+func estimateRecordsSize(messages []*common.Message) int {
+	size := 0
+	for _, message := range messages {
+		size += 2*binary.MaxVarintLen32 + 2*binary.MaxVarintLen64 + 1 + len(message.Key) + len(message.Value)
+		for k, v := range message.Headers {
+			size += 2*binary.MaxVarintLen32 + len(k) + len(v)
+		}
+	}
+	return size
+}
+
+// appendRecord 把一条记录编码后追加到buf末尾
+func appendRecord(buf []byte, offsetDelta, timestampDelta int64, message *common.Message) []byte {
+	body := make([]byte, 0, 1+2*binary.MaxVarintLen64+2*binary.MaxVarintLen32+len(message.Key)+len(message.Value))
+	body = append(body, 0) // attributes
+	body = binary.AppendVarint(body, timestampDelta)
+	body = binary.AppendVarint(body, offsetDelta)
+	body = appendVarBytes(body, message.Key)
+	body = appendVarBytes(body, message.Value)
+
+	// header按key排序，保证同一条消息的编码结果固定
+	headerKeys := make([]string, 0, len(message.Headers))
+	for k := range message.Headers {
+		headerKeys = append(headerKeys, k)
+	}
+	sort.Strings(headerKeys)
+	body = binary.AppendVarint(body, int64(len(headerKeys)))
+	for _, k := range headerKeys {
+		body = appendVarBytes(body, []byte(k))
+		body = appendVarBytes(body, message.Headers[k])
+	}
+
+	buf = binary.AppendVarint(buf, int64(len(body)))
+	return append(buf, body...)
+}
+
+func appendVarBytes(buf []byte, b []byte) []byte {
+	if b == nil {
+		return binary.AppendVarint(buf, -1)
+	}
+	buf = binary.AppendVarint(buf, int64(len(b)))
+	return append(buf, b...)
+}
+
+// forEachRecord 按顺序解析batch中的前n条记录，返回最后一条记录结束的位置
+func (b Batch) forEachRecord(n int, fn func(r *rawRecord) error) (int, error) {
+	d := &decoder{buf: b, pos: BatchHeaderSize}
+	for i := 0; i < n; i++ {
+		length := d.varint()
+		if d.err != nil {
+			break
+		}
+		if length < 0 || length > int64(len(d.buf)-d.pos) {
+			return 0, fmt.Errorf("%w: record %d has invalid length %d", common.ErrCorruptMessage, i, length)
+		}
+		end := d.pos + int(length)
+		record := d.record(end)
+		if d.err != nil {
+			break
+		}
+		if d.pos != end {
+			return 0, fmt.Errorf("%w: record %d has %d trailing bytes", common.ErrCorruptMessage, i, end-d.pos)
+		}
+		if err := fn(record); err != nil {
+			return 0, err
+		}
+	}
+	if d.err != nil {
+		return 0, fmt.Errorf("%w: %v", common.ErrCorruptMessage, d.err)
+	}
+	return d.pos, nil
+}
+
+// decoder 按顺序解析varint和变长字节，出错后后续读取都返回零值
+type decoder struct {
+	buf []byte
+	pos int
+	err error
+}
+
+func (d *decoder) record(end int) *rawRecord {
+	// 限制在这条记录的范围内解析，长度字段写错时不会读到下一条记录
+	full := d.buf
+	d.buf = d.buf[:end]
+	defer func() { d.buf = full }()
+
+	d.byte() // attributes
+	r := &rawRecord{
+		timestampDelta: d.varint(),
+		offsetDelta:    d.varint(),
+		key:            d.bytes(),
+		value:          d.bytes(),
+	}
+	headerCount := d.varint()
+	if headerCount < 0 || headerCount > int64(end-d.pos) {
+		d.fail()
+		return r
+	}
+	r.headers = make([]rawHeader, 0, headerCount)
+	for i := int64(0); i < headerCount && d.err == nil; i++ {
+		r.headers = append(r.headers, rawHeader{key: d.bytes(), value: d.bytes()})
+	}
+	return r
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = fmt.Errorf("malformed record at byte %d", d.pos)
+	}
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil || d.pos >= len(d.buf) {
+		d.fail()
+		return 0
+	}
+	v := d.buf[d.pos]
+	d.pos++
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.buf[d.pos:])
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.pos += n
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.varint()
+	if n == -1 || d.err != nil {
+		return nil
+	}
+	if n < -1 || n > int64(len(d.buf)-d.pos) {
+		d.fail()
+		return nil
+	}
+	b := d.buf[d.pos : d.pos+int(n) : d.pos+int(n)]
+	d.pos += int(n)
+	return b
+}
@@ -0,0 +1,31 @@
+package record
+
+import "io"
+
+// Records 一段首尾相接的RecordBatch，Broker把它原样发送给Consumer
+// 数据可能在内存里，也可能是segment文件中的一段（见storage.FileRecords），发送完之后要调用Close
+type Records interface {
+	// Size 数据的总字节数
+	Size() int64
+
+	// WriteTo 把全部数据写到w，w是*net.TCPConn并且数据在文件中时会用sendfile，不经过用户态内存
+	WriteTo(w io.Writer) (int64, error)
+
+	Close() error
+}
+
+// MemoryRecords 内存中的Records
+type MemoryRecords []byte
+
+func (r MemoryRecords) Size() int64 {
+	return int64(len(r))
+}
+
+func (r MemoryRecords) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(r)
+	return int64(n), err
+}
+
+func (r MemoryRecords) Close() error {
+	return nil
+}
@@ -0,0 +1,172 @@
+package server_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kafka-from-scratch/internal/broker"
+	"github.com/kafka-from-scratch/internal/common"
+	"github.com/kafka-from-scratch/internal/protocol"
+	"github.com/kafka-from-scratch/internal/record"
+	"github.com/kafka-from-scratch/internal/storage"
+	"github.com/kafka-from-scratch/internal/wire"
+)
+
+const (
+	benchTopic     = "bench"
+	benchMessages  = 20000
+	benchValueSize = 200
+	benchBatchSize = 100
+	benchFetchSize = 500
+)
+
+// BenchmarkFetch 比较两种Fetch路径把同一个分区的全部消息发送到本机TCP连接的吞吐，每次操作从头读完整个分区:
+//
+//	json:     读出消息 -> 转换成NetworkMessage -> 时间戳格式化成RFC3339 -> JSON编码（原来handleConsume的做法）
+//	sendfile: 只读batch头部确定范围 -> 帧体之后直接把segment文件写到socket（现在的做法）
+//
+// 用法: go test -run '^$' -bench BenchmarkFetch ./internal/server
+func BenchmarkFetch(b *testing.B) {
+	diskBroker, err := broker.NewDiskBroker(b.TempDir(), storage.LogConfig{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer diskBroker.Close()
+	if err := fill(diskBroker); err != nil {
+		b.Fatal(err)
+	}
+
+	paths := []struct {
+		name  string
+		fetch func(conn *wire.Conn, encoder *json.Encoder, offset int64) (int64, error)
+	}{
+		{"json", func(conn *wire.Conn, encoder *json.Encoder, offset int64) (int64, error) {
+			return fetchJSON(diskBroker, encoder, offset)
+		}},
+		{"sendfile", func(conn *wire.Conn, encoder *json.Encoder, offset int64) (int64, error) {
+			return fetchRecords(diskBroker, conn, offset)
+		}},
+	}
+	for _, path := range paths {
+		b.Run(path.name, func(b *testing.B) {
+			// 按消息的value计算吞吐，两种路径的MB/s可以直接比较
+			b.SetBytes(benchMessages * benchValueSize)
+			conn, encoder := dialDiscard(b)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for offset := int64(0); offset < benchMessages; {
+					next, err := path.fetch(conn, encoder, offset)
+					if err != nil {
+						b.Fatal(err)
+					}
+					offset = next
+				}
+			}
+		})
+	}
+}
+
+// fill 用ProduceBatch写入测试数据
+func fill(b *broker.DiskBroker) error {
+	if err := b.CreateTopic(benchTopic, 1); err != nil {
+		return err
+	}
+	value := []byte(strings.Repeat("x", benchValueSize))
+	for written := 0; written < benchMessages; written += benchBatchSize {
+		batch := make([]*common.Message, benchBatchSize)
+		for i := range batch {
+			batch[i] = &common.Message{
+				Key:       []byte(fmt.Sprintf("key-%d", written+i)),
+				Value:     value,
+				Headers:   map[string][]byte{"source": []byte("bench")},
+				Timestamp: time.Now(),
+			}
+		}
+		if _, _, err := b.ProduceBatch(benchTopic, record.Build(batch)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dialDiscard 建立一条本机TCP连接，对端只负责读走所有数据，benchmark结束时关闭
+func dialDiscard(b *testing.B) (*wire.Conn, *json.Encoder) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { conn.Close() })
+	return wire.NewConn(conn, wire.CodecBinary), json.NewEncoder(conn)
+}
+
+// fetchJSON 原来的Fetch路径：每条消息解码、转换、格式化时间戳，再整体JSON编码
+func fetchJSON(b *broker.DiskBroker, encoder *json.Encoder, offset int64) (int64, error) {
+	messages, err := b.ConsumeMessages(benchTopic, 0, offset, benchFetchSize)
+	if err != nil {
+		return 0, err
+	}
+	if len(messages) == 0 {
+		return 0, fmt.Errorf("no messages at offset %d", offset)
+	}
+
+	networkMessages := make([]*protocol.NetworkMessage, len(messages))
+	for i, msg := range messages {
+		networkMessages[i] = &protocol.NetworkMessage{
+			Key:       msg.Key,
+			Value:     msg.Value,
+			Headers:   msg.Headers,
+			Offset:    msg.Offset,
+			Timestamp: msg.Timestamp.Format(time.RFC3339),
+			Tombstone: msg.IsTombstone(),
+		}
+	}
+	response := &protocol.Response{Success: true, Data: networkMessages}
+	if err := encoder.Encode(response); err != nil {
+		return 0, err
+	}
+	return messages[len(messages)-1].Offset + 1, nil
+}
+
+// fetchRecords 现在的Fetch路径：和TCPServer.writeResponse一样，响应帧的帧体之后直接发送segment文件中的batch
+func fetchRecords(b *broker.DiskBroker, conn *wire.Conn, offset int64) (int64, error) {
+	records, err := b.FetchRecords(benchTopic, 0, offset, benchFetchSize)
+	if err != nil {
+		return 0, err
+	}
+	defer records.Close()
+	if records.Size() == 0 {
+		return 0, fmt.Errorf("no records at offset %d", offset)
+	}
+
+	response := &protocol.Response{
+		Type:    protocol.RequestTypeConsume,
+		Success: true,
+		Data:    &protocol.ConsumeResponse{RecordsSize: records.Size()},
+		Records: records,
+	}
+	if err := conn.WriteResponse(response); err != nil {
+		return 0, err
+	}
+	// 写入时每个batch的offset都是连续的，返回的batch至少覆盖benchFetchSize条消息
+	return offset + benchFetchSize, nil
+}
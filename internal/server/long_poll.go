@@ -0,0 +1,58 @@
+package server
+
+import (
+	"time"
+
+	"github.com/kafka-from-scratch/internal/protocol"
+)
+
+// maxConsumeWait Broker最多让一个CONSUME等待的时间，MaxWaitMs更大时按它处理
+// MaxWaitMs是客户端给的，不设上限的话一个请求可以占着goroutine和in-flight的名额很多天
+const maxConsumeWait = 30 * time.Second
+
+// longPollConsume CONSUME读到的数据不到MinBytes时，等分区追加了新消息再重新读取，
+// 直到够MinBytes、读满MaxMessages条或者等了MaxWaitMs，超时时返回最后一次读到的数据
+//
+// response是handleRequest按顺序处理时读到的结果；调用时请求已经不占用Topic的处理顺序，
+// 等待期间同一个连接上后面的PRODUCE可以先处理，它们写入的消息也会出现在这个响应里
+// closed关闭表示连接上不再读新的请求，一般是客户端断开了，这时不再等待，马上返回已经读到的数据
+func (s *TCPServer) longPollConsume(request *protocol.Request, response *protocol.Response, closed <-chan struct{}) *protocol.Response {
+	data := request.Data.(*protocol.ConsumeRequest)
+	if !response.Success || data.MaxWaitMs <= 0 || s.consumeSatisfied(data, response) {
+		return response
+	}
+
+	timer := time.NewTimer(min(time.Duration(data.MaxWaitMs)*time.Millisecond, maxConsumeWait))
+	defer timer.Stop()
+	for {
+		// 先拿到channel再重新读取，上一次读取之后追加的消息不会错过
+		appended, err := s.broker.Appended(data.TopicName, data.PartitionId)
+		if err != nil {
+			return response
+		}
+		next := s.handleConsume(request)
+		response.Records.Close()
+		response = next
+		if !response.Success || s.consumeSatisfied(data, response) {
+			return response
+		}
+
+		select {
+		case <-appended:
+		case <-timer.C:
+			return response
+		case <-closed:
+			return response
+		}
+	}
+}
+
+// consumeSatisfied 读到的数据是否已经可以返回
+func (s *TCPServer) consumeSatisfied(data *protocol.ConsumeRequest, response *protocol.Response) bool {
+	if response.Records.Size() >= int64(data.MinBytes) {
+		return true
+	}
+	// MaxMessages条消息不到MinBytes时，再等也不会返回更多的消息
+	latest, err := s.broker.GetLatestOffset(data.TopicName, data.PartitionId)
+	return err != nil || latest-data.Offset >= int64(data.MaxMessages)
+}
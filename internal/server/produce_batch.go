@@ -0,0 +1,131 @@
+package server
+
+import (
+	"github.com/kafka-from-scratch/internal/common"
+	"github.com/kafka-from-scratch/internal/protocol"
+	"github.com/kafka-from-scratch/internal/record"
+)
+
+// partitionKey PRODUCE_BATCH中的一个分区
+type partitionKey struct {
+	topic     string
+	partition int32
+}
+
+// partitionBatch 要写入一个分区的消息，写入时是一个batch
+// 只有一个指定了这个分区的batch时原样写入raw，否则把所有消息解码到messages里重新编码
+type partitionBatch struct {
+	raw      record.Batch
+	messages []*common.Message
+	err      error
+}
+
+// add 加入更多的消息，raw还没有解码的话先解码，消息保持加入的顺序
+func (b *partitionBatch) add(messages []*common.Message) {
+	if b.raw != nil {
+		if b.err = b.raw.Validate(); b.err == nil {
+			b.messages, b.err = b.raw.Messages()
+		}
+		b.raw = nil
+	}
+	b.messages = append(b.messages, messages...)
+}
+
+// handleProduceBatch 按(Topic, 分区)分组写入，每个分区只写入一个batch，整个写入或者整个失败，一个分区失败不影响其他分区
+// PartitionId小于0的batch解码之后按每条消息的key分到各个分区，和PRODUCE单独发送时选择的分区一样，
+// 再和指定了同一个分区的消息合在一起
+//
+// 每个分区一个结果，顺序是分区在请求中第一次出现的顺序；
+// 整个batch无法分组时（batch损坏、Topic不存在），这个batch在它出现的位置有一个错误结果，PartitionId和请求中一样
+func (s *TCPServer) handleProduceBatch(request *protocol.Request) *protocol.Response {
+	data := request.Data.(*protocol.ProduceBatchRequest)
+
+	var results []protocol.ProduceBatchResult
+	var keys []partitionKey
+	batches := make(map[partitionKey]*partitionBatch)
+	slots := make(map[partitionKey]int) // 分区在results中的下标
+	batchFor := func(key partitionKey) *partitionBatch {
+		if batch, ok := batches[key]; ok {
+			return batch
+		}
+		batch := &partitionBatch{}
+		batches[key] = batch
+		keys = append(keys, key)
+		slots[key] = len(results)
+		results = append(results, protocol.ProduceBatchResult{Topic: key.topic, PartitionId: key.partition})
+		return batch
+	}
+	fail := func(p protocol.ProducePartitionData, err error) {
+		results = append(results, produceBatchError(protocol.ProduceBatchResult{Topic: p.Topic, PartitionId: p.PartitionId}, err))
+	}
+
+	for _, p := range data.Partitions {
+		batch := record.Batch(p.Records)
+		if p.PartitionId >= 0 {
+			key := partitionKey{p.Topic, p.PartitionId}
+			if _, ok := batches[key]; !ok {
+				// 完整的校验在写入时做
+				batchFor(key).raw = batch
+				continue
+			}
+		}
+
+		err := batch.Validate()
+		var messages []*common.Message
+		if err == nil {
+			messages, err = batch.Messages()
+		}
+		if err != nil {
+			fail(p, err)
+			continue
+		}
+		if p.PartitionId >= 0 {
+			batchFor(partitionKey{p.Topic, p.PartitionId}).add(messages)
+			continue
+		}
+
+		// 先为所有消息选好分区，Topic不存在时整个batch都不写入
+		var order []int32
+		byPartition := make(map[int32][]*common.Message)
+		for _, message := range messages {
+			var partition int32
+			if partition, err = s.broker.PartitionForKey(p.Topic, message.Key); err != nil {
+				break
+			}
+			if _, ok := byPartition[partition]; !ok {
+				order = append(order, partition)
+			}
+			byPartition[partition] = append(byPartition[partition], message)
+		}
+		if err != nil {
+			fail(p, err)
+			continue
+		}
+		for _, partition := range order {
+			batchFor(partitionKey{p.Topic, partition}).add(byPartition[partition])
+		}
+	}
+
+	for _, key := range keys {
+		batch := batches[key]
+		result := &results[slots[key]]
+		err := batch.err
+		if err == nil {
+			if batch.raw == nil {
+				batch.raw = record.Build(batch.messages)
+			}
+			result.BaseOffset, err = s.broker.ProduceBatchToPartition(key.topic, key.partition, batch.raw)
+		}
+		if err != nil {
+			*result = produceBatchError(*result, err)
+		}
+	}
+	return s.createSuccessResponse(request.RequestID, &protocol.ProduceBatchResponse{Partitions: results})
+}
+
+func produceBatchError(result protocol.ProduceBatchResult, err error) protocol.ProduceBatchResult {
+	result.BaseOffset = -1
+	result.Error = err.Error()
+	result.ErrorCode = protocol.ErrorCodeOf(err)
+	return result
+}
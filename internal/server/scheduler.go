@@ -0,0 +1,128 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/kafka-from-scratch/internal/protocol"
+)
+
+// maxInFlightRequests 每个连接最多同时处理的请求数，达到之后不再读新的请求，剩下的留在socket缓冲区里
+// 长轮询的CONSUME在等待新消息时也占一个
+const maxInFlightRequests = 64
+
+// requestScheduler 决定同一个连接上的请求什么时候可以开始处理
+// 涉及同一个Topic或同一个Group的请求按收到的顺序一个一个处理，例如先CREATE_TOPIC再PRODUCE、
+// 先PRODUCE再CONSUME，不等响应连续发送也和一个一个发送的结果一样；互不相关的请求并发处理
+// SNAPSHOT和RESTORE涉及整个Broker，要等之前的请求都处理完，之后的请求也要等它们处理完
+// 长轮询的CONSUME只有第一次读取按这个顺序，之后等新消息的时候已经调用了done，见longPollConsume
+type requestScheduler struct {
+	mu      sync.Mutex
+	last    map[string]chan struct{} // 每个key最后一个请求，处理完时关闭
+	barrier chan struct{}            // 最后一个涉及整个Broker的请求
+}
+
+func newRequestScheduler() *requestScheduler {
+	return &requestScheduler{last: make(map[string]chan struct{})}
+}
+
+// schedule 必须按收到请求的顺序调用，返回开始处理之前要等待的channel，处理完之后调用done
+func (s *requestScheduler) schedule(request *protocol.Request) (wait []chan struct{}, done func()) {
+	keys, all := orderingKeys(request)
+	finished := make(chan struct{})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.barrier != nil {
+		wait = append(wait, s.barrier)
+	}
+	if all {
+		for _, ch := range s.last {
+			wait = append(wait, ch)
+		}
+		s.last = make(map[string]chan struct{})
+		s.barrier = finished
+	} else {
+		for _, key := range keys {
+			if ch, ok := s.last[key]; ok {
+				wait = append(wait, ch)
+			}
+			s.last[key] = finished
+		}
+	}
+
+	return wait, func() {
+		close(finished)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, key := range keys {
+			if s.last[key] == finished {
+				delete(s.last, key)
+			}
+		}
+		if s.barrier == finished {
+			s.barrier = nil
+		}
+	}
+}
+
+// orderingKeys 请求涉及的Topic和Group，all为true表示涉及整个Broker
+// 没有key的请求（API_VERSIONS，或者解码失败的请求）不和任何请求冲突
+func orderingKeys(request *protocol.Request) (keys []string, all bool) {
+	topic := func(name string) string { return "topic/" + name }
+	group := func(id string) string { return "group/" + id }
+
+	switch data := request.Data.(type) {
+	case *protocol.CreateTopicRequest:
+		return []string{topic(data.TopicName)}, false
+	case *protocol.ProduceRequest:
+		return []string{topic(data.TopicName)}, false
+	case *protocol.ProduceBatchRequest:
+		seen := make(map[string]bool)
+		for _, p := range data.Partitions {
+			if !seen[p.Topic] {
+				seen[p.Topic] = true
+				keys = append(keys, topic(p.Topic))
+			}
+		}
+		return keys, false
+	case *protocol.ConsumeRequest:
+		return []string{topic(data.TopicName)}, false
+	case *protocol.SubscribeRequest:
+		for _, name := range data.Topics {
+			keys = append(keys, topic(name))
+		}
+		return keys, false
+	case *protocol.SeekRequest:
+		return []string{topic(data.Topic)}, false
+	case *protocol.OffsetForTimeRequest:
+		return []string{topic(data.Topic)}, false
+	case *protocol.DeleteRecordsRequest:
+		seen := make(map[string]bool)
+		for _, p := range data.Partitions {
+			if !seen[p.Topic] {
+				seen[p.Topic] = true
+				keys = append(keys, topic(p.Topic))
+			}
+		}
+		return keys, false
+
+	case *protocol.JoinGroupRequest:
+		return []string{group(data.GroupId)}, false
+	case *protocol.LeaveGroupRequest:
+		return []string{group(data.GroupId)}, false
+	case *protocol.SyncGroupRequest:
+		return []string{group(data.GroupId)}, false
+	case *protocol.HeartbeatRequest:
+		return []string{group(data.GroupId)}, false
+	case *protocol.CommitOffsetRequest:
+		return []string{group(data.GroupId)}, false
+	case *protocol.GetOffsetRequest:
+		return []string{group(data.GroupId)}, false
+
+	case *protocol.SnapshotRequest, *protocol.RestoreRequest:
+		return nil, true
+	}
+	return nil, false
+}
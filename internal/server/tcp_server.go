@@ -1,9 +1,12 @@
 package server
 
 import (
-	"encoding/json"
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"sort"
 	"sync"
 	"time"
 
@@ -11,12 +14,15 @@ import (
 	"github.com/kafka-from-scratch/internal/common"
 	"github.com/kafka-from-scratch/internal/coordinator"
 	"github.com/kafka-from-scratch/internal/protocol"
+	"github.com/kafka-from-scratch/internal/record"
+	"github.com/kafka-from-scratch/internal/snapshot"
+	"github.com/kafka-from-scratch/internal/wire"
 )
 
 // TCPServer TCP服务器，负责处理网络连接和请求
 type TCPServer struct {
 	address string
-	broker  *broker.MemoryBroker
+	broker  broker.Broker
 	groupCoordinator *coordinator.GroupCoordinator  // Consumer Group协调器
 
 	listener net.Listener
@@ -25,7 +31,7 @@ type TCPServer struct {
 }
 
 // NewTCPServer 创建新的TCP服务器
-func NewTCPServer(address string, broker *broker.MemoryBroker) *TCPServer {
+func NewTCPServer(address string, broker broker.Broker) *TCPServer {
 	return &TCPServer{
 		address: address,
 		broker:  broker,
@@ -42,14 +48,37 @@ func NewTCPServer(address string, broker *broker.MemoryBroker) *TCPServer {
 // 3. 每个新连接启动一个 handleConnection goroutine
 func (s *TCPServer) Start() error {
 	// TODO: 实现服务器启动逻辑
+	if err := s.Listen(); err != nil {
+		return err
+	}
+	return s.Serve()
+}
+
+// Listen 开始监听但还不接受连接，address的端口为0时由系统分配，用Addr查看实际的地址
+func (s *TCPServer) Listen() error {
 	listener, err := net.Listen("tcp", s.address)
 	if err != nil {
 		return fmt.Errorf("failed to start server: %w", err)
 	}
 	s.listener = listener
-	fmt.Printf("tcp server listening %s\n", s.address)
+	fmt.Printf("tcp server listening %s\n", listener.Addr())
+	return nil
+}
+
+// Addr 实际监听的地址，Listen之后才有
+func (s *TCPServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// GroupCoordinator 服务器使用的Consumer Group协调器，Kafka协议的listener和它共用，两边看到的是同样的Group和offset
+func (s *TCPServer) GroupCoordinator() *coordinator.GroupCoordinator {
+	return s.groupCoordinator
+}
+
+// Serve 接受连接直到Stop，每个连接一个goroutine
+func (s *TCPServer) Serve() error {
 	for {
-		conn, err := listener.Accept()
+		conn, err := s.listener.Accept()
 		if err != nil {
 			return err
 		}
@@ -62,7 +91,7 @@ func (s *TCPServer) Start() error {
 // 功能：处理客户端连接
 // 提示：
 // 1. 循环读取客户端请求
-// 2. 解析JSON请求到protocol.Request
+// 2. 解码帧到protocol.Request
 // 3. 调用handleRequest处理请求
 // 4. 将响应发送回客户端
 // 5. 处理连接错误和关闭
@@ -71,35 +100,94 @@ func (s *TCPServer) handleConnection(conn net.Conn) {
 	defer conn.Close()
 
 	clientAddr := conn.RemoteAddr().String()
-	fmt.Printf("client addr %s\n", clientAddr)
+	wireConn, err := wire.Accept(conn)
+	if err != nil {
+		fmt.Printf("handshake error %s: %v\n", clientAddr, err)
+		return
+	}
+	wireConn.MaxFrameBytes = wire.DefaultMaxRequestBytes
+	fmt.Printf("client addr %s (codec %s)\n", clientAddr, wireConn.Codec())
 
-	decoder := json.NewDecoder(conn)
-	encoder := json.NewEncoder(conn)
+	// 请求按收到的顺序交给scheduler，不冲突的请求在各自的goroutine中并发处理，
+	// 响应带着请求的correlation ID，谁先处理完谁先发送
+	scheduler := newRequestScheduler()
+	slots := make(chan struct{}, maxInFlightRequests)
+	var inFlight sync.WaitGroup
+	defer inFlight.Wait()
+	// 不再读请求时关闭，正在等新消息的CONSUME马上返回，不用等到超时才释放连接
+	closed := make(chan struct{})
+	defer close(closed)
 
 	for {
-		var request protocol.Request
-		if err := decoder.Decode(&request); err != nil {
-			fmt.Printf("decode error %v", err)
+		request, err := wireConn.ReadRequest()
+		if request == nil {
+			if err != io.EOF {
+				fmt.Printf("decode error %v\n", err)
+			}
 			break
 		}
-		fmt.Printf("recieved %s (ID: %s)\n", request.Type, request.RequestID)
-
-		response := s.handleRequest(&request)
 
-		if err := encoder.Encode(response); err != nil {
-			fmt.Printf("reply error %v\n", err)
-			break
+		if err != nil {
+			// 帧是完整的，回复错误之后还可以继续处理下一个请求
+			fmt.Printf("bad request (ID: %d): %v\n", request.RequestID, err)
+			response := s.createErrorResponse(request.RequestID, err)
+			response.ErrorCode = protocol.ErrorCodeInvalidRequest
+			if errors.Is(err, wire.ErrUnsupportedVersion) {
+				response.ErrorCode = protocol.ErrorCodeUnsupportedVersion
+			}
+			response.Type = request.Type
+			response.Version = request.Version
+			if err := s.writeResponse(wireConn, response); err != nil {
+				fmt.Printf("reply error %v\n", err)
+				break
+			}
+			continue
 		}
+		fmt.Printf("recieved %s (ID: %d)\n", request.Type, request.RequestID)
+
+		slots <- struct{}{}
+		wait, done := scheduler.schedule(request)
+		inFlight.Add(1)
+		go func() {
+			defer inFlight.Done()
+			defer func() { <-slots }()
+
+			for _, ch := range wait {
+				<-ch
+			}
+			response := s.handleRequest(request)
+			done()
+			if _, ok := request.Data.(*protocol.ConsumeRequest); ok {
+				// 长轮询等新消息时不能占着Topic的处理顺序，否则同一个连接上后面的PRODUCE要等它超时
+				response = s.longPollConsume(request, response, closed)
+			}
+			response.Type = request.Type
+			response.Version = request.Version
+
+			if err := s.writeResponse(wireConn, response); err != nil {
+				// 关闭连接让上面的ReadRequest返回，不再读新的请求
+				fmt.Printf("reply error %v\n", err)
+				wireConn.Close()
+			}
+		}()
 	}
 	fmt.Printf("client disconnected %s\n", clientAddr)
 
 }
 
+// writeResponse 发送响应，响应带有batch数据时放在帧的最后直接发送，发送完之后关闭
+func (s *TCPServer) writeResponse(conn *wire.Conn, response *protocol.Response) error {
+	if response.Records != nil {
+		defer response.Records.Close()
+	}
+	return conn.WriteResponse(response)
+}
+
 // TODO: 你来实现这个方法！
 // 功能：根据请求类型分发处理
 // 提示：
 // 1. 根据request.Type进行switch分发
-// 2. 解析request.Data到具体的请求类型
+// 2. request.Data已经按请求类型解码好了，断言成具体的请求类型
 // 3. 调用对应的处理方法
 // 4. 返回protocol.Response
 func (s *TCPServer) handleRequest(request *protocol.Request) *protocol.Response {
@@ -110,12 +198,16 @@ func (s *TCPServer) handleRequest(request *protocol.Request) *protocol.Response
 		return s.handleCreateTopic(request)
 	case protocol.RequestTypeProduce:
 		return s.handleProduce(request)
+	case protocol.RequestTypeProduceBatch:
+		return s.handleProduceBatch(request)
 	case protocol.RequestTypeConsume:
 		return s.handleConsume(request)
 	case protocol.RequestTypeSubscribe:
 		return s.handleSubscribe(request)
 	case protocol.RequestTypeSeek:
 		return s.handleSeek(request)
+	case protocol.RequestTypeOffsetForTime:
+		return s.handleOffsetForTime(request)
 	
 	// Consumer Group 协议处理
 	case protocol.RequestTypeJoinGroup:
@@ -130,10 +222,24 @@ func (s *TCPServer) handleRequest(request *protocol.Request) *protocol.Response
 		return s.handleCommitOffset(request)
 	case protocol.RequestTypeGetOffset:
 		return s.handleGetOffset(request)
+
+	// 管理协议
+	case protocol.RequestTypeSnapshot:
+		return s.handleSnapshot(request)
+	case protocol.RequestTypeRestore:
+		return s.handleRestore(request)
+	case protocol.RequestTypeDeleteRecords:
+		return s.handleDeleteRecords(request)
+
+	// 版本协商
+	case protocol.RequestTypeAPIVersions:
+		return s.handleAPIVersions(request)
 	
 	default:
-		return s.createErrorResponse(request.RequestID, 
+		response := s.createErrorResponse(request.RequestID, 
 			fmt.Errorf("unknown request type: %s", request.Type))
+		response.ErrorCode = protocol.ErrorCodeInvalidRequest
+		return response
 	}
 }
 
@@ -142,20 +248,18 @@ func (s *TCPServer) handleSeek(request *protocol.Request) *protocol.Response {
 	// 服务器端只需要确认offset的有效性，真正的Seek逻辑在客户端Consumer中
 	
 	// 解析请求数据
-	reqData, _ := json.Marshal(request.Data)
-	var seekReq protocol.SeekRequest
-	json.Unmarshal(reqData, &seekReq)
+	seekReq := request.Data.(*protocol.SeekRequest)
 	
 	// 验证Topic和分区是否存在
-	topic, err := s.broker.GetTopic(seekReq.Topic)
+	partitions, err := s.broker.GetPartitionCount(seekReq.Topic)
 	if err != nil {
 		return s.createErrorResponse(request.RequestID, 
-			fmt.Errorf("topic not found: %s", seekReq.Topic))
+			fmt.Errorf("%w: %s", common.ErrUnknownTopic, seekReq.Topic))
 	}
 	
-	_, err = topic.GetPartition(seekReq.PartitionId)
-	if err != nil {
-		return s.createErrorResponse(request.RequestID, err)
+	if seekReq.PartitionId < 0 || seekReq.PartitionId >= partitions {
+		return s.createErrorResponse(request.RequestID,
+			fmt.Errorf("%w: partition %d does not exist in topic %s", common.ErrUnknownPartition, seekReq.PartitionId, seekReq.Topic))
 	}
 	
 	// 返回成功响应，表示offset设置请求已确认
@@ -163,18 +267,29 @@ func (s *TCPServer) handleSeek(request *protocol.Request) *protocol.Response {
 		Result: 0,
 	})
 }
+func (s *TCPServer) handleOffsetForTime(request *protocol.Request) *protocol.Response {
+	data := request.Data.(*protocol.OffsetForTimeRequest)
+
+	offset, err := s.broker.GetOffsetForTimestamp(data.Topic, data.PartitionId, time.UnixMilli(data.Timestamp))
+	if err != nil {
+		return s.createErrorResponse(request.RequestID, err)
+	}
+
+	return s.createSuccessResponse(request.RequestID, &protocol.OffsetForTimeResponse{
+		Offset: offset,
+	})
+}
+
 func (s *TCPServer) handleSubscribe(request *protocol.Request) *protocol.Response {
 	// Subscribe操作的处理：验证Topic是否存在
-	reqData, _ := json.Marshal(request.Data)
-	var subReq protocol.SubscribeRequest
-	json.Unmarshal(reqData, &subReq)
+	subReq := request.Data.(*protocol.SubscribeRequest)
 	
 	// 验证所有Topic是否存在
 	for _, topicName := range subReq.Topics {
-		_, err := s.broker.GetTopic(topicName)
+		_, err := s.broker.GetPartitionCount(topicName)
 		if err != nil {
 			return s.createErrorResponse(request.RequestID, 
-				fmt.Errorf("topic not found: %s", topicName))
+				fmt.Errorf("%w: %s", common.ErrUnknownTopic, topicName))
 		}
 	}
 	
@@ -185,45 +300,25 @@ func (s *TCPServer) handleSubscribe(request *protocol.Request) *protocol.Respons
 }
 
 func (s *TCPServer) handleConsume(request *protocol.Request) *protocol.Response {
-	reqData, _ := json.Marshal(request.Data)
-	var data protocol.ConsumeRequest
-	json.Unmarshal(reqData, &data)
+	data := request.Data.(*protocol.ConsumeRequest)
 	
-	messages, err := s.broker.ConsumeMessages(data.TopicName, data.PartitionId, data.Offset, data.MaxMessages)
+	records, err := s.broker.FetchRecords(data.TopicName, data.PartitionId, data.Offset, data.MaxMessages)
 	if err != nil {
 		return s.createErrorResponse(request.RequestID, err)
 	}
 	
-	// 转换为NetworkMessage格式
-	networkMessages := make([]*protocol.NetworkMessage, len(messages))
-	for i, msg := range messages {
-		networkMessages[i] = &protocol.NetworkMessage{
-			Key:       string(msg.Key),
-			Value:     string(msg.Value),
-			Headers:   msg.Headers,
-			Offset:    msg.Offset,
-			Timestamp: msg.Timestamp.Format(time.RFC3339),
-		}
-	}
-	
-	return s.createSuccessResponse(request.RequestID, &protocol.ConsumeResponse{
-		Messages: networkMessages,
-		Result:   0,
+	// batch数据不经过codec编码，由writeResponse放在响应帧的最后直接发送
+	response := s.createSuccessResponse(request.RequestID, &protocol.ConsumeResponse{
+		RecordsSize: records.Size(),
+		Result:      0,
 	})
+	response.Records = records
+	return response
 }
 func (s *TCPServer) handleProduce(request *protocol.Request) *protocol.Response {
-	reqData, _ := json.Marshal(request.Data)
-	var data protocol.ProduceRequest
-	json.Unmarshal(reqData, &data)
+	data := request.Data.(*protocol.ProduceRequest)
 	
-	message := &common.Message{
-		Key:       []byte(data.PartitionKey),
-		Value:     []byte(data.Value),
-		Headers:   data.Headers,
-		Timestamp: time.Now(),
-	}
-	
-	partitionID, offset, err := s.broker.ProduceMessage(data.TopicName, message)
+	partitionID, offset, err := s.broker.ProduceBatch(data.TopicName, record.Batch(data.Records))
 	if err != nil {
 		return s.createErrorResponse(request.RequestID, err)
 	}
@@ -236,11 +331,14 @@ func (s *TCPServer) handleProduce(request *protocol.Request) *protocol.Response
 }
 
 func (s *TCPServer) handleCreateTopic(request *protocol.Request) *protocol.Response {
-	reqData, _ := json.Marshal(request.Data)
-	var data protocol.CreateTopicRequest
-	json.Unmarshal(reqData, &data)
-	
-	err := s.broker.CreateTopic(data.TopicName, data.PartitionNum)
+	data := request.Data.(*protocol.CreateTopicRequest)
+
+	config, err := common.ParseTopicConfig(data.Configs)
+	if err != nil {
+		return s.createErrorResponse(request.RequestID, fmt.Errorf("%w: %v", common.ErrInvalidConfig, err))
+	}
+
+	err = s.broker.CreateTopicWithConfig(data.TopicName, data.PartitionNum, config)
 	if err != nil {
 		return s.createErrorResponse(request.RequestID, err)
 	}
@@ -252,37 +350,160 @@ func (s *TCPServer) handleCreateTopic(request *protocol.Request) *protocol.Respo
 
 // ==================== Consumer Group 请求处理 ====================
 
-// TODO: 你来实现这些Consumer Group请求处理方法
-// 提示: 每个方法都需要解析请求数据，调用GroupCoordinator的对应方法，然后返回响应
+// 每个请求交给GroupCoordinator处理，它返回的错误包装了common中的错误，createErrorResponse据此设置ErrorCode
 
 func (s *TCPServer) handleJoinGroup(request *protocol.Request) *protocol.Response {
-	// TODO: 解析JoinGroupRequest，调用GroupCoordinator.HandleJoinGroup
-	panic("TODO: 实现handleJoinGroup")
+	resp, err := s.groupCoordinator.HandleJoinGroup(request.Data.(*protocol.JoinGroupRequest))
+	if err != nil {
+		return s.createErrorResponse(request.RequestID, err)
+	}
+	return s.createSuccessResponse(request.RequestID, resp)
 }
 
 func (s *TCPServer) handleLeaveGroup(request *protocol.Request) *protocol.Response {
-	// TODO: 解析LeaveGroupRequest，调用GroupCoordinator.HandleLeaveGroup
-	panic("TODO: 实现handleLeaveGroup")
+	resp, err := s.groupCoordinator.HandleLeaveGroup(request.Data.(*protocol.LeaveGroupRequest))
+	if err != nil {
+		return s.createErrorResponse(request.RequestID, err)
+	}
+	return s.createSuccessResponse(request.RequestID, resp)
 }
 
 func (s *TCPServer) handleSyncGroup(request *protocol.Request) *protocol.Response {
-	// TODO: 解析SyncGroupRequest，调用GroupCoordinator.HandleSyncGroup
-	panic("TODO: 实现handleSyncGroup")
+	resp, err := s.groupCoordinator.HandleSyncGroup(request.Data.(*protocol.SyncGroupRequest))
+	if err != nil {
+		return s.createErrorResponse(request.RequestID, err)
+	}
+	return s.createSuccessResponse(request.RequestID, resp)
 }
 
 func (s *TCPServer) handleHeartbeat(request *protocol.Request) *protocol.Response {
-	// TODO: 解析HeartbeatRequest，调用GroupCoordinator.HandleHeartbeat
-	panic("TODO: 实现handleHeartbeat")
+	resp, err := s.groupCoordinator.HandleHeartbeat(request.Data.(*protocol.HeartbeatRequest))
+	if err != nil {
+		return s.createErrorResponse(request.RequestID, err)
+	}
+	return s.createSuccessResponse(request.RequestID, resp)
 }
 
 func (s *TCPServer) handleCommitOffset(request *protocol.Request) *protocol.Response {
-	// TODO: 解析CommitOffsetRequest，调用GroupCoordinator.HandleCommitOffset
-	panic("TODO: 实现handleCommitOffset")
+	resp, err := s.groupCoordinator.HandleCommitOffset(request.Data.(*protocol.CommitOffsetRequest))
+	if err != nil {
+		return s.createErrorResponse(request.RequestID, err)
+	}
+	return s.createSuccessResponse(request.RequestID, resp)
 }
 
 func (s *TCPServer) handleGetOffset(request *protocol.Request) *protocol.Response {
-	// TODO: 解析GetOffsetRequest，调用GroupCoordinator.HandleGetOffset
-	panic("TODO: 实现handleGetOffset")
+	resp, err := s.groupCoordinator.HandleGetOffset(request.Data.(*protocol.GetOffsetRequest))
+	if err != nil {
+		return s.createErrorResponse(request.RequestID, err)
+	}
+	return s.createSuccessResponse(request.RequestID, resp)
+}
+
+// ==================== 管理协议请求处理 ====================
+
+// handleSnapshot 把所有Topic和Group提交的offset打包成归档，归档放在响应帧的最后发送
+func (s *TCPServer) handleSnapshot(request *protocol.Request) *protocol.Response {
+	snapshotBroker, err := s.snapshotBroker()
+	if err != nil {
+		return s.createErrorResponse(request.RequestID, err)
+	}
+	topics, err := snapshotBroker.Snapshot()
+	if err != nil {
+		return s.createErrorResponse(request.RequestID, err)
+	}
+	var archive bytes.Buffer
+	err = snapshot.Write(&archive, &snapshot.Snapshot{
+		Topics:       topics,
+		GroupOffsets: s.groupCoordinator.CommittedOffsets(),
+	})
+	if err != nil {
+		return s.createErrorResponse(request.RequestID, err)
+	}
+
+	response := s.createSuccessResponse(request.RequestID, &protocol.SnapshotResponse{
+		ArchiveSize: int64(archive.Len()),
+	})
+	response.Records = record.MemoryRecords(archive.Bytes())
+	return response
+}
+
+// handleRestore 先恢复Topic，成功之后再恢复Group提交的offset
+func (s *TCPServer) handleRestore(request *protocol.Request) *protocol.Response {
+	data := request.Data.(*protocol.RestoreRequest)
+
+	snapshotBroker, err := s.snapshotBroker()
+	if err != nil {
+		return s.createErrorResponse(request.RequestID, err)
+	}
+	snap, err := snapshot.Read(bytes.NewReader(data.Archive))
+	if err != nil {
+		return s.createErrorResponse(request.RequestID, err)
+	}
+	if err := snapshotBroker.Restore(snap.Topics, data.Force); err != nil {
+		return s.createErrorResponse(request.RequestID, err)
+	}
+	s.groupCoordinator.RestoreCommittedOffsets(snap.GroupOffsets)
+
+	response := &protocol.RestoreResponse{
+		Topics: make([]string, 0, len(snap.Topics)),
+		Groups: make([]string, 0, len(snap.GroupOffsets)),
+	}
+	for _, topic := range snap.Topics {
+		response.Topics = append(response.Topics, topic.Name)
+	}
+	for group := range snap.GroupOffsets {
+		response.Groups = append(response.Groups, group)
+	}
+	sort.Strings(response.Groups)
+	fmt.Printf("♻️ Restored %d topics and %d consumer groups from snapshot\n", len(response.Topics), len(response.Groups))
+	return s.createSuccessResponse(request.RequestID, response)
+}
+
+// snapshotBroker 只有实现了broker.SnapshotBroker的Broker才支持SNAPSHOT和RESTORE
+func (s *TCPServer) snapshotBroker() (broker.SnapshotBroker, error) {
+	snapshotBroker, ok := s.broker.(broker.SnapshotBroker)
+	if !ok {
+		return nil, fmt.Errorf("broker %T does not support snapshots", s.broker)
+	}
+	return snapshotBroker, nil
+}
+
+// handleDeleteRecords 逐个分区删除，一个分区失败不影响其他分区，错误放在各自的结果里
+func (s *TCPServer) handleDeleteRecords(request *protocol.Request) *protocol.Response {
+	data := request.Data.(*protocol.DeleteRecordsRequest)
+
+	response := &protocol.DeleteRecordsResponse{
+		Partitions: make([]protocol.DeleteRecordsResult, 0, len(data.Partitions)),
+	}
+	for _, p := range data.Partitions {
+		result := protocol.DeleteRecordsResult{Topic: p.Topic, PartitionId: p.PartitionId}
+		lowWatermark, err := s.broker.DeleteRecords(p.Topic, p.PartitionId, p.Offset)
+		if err != nil {
+			result.Error = err.Error()
+			result.ErrorCode = protocol.ErrorCodeOf(err)
+		} else {
+			result.LowWatermark = lowWatermark
+		}
+		response.Partitions = append(response.Partitions, result)
+	}
+	return s.createSuccessResponse(request.RequestID, response)
+}
+
+// ==================== 版本协商 ====================
+
+// handleAPIVersions 返回每种请求支持的版本范围，超出范围的请求在wire.Conn.ReadRequest中就被拒绝了
+func (s *TCPServer) handleAPIVersions(request *protocol.Request) *protocol.Response {
+	response := &protocol.APIVersionsResponse{}
+	for _, api := range protocol.APIs() {
+		response.APIs = append(response.APIs, protocol.APIVersionRange{
+			Key:        api.Key,
+			Type:       api.Type,
+			MinVersion: api.MinVersion,
+			MaxVersion: api.MaxVersion,
+		})
+	}
+	return s.createSuccessResponse(request.RequestID, response)
 }
 
 // Stop 停止服务器
@@ -297,7 +518,7 @@ func (s *TCPServer) Stop() error {
 }
 
 // 辅助方法：创建成功响应
-func (s *TCPServer) createSuccessResponse(requestID string, data interface{}) *protocol.Response {
+func (s *TCPServer) createSuccessResponse(requestID int32, data interface{}) *protocol.Response {
 	return &protocol.Response{
 		RequestID: requestID,
 		Success:   true,
@@ -305,11 +526,12 @@ func (s *TCPServer) createSuccessResponse(requestID string, data interface{}) *p
 	}
 }
 
-// 辅助方法：创建错误响应
-func (s *TCPServer) createErrorResponse(requestID string, err error) *protocol.Response {
+// 辅助方法：创建错误响应，ErrorCode根据err包装的common中的错误得出
+func (s *TCPServer) createErrorResponse(requestID int32, err error) *protocol.Response {
 	return &protocol.Response{
 		RequestID: requestID,
 		Success:   false,
+		ErrorCode: protocol.ErrorCodeOf(err),
 		Error:     err.Error(),
 	}
 }
@@ -0,0 +1,250 @@
+// Package snapshot 把整个Broker的状态（所有Topic、分区、消息以及Consumer Group提交的offset）
+// 保存成一个归档文件，并从归档文件恢复到另一个Broker，用于刷新staging环境
+//
+// 归档是一个gzip压缩的tar文件:
+//
+//	manifest.json          版本、Topic配置、每个分区的offset范围、Group的offset
+//	partitions/<t>-<p>     第t个Topic第p个分区的消息，首尾相接的RecordBatch（格式见record包）
+package snapshot
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/kafka-from-scratch/internal/common"
+	"github.com/kafka-from-scratch/internal/record"
+)
+
+// Version 归档格式的版本，格式不兼容地改变时加一
+const Version = 1
+
+const (
+	manifestName = "manifest.json"
+
+	// messagesPerBatch 写入归档时每个batch最多的消息数，避免一个分区编码成一个巨大的batch
+	messagesPerBatch = 1000
+)
+
+// Snapshot Broker的完整状态
+type Snapshot struct {
+	Topics []*Topic
+
+	// GroupOffsets Consumer Group提交的offset: group -> topic -> partition -> offset
+	GroupOffsets map[string]map[string]map[int32]int64
+}
+
+// Topic 快照中的一个Topic，Partitions的下标就是分区ID
+type Topic struct {
+	Name       string
+	Config     common.TopicConfig
+	Partitions []*Partition
+}
+
+// Partition 快照中的一个分区。compact过的分区中offset不连续，所以每条消息的offset都原样保存
+type Partition struct {
+	StartOffset int64
+	NextOffset  int64
+	Messages    []*common.Message
+}
+
+type manifest struct {
+	Version      int                                   `json:"version"`
+	CreatedAt    time.Time                             `json:"created_at"`
+	Topics       []*topicManifest                      `json:"topics"`
+	GroupOffsets map[string]map[string]map[int32]int64 `json:"group_offsets"`
+}
+
+type topicManifest struct {
+	Name       string               `json:"name"`
+	Configs    map[string]string    `json:"configs"`
+	Partitions []*partitionManifest `json:"partitions"`
+}
+
+type partitionManifest struct {
+	StartOffset int64  `json:"start_offset"`
+	NextOffset  int64  `json:"next_offset"`
+	Messages    int    `json:"messages"`
+	File        string `json:"file"`
+}
+
+// Write 把快照写成归档
+func Write(w io.Writer, s *Snapshot) error {
+	m := &manifest{
+		Version:      Version,
+		CreatedAt:    time.Now(),
+		Topics:       make([]*topicManifest, 0, len(s.Topics)),
+		GroupOffsets: s.GroupOffsets,
+	}
+	for i, topic := range s.Topics {
+		tm := &topicManifest{
+			Name:       topic.Name,
+			Configs:    topic.Config.Configs(),
+			Partitions: make([]*partitionManifest, 0, len(topic.Partitions)),
+		}
+		for j, partition := range topic.Partitions {
+			tm.Partitions = append(tm.Partitions, &partitionManifest{
+				StartOffset: partition.StartOffset,
+				NextOffset:  partition.NextOffset,
+				Messages:    len(partition.Messages),
+				File:        fmt.Sprintf("partitions/%d-%d", i, j),
+			})
+		}
+		m.Topics = append(m.Topics, tm)
+	}
+	manifestData, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	if err := writeEntry(tw, manifestName, manifestData); err != nil {
+		return err
+	}
+	for i, topic := range s.Topics {
+		for j, partition := range topic.Partitions {
+			if err := writeEntry(tw, m.Topics[i].Partitions[j].File, encodeMessages(partition.Messages)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// encodeMessages 按原来的offset把消息编码成若干个batch
+func encodeMessages(messages []*common.Message) []byte {
+	data := make([]byte, 0)
+	for start := 0; start < len(messages); start += messagesPerBatch {
+		end := min(start+messagesPerBatch, len(messages))
+		data = append(data, record.Encode(messages[start:end])...)
+	}
+	return data
+}
+
+func writeEntry(tw *tar.Writer, name string, data []byte) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// Read 读取Write写出的归档，校验每个batch的CRC以及消息数和offset范围
+func Read(r io.Reader) (*Snapshot, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("read snapshot: %w", err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+
+	header, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("read snapshot: %w", err)
+	}
+	if header.Name != manifestName {
+		return nil, fmt.Errorf("read snapshot: first entry is %q, expected %s", header.Name, manifestName)
+	}
+	var m manifest
+	if err := json.NewDecoder(tr).Decode(&m); err != nil {
+		return nil, fmt.Errorf("read snapshot manifest: %w", err)
+	}
+	if m.Version != Version {
+		return nil, fmt.Errorf("unsupported snapshot version %d", m.Version)
+	}
+
+	s := &Snapshot{
+		Topics:       make([]*Topic, 0, len(m.Topics)),
+		GroupOffsets: m.GroupOffsets,
+	}
+	if s.GroupOffsets == nil {
+		s.GroupOffsets = make(map[string]map[string]map[int32]int64)
+	}
+	files := make(map[string]*Partition)
+	for _, tm := range m.Topics {
+		config, err := common.ParseTopicConfig(tm.Configs)
+		if err != nil {
+			return nil, fmt.Errorf("topic %s in snapshot: %w", tm.Name, err)
+		}
+		topic := &Topic{Name: tm.Name, Config: config, Partitions: make([]*Partition, 0, len(tm.Partitions))}
+		for _, pm := range tm.Partitions {
+			partition := &Partition{StartOffset: pm.StartOffset, NextOffset: pm.NextOffset}
+			topic.Partitions = append(topic.Partitions, partition)
+			files[pm.File] = partition
+		}
+		s.Topics = append(s.Topics, topic)
+	}
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read snapshot: %w", err)
+		}
+		partition, ok := files[header.Name]
+		if !ok {
+			return nil, fmt.Errorf("read snapshot: unexpected entry %q", header.Name)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("read snapshot %s: %w", header.Name, err)
+		}
+		if partition.Messages, err = decodeMessages(data); err != nil {
+			return nil, fmt.Errorf("read snapshot %s: %w", header.Name, err)
+		}
+		delete(files, header.Name)
+	}
+	for name := range files {
+		return nil, fmt.Errorf("read snapshot: missing entry %q", name)
+	}
+
+	for i, tm := range m.Topics {
+		for j, pm := range tm.Partitions {
+			if got := len(s.Topics[i].Partitions[j].Messages); got != pm.Messages {
+				return nil, fmt.Errorf("read snapshot: %s has %d messages, manifest says %d", pm.File, got, pm.Messages)
+			}
+		}
+	}
+	return s, nil
+}
+
+func decodeMessages(data []byte) ([]*common.Message, error) {
+	batches, err := record.Split(data)
+	if err != nil {
+		return nil, err
+	}
+	size := 0
+	messages := make([]*common.Message, 0)
+	for _, batch := range batches {
+		if err := batch.Verify(); err != nil {
+			return nil, err
+		}
+		batchMessages, err := batch.Messages()
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, batchMessages...)
+		size += batch.Size()
+	}
+	// Split会忽略末尾不完整的batch，归档中不应该有
+	if size != len(data) {
+		return nil, errors.New("truncated record batch")
+	}
+	return messages, nil
+}
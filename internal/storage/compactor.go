@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/kafka-from-scratch/internal/common"
+	"github.com/kafka-from-scratch/internal/record"
+)
+
+const cleanedFileSuffix = ".cleaned"
+
+// Compact 对日志做key压缩：每个key只保留offset最大的那条消息，保留下来的消息offset不变
+// 超过deleteRetentionMs的tombstone也会被删除；没有key的消息原样保留
+// 和Kafka一样只压缩只读segment，active segment不动，但判断"最新"时会把active segment也算进去
+// 压缩期间持有写锁，会阻塞写入和读取。返回删除的消息数
+func (l *Log) Compact(deleteRetentionMs int64, now time.Time) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	latest := make(map[string]int64)
+	for _, segment := range l.segments {
+		err := segment.forEach(func(message *common.Message) error {
+			if message.Key != nil {
+				latest[string(message.Key)] = message.Offset
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	keep := func(message *common.Message) bool {
+		if message.Key == nil {
+			return true
+		}
+		if latest[string(message.Key)] != message.Offset {
+			return false
+		}
+		return !message.IsTombstone() || now.Sub(message.Timestamp) <= time.Duration(deleteRetentionMs)*time.Millisecond
+	}
+
+	removed := 0
+	for i := 0; i < len(l.segments)-1; i++ {
+		n, err := l.compactSegment(i, keep)
+		if err != nil {
+			return removed, err
+		}
+		removed += n
+	}
+	return removed, nil
+}
+
+// compactSegment 把第i个segment中需要保留的消息写到临时文件，再替换掉原来的segment文件并重建索引
+// 每个batch单独重新编码，保留下来的消息仍然在原来的batch里，offset不变
+func (l *Log) compactSegment(i int, keep func(message *common.Message) bool) (int, error) {
+	segment := l.segments[i]
+	cleanedPath := segmentFileName(l.dir, segment.baseOffset, logFileSuffix+cleanedFileSuffix)
+	cleaned, err := os.Create(cleanedPath)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(cleanedPath)
+
+	removed := 0
+	err = segment.forEachBatch(func(batch record.Batch) error {
+		messages, err := batch.Messages()
+		if err != nil {
+			return err
+		}
+		kept := make([]*common.Message, 0, len(messages))
+		for _, message := range messages {
+			if keep(message) {
+				kept = append(kept, message)
+			}
+		}
+		removed += len(messages) - len(kept)
+		if len(kept) == 0 {
+			return nil
+		}
+		if len(kept) == len(messages) {
+			_, err = cleaned.Write(batch)
+		} else {
+			_, err = cleaned.Write(record.Encode(kept))
+		}
+		return err
+	})
+	if err == nil {
+		err = cleaned.Sync()
+	}
+	if closeErr := cleaned.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || removed == 0 {
+		return 0, err
+	}
+
+	// 先关闭旧文件并删掉旧的索引文件，再rename，rename是原子的：崩溃时要么是旧segment要么是新segment，
+	// 两种情况下都没有索引文件，打开时按数据重建，不会用旧索引中的position去读新文件
+	nextOffset := segment.nextOffset
+	err = segment.close()
+	if err == nil {
+		err = removeSegmentIndexes(l.dir, segment.baseOffset)
+	}
+	if err == nil {
+		err = os.Rename(cleanedPath, segmentFileName(l.dir, segment.baseOffset, logFileSuffix))
+		if err != nil {
+			err = fmt.Errorf("replace segment %d: %w", segment.baseOffset, err)
+		}
+	}
+	if err != nil {
+		// 旧segment已经关闭了，重新打开它，这个Log之后还能继续读写
+		if reopened, reopenErr := l.reopenSegment(segment.baseOffset, nextOffset); reopenErr == nil {
+			l.segments[i] = reopened
+		} else {
+			err = fmt.Errorf("%w (reopen segment %d: %v)", err, segment.baseOffset, reopenErr)
+		}
+		return 0, err
+	}
+
+	replaced, err := l.reopenSegment(segment.baseOffset, nextOffset)
+	if err != nil {
+		return 0, err
+	}
+	l.segments[i] = replaced
+	return removed, nil
+}
+
+// reopenSegment 重新打开compact过的只读segment，按数据重建索引
+func (l *Log) reopenSegment(baseOffset, nextOffset int64) (*Segment, error) {
+	segment, err := openSegment(l.dir, baseOffset, l.config.IndexIntervalBytes)
+	if err != nil {
+		return nil, err
+	}
+	segment.nextOffset = nextOffset
+	if err := segment.rebuildIndex(false); err != nil {
+		segment.close()
+		return nil, err
+	}
+	if err := segment.onRoll(); err != nil {
+		segment.close()
+		return nil, err
+	}
+	return segment, nil
+}
+
+// removeSegmentIndexes 删除segment的offset索引和时间索引文件，并fsync目录，保证删除在之后的rename之前落盘
+func removeSegmentIndexes(dir string, baseOffset int64) error {
+	for _, suffix := range []string{indexFileSuffix, timeIndexFileSuffix} {
+		if err := os.Remove(segmentFileName(dir, baseOffset, suffix)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return syncDir(dir)
+}
@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"io"
+	"os"
+)
+
+// FileRecords 分布在一个或多个segment文件中的一段batch数据，实现了record.Records
+// 每一段都持有自己打开的文件句柄：即使segment随后被retention删除或被compact替换，
+// 已经打开的句柄仍然指向原来的文件内容，发送完之后由调用方Close
+type FileRecords struct {
+	slices []fileSlice
+	size   int64
+}
+
+// fileSlice segment文件中的[position, position+size)
+type fileSlice struct {
+	file     *os.File
+	position int64
+	size     int64
+}
+
+func (r *FileRecords) Size() int64 {
+	return r.size
+}
+
+// WriteTo 依次发送每一段数据
+// io.Copy遇到*net.TCPConn和*io.LimitedReader{R: *os.File}时会走sendfile，数据不经过用户态
+// 每个fileSlice的句柄只属于这个FileRecords，所以可以放心地Seek
+func (r *FileRecords) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	for _, slice := range r.slices {
+		if _, err := slice.file.Seek(slice.position, io.SeekStart); err != nil {
+			return written, err
+		}
+		n, err := io.Copy(w, &io.LimitedReader{R: slice.file, N: slice.size})
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if n < slice.size {
+			return written, io.ErrUnexpectedEOF
+		}
+	}
+	return written, nil
+}
+
+// Close 关闭所有文件句柄
+func (r *FileRecords) Close() error {
+	var firstErr error
+	for _, slice := range r.slices {
+		if err := slice.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	r.slices = nil
+	return firstErr
+}
+
+func (r *FileRecords) add(file *os.File, position, size int64) {
+	r.slices = append(r.slices, fileSlice{file: file, position: position, size: size})
+	r.size += size
+}
@@ -0,0 +1,390 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kafka-from-scratch/internal/common"
+	"github.com/kafka-from-scratch/internal/record"
+)
+
+// FileStore 把一个分区的所有消息保存在一个文件里的存储引擎，实现了common.PartitionStore
+// 文件格式: 4字节magic + 8字节log start offset，后面是一个接一个的RecordBatch，和segment文件中的格式一样
+// 没有segment滚动和索引文件，打开时扫描整个文件在内存中建立batch列表，适合消息量不大、文件数要少的场景
+type FileStore struct {
+	path       string
+	file       *os.File
+	syncWrites bool
+	mu         sync.RWMutex
+
+	batches     []fileBatch // 按offset升序
+	size        int64       // 文件大小，也是下一个batch写入的位置
+	startOffset int64
+	nextOffset  int64
+
+	appended common.AppendNotifier
+}
+
+// fileBatch 文件中一个batch的位置和头部信息
+type fileBatch struct {
+	baseOffset   int64
+	lastOffset   int64
+	position     int64
+	size         int64
+	maxTimestamp int64
+}
+
+const (
+	fileStoreMagic      = "KFS1"
+	fileStoreHeaderSize = 12
+)
+
+// OpenFileStore 打开path处的单文件存储，文件不存在时创建一个空的
+// syncWrites为true时每次Append都fsync之后才返回；文件末尾写了一半或校验失败的batch会被截掉
+func OpenFileStore(path string, syncWrites bool) (*FileStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &FileStore{path: path, file: file, syncWrites: syncWrites}
+	if err := s.load(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("open file store %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// load 读取文件头，扫描所有batch，算出nextOffset
+func (s *FileStore) load() error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		if _, err := s.file.WriteAt(fileStoreHeader(0), 0); err != nil {
+			return err
+		}
+		if err := s.file.Sync(); err != nil {
+			return err
+		}
+		s.size = fileStoreHeaderSize
+		return nil
+	}
+
+	header := make([]byte, fileStoreHeaderSize)
+	if _, err := s.file.ReadAt(header, 0); err != nil || string(header[:4]) != fileStoreMagic {
+		return errors.New("not a file store")
+	}
+	s.startOffset = int64(binary.BigEndian.Uint64(header[4:]))
+	s.nextOffset = s.startOffset
+
+	reader := bufio.NewReader(io.NewSectionReader(s.file, fileStoreHeaderSize, info.Size()-fileStoreHeaderSize))
+	position := int64(fileStoreHeaderSize)
+	for {
+		batch, err := readVerifiedBatch(reader)
+		if err == io.EOF {
+			break
+		}
+		if err == record.ErrIncompleteBatch || errors.Is(err, common.ErrCorruptMessage) {
+			fmt.Printf("⚠️ %s: bad batch at position %d: %v\n", s.path, position, err)
+			break
+		}
+		if err != nil {
+			return err
+		}
+		s.batches = append(s.batches, fileBatch{
+			baseOffset:   batch.BaseOffset(),
+			lastOffset:   batch.LastOffset(),
+			position:     position,
+			size:         int64(batch.Size()),
+			maxTimestamp: batch.MaxTimestamp(),
+		})
+		position += int64(batch.Size())
+		s.nextOffset = max(s.nextOffset, batch.LastOffset()+1)
+	}
+
+	// 和active segment一样，崩溃时写了一半的batch要截掉，后续追加才不会写在垃圾数据后面
+	if position < info.Size() {
+		fmt.Printf("⚠️ %s: truncating %d bytes of incomplete or corrupt data\n", s.path, info.Size()-position)
+		if err := s.file.Truncate(position); err != nil {
+			return err
+		}
+	}
+	s.size = position
+	return nil
+}
+
+func fileStoreHeader(startOffset int64) []byte {
+	header := make([]byte, fileStoreHeaderSize)
+	copy(header, fileStoreMagic)
+	binary.BigEndian.PutUint64(header[4:], uint64(startOffset))
+	return header
+}
+
+// Append 把消息编码成一个batch追加到文件末尾，分配连续的offset写回每条消息，返回第一条消息的offset
+func (s *FileStore) Append(messages ...*common.Message) (int64, error) {
+	if len(messages) == 0 {
+		return s.LatestOffset(), nil
+	}
+	batch := record.Build(messages)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	batch.SetBaseOffset(s.nextOffset)
+	if _, err := s.file.WriteAt(batch, s.size); err != nil {
+		// 去掉可能写了一部分的数据，文件末尾仍然是完整的batch
+		s.file.Truncate(s.size)
+		return 0, fmt.Errorf("append to %s: %w", s.path, err)
+	}
+	if s.syncWrites {
+		if err := s.file.Sync(); err != nil {
+			return 0, fmt.Errorf("fsync %s: %w", s.path, err)
+		}
+	}
+	s.batches = append(s.batches, fileBatch{
+		baseOffset:   batch.BaseOffset(),
+		lastOffset:   batch.LastOffset(),
+		position:     s.size,
+		size:         int64(batch.Size()),
+		maxTimestamp: batch.MaxTimestamp(),
+	})
+	s.size += int64(batch.Size())
+	s.nextOffset = batch.LastOffset() + 1
+	s.appended.Notify()
+
+	for i, message := range messages {
+		message.Offset = batch.BaseOffset() + int64(i)
+	}
+	return batch.BaseOffset(), nil
+}
+
+// Appended 返回下一次Append时关闭的channel
+func (s *FileStore) Appended() <-chan struct{} {
+	return s.appended.Wait()
+}
+
+// Read 从startOffset开始读取最多maxMessages条消息
+// 早于log start offset时返回ErrOffsetOutOfRange，读到末尾时返回空列表
+func (s *FileStore) Read(startOffset int64, maxMessages int) ([]*common.Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if startOffset < s.startOffset {
+		return nil, fmt.Errorf("%w: offset %d is before log start offset %d", common.ErrOffsetOutOfRange, startOffset, s.startOffset)
+	}
+	messages := make([]*common.Message, 0)
+	for i := s.batchIndexFor(startOffset); i < len(s.batches) && len(messages) < maxMessages; i++ {
+		batch, err := s.readBatch(s.batches[i])
+		if err != nil {
+			return nil, err
+		}
+		if messages, err = appendMessages(messages, batch, startOffset, maxMessages); err != nil {
+			return nil, err
+		}
+	}
+	return messages, nil
+}
+
+// batchIndexFor 返回第一个LastOffset >= offset的batch的下标，调用方需要持有锁
+func (s *FileStore) batchIndexFor(offset int64) int {
+	return sort.Search(len(s.batches), func(i int) bool {
+		return s.batches[i].lastOffset >= offset
+	})
+}
+
+// readBatch 读取整个batch，调用方需要持有锁
+func (s *FileStore) readBatch(b fileBatch) (record.Batch, error) {
+	batch := make(record.Batch, b.size)
+	if _, err := s.file.ReadAt(batch, b.position); err != nil {
+		return nil, fmt.Errorf("read %s at position %d: %w", s.path, b.position, err)
+	}
+	return batch, nil
+}
+
+// LatestOffset 返回下一条消息将要使用的offset
+func (s *FileStore) LatestOffset() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.nextOffset
+}
+
+// EarliestOffset 返回log start offset，更早的消息已经被清理
+func (s *FileStore) EarliestOffset() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.startOffset
+}
+
+// Size 返回文件的字节数
+func (s *FileStore) Size() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.size
+}
+
+// DeleteRecordsBefore 删除offset之前的所有消息，log start offset前进到offset，返回新的log start offset
+// 把新的log start offset和剩下的batch写进临时文件，fsync之后rename替换原文件，崩溃后文件要么是旧的要么是新的
+// 包含offset的batch整个保留，其中更早的消息靠文件头中的log start offset隐藏
+// offset已经不大于log start offset时什么都不做；offset为负数或大于LatestOffset时返回ErrOffsetOutOfRange
+func (s *FileStore) DeleteRecordsBefore(offset int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if offset < 0 || offset > s.nextOffset {
+		return 0, fmt.Errorf("%w: offset %d is not in [0, %d]", common.ErrOffsetOutOfRange, offset, s.nextOffset)
+	}
+	if offset <= s.startOffset {
+		return s.startOffset, nil
+	}
+	if err := s.rewrite(offset, s.batchIndexFor(offset)); err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
+
+// rewrite 用log start offset为startOffset、只包含batches[first:]的新文件替换原文件，调用方需要持有写锁
+func (s *FileStore) rewrite(startOffset int64, first int) error {
+	kept := s.batches[first:]
+	from := s.size
+	if len(kept) > 0 {
+		from = kept[0].position
+	}
+
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("rewrite %s: %w", s.path, err)
+	}
+	_, err = tmp.Write(fileStoreHeader(startOffset))
+	if err == nil {
+		_, err = io.Copy(tmp, io.NewSectionReader(s.file, from, s.size-from))
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, s.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("rewrite %s: %w", s.path, err)
+	}
+
+	// rename之后tmp就是新的文件，继续用它追加
+	s.file.Close()
+	s.file = tmp
+	shift := from - fileStoreHeaderSize
+	batches := make([]fileBatch, len(kept))
+	for i, b := range kept {
+		b.position -= shift
+		batches[i] = b
+	}
+	s.batches = batches
+	s.size -= shift
+	s.startOffset = startOffset
+
+	if err := syncDir(filepath.Dir(s.path)); err != nil {
+		return fmt.Errorf("rewrite %s: %w", s.path, err)
+	}
+	return nil
+}
+
+// ApplyRetention 从最旧的batch开始，删除整个都早于retentionMs的batch，以及删除后总大小仍不小于retentionBytes的batch
+// 参数为-1表示不按该维度清理，返回删除的batch数
+func (s *FileStore) ApplyRetention(retentionMs, retentionBytes int64, now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	size := s.size - fileStoreHeaderSize
+	for n < len(s.batches) {
+		b := s.batches[n]
+		expired := retentionMs >= 0 && now.Sub(time.UnixMilli(b.maxTimestamp)) > time.Duration(retentionMs)*time.Millisecond
+		oversized := retentionBytes >= 0 && size-b.size >= retentionBytes
+		if !expired && !oversized {
+			break
+		}
+		size -= b.size
+		n++
+	}
+	if n == 0 {
+		return 0, nil
+	}
+
+	startOffset := s.nextOffset
+	if n < len(s.batches) {
+		startOffset = s.batches[n].baseOffset
+	}
+	if err := s.rewrite(max(startOffset, s.startOffset), n); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// OffsetForTimestamp 返回第一条offset不早于log start offset、时间戳 >= t 的消息的offset
+// 所有消息都早于t时返回最新offset
+func (s *FileStore) OffsetForTimestamp(t time.Time) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	timestamp := t.UnixMilli()
+	for i := s.batchIndexFor(s.startOffset); i < len(s.batches); i++ {
+		// batch头部有最大时间戳，整个batch都早于timestamp时不需要读它
+		if s.batches[i].maxTimestamp < timestamp {
+			continue
+		}
+		batch, err := s.readBatch(s.batches[i])
+		if err != nil {
+			return 0, err
+		}
+		offset, ok, err := offsetForTimestampInBatch(batch, s.startOffset, timestamp)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return offset, nil
+		}
+	}
+	return s.nextOffset, nil
+}
+
+// Close 关闭文件，配置了syncWrites时先fsync
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	if s.syncWrites {
+		err = s.file.Sync()
+	}
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// syncDir fsync目录，保证其中的rename和新建文件在崩溃后仍然存在
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,23 @@
+package storage_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/kafka-from-scratch/internal/common"
+	"github.com/kafka-from-scratch/internal/storage"
+	"github.com/kafka-from-scratch/internal/storetest"
+)
+
+func TestFileStorePartitionStore(t *testing.T) {
+	storetest.Run(t, storetest.Engine{
+		Open: func(dir string) (common.PartitionStore, error) {
+			store, err := storage.OpenFileStore(filepath.Join(dir, "partition.store"), false)
+			if err != nil {
+				return nil, err
+			}
+			return store, nil
+		},
+		Persistent: true,
+	})
+}
@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// FlushPolicy 决定分区日志什么时候fsync，以及Append什么时候返回
+// Messages和Interval都不生效时，数据留在操作系统的page cache里，Append写完立即返回
+// 只要有一个生效，Append都会等到这条消息被fsync之后才返回
+type FlushPolicy struct {
+	// Messages 未fsync的消息攒够这么多条就fsync一次，1表示每条消息都fsync，<=0表示不按条数
+	Messages int64
+
+	// Interval 每隔这么久fsync一次，<=0表示不按时间
+	Interval time.Duration
+}
+
+func (p FlushPolicy) enabled() bool {
+	return p.Messages > 0 || p.Interval > 0
+}
+
+var errLogClosed = errors.New("log is closed")
+
+// startFlusher 按时间fsync的后台goroutine
+func (l *Log) startFlusher() {
+	if l.config.Flush.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(l.config.Flush.Interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := l.Flush(); err != nil && err != errLogClosed {
+					fmt.Printf("❌ Failed to flush log %s: %v\n", l.dir, err)
+				}
+			case <-l.flushStop:
+				return
+			}
+		}
+	}()
+}
+
+// waitFlushed 等待offset这条消息被fsync
+// 这里实现了group commit：同一时间只有一个调用方在做fsync，其余的在flushCond上等待，
+// 一次fsync会覆盖发起时已经写入的所有消息，所以并发写入同一分区的Producer共用一次fsync
+func (l *Log) waitFlushed(offset int64) error {
+	l.flushMu.Lock()
+	defer l.flushMu.Unlock()
+
+	for l.flushedOffset <= offset {
+		if l.closed {
+			return errLogClosed
+		}
+		if !l.flushing && l.unflushedMessages() >= l.config.Flush.Messages && l.config.Flush.Messages > 0 {
+			if err := l.flushLocked(); err != nil {
+				return err
+			}
+			continue
+		}
+		// 有其他调用方正在fsync，或者还没攒够条数，等待fsync完成或者后台定时fsync
+		l.flushCond.Wait()
+	}
+	return nil
+}
+
+// Flush 立即把已经写入的消息fsync到磁盘
+func (l *Log) Flush() error {
+	l.flushMu.Lock()
+	defer l.flushMu.Unlock()
+
+	for l.flushing {
+		l.flushCond.Wait()
+	}
+	if l.closed {
+		return errLogClosed
+	}
+	return l.flushLocked()
+}
+
+// flushLocked 调用方持有flushMu且当前没有其他fsync在进行
+// fsync期间会释放flushMu，让新的写入者可以进来排队
+func (l *Log) flushLocked() error {
+	l.flushing = true
+	l.flushMu.Unlock()
+
+	l.mu.RLock()
+	target := l.nextOffset
+	active := l.activeSegment()
+	l.mu.RUnlock()
+	err := active.file.Sync()
+	if errors.Is(err, os.ErrClosed) && !l.isClosed() {
+		// fsync期间segment滚动后又被compact替换掉了，滚动时已经fsync过，这里不算失败
+		err = nil
+	}
+
+	l.flushMu.Lock()
+	l.flushing = false
+	if err == nil && target > l.flushedOffset {
+		l.flushedOffset = target
+	}
+	l.flushCond.Broadcast()
+	if err != nil {
+		return fmt.Errorf("fsync segment %d: %w", active.baseOffset, err)
+	}
+	return nil
+}
+
+func (l *Log) isClosed() bool {
+	l.flushMu.Lock()
+	defer l.flushMu.Unlock()
+
+	return l.closed
+}
+
+// unflushedMessages 还没有fsync的消息数，调用方持有flushMu
+func (l *Log) unflushedMessages() int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.nextOffset - l.flushedOffset
+}
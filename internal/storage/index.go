@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+)
+
+const (
+	indexFileSuffix = ".index"
+
+	// indexEntrySize 每个索引项: 相对offset uint32 | 文件位置 uint32
+	indexEntrySize = 8
+
+	// DefaultIndexIntervalBytes 每写入这么多字节的数据才加一个索引项，和Kafka的index.interval.bytes一致
+	DefaultIndexIntervalBytes int64 = 4096
+)
+
+// indexEntry 稀疏索引中的一项，表示offset这条记录从segment文件的position处开始
+type indexEntry struct {
+	offset   int64
+	position int64
+}
+
+// offsetIndex segment的稀疏offset索引
+// 不是每条记录都有索引项，查找时先定位到不大于目标offset的最近一项，再从那里往后扫描
+type offsetIndex struct {
+	baseOffset int64
+	entries    []indexEntry
+	file       *os.File
+}
+
+// openOffsetIndex 打开segment对应的索引文件，文件不存在时创建一个空索引
+// 索引内容需要再调用load加载
+func openOffsetIndex(dir string, baseOffset int64) (*offsetIndex, error) {
+	path := segmentFileName(dir, baseOffset, indexFileSuffix)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	idx := &offsetIndex{
+		baseOffset: baseOffset,
+		entries:    make([]indexEntry, 0),
+		file:       file,
+	}
+	return idx, nil
+}
+
+func (idx *offsetIndex) load() error {
+	data, err := os.ReadFile(idx.file.Name())
+	if err != nil {
+		return err
+	}
+	return idx.parse(data)
+}
+
+// parse 解析索引文件的内容，远程存储中的索引也用它解析
+func (idx *offsetIndex) parse(data []byte) error {
+	for pos := 0; pos+indexEntrySize <= len(data); pos += indexEntrySize {
+		idx.entries = append(idx.entries, indexEntry{
+			offset:   idx.baseOffset + int64(binary.BigEndian.Uint32(data[pos:])),
+			position: int64(binary.BigEndian.Uint32(data[pos+4:])),
+		})
+	}
+	// 长度不是整数个索引项说明上次写了一半
+	if len(data)%indexEntrySize != 0 {
+		return fmt.Errorf("index file size %d is not a multiple of %d", len(data), indexEntrySize)
+	}
+	return nil
+}
+
+// sanityCheck 检查索引是否和segment数据一致：offset和位置都必须严格递增，且不能超出segment范围
+func (idx *offsetIndex) sanityCheck(nextOffset, segmentSize int64) error {
+	for i, entry := range idx.entries {
+		if entry.offset < idx.baseOffset || entry.offset >= nextOffset || entry.position >= segmentSize {
+			return fmt.Errorf("index entry %d (offset %d, position %d) out of range", i, entry.offset, entry.position)
+		}
+		if i > 0 && (entry.offset <= idx.entries[i-1].offset || entry.position <= idx.entries[i-1].position) {
+			return fmt.Errorf("index entry %d is not increasing", i)
+		}
+	}
+	return nil
+}
+
+// append 追加一个索引项，offset必须比已有的都大
+func (idx *offsetIndex) append(offset, position int64) error {
+	if n := len(idx.entries); n > 0 && offset <= idx.entries[n-1].offset {
+		return nil
+	}
+
+	var buf [indexEntrySize]byte
+	binary.BigEndian.PutUint32(buf[0:], uint32(offset-idx.baseOffset))
+	binary.BigEndian.PutUint32(buf[4:], uint32(position))
+	if _, err := idx.file.WriteAt(buf[:], int64(len(idx.entries))*indexEntrySize); err != nil {
+		return err
+	}
+	idx.entries = append(idx.entries, indexEntry{offset: offset, position: position})
+	return nil
+}
+
+// lookup 返回offset不大于目标offset的最后一个索引项对应的文件位置
+// 没有合适的索引项时返回0，也就是从segment开头扫描
+func (idx *offsetIndex) lookup(offset int64) int64 {
+	i := sort.Search(len(idx.entries), func(i int) bool {
+		return idx.entries[i].offset > offset
+	})
+	if i == 0 {
+		return 0
+	}
+	return idx.entries[i-1].position
+}
+
+// truncate 清空索引，用于重建
+func (idx *offsetIndex) truncate() error {
+	idx.entries = idx.entries[:0]
+	return idx.file.Truncate(0)
+}
+
+func (idx *offsetIndex) close() error {
+	return idx.file.Close()
+}
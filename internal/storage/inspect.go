@@ -0,0 +1,212 @@
+package storage
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/kafka-from-scratch/internal/common"
+	"github.com/kafka-from-scratch/internal/record"
+)
+
+// 离线检查分区目录，供cmd/dump-log使用
+// 和OpenLog不同，这里只读取文件：不截断写了一半的数据，也不重建索引，发现的问题原样报告
+
+// BatchInfo 扫描segment时读到的一个batch
+type BatchInfo struct {
+	SegmentBaseOffset int64
+	Position          int64 // batch在segment文件中的起始位置
+	Batch             record.Batch
+
+	// Messages batch中解码出来的消息，Err不为nil时可能不完整
+	Messages []*common.Message
+
+	// Err CRC校验失败或者记录无法解码，batch的长度仍然可信，扫描会继续
+	Err error
+}
+
+// SegmentReport 一个segment的检查结果
+type SegmentReport struct {
+	BaseOffset   int64
+	Files        SegmentFiles
+	Size         int64
+	Batches      int
+	Records      int
+	NextOffset   int64 // 最后一个batch的LastOffset+1，没有batch时等于BaseOffset
+	MaxTimestamp int64 // -1表示没有消息
+
+	IndexEntries     int
+	TimeIndexEntries int
+
+	// Problems 数据损坏以及索引和数据不一致的地方，为空表示没有发现问题
+	Problems []string
+}
+
+// LogReport 整个分区目录的检查结果
+type LogReport struct {
+	Dir string
+
+	// LogStartOffset DeleteRecordsBefore设置的log start offset，没有checkpoint文件时为0
+	LogStartOffset int64
+	Segments       []*SegmentReport
+
+	// Problems segment之间的问题，例如offset范围重叠
+	Problems []string
+}
+
+// Corrupt 是否发现了任何问题
+func (r *LogReport) Corrupt() bool {
+	if len(r.Problems) > 0 {
+		return true
+	}
+	for _, segment := range r.Segments {
+		if len(segment.Problems) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// InspectLog 按offset顺序扫描dir中的所有segment，对每个batch调用fn，并用扫描结果检查每个segment的索引
+// 只有读文件失败或者fn返回错误时才返回错误，数据损坏记录在LogReport中
+func InspectLog(dir string, fn func(BatchInfo) error) (*LogReport, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	baseOffsets := make([]int64, 0)
+	for _, entry := range entries {
+		if baseOffset, ok := parseSegmentBaseOffset(entry.Name()); ok && !entry.IsDir() {
+			baseOffsets = append(baseOffsets, baseOffset)
+		}
+	}
+	sort.Slice(baseOffsets, func(i, j int) bool { return baseOffsets[i] < baseOffsets[j] })
+
+	report := &LogReport{Dir: dir, Segments: make([]*SegmentReport, 0, len(baseOffsets))}
+	if report.LogStartOffset, err = ReadLogStartOffset(dir); err != nil {
+		report.Problems = append(report.Problems, err.Error())
+	}
+	for i, baseOffset := range baseOffsets {
+		segment, err := inspectSegment(dir, baseOffset, fn)
+		if err != nil {
+			return nil, err
+		}
+		report.Segments = append(report.Segments, segment)
+		if i+1 < len(baseOffsets) && segment.NextOffset > baseOffsets[i+1] {
+			report.Problems = append(report.Problems, fmt.Sprintf("segment %d ends at offset %d, overlapping segment %d",
+				baseOffset, segment.NextOffset, baseOffsets[i+1]))
+		}
+	}
+	return report, nil
+}
+
+// inspectSegment 扫描一个segment的数据，再检查offset索引和时间索引的每一项都指向真实的batch
+func inspectSegment(dir string, baseOffset int64, fn func(BatchInfo) error) (*SegmentReport, error) {
+	report := &SegmentReport{
+		BaseOffset: baseOffset,
+		Files: SegmentFiles{
+			Log:         segmentFileName(dir, baseOffset, logFileSuffix),
+			OffsetIndex: segmentFileName(dir, baseOffset, indexFileSuffix),
+			TimeIndex:   segmentFileName(dir, baseOffset, timeIndexFileSuffix),
+		},
+		NextOffset:   baseOffset,
+		MaxTimestamp: -1,
+	}
+	problem := func(format string, args ...any) {
+		report.Problems = append(report.Problems, fmt.Sprintf(format, args...))
+	}
+
+	file, err := os.Open(report.Files.Log)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// 索引项要和batch的起始位置、baseOffset以及最大时间戳对上
+	batchAt := make(map[int64]int64)        // 起始位置 -> baseOffset
+	maxTimestampOf := make(map[int64]int64) // LastOffset -> MaxTimestamp
+
+	reader := bufio.NewReader(file)
+	var position int64
+	for {
+		batch, err := record.ReadBatch(reader)
+		if err == io.EOF {
+			break
+		}
+		if err == record.ErrIncompleteBatch || errors.Is(err, common.ErrCorruptMessage) {
+			// 长度本身不可信，不知道下一个batch从哪里开始，后面的数据都无法检查
+			problem("bad batch at position %d: %v", position, err)
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read segment %d: %w", baseOffset, err)
+		}
+
+		info := BatchInfo{SegmentBaseOffset: baseOffset, Position: position, Batch: batch}
+		if info.Err = batch.Verify(); info.Err == nil {
+			info.Messages, info.Err = batch.Messages()
+		}
+		if info.Err != nil {
+			problem("batch at position %d (offsets %d-%d): %v", position, batch.BaseOffset(), batch.LastOffset(), info.Err)
+		}
+		if batch.BaseOffset() < report.NextOffset || batch.LastOffset() < batch.BaseOffset() {
+			problem("batch at position %d has offsets %d-%d, expected to start at or after %d",
+				position, batch.BaseOffset(), batch.LastOffset(), report.NextOffset)
+		}
+
+		batchAt[position] = batch.BaseOffset()
+		maxTimestampOf[batch.LastOffset()] = batch.MaxTimestamp()
+		report.Batches++
+		report.Records += batch.RecordCount()
+		report.NextOffset = max(report.NextOffset, batch.LastOffset()+1)
+		report.MaxTimestamp = max(report.MaxTimestamp, batch.MaxTimestamp())
+		position += int64(batch.Size())
+
+		if fn != nil {
+			if err := fn(info); err != nil {
+				return nil, err
+			}
+		}
+	}
+	report.Size = position
+	if info, err := file.Stat(); err == nil && info.Size() > position {
+		report.Size = info.Size()
+	}
+
+	index := &offsetIndex{baseOffset: baseOffset}
+	if data, err := os.ReadFile(report.Files.OffsetIndex); err != nil {
+		problem("offset index: %v", err)
+	} else if err := index.parse(data); err != nil {
+		problem("offset index: %v", err)
+	} else if err := index.sanityCheck(report.NextOffset, report.Size); err != nil {
+		problem("offset index: %v", err)
+	}
+	report.IndexEntries = len(index.entries)
+	for i, entry := range index.entries {
+		if batchOffset, ok := batchAt[entry.position]; !ok || batchOffset != entry.offset {
+			problem("offset index entry %d (offset %d, position %d) does not point to the start of a batch with that offset",
+				i, entry.offset, entry.position)
+		}
+	}
+
+	timeIndex := &timeIndex{baseOffset: baseOffset}
+	if data, err := os.ReadFile(report.Files.TimeIndex); err != nil {
+		problem("time index: %v", err)
+	} else if err := timeIndex.parse(data); err != nil {
+		problem("time index: %v", err)
+	} else if err := timeIndex.sanityCheck(report.NextOffset); err != nil {
+		problem("time index: %v", err)
+	}
+	report.TimeIndexEntries = len(timeIndex.entries)
+	// 时间索引项记录的是截止到这里的最大时间戳，以及这个时间戳所在batch的LastOffset
+	for i, entry := range timeIndex.entries {
+		if timestamp, ok := maxTimestampOf[entry.offset]; !ok || timestamp != entry.timestamp {
+			problem("time index entry %d (timestamp %d, offset %d) does not match the batch ending at that offset",
+				i, entry.timestamp, entry.offset)
+		}
+	}
+	return report, nil
+}
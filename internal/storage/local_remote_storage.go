@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const remoteMetadataSuffix = ".meta"
+
+// LocalRemoteStorage 用本地目录模拟的远程存储，主要用于测试，也可以指向NFS之类的共享目录
+// 每个分区一个子目录，每个segment有 .log/.index/.timeindex 三个文件和一个 .meta 元数据文件
+// .meta 最后写入，它存在就表示这个segment已经完整上传
+type LocalRemoteStorage struct {
+	root string
+}
+
+// NewLocalRemoteStorage 创建以root为根目录的远程存储，目录不存在时会自动创建
+func NewLocalRemoteStorage(root string) (*LocalRemoteStorage, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("create remote storage dir: %w", err)
+	}
+	return &LocalRemoteStorage{root: root}, nil
+}
+
+func (s *LocalRemoteStorage) CopySegment(partition string, segment RemoteSegment, files SegmentFiles) error {
+	dir := filepath.Join(s.root, partition)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	copies := []struct{ src, suffix string }{
+		{files.Log, logFileSuffix},
+		{files.OffsetIndex, indexFileSuffix},
+		{files.TimeIndex, timeIndexFileSuffix},
+	}
+	for _, c := range copies {
+		if err := copyFile(c.src, segmentFileName(dir, segment.BaseOffset, c.suffix)); err != nil {
+			return err
+		}
+	}
+
+	metadata, err := json.Marshal(segment)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(segmentFileName(dir, segment.BaseOffset, remoteMetadataSuffix), metadata)
+}
+
+func (s *LocalRemoteStorage) FetchSegment(partition string, segment RemoteSegment, position int64) (io.ReadCloser, error) {
+	file, err := os.Open(segmentFileName(filepath.Join(s.root, partition), segment.BaseOffset, logFileSuffix))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(position, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (s *LocalRemoteStorage) FetchIndex(partition string, segment RemoteSegment, indexType IndexType) ([]byte, error) {
+	suffix := indexFileSuffix
+	if indexType == TimeIndexType {
+		suffix = timeIndexFileSuffix
+	}
+	return os.ReadFile(segmentFileName(filepath.Join(s.root, partition), segment.BaseOffset, suffix))
+}
+
+func (s *LocalRemoteStorage) DeleteSegment(partition string, segment RemoteSegment) error {
+	dir := filepath.Join(s.root, partition)
+	// 先删除元数据，删到一半失败时segment也不会再被列出来
+	for _, suffix := range []string{remoteMetadataSuffix, logFileSuffix, indexFileSuffix, timeIndexFileSuffix} {
+		if err := os.Remove(segmentFileName(dir, segment.BaseOffset, suffix)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *LocalRemoteStorage) ListSegments(partition string) ([]RemoteSegment, error) {
+	dir := filepath.Join(s.root, partition)
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	segments := make([]RemoteSegment, 0)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), remoteMetadataSuffix) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var segment RemoteSegment
+		if err := json.Unmarshal(data, &segment); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", entry.Name(), err)
+		}
+		segments = append(segments, segment)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].BaseOffset < segments[j].BaseOffset })
+	return segments, nil
+}
+
+// copyFile 复制文件内容并fsync，目标文件已经存在时覆盖（上次上传到一半失败的情况）
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// writeFileAtomic 先写临时文件再rename，读到的文件要么是旧的要么是完整的新内容
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,509 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kafka-from-scratch/internal/common"
+	"github.com/kafka-from-scratch/internal/record"
+)
+
+// DefaultSegmentBytes 默认的segment大小，和Kafka的log.segment.bytes默认值一致
+const DefaultSegmentBytes int64 = 1 << 30
+
+// MaxSegmentBytes segment最大的大小，和Kafka一样是math.MaxInt32
+// 索引项用32位保存相对offset和文件位置，segment再大的话索引里的位置会溢出
+const MaxSegmentBytes int64 = math.MaxInt32
+
+// LogConfig 分区日志的配置
+type LogConfig struct {
+	// SegmentBytes 单个segment文件的最大字节数，写满后滚动到新的segment
+	SegmentBytes int64
+
+	// IndexIntervalBytes 稀疏索引的密度：每写入这么多字节加一个索引项
+	IndexIntervalBytes int64
+
+	// Flush 什么时候fsync，以及Append什么时候返回，零值表示交给操作系统
+	Flush FlushPolicy
+
+	// Remote 分层存储，nil表示只用本地磁盘。见remote.go
+	Remote RemoteStorage
+}
+
+// Log 一个分区在磁盘上的追加写日志，由若干个segment组成
+// 只有最后一个segment(active segment)会被写入，其余的都是只读的
+type Log struct {
+	dir        string
+	name       string // 分区目录名，也是分区在远程存储中的名字
+	config     LogConfig
+	segments   []*Segment // 按baseOffset升序排列
+	nextOffset int64
+	mu         sync.RWMutex
+
+	// startOffset DeleteRecordsBefore设置的log start offset，更早的消息即使还在segment中也不能读到，见log_start_offset.go
+	startOffset int64
+
+	// 已经上传到远程存储的segment，按baseOffset升序排列，它们可能和本地segment重叠
+	remoteSegments  []*remoteSegment
+	remoteEndOffset int64 // 小于它的消息都已经上传
+
+	appended common.AppendNotifier
+
+	// 以下字段由flushMu保护，见flush.go
+	flushMu       sync.Mutex
+	flushCond     *sync.Cond
+	flushedOffset int64 // 小于它的消息都已经fsync
+	flushing      bool
+	closed        bool
+	flushStop     chan struct{}
+}
+
+// OpenLog 打开dir目录下的分区日志，目录不存在时会自动创建
+// 已有的segment会被加载，并从最后一个segment恢复出下一个offset
+func OpenLog(dir string, config LogConfig) (*Log, error) {
+	if config.SegmentBytes <= 0 {
+		config.SegmentBytes = DefaultSegmentBytes
+	}
+	if config.SegmentBytes > MaxSegmentBytes {
+		return nil, fmt.Errorf("segment bytes %d exceeds maximum %d", config.SegmentBytes, MaxSegmentBytes)
+	}
+	if config.IndexIntervalBytes <= 0 {
+		config.IndexIntervalBytes = DefaultIndexIntervalBytes
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	baseOffsets := make([]int64, 0)
+	for _, entry := range entries {
+		if baseOffset, ok := parseSegmentBaseOffset(entry.Name()); ok && !entry.IsDir() {
+			baseOffsets = append(baseOffsets, baseOffset)
+		}
+	}
+	sort.Slice(baseOffsets, func(i, j int) bool { return baseOffsets[i] < baseOffsets[j] })
+
+	l := &Log{
+		dir:       dir,
+		name:      filepath.Base(dir),
+		config:    config,
+		segments:  make([]*Segment, 0, len(baseOffsets)),
+		flushStop: make(chan struct{}),
+	}
+	l.flushCond = sync.NewCond(&l.flushMu)
+	if l.startOffset, err = ReadLogStartOffset(dir); err != nil {
+		return nil, err
+	}
+	if config.Remote != nil {
+		if err := l.loadRemoteSegments(); err != nil {
+			return nil, err
+		}
+	}
+	// 本地的数据都已经上传并删除时，从远程存储的末尾继续写
+	if len(baseOffsets) == 0 {
+		baseOffsets = append(baseOffsets, max(l.remoteEndOffset, l.startOffset))
+	}
+	for i, baseOffset := range baseOffsets {
+		segment, err := openSegment(dir, baseOffset, config.IndexIntervalBytes)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		l.segments = append(l.segments, segment)
+		// 只读segment的范围由下一个segment的baseOffset决定，不需要扫描数据
+		if i+1 < len(baseOffsets) {
+			segment.nextOffset = baseOffsets[i+1]
+			if err := segment.loadIndex(); err != nil {
+				l.Close()
+				return nil, err
+			}
+		}
+	}
+
+	// active segment可能在写入过程中崩溃过，总是扫描一遍恢复数据和索引
+	active := l.activeSegment()
+	if err := active.recover(); err != nil {
+		l.Close()
+		return nil, err
+	}
+	l.nextOffset = active.nextOffset
+	// DeleteRecordsBefore写完checkpoint之后崩溃时，继续删除它之前的segment
+	// 没有fsync的消息在崩溃中丢失时，log start offset可能超过了最后一条消息，新消息要从log start offset开始
+	if l.startOffset > l.nextOffset {
+		l.nextOffset = l.startOffset
+	}
+	if err := l.deleteSegmentsBefore(l.startOffset); err != nil {
+		l.Close()
+		return nil, err
+	}
+	// 打开时已经在文件里的数据当作已经落盘
+	l.flushedOffset = l.nextOffset
+	l.startFlusher()
+
+	return l, nil
+}
+
+// Append 把消息编码成一个batch追加，分配连续的offset写回每条消息，返回第一条消息的offset
+// 配置了Flush策略时，会等到这些消息被fsync之后才返回
+func (l *Log) Append(messages ...*common.Message) (int64, error) {
+	if len(messages) == 0 {
+		return l.LatestOffset(), nil
+	}
+	offset, err := l.AppendBatch(record.Build(messages))
+	if err != nil {
+		return 0, err
+	}
+	for i, message := range messages {
+		message.Offset = offset + int64(i)
+	}
+	return offset, nil
+}
+
+// AppendBatch 校验Producer发来的batch，为它分配offset后原样写入，返回第一条消息的offset
+// batch中的消息总是写在同一个segment里，要么全部写入要么都不写入
+// 配置了Flush策略时，会等到整个batch被fsync之后才返回
+func (l *Log) AppendBatch(batch record.Batch) (int64, error) {
+	if err := batch.Validate(); err != nil {
+		return 0, err
+	}
+	if err := l.appendBatch(batch); err != nil {
+		return 0, err
+	}
+	if l.config.Flush.enabled() {
+		if err := l.waitFlushed(batch.LastOffset()); err != nil {
+			return 0, err
+		}
+	}
+	return batch.BaseOffset(), nil
+}
+
+func (l *Log) appendBatch(batch record.Batch) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	batch.SetBaseOffset(l.nextOffset)
+
+	active := l.activeSegment()
+	if active.size > 0 && active.size+int64(batch.Size()) > l.config.SegmentBytes {
+		segment, err := l.roll()
+		if err != nil {
+			return err
+		}
+		active = segment
+	}
+
+	if err := active.append(batch); err != nil {
+		return fmt.Errorf("append to segment %d: %w", active.baseOffset, err)
+	}
+	l.nextOffset = batch.LastOffset() + 1
+	// 写入segment之后就可以读到了，不用等fsync
+	l.appended.Notify()
+	return nil
+}
+
+// Appended 返回下一次追加batch时关闭的channel
+func (l *Log) Appended() <-chan struct{} {
+	return l.appended.Wait()
+}
+
+// roll 以当前的nextOffset为baseOffset创建新的active segment
+// 旧的active segment在滚动前fsync，flusher之后只需要fsync新的active segment
+func (l *Log) roll() (*Segment, error) {
+	old := l.activeSegment()
+	if err := old.onRoll(); err != nil {
+		return nil, fmt.Errorf("roll segment: %w", err)
+	}
+	if l.config.Flush.enabled() {
+		if err := old.file.Sync(); err != nil {
+			return nil, fmt.Errorf("roll segment: fsync segment %d: %w", old.baseOffset, err)
+		}
+	}
+	segment, err := openSegment(l.dir, l.nextOffset, l.config.IndexIntervalBytes)
+	if err != nil {
+		return nil, fmt.Errorf("roll segment: %w", err)
+	}
+	l.segments = append(l.segments, segment)
+	return segment, nil
+}
+
+// Read 从startOffset开始读取最多maxMessages条消息，可能跨越多个segment
+// 和Partition.Read保持一致：早于log start offset时返回ErrOffsetOutOfRange，读到末尾时返回空列表
+// 本地已经删除、只在远程存储中的消息每次只从一个远程segment读取
+func (l *Log) Read(startOffset int64, maxMessages int) ([]*common.Message, error) {
+	for {
+		messages, remote, err := l.readLocal(startOffset, maxMessages)
+		if remote == nil {
+			return messages, err
+		}
+		messages, err = remote.read(l, startOffset, maxMessages)
+		// compact过的远程segment末尾可能没有消息，继续读下一个segment
+		if err != nil || len(messages) > 0 || maxMessages <= 0 {
+			return messages, err
+		}
+		startOffset = remote.NextOffset
+	}
+}
+
+// readLocal startOffset在本地segment中时读取消息，只在远程存储中时返回对应的远程segment，
+// 由调用方在不持有锁的情况下读取
+func (l *Log) readLocal(startOffset int64, maxMessages int) ([]*common.Message, *remoteSegment, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	messages := make([]*common.Message, 0)
+	if startOffset < l.logStartOffset() {
+		return nil, nil, fmt.Errorf("%w: offset %d is before log start offset %d", common.ErrOffsetOutOfRange, startOffset, l.logStartOffset())
+	}
+	if startOffset >= l.nextOffset {
+		return messages, nil, nil
+	}
+	if startOffset < l.localLogStartOffset() {
+		remote, err := l.remoteSegmentBefore(startOffset)
+		return nil, remote, err
+	}
+
+	for i := l.segmentIndexFor(startOffset); i < len(l.segments) && len(messages) < maxMessages; i++ {
+		batch, err := l.segments[i].read(startOffset, maxMessages-len(messages))
+		if err != nil {
+			return nil, nil, err
+		}
+		messages = append(messages, batch...)
+	}
+	return messages, nil, nil
+}
+
+// ReadRecords 找到从包含startOffset的batch开始、至少覆盖maxMessages条消息的batch数据，可能跨越多个segment
+// 本地的数据不读进内存，返回FileRecords，由调用方通过WriteTo直接发送；只在远程存储中的数据读进内存返回
+// 发送完之后要Close。第一个batch里早于startOffset的消息由消费方跳过，和Kafka的Fetch一样
+// 早于log start offset时返回ErrOffsetOutOfRange，读到末尾时返回空的Records
+func (l *Log) ReadRecords(startOffset int64, maxMessages int) (record.Records, error) {
+	for {
+		local, remote, err := l.readLocalRecords(startOffset, maxMessages)
+		if err != nil {
+			return nil, err
+		}
+		if remote == nil {
+			return local, nil
+		}
+		records, err := remote.readRecords(l, startOffset, maxMessages)
+		if err != nil {
+			return nil, err
+		}
+		if records.Size() > 0 || maxMessages <= 0 {
+			return records, nil
+		}
+		startOffset = remote.NextOffset
+	}
+}
+
+// readLocalRecords 和readLocal一样，startOffset只在远程存储中时返回对应的远程segment
+func (l *Log) readLocalRecords(startOffset int64, maxMessages int) (*FileRecords, *remoteSegment, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if startOffset < l.logStartOffset() {
+		return nil, nil, fmt.Errorf("%w: offset %d is before log start offset %d", common.ErrOffsetOutOfRange, startOffset, l.logStartOffset())
+	}
+	if startOffset < l.localLogStartOffset() {
+		remote, err := l.remoteSegmentBefore(startOffset)
+		return nil, remote, err
+	}
+
+	records := &FileRecords{}
+	for i := l.segmentIndexFor(startOffset); i < len(l.segments) && maxMessages > 0 && startOffset < l.nextOffset; i++ {
+		segment := l.segments[i]
+		start, end, count, err := segment.batchRange(startOffset, maxMessages)
+		if err != nil {
+			records.Close()
+			return nil, nil, err
+		}
+		if end > start {
+			// 持有读锁时打开新的句柄，compact替换文件需要写锁，所以打开的一定是刚才算出范围的那个文件
+			file, err := os.Open(segment.file.Name())
+			if err != nil {
+				records.Close()
+				return nil, nil, fmt.Errorf("read segment %d: %w", segment.baseOffset, err)
+			}
+			records.add(file, start, end-start)
+		}
+		// compact之后segment可能是空的，或者中间的offset已经不存在了，下一个segment从它自己的baseOffset开始
+		maxMessages -= count
+		startOffset = segment.nextOffset
+	}
+	return records, nil, nil
+}
+
+// segmentIndexFor 找到包含offset的segment：baseOffset <= offset 的最后一个
+func (l *Log) segmentIndexFor(offset int64) int {
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return l.segments[i].baseOffset > offset
+	})
+	if i == 0 {
+		return 0
+	}
+	return i - 1
+}
+
+// OffsetForTimestamp 返回第一条时间戳 >= t 的消息的offset
+// 所有消息都早于t时返回LatestOffset，也就是从下一条新消息开始消费
+// 先查远程存储中本地已经删除的segment，再查本地segment；早于log start offset的消息不算
+func (l *Log) OffsetForTimestamp(t time.Time) (int64, error) {
+	timestamp := t.UnixMilli()
+	var from int64
+	for {
+		offset, remote, err := l.localOffsetForTimestamp(timestamp, from)
+		if remote == nil {
+			return offset, err
+		}
+		offset, err = remote.findOffsetByTimestamp(l, timestamp, offset)
+		if err != nil || offset < remote.NextOffset {
+			return offset, err
+		}
+		// 这个segment里晚于t的消息都在log start offset之前，继续找下一个segment
+		from = remote.NextOffset
+	}
+}
+
+// localOffsetForTimestamp 从from和log start offset中较大的那个开始查找
+// 要找的消息只在远程存储中时返回对应的远程segment和查找的起点，由调用方在不持有锁的情况下查找
+func (l *Log) localOffsetForTimestamp(timestamp, from int64) (int64, *remoteSegment, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	from = max(from, l.logStartOffset())
+	for _, remote := range l.remoteSegments {
+		if remote.BaseOffset >= l.localLogStartOffset() {
+			break
+		}
+		if remote.NextOffset > from && remote.MaxTimestamp >= timestamp {
+			return from, remote, nil
+		}
+	}
+	for _, segment := range l.segments {
+		if segment.nextOffset <= from || segment.maxTimestamp < timestamp {
+			continue
+		}
+		offset, err := segment.findOffsetByTimestamp(timestamp, from)
+		if err != nil || offset < segment.nextOffset {
+			return offset, nil, err
+		}
+	}
+	return l.nextOffset, nil, nil
+}
+
+// EarliestOffset 返回log start offset，更早的消息已经被清理
+func (l *Log) EarliestOffset() int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.logStartOffset()
+}
+
+// Size 返回本地所有segment的总字节数
+func (l *Log) Size() int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var size int64
+	for _, segment := range l.segments {
+		size += segment.size
+	}
+	return size
+}
+
+// DeleteOldSegments 按保留策略删除最旧的整个segment，log start offset前进到剩下的第一个segment
+// retentionMs: segment中最新的消息也早于这个时间才删除；retentionBytes: 删除后总大小仍不小于这个值才删除
+// 参数为-1表示不按该维度清理；active segment永远不会被删除。返回删除的segment数
+// 配置了远程存储时这是本地的保留策略，只删除已经上传的segment，log start offset不变
+func (l *Log) DeleteOldSegments(retentionMs, retentionBytes int64, now time.Time) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var totalSize int64
+	for _, segment := range l.segments {
+		totalSize += segment.size
+	}
+
+	deleted := 0
+	for len(l.segments) > 1 {
+		segment := l.segments[0]
+		expired := retentionMs >= 0 && segment.maxTimestamp >= 0 &&
+			now.Sub(time.UnixMilli(segment.maxTimestamp)) > time.Duration(retentionMs)*time.Millisecond
+		oversized := retentionBytes >= 0 && totalSize-segment.size >= retentionBytes
+		purged := segment.nextOffset <= l.startOffset // DeleteRecordsBefore没有删干净的segment
+		if !expired && !oversized && !purged {
+			break
+		}
+		if l.config.Remote != nil && segment.nextOffset > l.remoteEndOffset && !purged {
+			break
+		}
+
+		if err := segment.remove(); err != nil {
+			return deleted, fmt.Errorf("delete segment %d: %w", segment.baseOffset, err)
+		}
+		l.segments = l.segments[1:]
+		totalSize -= segment.size
+		deleted++
+	}
+	return deleted, nil
+}
+
+// logStartOffset 调用方需要持有锁
+func (l *Log) logStartOffset() int64 {
+	start := l.segments[0].baseOffset
+	if len(l.remoteSegments) > 0 && l.remoteSegments[0].BaseOffset < start {
+		start = l.remoteSegments[0].BaseOffset
+	}
+	return max(start, l.startOffset)
+}
+
+// localLogStartOffset 本地第一条消息的offset，调用方需要持有锁
+func (l *Log) localLogStartOffset() int64 {
+	return l.segments[0].baseOffset
+}
+
+// LatestOffset 返回下一条消息将要使用的offset
+func (l *Log) LatestOffset() int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.nextOffset
+}
+
+// Close 关闭所有segment文件，还在等待fsync的Append会返回错误
+func (l *Log) Close() error {
+	l.flushMu.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.flushStop)
+	}
+	l.flushCond.Broadcast()
+	l.flushMu.Unlock()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var firstErr error
+	if l.config.Flush.enabled() && len(l.segments) > 0 {
+		firstErr = l.activeSegment().file.Sync()
+	}
+	for _, segment := range l.segments {
+		if err := segment.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (l *Log) activeSegment() *Segment {
+	return l.segments[len(l.segments)-1]
+}
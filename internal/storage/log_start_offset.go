@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/kafka-from-scratch/internal/common"
+)
+
+// logStartOffsetFile 分区目录下记录DeleteRecordsBefore设置的log start offset的文件
+// segment是整个删除的，log start offset可能落在一个segment中间，这个segment里更早的消息还在文件中，
+// 重启后要靠这个文件继续隐藏它们，和Kafka的log-start-offset-checkpoint一样
+const logStartOffsetFile = "log-start-offset.checkpoint"
+
+// DeleteRecordsBefore 删除offset之前的所有消息，log start offset前进到offset，返回新的log start offset
+// 先把新的log start offset写入checkpoint文件并fsync，之后再删除完全在它之前的本地segment和远程segment，
+// 中途失败或崩溃时消息也不会再被读到。包含offset的segment保留，其中更早的消息在删除这个segment时才真正从磁盘上消失
+// offset已经不大于log start offset时什么都不做；offset为负数或大于LatestOffset时返回ErrOffsetOutOfRange
+func (l *Log) DeleteRecordsBefore(offset int64) (int64, error) {
+	l.mu.Lock()
+	if offset < 0 || offset > l.nextOffset {
+		l.mu.Unlock()
+		return 0, fmt.Errorf("%w: offset %d is not in [0, %d]", common.ErrOffsetOutOfRange, offset, l.nextOffset)
+	}
+	if offset <= l.logStartOffset() {
+		start := l.logStartOffset()
+		l.mu.Unlock()
+		return start, nil
+	}
+	if err := writeLogStartOffset(l.dir, offset); err != nil {
+		l.mu.Unlock()
+		return 0, err
+	}
+	l.startOffset = offset
+
+	err := l.deleteSegmentsBefore(offset)
+
+	deleted := make([]*remoteSegment, 0)
+	for len(l.remoteSegments) > 0 && l.remoteSegments[0].NextOffset <= offset {
+		deleted = append(deleted, l.remoteSegments[0])
+		l.remoteSegments = l.remoteSegments[1:]
+	}
+	l.mu.Unlock()
+
+	// 和DeleteRemoteSegments一样，已经从列表中去掉了，远程删除不需要持有锁
+	for _, segment := range deleted {
+		if deleteErr := l.config.Remote.DeleteSegment(l.remotePartition(), segment.RemoteSegment); deleteErr != nil && err == nil {
+			err = fmt.Errorf("delete remote segment %d: %w", segment.BaseOffset, deleteErr)
+		}
+	}
+	// log start offset已经生效，只是旧数据没有删干净，保留策略下次执行时会继续删除
+	return offset, err
+}
+
+// deleteSegmentsBefore 删除完全在offset之前的本地segment，调用方需要持有写锁
+// 删除到最新offset时active segment也要删除，先滚动出一个以offset为baseOffset的新segment
+func (l *Log) deleteSegmentsBefore(offset int64) error {
+	if offset == l.nextOffset && l.activeSegment().baseOffset < offset {
+		if _, err := l.roll(); err != nil {
+			return err
+		}
+	}
+	for len(l.segments) > 1 && l.segments[0].nextOffset <= offset {
+		if err := l.segments[0].remove(); err != nil {
+			return fmt.Errorf("delete segment %d: %w", l.segments[0].baseOffset, err)
+		}
+		l.segments = l.segments[1:]
+	}
+	return nil
+}
+
+// ReadLogStartOffset 读取分区目录中的log start offset checkpoint文件，文件不存在时返回0
+func ReadLogStartOffset(dir string) (int64, error) {
+	data, err := os.ReadFile(filepath.Join(dir, logStartOffsetFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("read log start offset: %w", err)
+	}
+	offset, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil || offset < 0 {
+		return 0, fmt.Errorf("invalid log start offset checkpoint %q in %s", strings.TrimSpace(string(data)), dir)
+	}
+	return offset, nil
+}
+
+// writeLogStartOffset 先写临时文件并fsync，再rename替换，最后fsync目录，崩溃后文件要么是旧的要么是新的
+func writeLogStartOffset(dir string, offset int64) error {
+	path := filepath.Join(dir, logStartOffsetFile)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("write log start offset: %w", err)
+	}
+	_, err = f.WriteString(strconv.FormatInt(offset, 10) + "\n")
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("write log start offset: %w", err)
+	}
+
+	if err := syncDir(dir); err != nil {
+		return fmt.Errorf("write log start offset: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/kafka-from-scratch/internal/common"
+	"github.com/kafka-from-scratch/internal/storage"
+	"github.com/kafka-from-scratch/internal/storetest"
+)
+
+func TestLogPartitionStore(t *testing.T) {
+	storetest.Run(t, storetest.Engine{
+		Open: func(dir string) (common.PartitionStore, error) {
+			// segment很小，测试数据会分布在多个segment中
+			log, err := storage.OpenLog(dir, storage.LogConfig{SegmentBytes: 512, IndexIntervalBytes: 128})
+			if err != nil {
+				return nil, err
+			}
+			return log, nil
+		},
+		Persistent: true,
+	})
+}
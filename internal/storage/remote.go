@@ -0,0 +1,355 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kafka-from-scratch/internal/common"
+	"github.com/kafka-from-scratch/internal/record"
+)
+
+// RemoteStorage 分层存储的远程存储，已经关闭的segment和它的索引会被上传到这里
+// 上传之后本地副本可以按local.retention.*提前删除，读取更早的offset时再从远程读取
+// partition是分区目录名（例如 orders-0），同一个RemoteStorage可以被所有分区共用
+type RemoteStorage interface {
+	// CopySegment 上传一个已经关闭的segment，成功返回后它必须能被ListSegments列出来
+	CopySegment(partition string, segment RemoteSegment, files SegmentFiles) error
+
+	// FetchSegment 读取segment数据文件从position开始到末尾的内容
+	FetchSegment(partition string, segment RemoteSegment, position int64) (io.ReadCloser, error)
+
+	// FetchIndex 读取segment的整个索引文件
+	FetchIndex(partition string, segment RemoteSegment, indexType IndexType) ([]byte, error)
+
+	// DeleteSegment 删除segment的数据和索引，segment不存在时不报错
+	DeleteSegment(partition string, segment RemoteSegment) error
+
+	// ListSegments 按baseOffset升序返回分区已经上传完成的所有segment
+	ListSegments(partition string) ([]RemoteSegment, error)
+}
+
+// RemoteSegment 远程存储中一个segment的元数据
+type RemoteSegment struct {
+	BaseOffset   int64 `json:"base_offset"`
+	NextOffset   int64 `json:"next_offset"`   // segment之后第一条消息的offset
+	Size         int64 `json:"size"`          // 数据文件的字节数
+	MaxTimestamp int64 `json:"max_timestamp"` // 最大的消息时间戳(Unix毫秒)，空segment为-1
+}
+
+// SegmentFiles 要上传的segment在本地的文件路径
+type SegmentFiles struct {
+	Log         string
+	OffsetIndex string
+	TimeIndex   string
+}
+
+// IndexType 索引文件的类型
+type IndexType int
+
+const (
+	OffsetIndexType IndexType = iota
+	TimeIndexType
+)
+
+// remoteSegment Log中记录的一个远程segment，索引第一次用到时才下载
+type remoteSegment struct {
+	RemoteSegment
+
+	mu        sync.Mutex
+	index     *offsetIndex
+	timeIndex *timeIndex
+}
+
+// remotePartition 分区在远程存储中的名字
+func (l *Log) remotePartition() string {
+	return l.name
+}
+
+// loadRemoteSegments 打开日志时从远程存储恢复已经上传的segment列表
+func (l *Log) loadRemoteSegments() error {
+	segments, err := l.config.Remote.ListSegments(l.remotePartition())
+	if err != nil {
+		return fmt.Errorf("list remote segments: %w", err)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].BaseOffset < segments[j].BaseOffset })
+	for _, segment := range segments {
+		l.remoteSegments = append(l.remoteSegments, &remoteSegment{RemoteSegment: segment})
+		if segment.NextOffset > l.remoteEndOffset {
+			l.remoteEndOffset = segment.NextOffset
+		}
+	}
+	return nil
+}
+
+// remoteSegmentFor 找到包含offset的远程segment，调用方需要持有锁
+func (l *Log) remoteSegmentFor(offset int64) *remoteSegment {
+	i := sort.Search(len(l.remoteSegments), func(i int) bool {
+		return l.remoteSegments[i].NextOffset > offset
+	})
+	if i == len(l.remoteSegments) || l.remoteSegments[i].BaseOffset > offset {
+		return nil
+	}
+	return l.remoteSegments[i]
+}
+
+// remoteSegmentBefore startOffset早于本地第一个segment时找到包含它的远程segment，调用方需要持有锁
+// 没有远程segment包含它时这段消息已经丢失（例如上传之前本地segment就被删掉了），
+// 返回ErrOffsetOutOfRange，不能跳到本地第一个segment继续读，否则消费者不会知道中间少了消息
+func (l *Log) remoteSegmentBefore(startOffset int64) (*remoteSegment, error) {
+	if remote := l.remoteSegmentFor(startOffset); remote != nil {
+		return remote, nil
+	}
+	return nil, fmt.Errorf("%w: offset %d is not in remote storage and local data starts at %d", common.ErrOffsetOutOfRange, startOffset, l.localLogStartOffset())
+}
+
+// CopyToRemote 把还没有上传的只读segment上传到远程存储，返回上传的segment数
+// 上传不持有锁，只在记录结果时短暂加写锁；只有后台清理goroutine调用它
+func (l *Log) CopyToRemote() (int, error) {
+	if l.config.Remote == nil {
+		return 0, nil
+	}
+
+	type candidate struct {
+		segment RemoteSegment
+		files   SegmentFiles
+	}
+	l.mu.RLock()
+	candidates := make([]candidate, 0)
+	for _, segment := range l.segments[:len(l.segments)-1] {
+		if segment.baseOffset < l.remoteEndOffset || segment.nextOffset <= l.startOffset {
+			continue
+		}
+		// 只读segment不会再变化，而且没有上传的segment不会被retention删除，放锁之后也可以安全地读
+		// 只有DeleteRecordsBefore可能在上传过程中删除它，上传之后再检查
+		candidates = append(candidates, candidate{
+			segment: RemoteSegment{
+				BaseOffset:   segment.baseOffset,
+				NextOffset:   segment.nextOffset,
+				Size:         segment.size,
+				MaxTimestamp: segment.maxTimestamp,
+			},
+			files: SegmentFiles{
+				Log:         segment.file.Name(),
+				OffsetIndex: segment.index.file.Name(),
+				TimeIndex:   segment.timeIndex.file.Name(),
+			},
+		})
+	}
+	l.mu.RUnlock()
+
+	copied := 0
+	for _, c := range candidates {
+		if err := l.config.Remote.CopySegment(l.remotePartition(), c.segment, c.files); err != nil {
+			return copied, fmt.Errorf("copy segment %d to remote storage: %w", c.segment.BaseOffset, err)
+		}
+		l.mu.Lock()
+		purged := c.segment.NextOffset <= l.startOffset
+		if !purged {
+			l.remoteSegments = append(l.remoteSegments, &remoteSegment{RemoteSegment: c.segment})
+		}
+		l.remoteEndOffset = c.segment.NextOffset
+		l.mu.Unlock()
+		if purged {
+			if err := l.config.Remote.DeleteSegment(l.remotePartition(), c.segment); err != nil {
+				return copied, fmt.Errorf("delete remote segment %d: %w", c.segment.BaseOffset, err)
+			}
+			continue
+		}
+		copied++
+	}
+	return copied, nil
+}
+
+// DeleteRemoteSegments 按总的保留策略删除远程存储中最旧的segment，log start offset随之前进
+// retentionBytes按整个分区计算：远程的segment加上还没有上传的本地segment
+// 被删除范围内如果还有本地副本，也一起删除。参数为-1表示不按该维度清理，返回删除的远程segment数
+func (l *Log) DeleteRemoteSegments(retentionMs, retentionBytes int64, now time.Time) (int, error) {
+	if l.config.Remote == nil {
+		return 0, nil
+	}
+
+	l.mu.Lock()
+	var totalSize int64
+	for _, segment := range l.remoteSegments {
+		totalSize += segment.Size
+	}
+	for _, segment := range l.segments {
+		if segment.baseOffset >= l.remoteEndOffset {
+			totalSize += segment.size
+		}
+	}
+
+	deleted := make([]*remoteSegment, 0)
+	for len(l.remoteSegments) > 0 {
+		segment := l.remoteSegments[0]
+		expired := retentionMs >= 0 && segment.MaxTimestamp >= 0 &&
+			now.Sub(time.UnixMilli(segment.MaxTimestamp)) > time.Duration(retentionMs)*time.Millisecond
+		oversized := retentionBytes >= 0 && totalSize-segment.Size >= retentionBytes
+		if !expired && !oversized && segment.NextOffset > l.startOffset {
+			break
+		}
+		deleted = append(deleted, segment)
+		l.remoteSegments = l.remoteSegments[1:]
+		totalSize -= segment.Size
+	}
+
+	var err error
+	if len(deleted) > 0 {
+		deletedUpTo := deleted[len(deleted)-1].NextOffset
+		for len(l.segments) > 1 && l.segments[0].nextOffset <= deletedUpTo {
+			if err = l.segments[0].remove(); err != nil {
+				err = fmt.Errorf("delete segment %d: %w", l.segments[0].baseOffset, err)
+				break
+			}
+			l.segments = l.segments[1:]
+		}
+	}
+	l.mu.Unlock()
+
+	// 已经从列表中去掉了，新的读取不会再用到它们，远程删除不需要持有锁
+	for i, segment := range deleted {
+		if deleteErr := l.config.Remote.DeleteSegment(l.remotePartition(), segment.RemoteSegment); deleteErr != nil {
+			return i, fmt.Errorf("delete remote segment %d: %w", segment.BaseOffset, deleteErr)
+		}
+	}
+	return len(deleted), err
+}
+
+// offsetIndex 返回远程segment的offset索引，第一次调用时下载
+func (s *remoteSegment) offsetIndex(l *Log) (*offsetIndex, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.index == nil {
+		data, err := l.config.Remote.FetchIndex(l.remotePartition(), s.RemoteSegment, OffsetIndexType)
+		if err != nil {
+			return nil, fmt.Errorf("fetch index of remote segment %d: %w", s.BaseOffset, err)
+		}
+		index := &offsetIndex{baseOffset: s.BaseOffset}
+		err = index.parse(data)
+		if err == nil {
+			err = index.sanityCheck(s.NextOffset, s.Size)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("remote segment %d: %w", s.BaseOffset, err)
+		}
+		s.index = index
+	}
+	return s.index, nil
+}
+
+// timeIndexFor 返回远程segment的时间索引，第一次调用时下载
+func (s *remoteSegment) timeIndexFor(l *Log) (*timeIndex, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.timeIndex == nil {
+		data, err := l.config.Remote.FetchIndex(l.remotePartition(), s.RemoteSegment, TimeIndexType)
+		if err != nil {
+			return nil, fmt.Errorf("fetch time index of remote segment %d: %w", s.BaseOffset, err)
+		}
+		index := &timeIndex{baseOffset: s.BaseOffset}
+		err = index.parse(data)
+		if err == nil {
+			err = index.sanityCheck(s.NextOffset)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("remote segment %d: %w", s.BaseOffset, err)
+		}
+		s.timeIndex = index
+	}
+	return s.timeIndex, nil
+}
+
+// forEachBatch 从远程segment中startOffset附近的位置开始顺序读取batch，fn返回false时停止
+func (s *remoteSegment) forEachBatch(l *Log, startOffset int64, verify bool, fn func(batch record.Batch) (bool, error)) error {
+	index, err := s.offsetIndex(l)
+	if err != nil {
+		return err
+	}
+	data, err := l.config.Remote.FetchSegment(l.remotePartition(), s.RemoteSegment, index.lookup(startOffset))
+	if err != nil {
+		return fmt.Errorf("fetch remote segment %d: %w", s.BaseOffset, err)
+	}
+	defer data.Close()
+
+	reader := bufio.NewReader(data)
+	for {
+		var batch record.Batch
+		if verify {
+			batch, err = readVerifiedBatch(reader)
+		} else {
+			batch, err = record.ReadBatch(reader)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read remote segment %d: %w", s.BaseOffset, err)
+		}
+		more, err := fn(batch)
+		if err != nil {
+			return fmt.Errorf("read remote segment %d: %w", s.BaseOffset, err)
+		}
+		if !more {
+			return nil
+		}
+	}
+}
+
+// read 从远程segment读取startOffset开始最多maxMessages条消息
+func (s *remoteSegment) read(l *Log, startOffset int64, maxMessages int) ([]*common.Message, error) {
+	messages := make([]*common.Message, 0)
+	err := s.forEachBatch(l, startOffset, true, func(batch record.Batch) (bool, error) {
+		var err error
+		messages, err = appendMessages(messages, batch, startOffset, maxMessages)
+		return len(messages) < maxMessages, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// readRecords 从远程segment读取覆盖startOffset开始maxMessages条消息的原始batch
+// 远程的数据不能sendfile，读进内存之后返回
+func (s *remoteSegment) readRecords(l *Log, startOffset int64, maxMessages int) (record.Records, error) {
+	data := make([]byte, 0)
+	count := 0
+	err := s.forEachBatch(l, startOffset, false, func(batch record.Batch) (bool, error) {
+		if lastOffset := batch.LastOffset(); lastOffset >= startOffset {
+			data = append(data, batch...)
+			count += int(lastOffset - max(batch.BaseOffset(), startOffset) + 1)
+		}
+		return count < maxMessages, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return record.MemoryRecords(data), nil
+}
+
+// findOffsetByTimestamp 和Segment.findOffsetByTimestamp一样，先查时间索引再扫描数据
+func (s *remoteSegment) findOffsetByTimestamp(l *Log, timestamp, minOffset int64) (int64, error) {
+	index, err := s.timeIndexFor(l)
+	if err != nil {
+		return 0, err
+	}
+	startOffset := max(index.lookup(timestamp), minOffset)
+	offset := s.NextOffset
+	err = s.forEachBatch(l, startOffset, true, func(batch record.Batch) (bool, error) {
+		found, ok, err := offsetForTimestampInBatch(batch, startOffset, timestamp)
+		if ok {
+			offset = found
+		}
+		return !ok && err == nil, err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
@@ -0,0 +1,68 @@
+package storage_test
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kafka-from-scratch/internal/common"
+	"github.com/kafka-from-scratch/internal/storage"
+)
+
+// 远程存储中间缺了一个segment时，读取这段offset要报错，不能跳到后面的数据
+func TestReadMissingRemoteSegment(t *testing.T) {
+	remote, err := storage.NewLocalRemoteStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(t.TempDir(), "topic-0")
+	config := storage.LogConfig{SegmentBytes: 512, Remote: remote}
+	log, err := storage.OpenLog(dir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 40; i++ {
+		if _, err := log.Append(&common.Message{Value: []byte(fmt.Sprintf("value-%02d-%s", i, "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx"))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := log.CopyToRemote(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := log.DeleteOldSegments(-1, 0, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	segments, err := remote.ListSegments("topic-0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) < 3 {
+		t.Fatalf("got %d remote segments, want at least 3", len(segments))
+	}
+	missing := segments[1]
+	if err := remote.DeleteSegment("topic-0", missing); err != nil {
+		t.Fatal(err)
+	}
+
+	log, err = storage.OpenLog(dir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+
+	if messages, err := log.Read(0, 1); err != nil || len(messages) != 1 || messages[0].Offset != 0 {
+		t.Fatalf("read offset 0: got (%d messages, %v)", len(messages), err)
+	}
+	if _, err := log.Read(missing.BaseOffset, 10); !errors.Is(err, common.ErrOffsetOutOfRange) {
+		t.Fatalf("read missing offset %d: got %v, want ErrOffsetOutOfRange", missing.BaseOffset, err)
+	}
+	if _, err := log.ReadRecords(missing.BaseOffset, 10); !errors.Is(err, common.ErrOffsetOutOfRange) {
+		t.Fatalf("read records at missing offset %d: got %v, want ErrOffsetOutOfRange", missing.BaseOffset, err)
+	}
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/kafka-from-scratch/internal/common"
+	"github.com/kafka-from-scratch/internal/record"
+)
+
+// restoreBatchMessages 恢复分区时每个batch最多的消息数
+const restoreBatchMessages = 1000
+
+// RestoreLog 在dir中写入一个新的分区日志，消息的offset、log start offset和下一个offset与快照完全一致，写完后关闭
+// dir中已有的内容会被删除；messages必须按offset递增并且都在[startOffset, nextOffset)范围内，compact过的offset可以不连续
+// 调用方之后用OpenLog打开它
+func RestoreLog(dir string, messages []*common.Message, startOffset, nextOffset int64) error {
+	if err := checkRestoreRange(messages, startOffset, nextOffset); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	// 第一个segment从log start offset开始
+	if startOffset > 0 {
+		if err := writeLogStartOffset(dir, startOffset); err != nil {
+			return err
+		}
+	}
+	// 每个segment滚动和关闭时都fsync
+	l, err := OpenLog(dir, LogConfig{Flush: FlushPolicy{Messages: 1}})
+	if err != nil {
+		return err
+	}
+
+	// 这时只有这里在使用这个日志
+	for from := 0; from < len(messages) && err == nil; from += restoreBatchMessages {
+		batch := record.Encode(messages[from:min(from+restoreBatchMessages, len(messages))])
+		// appendBatch把batch写在nextOffset，先跳到第一条消息的offset
+		l.mu.Lock()
+		l.nextOffset = batch.BaseOffset()
+		l.mu.Unlock()
+		err = l.appendBatch(batch)
+	}
+	// 末尾的消息被compact掉了，用一个从nextOffset开始的空segment记住下一个offset
+	l.mu.Lock()
+	if err == nil && nextOffset > l.nextOffset {
+		l.nextOffset = nextOffset
+		_, err = l.roll()
+	}
+	l.mu.Unlock()
+
+	if closeErr := l.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = syncDir(dir)
+	}
+	if err != nil {
+		return fmt.Errorf("restore log %s: %w", dir, err)
+	}
+	return nil
+}
+
+// RestoreFileStore 在path写入一个新的单文件存储，消息的offset、log start offset和下一个offset与快照完全一致
+// path已经存在时会被替换；单文件存储只能从最后一个batch得到下一个offset，nextOffset必须紧接着最后一条消息，
+// 没有消息时必须等于startOffset
+func RestoreFileStore(path string, messages []*common.Message, startOffset, nextOffset int64) error {
+	if err := checkRestoreRange(messages, startOffset, nextOffset); err != nil {
+		return err
+	}
+	end := startOffset
+	if len(messages) > 0 {
+		end = messages[len(messages)-1].Offset + 1
+	}
+	if nextOffset != end {
+		return fmt.Errorf("restore file store %s: next offset %d does not follow the last message at %d", path, nextOffset, end-1)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("restore file store %s: %w", path, err)
+	}
+	_, err = tmp.Write(fileStoreHeader(startOffset))
+	for from := 0; from < len(messages) && err == nil; from += restoreBatchMessages {
+		_, err = tmp.Write(record.Encode(messages[from:min(from+restoreBatchMessages, len(messages))]))
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(path))
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("restore file store %s: %w", path, err)
+	}
+	return nil
+}
+
+func checkRestoreRange(messages []*common.Message, startOffset, nextOffset int64) error {
+	if startOffset < 0 || nextOffset < startOffset {
+		return fmt.Errorf("invalid offset range [%d, %d)", startOffset, nextOffset)
+	}
+	for i, message := range messages {
+		if message.Offset < startOffset || message.Offset >= nextOffset || (i > 0 && message.Offset <= messages[i-1].Offset) {
+			return fmt.Errorf("message offset %d out of order or outside [%d, %d)", message.Offset, startOffset, nextOffset)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package storage_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kafka-from-scratch/internal/common"
+	"github.com/kafka-from-scratch/internal/storage"
+)
+
+// compact过的分区：offset不连续，末尾的消息也被删掉了
+func compactedMessages() []*common.Message {
+	var messages []*common.Message
+	for _, offset := range []int64{3, 4, 7, 9} {
+		messages = append(messages, &common.Message{
+			Offset:    offset,
+			Key:       []byte(fmt.Sprintf("k%d", offset)),
+			Value:     []byte(fmt.Sprintf("v%d", offset)),
+			Timestamp: time.UnixMilli(1700000000000 + offset),
+		})
+	}
+	return messages
+}
+
+func TestRestoreLogKeepsOffsets(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "topic-0")
+	if err := storage.RestoreLog(dir, compactedMessages(), 2, 12); err != nil {
+		t.Fatal(err)
+	}
+	log, err := storage.OpenLog(dir, storage.LogConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+
+	if earliest, latest := log.EarliestOffset(), log.LatestOffset(); earliest != 2 || latest != 12 {
+		t.Fatalf("offsets [%d, %d), want [2, 12)", earliest, latest)
+	}
+	messages, err := log.Read(2, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := compactedMessages()
+	if len(messages) != len(want) {
+		t.Fatalf("got %d messages, want %d", len(messages), len(want))
+	}
+	for i, message := range messages {
+		if message.Offset != want[i].Offset || string(message.Value) != string(want[i].Value) {
+			t.Fatalf("message %d is (%d, %q), want (%d, %q)", i, message.Offset, message.Value, want[i].Offset, want[i].Value)
+		}
+	}
+	offset, err := log.Append(&common.Message{Value: []byte("next")})
+	if err != nil || offset != 12 {
+		t.Fatalf("append after restore: got (%d, %v), want (12, nil)", offset, err)
+	}
+}
+
+func TestRestoreFileStoreKeepsOffsets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "topic-0.store")
+	// 单文件存储无法记住最后一条消息之后的下一个offset
+	if err := storage.RestoreFileStore(path, compactedMessages(), 2, 12); err == nil {
+		t.Fatal("restore with a gap at the end succeeded")
+	}
+	if err := storage.RestoreFileStore(path, compactedMessages(), 2, 10); err != nil {
+		t.Fatal(err)
+	}
+	store, err := storage.OpenFileStore(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if earliest, latest := store.EarliestOffset(), store.LatestOffset(); earliest != 2 || latest != 10 {
+		t.Fatalf("offsets [%d, %d), want [2, 10)", earliest, latest)
+	}
+	messages, err := store.Read(5, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[0].Offset != 7 || messages[1].Offset != 9 {
+		t.Fatalf("read from 5: got %d messages, want offsets 7 and 9", len(messages))
+	}
+}
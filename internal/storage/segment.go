@@ -0,0 +1,432 @@
+package storage
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/kafka-from-scratch/internal/common"
+	"github.com/kafka-from-scratch/internal/record"
+)
+
+const logFileSuffix = ".log"
+
+// Segment 分区日志中的一个分段，对应磁盘上一个以baseOffset命名的文件
+// 例如 00000000000000000100.log 里第一条消息的offset是100
+// 文件内容是首尾相接的RecordBatch（格式见record包），和网络上传输的字节完全一样
+type Segment struct {
+	baseOffset int64
+	nextOffset int64 // 下一条写入这个segment的消息的offset
+	size       int64
+	file       *os.File
+
+	index                    *offsetIndex
+	timeIndex                *timeIndex
+	indexIntervalBytes       int64
+	bytesSinceLastIndexEntry int64
+
+	// segment中最大的消息时间戳(Unix毫秒)以及它所在batch的最后一个offset，用于按时间查找
+	maxTimestamp         int64
+	offsetOfMaxTimestamp int64
+}
+
+// segmentFileName 用20位数字补零，保证按文件名排序就是按offset排序
+func segmentFileName(dir string, baseOffset int64, suffix string) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", baseOffset, suffix))
+}
+
+// parseSegmentBaseOffset 从文件名中解析baseOffset，不是segment文件时返回false
+func parseSegmentBaseOffset(name string) (int64, bool) {
+	if !strings.HasSuffix(name, logFileSuffix) {
+		return 0, false
+	}
+	baseOffset, err := strconv.ParseInt(strings.TrimSuffix(name, logFileSuffix), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return baseOffset, true
+}
+
+// openSegment 打开（不存在则创建）baseOffset对应的segment文件和索引文件
+func openSegment(dir string, baseOffset int64, indexIntervalBytes int64) (*Segment, error) {
+	file, err := os.OpenFile(segmentFileName(dir, baseOffset, logFileSuffix), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	index, err := openOffsetIndex(dir, baseOffset)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	timeIndex, err := openTimeIndex(dir, baseOffset)
+	if err != nil {
+		index.close()
+		file.Close()
+		return nil, err
+	}
+
+	return &Segment{
+		baseOffset:         baseOffset,
+		nextOffset:         baseOffset,
+		size:               info.Size(),
+		file:               file,
+		index:              index,
+		timeIndex:          timeIndex,
+		indexIntervalBytes: indexIntervalBytes,
+		maxTimestamp:       -1,
+	}, nil
+}
+
+// loadIndex 加载只读segment的offset索引和时间索引，任意一个缺失或损坏时扫描数据重建
+func (s *Segment) loadIndex() error {
+	err := s.index.load()
+	if err == nil {
+		err = s.index.sanityCheck(s.nextOffset, s.size)
+	}
+	if err == nil {
+		err = s.timeIndex.load()
+	}
+	if err == nil {
+		err = s.timeIndex.sanityCheck(s.nextOffset)
+	}
+	// 数据超过一个索引间隔就一定有offset索引项；只读segment滚动时一定写过最终的时间索引项
+	missing := (len(s.index.entries) == 0 && s.size > s.indexIntervalBytes) ||
+		(len(s.timeIndex.entries) == 0 && s.size > 0)
+	if err == nil && !missing {
+		return s.loadMaxTimestamp()
+	}
+
+	if err != nil {
+		fmt.Printf("⚠️ segment %d: rebuilding corrupt index: %v\n", s.baseOffset, err)
+	} else {
+		fmt.Printf("⚠️ segment %d: rebuilding missing index\n", s.baseOffset)
+	}
+	// 只读segment不会有写了一半的记录，如果扫描时发现坏数据，只建到坏数据之前，不截断
+	return s.rebuildIndex(false)
+}
+
+// loadMaxTimestamp 恢复segment的最大时间戳
+// 时间索引的最后一项之后可能还有更大的时间戳，从最后一个offset索引项开始扫描到末尾即可补齐
+func (s *Segment) loadMaxTimestamp() error {
+	if entry, ok := s.timeIndex.lastEntry(); ok {
+		s.maxTimestamp = entry.timestamp
+		s.offsetOfMaxTimestamp = entry.offset
+	}
+
+	position := s.index.lookup(s.nextOffset)
+	reader := bufio.NewReader(io.NewSectionReader(s.file, position, s.size-position))
+	for {
+		batch, err := readVerifiedBatch(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err == record.ErrIncompleteBatch || errors.Is(err, common.ErrCorruptMessage) {
+			// 坏数据留给读取时报错，这里不影响Broker启动
+			fmt.Printf("⚠️ segment %d: %v\n", s.baseOffset, err)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("load segment %d: %w", s.baseOffset, err)
+		}
+		s.updateMaxTimestamp(batch)
+	}
+}
+
+func (s *Segment) updateMaxTimestamp(batch record.Batch) {
+	if timestamp := batch.MaxTimestamp(); timestamp > s.maxTimestamp {
+		s.maxTimestamp = timestamp
+		s.offsetOfMaxTimestamp = batch.LastOffset()
+	}
+}
+
+// readVerifiedBatch 读取下一个batch并校验CRC
+func readVerifiedBatch(r io.Reader) (record.Batch, error) {
+	batch, err := record.ReadBatch(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := batch.Verify(); err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+// recover 扫描整个active segment，校验每个batch的CRC，算出nextOffset并重建索引
+// 从第一个写了一半或校验失败的batch开始截掉，后续追加才不会写在垃圾数据后面
+func (s *Segment) recover() error {
+	return s.rebuildIndex(true)
+}
+
+// rebuildIndex 从头扫描segment数据，重新生成索引，遇到第一个不完整或损坏的batch时停止
+// truncate为true时把这个batch及之后的数据全部截掉
+func (s *Segment) rebuildIndex(truncate bool) error {
+	if err := s.index.truncate(); err != nil {
+		return err
+	}
+	if err := s.timeIndex.truncate(); err != nil {
+		return err
+	}
+	s.bytesSinceLastIndexEntry = 0
+	s.maxTimestamp = -1
+
+	reader := bufio.NewReader(io.NewSectionReader(s.file, 0, s.size))
+
+	var validSize int64
+	nextOffset := s.baseOffset
+	for {
+		batch, err := readVerifiedBatch(reader)
+		if err == io.EOF {
+			break
+		}
+		if err == record.ErrIncompleteBatch || errors.Is(err, common.ErrCorruptMessage) {
+			fmt.Printf("⚠️ segment %d: bad batch at position %d: %v\n", s.baseOffset, validSize, err)
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("recover segment %d: %w", s.baseOffset, err)
+		}
+		if err := s.maybeIndex(batch, validSize); err != nil {
+			return err
+		}
+		validSize += int64(batch.Size())
+		nextOffset = batch.LastOffset() + 1
+	}
+
+	if truncate && validSize < s.size {
+		fmt.Printf("⚠️ segment %d: truncating %d bytes of incomplete or corrupt data\n", s.baseOffset, s.size-validSize)
+		if err := s.file.Truncate(validSize); err != nil {
+			return err
+		}
+		s.size = validSize
+	}
+	// compact之后只读segment末尾的offset可能被删掉了，它的nextOffset以下一个segment的baseOffset为准
+	if nextOffset > s.nextOffset {
+		s.nextOffset = nextOffset
+	}
+	return nil
+}
+
+// maybeIndex 距离上一个索引项写入的数据超过indexIntervalBytes时，为这个batch加一个offset索引项，
+// 同时把目前为止的最大时间戳写入时间索引。索引项指向batch的开头，key是batch的baseOffset
+func (s *Segment) maybeIndex(batch record.Batch, position int64) error {
+	s.updateMaxTimestamp(batch)
+	if s.bytesSinceLastIndexEntry > s.indexIntervalBytes {
+		if err := s.index.append(batch.BaseOffset(), position); err != nil {
+			return fmt.Errorf("append index of segment %d: %w", s.baseOffset, err)
+		}
+		if err := s.timeIndex.append(s.maxTimestamp, s.offsetOfMaxTimestamp); err != nil {
+			return fmt.Errorf("append time index of segment %d: %w", s.baseOffset, err)
+		}
+		s.bytesSinceLastIndexEntry = 0
+	}
+	s.bytesSinceLastIndexEntry += int64(batch.Size())
+	return nil
+}
+
+// onRoll segment变为只读时，把最终的最大时间戳写进时间索引
+func (s *Segment) onRoll() error {
+	if s.maxTimestamp < 0 {
+		return nil
+	}
+	return s.timeIndex.append(s.maxTimestamp, s.offsetOfMaxTimestamp)
+}
+
+// append 把已经分配好offset的batch原样追加到segment末尾
+func (s *Segment) append(batch record.Batch) error {
+	if err := s.maybeIndex(batch, s.size); err != nil {
+		return err
+	}
+	if _, err := s.file.WriteAt(batch, s.size); err != nil {
+		return err
+	}
+	s.size += int64(batch.Size())
+	s.nextOffset = batch.LastOffset() + 1
+	return nil
+}
+
+// read 从startOffset开始读取最多maxMessages条消息
+// 先通过稀疏索引定位到附近的位置，只需要扫描很少的batch
+func (s *Segment) read(startOffset int64, maxMessages int) ([]*common.Message, error) {
+	messages := make([]*common.Message, 0)
+	err := s.forEachBatchFrom(startOffset, func(batch record.Batch) (bool, error) {
+		var err error
+		messages, err = appendMessages(messages, batch, startOffset, maxMessages)
+		return len(messages) < maxMessages, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// appendMessages 把batch中offset >= startOffset的消息追加到messages，总数不超过maxMessages
+func appendMessages(messages []*common.Message, batch record.Batch, startOffset int64, maxMessages int) ([]*common.Message, error) {
+	if batch.LastOffset() < startOffset {
+		return messages, nil
+	}
+	batchMessages, err := batch.Messages()
+	if err != nil {
+		return messages, err
+	}
+	for _, message := range batchMessages {
+		if message.Offset >= startOffset && len(messages) < maxMessages {
+			messages = append(messages, message)
+		}
+	}
+	return messages, nil
+}
+
+// batchRange 找到从包含startOffset的batch开始、至少覆盖maxMessages条消息的batch在文件中的范围[start, end)，
+// 以及其中offset >= startOffset的消息数
+// 只读取每个batch的头部，跳过整个batch时不需要读它的内容
+// compact过的batch中offset不连续，这时按offset范围估算的消息数会偏多，只影响一次返回多少数据
+func (s *Segment) batchRange(startOffset int64, maxMessages int) (int64, int64, int, error) {
+	position := s.index.lookup(startOffset)
+	start := int64(-1)
+	count := 0
+	var header [record.BatchHeaderSize]byte
+	for position < s.size && count < maxMessages {
+		if _, err := s.file.ReadAt(header[:], position); err != nil {
+			return 0, 0, 0, fmt.Errorf("read segment %d at position %d: %w", s.baseOffset, position, err)
+		}
+		batch := record.Batch(header[:])
+		size, err := record.BatchSize(batch)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("read segment %d at position %d: %w", s.baseOffset, position, err)
+		}
+		if lastOffset := batch.LastOffset(); lastOffset >= startOffset {
+			if start < 0 {
+				start = position
+			}
+			firstOffset := batch.BaseOffset()
+			if firstOffset < startOffset {
+				firstOffset = startOffset
+			}
+			count += int(lastOffset - firstOffset + 1)
+		}
+		position += int64(size)
+	}
+	if start < 0 {
+		return position, position, 0, nil
+	}
+	return start, position, count, nil
+}
+
+// forEachBatchFrom 从索引中startOffset附近的位置开始，按顺序遍历校验过的batch，fn返回false时停止
+func (s *Segment) forEachBatchFrom(startOffset int64, fn func(batch record.Batch) (bool, error)) error {
+	position := s.index.lookup(startOffset)
+	reader := bufio.NewReader(io.NewSectionReader(s.file, position, s.size-position))
+	for {
+		batch, err := readVerifiedBatch(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read segment %d: %w", s.baseOffset, err)
+		}
+		more, err := fn(batch)
+		if err != nil {
+			return fmt.Errorf("read segment %d: %w", s.baseOffset, err)
+		}
+		if !more {
+			return nil
+		}
+	}
+}
+
+// forEachBatch 按顺序遍历segment中的每一个batch
+func (s *Segment) forEachBatch(fn func(batch record.Batch) error) error {
+	return s.forEachBatchFrom(s.baseOffset, func(batch record.Batch) (bool, error) {
+		return true, fn(batch)
+	})
+}
+
+// forEach 按顺序遍历segment中的每一条消息
+func (s *Segment) forEach(fn func(message *common.Message) error) error {
+	return s.forEachBatch(func(batch record.Batch) error {
+		messages, err := batch.Messages()
+		if err != nil {
+			return err
+		}
+		for _, message := range messages {
+			if err := fn(message); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// findOffsetByTimestamp 返回segment中offset >= minOffset、时间戳 >= timestamp(Unix毫秒) 的第一条消息的offset
+// 没有这样的消息时返回nextOffset
+func (s *Segment) findOffsetByTimestamp(timestamp, minOffset int64) (int64, error) {
+	startOffset := max(s.timeIndex.lookup(timestamp), minOffset)
+	offset := s.nextOffset
+	err := s.forEachBatchFrom(startOffset, func(batch record.Batch) (bool, error) {
+		found, ok, err := offsetForTimestampInBatch(batch, startOffset, timestamp)
+		if ok {
+			offset = found
+		}
+		return !ok && err == nil, err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
+
+// offsetForTimestampInBatch 在batch中找第一条offset >= startOffset且时间戳 >= timestamp的消息
+func offsetForTimestampInBatch(batch record.Batch, startOffset, timestamp int64) (int64, bool, error) {
+	// batch头部有最大时间戳，整个batch都早于timestamp时不需要解码
+	if batch.LastOffset() < startOffset || batch.MaxTimestamp() < timestamp {
+		return 0, false, nil
+	}
+	messages, err := batch.Messages()
+	if err != nil {
+		return 0, false, err
+	}
+	for _, message := range messages {
+		if message.Offset >= startOffset && message.Timestamp.UnixMilli() >= timestamp {
+			return message.Offset, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// remove 关闭并删除segment的数据文件和索引文件
+func (s *Segment) remove() error {
+	if err := s.close(); err != nil {
+		return err
+	}
+	for _, path := range []string{s.file.Name(), s.index.file.Name(), s.timeIndex.file.Name()} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Segment) close() error {
+	timeIndexErr := s.timeIndex.close()
+	indexErr := s.index.close()
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	if indexErr != nil {
+		return indexErr
+	}
+	return timeIndexErr
+}
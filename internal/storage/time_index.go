@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+)
+
+const (
+	timeIndexFileSuffix = ".timeindex"
+
+	// timeIndexEntrySize 每个时间索引项: 时间戳 int64(Unix毫秒) | 相对offset uint32
+	timeIndexEntrySize = 12
+)
+
+// timeIndexEntry 表示截止到offset这条记录，segment中出现过的最大时间戳是timestamp
+// 记录的是"最大时间戳"而不是每条记录自己的时间戳，所以即使消息时间戳乱序，索引也是单调递增的
+type timeIndexEntry struct {
+	timestamp int64
+	offset    int64
+}
+
+// timeIndex segment的稀疏时间索引，和offsetIndex同时写入
+type timeIndex struct {
+	baseOffset int64
+	entries    []timeIndexEntry
+	file       *os.File
+}
+
+// openTimeIndex 打开segment对应的时间索引文件，文件不存在时创建一个空索引
+// 索引内容需要再调用load加载
+func openTimeIndex(dir string, baseOffset int64) (*timeIndex, error) {
+	path := segmentFileName(dir, baseOffset, timeIndexFileSuffix)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &timeIndex{
+		baseOffset: baseOffset,
+		entries:    make([]timeIndexEntry, 0),
+		file:       file,
+	}, nil
+}
+
+func (idx *timeIndex) load() error {
+	data, err := os.ReadFile(idx.file.Name())
+	if err != nil {
+		return err
+	}
+	return idx.parse(data)
+}
+
+// parse 解析时间索引文件的内容，远程存储中的索引也用它解析
+func (idx *timeIndex) parse(data []byte) error {
+	for pos := 0; pos+timeIndexEntrySize <= len(data); pos += timeIndexEntrySize {
+		idx.entries = append(idx.entries, timeIndexEntry{
+			timestamp: int64(binary.BigEndian.Uint64(data[pos:])),
+			offset:    idx.baseOffset + int64(binary.BigEndian.Uint32(data[pos+8:])),
+		})
+	}
+	if len(data)%timeIndexEntrySize != 0 {
+		return fmt.Errorf("time index file size %d is not a multiple of %d", len(data), timeIndexEntrySize)
+	}
+	return nil
+}
+
+// sanityCheck 时间戳必须严格递增，offset必须递增且落在segment范围内
+func (idx *timeIndex) sanityCheck(nextOffset int64) error {
+	for i, entry := range idx.entries {
+		if entry.offset < idx.baseOffset || entry.offset >= nextOffset {
+			return fmt.Errorf("time index entry %d (offset %d) out of range", i, entry.offset)
+		}
+		if i > 0 && (entry.timestamp <= idx.entries[i-1].timestamp || entry.offset < idx.entries[i-1].offset) {
+			return fmt.Errorf("time index entry %d is not increasing", i)
+		}
+	}
+	return nil
+}
+
+// append 追加一个索引项，时间戳不大于最后一项时忽略
+func (idx *timeIndex) append(timestamp, offset int64) error {
+	if n := len(idx.entries); n > 0 && timestamp <= idx.entries[n-1].timestamp {
+		return nil
+	}
+
+	var buf [timeIndexEntrySize]byte
+	binary.BigEndian.PutUint64(buf[0:], uint64(timestamp))
+	binary.BigEndian.PutUint32(buf[8:], uint32(offset-idx.baseOffset))
+	if _, err := idx.file.WriteAt(buf[:], int64(len(idx.entries))*timeIndexEntrySize); err != nil {
+		return err
+	}
+	idx.entries = append(idx.entries, timeIndexEntry{timestamp: timestamp, offset: offset})
+	return nil
+}
+
+// lookup 返回一个起始offset，从这里往后扫描一定能找到第一条时间戳 >= timestamp 的记录
+// 也就是最大时间戳仍小于timestamp的最后一个索引项的offset
+func (idx *timeIndex) lookup(timestamp int64) int64 {
+	i := sort.Search(len(idx.entries), func(i int) bool {
+		return idx.entries[i].timestamp >= timestamp
+	})
+	if i == 0 {
+		return idx.baseOffset
+	}
+	return idx.entries[i-1].offset
+}
+
+func (idx *timeIndex) lastEntry() (timeIndexEntry, bool) {
+	if len(idx.entries) == 0 {
+		return timeIndexEntry{}, false
+	}
+	return idx.entries[len(idx.entries)-1], true
+}
+
+func (idx *timeIndex) truncate() error {
+	idx.entries = idx.entries[:0]
+	return idx.file.Truncate(0)
+}
+
+func (idx *timeIndex) close() error {
+	return idx.file.Close()
+}
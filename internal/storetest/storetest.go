@@ -0,0 +1,587 @@
+// Package storetest 是common.PartitionStore的一致性测试，每种存储引擎都必须全部通过
+// 每个引擎在自己包的_test.go中调用Run
+package storetest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kafka-from-scratch/internal/common"
+)
+
+// Engine 被测试的存储引擎
+type Engine struct {
+	// Open 在dir中创建或打开一个分区，dir是每个测试用例独占的空目录
+	Open func(dir string) (common.PartitionStore, error)
+
+	// Persistent Close之后用同一个dir再Open，数据和offset是否还在
+	Persistent bool
+}
+
+type testCase struct {
+	name       string
+	persistent bool // 只对Persistent的引擎运行
+	run        func(e Engine, dir string) error
+}
+
+var cases = []testCase{
+	{name: "empty store", run: testEmpty},
+	{name: "append assigns consecutive offsets", run: testAppendOffsets},
+	{name: "read ranges", run: testReadRanges},
+	{name: "message fields round trip", run: testRoundTrip},
+	{name: "delete records before offset", run: testDeleteRecords},
+	{name: "delete all records", run: testDeleteAll},
+	{name: "concurrent appends", run: testConcurrentAppends},
+	{name: "appended wakes waiters", run: testAppended},
+	{name: "reopen keeps data and offsets", persistent: true, run: testReopen},
+	{name: "reopen after delete records", persistent: true, run: testReopenAfterDelete},
+}
+
+// Run 对引擎运行所有测试用例，每个用例是一个子测试，使用单独的t.TempDir()
+func Run(t *testing.T, e Engine) {
+	for _, c := range cases {
+		if c.persistent && !e.Persistent {
+			continue
+		}
+		t.Run(c.name, func(t *testing.T) {
+			if err := c.run(e, t.TempDir()); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// open 打开分区，测试结束时由调用方Close
+func open(e Engine, dir string) (common.PartitionStore, error) {
+	store, err := e.Open(dir)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+	return store, nil
+}
+
+func testEmpty(e Engine, dir string) error {
+	store, err := open(e, dir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if err := checkOffsets(store, 0, 0); err != nil {
+		return err
+	}
+	messages, err := store.Read(0, 10)
+	if err != nil {
+		return fmt.Errorf("read empty store: %w", err)
+	}
+	if len(messages) != 0 {
+		return fmt.Errorf("read empty store: got %d messages, want 0", len(messages))
+	}
+	offset, err := store.Append()
+	if err != nil || offset != 0 {
+		return fmt.Errorf("append nothing: got (%d, %v), want (0, nil)", offset, err)
+	}
+	return checkOffsets(store, 0, 0)
+}
+
+func testAppendOffsets(e Engine, dir string) error {
+	store, err := open(e, dir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	first := newMessage(0)
+	offset, err := store.Append(first)
+	if err != nil {
+		return fmt.Errorf("append: %w", err)
+	}
+	if offset != 0 || first.Offset != 0 {
+		return fmt.Errorf("first append: returned offset %d, message offset %d, want 0", offset, first.Offset)
+	}
+
+	batch := []*common.Message{newMessage(1), newMessage(2), newMessage(3)}
+	offset, err = store.Append(batch...)
+	if err != nil {
+		return fmt.Errorf("append batch: %w", err)
+	}
+	if offset != 1 {
+		return fmt.Errorf("append batch: returned offset %d, want 1", offset)
+	}
+	for i, message := range batch {
+		if message.Offset != int64(i+1) {
+			return fmt.Errorf("append batch: message %d has offset %d, want %d", i, message.Offset, i+1)
+		}
+	}
+	return checkOffsets(store, 0, 4)
+}
+
+func testReadRanges(e Engine, dir string) error {
+	store, err := open(e, dir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	// 单条和多条混着写，引擎内部的batch边界不能影响读取结果
+	if err := appendMessages(store, 0, 10, 1); err != nil {
+		return err
+	}
+	if err := appendMessages(store, 10, 30, 7); err != nil {
+		return err
+	}
+
+	for _, r := range []struct {
+		offset int64
+		max    int
+		want   int
+	}{
+		{0, 5, 5},
+		{0, 100, 30},
+		{3, 4, 4},
+		{9, 3, 3},   // 跨过单条和批量写入的边界
+		{12, 2, 2},  // 从batch中间开始
+		{25, 10, 5}, // 读到末尾
+		{29, 1, 1},
+		{30, 10, 0}, // 最新offset
+		{5, 0, 0},
+	} {
+		messages, err := store.Read(r.offset, r.max)
+		if err != nil {
+			return fmt.Errorf("read(%d, %d): %w", r.offset, r.max, err)
+		}
+		if len(messages) != r.want {
+			return fmt.Errorf("read(%d, %d): got %d messages, want %d", r.offset, r.max, len(messages), r.want)
+		}
+		for i, message := range messages {
+			if err := checkMessage(message, r.offset+int64(i)); err != nil {
+				return fmt.Errorf("read(%d, %d): %w", r.offset, r.max, err)
+			}
+		}
+	}
+	return nil
+}
+
+func testRoundTrip(e Engine, dir string) error {
+	store, err := open(e, dir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	timestamp := time.UnixMilli(1714557600123)
+	want := []*common.Message{
+		{Key: []byte("key"), Value: []byte("value"), Headers: map[string][]byte{"h1": []byte("v1"), "h2": {}, "h3": nil, "h\xff": {0, 0xff}}, Timestamp: timestamp},
+		{Key: nil, Value: []byte("no key"), Timestamp: timestamp.Add(time.Second)},
+		{Key: []byte("tombstone"), Value: nil, Timestamp: timestamp.Add(2 * time.Second)},
+		{Key: []byte{}, Value: []byte{}, Timestamp: timestamp.Add(-time.Hour)}, // 时间戳可以乱序
+		{Key: []byte{0, 1, 2, 0xff}, Value: bytes.Repeat([]byte{0xfe}, 4096), Timestamp: timestamp},
+	}
+	// 引擎可以保存消息本身也可以保存编码后的数据，比较时用一份副本
+	appended := make([]*common.Message, len(want))
+	for i, message := range want {
+		copied := *message
+		appended[i] = &copied
+	}
+	if _, err := store.Append(appended...); err != nil {
+		return fmt.Errorf("append: %w", err)
+	}
+
+	got, err := store.Read(0, len(want))
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+	if len(got) != len(want) {
+		return fmt.Errorf("read: got %d messages, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if err := sameMessage(got[i], want[i]); err != nil {
+			return fmt.Errorf("message %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func testDeleteRecords(e Engine, dir string) error {
+	store, err := open(e, dir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if err := appendMessages(store, 0, 20, 4); err != nil {
+		return err
+	}
+
+	// 删除6之前的消息，log start offset可以落在引擎内部的batch中间
+	if start, err := store.DeleteRecordsBefore(6); err != nil || start != 6 {
+		return fmt.Errorf("delete records before 6: got (%d, %v), want (6, nil)", start, err)
+	}
+	if err := checkOffsets(store, 6, 20); err != nil {
+		return err
+	}
+	if _, err := store.Read(5, 10); !errors.Is(err, common.ErrOffsetOutOfRange) {
+		return fmt.Errorf("read before log start offset: got %v, want ErrOffsetOutOfRange", err)
+	}
+	messages, err := store.Read(6, 100)
+	if err != nil {
+		return fmt.Errorf("read from log start offset: %w", err)
+	}
+	if len(messages) != 14 {
+		return fmt.Errorf("read from log start offset: got %d messages, want 14", len(messages))
+	}
+	for i, message := range messages {
+		if err := checkMessage(message, int64(6+i)); err != nil {
+			return err
+		}
+	}
+
+	// 不能往回删，也不能删到最新offset之后
+	if start, err := store.DeleteRecordsBefore(3); err != nil || start != 6 {
+		return fmt.Errorf("delete records before 3: got (%d, %v), want (6, nil)", start, err)
+	}
+	if _, err := store.DeleteRecordsBefore(-1); !errors.Is(err, common.ErrOffsetOutOfRange) {
+		return fmt.Errorf("delete records before -1: got %v, want ErrOffsetOutOfRange", err)
+	}
+	if _, err := store.DeleteRecordsBefore(21); !errors.Is(err, common.ErrOffsetOutOfRange) {
+		return fmt.Errorf("delete records before 21: got %v, want ErrOffsetOutOfRange", err)
+	}
+	if err := checkOffsets(store, 6, 20); err != nil {
+		return err
+	}
+
+	// 删除之后继续追加，offset不受影响
+	offset, err := store.Append(newMessage(20))
+	if err != nil || offset != 20 {
+		return fmt.Errorf("append after delete: got (%d, %v), want (20, nil)", offset, err)
+	}
+	return checkOffsets(store, 6, 21)
+}
+
+func testDeleteAll(e Engine, dir string) error {
+	store, err := open(e, dir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if err := appendMessages(store, 0, 10, 3); err != nil {
+		return err
+	}
+	if start, err := store.DeleteRecordsBefore(10); err != nil || start != 10 {
+		return fmt.Errorf("delete records before 10: got (%d, %v), want (10, nil)", start, err)
+	}
+	if err := checkOffsets(store, 10, 10); err != nil {
+		return err
+	}
+	messages, err := store.Read(10, 10)
+	if err != nil || len(messages) != 0 {
+		return fmt.Errorf("read emptied store: got (%d messages, %v), want (0, nil)", len(messages), err)
+	}
+
+	if err := appendMessages(store, 10, 15, 2); err != nil {
+		return err
+	}
+	messages, err = store.Read(10, 10)
+	if err != nil {
+		return fmt.Errorf("read after append: %w", err)
+	}
+	if len(messages) != 5 {
+		return fmt.Errorf("read after append: got %d messages, want 5", len(messages))
+	}
+	return checkOffsets(store, 10, 15)
+}
+
+func testConcurrentAppends(e Engine, dir string) error {
+	store, err := open(e, dir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	const writers, perWriter = 8, 50
+	values := make([]map[int64]string, writers)
+	errs := make(chan error, writers)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		values[w] = make(map[int64]string)
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				value := fmt.Sprintf("writer-%d-%d", w, i)
+				message := &common.Message{Key: []byte(value), Value: []byte(value), Timestamp: time.Now()}
+				offset, err := store.Append(message)
+				if err != nil {
+					errs <- fmt.Errorf("writer %d: %w", w, err)
+					return
+				}
+				values[w][offset] = value
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return err
+	}
+
+	if err := checkOffsets(store, 0, writers*perWriter); err != nil {
+		return err
+	}
+	messages, err := store.Read(0, writers*perWriter)
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+	if len(messages) != writers*perWriter {
+		return fmt.Errorf("read: got %d messages, want %d", len(messages), writers*perWriter)
+	}
+	byOffset := make(map[int64]string, len(messages))
+	for i, message := range messages {
+		if message.Offset != int64(i) {
+			return fmt.Errorf("message %d has offset %d", i, message.Offset)
+		}
+		byOffset[message.Offset] = string(message.Value)
+	}
+	// 每个writer拿到的offset必须正好是它写入的那条消息
+	for w := range values {
+		for offset, value := range values[w] {
+			if byOffset[offset] != value {
+				return fmt.Errorf("offset %d: got %q, want %q", offset, byOffset[offset], value)
+			}
+		}
+	}
+	return nil
+}
+
+func testAppended(e Engine, dir string) error {
+	store, err := open(e, dir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	before := store.Appended()
+	if _, err := store.Append(); err != nil {
+		return fmt.Errorf("append nothing: %w", err)
+	}
+	if _, err := store.DeleteRecordsBefore(0); err != nil {
+		return fmt.Errorf("delete records: %w", err)
+	}
+	select {
+	case <-before:
+		return fmt.Errorf("appended closed without new messages")
+	default:
+	}
+
+	// 等待者在另一个goroutine中，追加之后读到的必须是新消息
+	read := make(chan error, 1)
+	go func() {
+		<-before
+		messages, err := store.Read(0, 10)
+		if err == nil && len(messages) != 2 {
+			err = fmt.Errorf("got %d messages after wakeup, want 2", len(messages))
+		}
+		read <- err
+	}()
+	if err := appendMessages(store, 0, 2, 2); err != nil {
+		return err
+	}
+	select {
+	case err := <-read:
+		if err != nil {
+			return fmt.Errorf("read after wakeup: %w", err)
+		}
+	case <-time.After(5 * time.Second):
+		return fmt.Errorf("appended not closed after append")
+	}
+
+	// 关闭过的channel不会再用，之后等待的要等下一次追加
+	after := store.Appended()
+	select {
+	case <-after:
+		return fmt.Errorf("new appended channel already closed")
+	default:
+	}
+	if err := appendMessages(store, 2, 3, 1); err != nil {
+		return err
+	}
+	select {
+	case <-after:
+	default:
+		return fmt.Errorf("appended not closed after second append")
+	}
+	return nil
+}
+
+func testReopen(e Engine, dir string) error {
+	store, err := open(e, dir)
+	if err != nil {
+		return err
+	}
+	if err := appendMessages(store, 0, 25, 5); err != nil {
+		store.Close()
+		return err
+	}
+	if err := store.Close(); err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+
+	store, err = open(e, dir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if err := checkOffsets(store, 0, 25); err != nil {
+		return err
+	}
+	messages, err := store.Read(0, 100)
+	if err != nil {
+		return fmt.Errorf("read after reopen: %w", err)
+	}
+	if len(messages) != 25 {
+		return fmt.Errorf("read after reopen: got %d messages, want 25", len(messages))
+	}
+	for i, message := range messages {
+		if err := checkMessage(message, int64(i)); err != nil {
+			return err
+		}
+	}
+	offset, err := store.Append(newMessage(25))
+	if err != nil || offset != 25 {
+		return fmt.Errorf("append after reopen: got (%d, %v), want (25, nil)", offset, err)
+	}
+	return nil
+}
+
+func testReopenAfterDelete(e Engine, dir string) error {
+	store, err := open(e, dir)
+	if err != nil {
+		return err
+	}
+	if err := appendMessages(store, 0, 12, 4); err != nil {
+		store.Close()
+		return err
+	}
+	if _, err := store.DeleteRecordsBefore(7); err != nil {
+		store.Close()
+		return fmt.Errorf("delete records before 7: %w", err)
+	}
+	if err := store.Close(); err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+
+	store, err = open(e, dir)
+	if err != nil {
+		return err
+	}
+	if err := checkOffsets(store, 7, 12); err != nil {
+		store.Close()
+		return fmt.Errorf("after reopen: %w", err)
+	}
+	if _, err := store.Read(6, 10); !errors.Is(err, common.ErrOffsetOutOfRange) {
+		store.Close()
+		return fmt.Errorf("read deleted offset after reopen: got %v, want ErrOffsetOutOfRange", err)
+	}
+
+	// 删除到最新offset之后再重启，新消息仍然从原来的offset继续
+	if _, err := store.DeleteRecordsBefore(12); err != nil {
+		store.Close()
+		return fmt.Errorf("delete records before 12: %w", err)
+	}
+	if err := store.Close(); err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+	store, err = open(e, dir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if err := checkOffsets(store, 12, 12); err != nil {
+		return fmt.Errorf("after deleting everything and reopening: %w", err)
+	}
+	offset, err := store.Append(newMessage(12))
+	if err != nil || offset != 12 {
+		return fmt.Errorf("append after reopen: got (%d, %v), want (12, nil)", offset, err)
+	}
+	return nil
+}
+
+// newMessage 内容由offset决定的消息，checkMessage据此检查读到的消息
+func newMessage(offset int64) *common.Message {
+	return &common.Message{
+		Key:       []byte(fmt.Sprintf("key-%d", offset)),
+		Value:     []byte(fmt.Sprintf("value-%d", offset)),
+		Headers:   map[string][]byte{"offset": []byte(fmt.Sprint(offset))},
+		Timestamp: time.UnixMilli(1714557600000 + offset),
+	}
+}
+
+// appendMessages 追加offset在[from, to)中的消息，每次追加batchSize条
+func appendMessages(store common.PartitionStore, from, to int64, batchSize int) error {
+	for from < to {
+		n := min(int64(batchSize), to-from)
+		batch := make([]*common.Message, n)
+		for i := range batch {
+			batch[i] = newMessage(from + int64(i))
+		}
+		offset, err := store.Append(batch...)
+		if err != nil {
+			return fmt.Errorf("append at %d: %w", from, err)
+		}
+		if offset != from {
+			return fmt.Errorf("append: got offset %d, want %d", offset, from)
+		}
+		from += n
+	}
+	return nil
+}
+
+func checkMessage(message *common.Message, offset int64) error {
+	if message.Offset != offset {
+		return fmt.Errorf("got message at offset %d, want %d", message.Offset, offset)
+	}
+	want := newMessage(offset)
+	want.Offset = offset
+	return sameMessage(message, want)
+}
+
+func checkOffsets(store common.PartitionStore, earliest, latest int64) error {
+	if got := store.EarliestOffset(); got != earliest {
+		return fmt.Errorf("earliest offset is %d, want %d", got, earliest)
+	}
+	if got := store.LatestOffset(); got != latest {
+		return fmt.Errorf("latest offset is %d, want %d", got, latest)
+	}
+	return nil
+}
+
+// sameMessage 比较key、value、headers和毫秒精度的时间戳，nil和空的[]byte{}要区分开
+func sameMessage(got, want *common.Message) error {
+	if !sameBytes(got.Key, want.Key) {
+		return fmt.Errorf("key: got %q (nil=%t), want %q (nil=%t)", got.Key, got.Key == nil, want.Key, want.Key == nil)
+	}
+	if !sameBytes(got.Value, want.Value) {
+		return fmt.Errorf("value: got %d bytes (nil=%t), want %d bytes (nil=%t)", len(got.Value), got.Value == nil, len(want.Value), want.Value == nil)
+	}
+	if len(got.Headers) != len(want.Headers) {
+		return fmt.Errorf("headers: got %v, want %v", got.Headers, want.Headers)
+	}
+	for k, v := range want.Headers {
+		if gv, ok := got.Headers[k]; !ok || !sameBytes(gv, v) {
+			return fmt.Errorf("header %q: got %q (nil=%t), want %q (nil=%t)", k, gv, gv == nil, v, v == nil)
+		}
+	}
+	if got.Timestamp.UnixMilli() != want.Timestamp.UnixMilli() {
+		return fmt.Errorf("timestamp: got %d, want %d", got.Timestamp.UnixMilli(), want.Timestamp.UnixMilli())
+	}
+	return nil
+}
+
+func sameBytes(a, b []byte) bool {
+	return (a == nil) == (b == nil) && bytes.Equal(a, b)
+}
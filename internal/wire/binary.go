@@ -0,0 +1,272 @@
+package wire
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// binary codec按结构体字段的定义顺序依次编码，没有字段名，整数都是大端:
+//
+//	bool, int8:        1字节
+//	int16/int32/int64: 2/4/8字节，int按int64编码
+//	string:            int32长度 + UTF-8字节
+//	[]byte:            int32长度 + 字节，nil的长度是-1
+//	[]T:               int32元素个数 + 每个元素，nil的个数是-1
+//	map[string]T:      int32元素个数 + 按key排序的key、value，nil的个数是-1
+//	struct:            每个导出字段
+//
+// 所以给请求或响应的结构体加字段只能加在最后，并且要提升API version，新字段用 `since:"版本"` 标出，
+// 按更早的版本编码时跳过这个字段，解码时保持零值
+
+// appendValue 把v按binary codec的version版本编码追加到buf
+func appendValue(buf []byte, v reflect.Value, version int16) ([]byte, error) {
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return append(buf, 1), nil
+		}
+		return append(buf, 0), nil
+	case reflect.Int8:
+		return append(buf, byte(v.Int())), nil
+	case reflect.Int16:
+		return binary.BigEndian.AppendUint16(buf, uint16(v.Int())), nil
+	case reflect.Int32:
+		return binary.BigEndian.AppendUint32(buf, uint32(v.Int())), nil
+	case reflect.Int64, reflect.Int:
+		return binary.BigEndian.AppendUint64(buf, uint64(v.Int())), nil
+	case reflect.String:
+		buf, err := appendLength(buf, v.Len())
+		if err != nil {
+			return nil, err
+		}
+		return append(buf, v.String()...), nil
+	case reflect.Slice:
+		if v.IsNil() {
+			return appendLength(buf, -1)
+		}
+		buf, err := appendLength(buf, v.Len())
+		if err != nil {
+			return nil, err
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return append(buf, v.Bytes()...), nil
+		}
+		for i := 0; i < v.Len(); i++ {
+			if buf, err = appendValue(buf, v.Index(i), version); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("unsupported map key type %s", v.Type().Key())
+		}
+		if v.IsNil() {
+			return appendLength(buf, -1)
+		}
+		buf, err := appendLength(buf, v.Len())
+		if err != nil {
+			return nil, err
+		}
+		// key排序之后同样的内容总是编码成同样的字节
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		for _, key := range keys {
+			if buf, err = appendValue(buf, key, version); err != nil {
+				return nil, err
+			}
+			if buf, err = appendValue(buf, v.MapIndex(key), version); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			ok, err := fieldInVersion(v.Type().Field(i), version)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+			if buf, err = appendValue(buf, v.Field(i), version); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil, fmt.Errorf("cannot encode nil %s", v.Type())
+		}
+		return appendValue(buf, v.Elem(), version)
+	case reflect.Invalid:
+		return nil, fmt.Errorf("cannot encode nil")
+	default:
+		return nil, fmt.Errorf("unsupported type %s", v.Type())
+	}
+}
+
+// fieldInVersion 字段是否导出并且在这个版本中存在
+func fieldInVersion(field reflect.StructField, version int16) (bool, error) {
+	if !field.IsExported() {
+		return false, nil
+	}
+	tag, ok := field.Tag.Lookup("since")
+	if !ok {
+		return true, nil
+	}
+	since, err := strconv.ParseInt(tag, 10, 16)
+	if err != nil {
+		return false, fmt.Errorf("invalid since tag %q on field %s", tag, field.Name)
+	}
+	return version >= int16(since), nil
+}
+
+func appendLength(buf []byte, n int) ([]byte, error) {
+	if n > math.MaxInt32 {
+		return nil, fmt.Errorf("length %d exceeds %d", n, math.MaxInt32)
+	}
+	return binary.BigEndian.AppendUint32(buf, uint32(int32(n))), nil
+}
+
+// decoder 从一个完整的帧体中按binary codec的version版本解码
+type decoder struct {
+	buf     []byte
+	off     int
+	version int16
+}
+
+// next 返回接下来的n个字节，不够时返回ErrMalformedFrame
+func (d *decoder) next(n int) ([]byte, error) {
+	if n < 0 || n > len(d.buf)-d.off {
+		return nil, fmt.Errorf("%w: need %d bytes at offset %d, only %d left", ErrMalformedFrame, n, d.off, len(d.buf)-d.off)
+	}
+	b := d.buf[d.off : d.off+n]
+	d.off += n
+	return b, nil
+}
+
+// length 读取长度或元素个数，-1表示nil
+// 每个元素至少占一个字节，超过剩余字节数的长度一定是错的，避免按错误的长度分配内存
+func (d *decoder) length() (int, error) {
+	b, err := d.next(4)
+	if err != nil {
+		return 0, err
+	}
+	n := int(int32(binary.BigEndian.Uint32(b)))
+	if n < -1 || n > len(d.buf)-d.off {
+		return 0, fmt.Errorf("%w: invalid length %d at offset %d", ErrMalformedFrame, n, d.off-4)
+	}
+	return n, nil
+}
+
+// value 解码到v，v必须是可以设置的
+func (d *decoder) value(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Bool, reflect.Int8:
+		b, err := d.next(1)
+		if err != nil {
+			return err
+		}
+		if v.Kind() == reflect.Bool {
+			v.SetBool(b[0] != 0)
+		} else {
+			v.SetInt(int64(int8(b[0])))
+		}
+	case reflect.Int16:
+		b, err := d.next(2)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(int16(binary.BigEndian.Uint16(b))))
+	case reflect.Int32:
+		b, err := d.next(4)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(int32(binary.BigEndian.Uint32(b))))
+	case reflect.Int64, reflect.Int:
+		b, err := d.next(8)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(binary.BigEndian.Uint64(b)))
+	case reflect.String:
+		n, err := d.length()
+		if err != nil {
+			return err
+		}
+		b, err := d.next(n)
+		if err != nil {
+			return err
+		}
+		v.SetString(string(b))
+	case reflect.Slice:
+		n, err := d.length()
+		if err != nil || n < 0 {
+			return err
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b, err := d.next(n)
+			if err != nil {
+				return err
+			}
+			// 每个帧的缓冲区都是新分配的，直接引用，不用复制
+			v.SetBytes(b)
+			return nil
+		}
+		slice := reflect.MakeSlice(v.Type(), n, n)
+		for i := 0; i < n; i++ {
+			if err := d.value(slice.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("unsupported map key type %s", v.Type().Key())
+		}
+		n, err := d.length()
+		if err != nil || n < 0 {
+			return err
+		}
+		m := reflect.MakeMapWithSize(v.Type(), n)
+		for i := 0; i < n; i++ {
+			key := reflect.New(v.Type().Key()).Elem()
+			if err := d.value(key); err != nil {
+				return err
+			}
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := d.value(elem); err != nil {
+				return err
+			}
+			m.SetMapIndex(key, elem)
+		}
+		v.Set(m)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			ok, err := fieldInVersion(v.Type().Field(i), d.version)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			if err := d.value(v.Field(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.value(v.Elem())
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/kafka-from-scratch/internal/protocol"
+)
+
+// Codec 帧体的编码方式，客户端建立连接时选择，整个连接都使用同一种
+// 帧头和响应最后的batch数据不受影响，总是二进制的
+type Codec byte
+
+const (
+	// CodecBinary 默认的编码方式，见binary.go
+	CodecBinary Codec = 'B'
+
+	// CodecJSON 帧体是JSON，用来调试：抓包或者用nc就能直接看到请求和响应的内容
+	CodecJSON Codec = 'J'
+)
+
+func (c Codec) String() string {
+	switch c {
+	case CodecBinary:
+		return "binary"
+	case CodecJSON:
+		return "json"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(c))
+	}
+}
+
+// ParseCodec 解析命令行参数中的 "binary" 或 "json"
+func ParseCodec(name string) (Codec, error) {
+	switch name {
+	case "binary":
+		return CodecBinary, nil
+	case "json":
+		return CodecJSON, nil
+	default:
+		return 0, fmt.Errorf("unknown codec %q, expected binary or json", name)
+	}
+}
+
+// codec 编码和解码请求、响应的帧体
+// 请求和响应的Version就是帧头中的API version，按这个版本的格式编码和解码
+type codec interface {
+	appendRequest(buf []byte, request *protocol.Request) ([]byte, error)
+	decodeRequest(body []byte, request *protocol.Request, data interface{}) error
+
+	// appendResponse 不包括response.Records，由Conn在帧体之后单独发送
+	appendResponse(buf []byte, response *protocol.Response) ([]byte, error)
+
+	// decodeResponse 解码帧体，返回帧体的长度，帧中剩下的字节是Records
+	// Success为true时把Data解码到newData()返回的结构体中
+	decodeResponse(body []byte, response *protocol.Response, newData func() interface{}) (int, error)
+}
+
+// errUnknownAPIResponse 只有错误响应的API key可以是不认识的，见Conn.WriteResponse
+var errUnknownAPIResponse = fmt.Errorf("%w: success response for unknown API", ErrMalformedFrame)
+
+func codecFor(c Codec) codec {
+	switch c {
+	case CodecBinary:
+		return binaryCodec{}
+	case CodecJSON:
+		return jsonCodec{}
+	default:
+		return nil
+	}
+}
+
+// binaryCodec 请求的帧体就是请求结构体
+// 响应的帧体是 responseHeader，Success为true时后面再跟着响应结构体
+type binaryCodec struct{}
+
+// responseHeader 二进制响应帧体的开头
+type responseHeader struct {
+	Success   bool
+	ErrorCode protocol.ErrorCode `since:"1"`
+	Error     string
+}
+
+func (binaryCodec) appendRequest(buf []byte, request *protocol.Request) ([]byte, error) {
+	return appendValue(buf, reflect.ValueOf(request.Data), request.Version)
+}
+
+func (binaryCodec) decodeRequest(body []byte, request *protocol.Request, data interface{}) error {
+	d := &decoder{buf: body, version: request.Version}
+	if err := d.value(reflect.ValueOf(data)); err != nil {
+		return err
+	}
+	if d.off != len(body) {
+		return fmt.Errorf("%w: %d unexpected bytes after request body", ErrMalformedFrame, len(body)-d.off)
+	}
+	return nil
+}
+
+func (binaryCodec) appendResponse(buf []byte, response *protocol.Response) ([]byte, error) {
+	header := responseHeader{
+		Success:   response.Success,
+		ErrorCode: response.ErrorCode,
+		Error:     response.Error,
+	}
+	buf, err := appendValue(buf, reflect.ValueOf(header), response.Version)
+	if err != nil {
+		return nil, err
+	}
+	if !response.Success {
+		return buf, nil
+	}
+	return appendValue(buf, reflect.ValueOf(response.Data), response.Version)
+}
+
+func (binaryCodec) decodeResponse(body []byte, response *protocol.Response, newData func() interface{}) (int, error) {
+	d := &decoder{buf: body, version: response.Version}
+	var header responseHeader
+	if err := d.value(reflect.ValueOf(&header)); err != nil {
+		return 0, err
+	}
+	response.Success = header.Success
+	response.ErrorCode = header.ErrorCode
+	response.Error = header.Error
+	if response.Success {
+		if newData == nil {
+			return 0, errUnknownAPIResponse
+		}
+		data := newData()
+		if err := d.value(reflect.ValueOf(data)); err != nil {
+			return 0, err
+		}
+		response.Data = data
+	}
+	return d.off, nil
+}
+
+// jsonCodec 请求的帧体是请求结构体的JSON，响应的帧体是 {"success":...,"error":...,"data":...}
+// 新版本加的字段在老版本的对端那里会被忽略或者保持零值，不需要按版本处理
+type jsonCodec struct{}
+
+type jsonResponse struct {
+	Success   bool               `json:"success"`
+	ErrorCode protocol.ErrorCode `json:"error_code,omitempty"`
+	Error     string             `json:"error,omitempty"`
+	Data      interface{}        `json:"data,omitempty"`
+}
+
+func (jsonCodec) appendRequest(buf []byte, request *protocol.Request) ([]byte, error) {
+	body, err := json.Marshal(request.Data)
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, body...), nil
+}
+
+func (jsonCodec) decodeRequest(body []byte, request *protocol.Request, data interface{}) error {
+	if err := json.Unmarshal(body, data); err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedFrame, err)
+	}
+	return nil
+}
+
+func (jsonCodec) appendResponse(buf []byte, response *protocol.Response) ([]byte, error) {
+	body, err := json.Marshal(&jsonResponse{
+		Success:   response.Success,
+		ErrorCode: response.ErrorCode,
+		Error:     response.Error,
+		Data:      response.Data,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, body...), nil
+}
+
+func (jsonCodec) decodeResponse(body []byte, response *protocol.Response, newData func() interface{}) (int, error) {
+	// 帧体后面可能还有batch数据，json.Decoder只读一个JSON值，InputOffset就是帧体的长度
+	var resp jsonResponse
+	if newData != nil {
+		resp.Data = newData()
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	if err := decoder.Decode(&resp); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrMalformedFrame, err)
+	}
+	response.Success = resp.Success
+	response.ErrorCode = resp.ErrorCode
+	response.Error = resp.Error
+	if resp.Success {
+		if newData == nil {
+			return 0, errUnknownAPIResponse
+		}
+		// "data": null会把Data设置成nil
+		if resp.Data == nil {
+			return 0, fmt.Errorf("%w: success response without data", ErrMalformedFrame)
+		}
+		response.Data = resp.Data
+	}
+	return int(decoder.InputOffset()), nil
+}
@@ -0,0 +1,484 @@
+// Package wire 实现Broker和客户端之间的TCP协议，internal/server和pkg下的客户端共用
+//
+// 连接建立之后客户端先发送5字节的preface: "KFSW" + 1字节Codec，Broker支持这个Codec时原样回复，之后双方收发帧:
+//
+//	帧:   4字节长度(不包括这4个字节) | 2字节API key | 2字节API version | 4字节correlation ID | 帧体 | [Records]
+//
+// 整数都是大端。API key和每种请求支持的API version见protocol.APIs，响应的帧头和对应的请求相同，客户端用correlation ID对应请求和响应
+// 客户端不用等响应就可以发送下一个请求，Broker会并发处理互不影响的请求，响应的顺序和请求的顺序不一定相同
+// 客户端握手之后用NegotiateVersions发送API_VERSIONS，之后每种请求都用双方都支持的最高版本
+// 帧体按Codec编码；响应带Records时（CONSUME、SNAPSHOT）原始字节放在帧的最后，Broker可以用sendfile直接从文件发送
+package wire
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sync"
+
+	"github.com/kafka-from-scratch/internal/protocol"
+	"github.com/kafka-from-scratch/internal/record"
+)
+
+const prefaceMagic = "KFSW"
+
+// 帧头: 4字节长度、2字节API key、2字节API version、4字节correlation ID
+const (
+	lengthSize = 4
+	headerSize = 8
+)
+
+// DefaultMaxRequestBytes Broker默认接受的最大请求帧，和Kafka的socket.request.max.bytes一样是100MB
+const DefaultMaxRequestBytes = 100 << 20
+
+var (
+	// ErrMalformedFrame 帧体和帧头中的API对不上，或者长度不对
+	ErrMalformedFrame = errors.New("malformed frame")
+
+	// ErrUnknownAPI 帧头中的API key不认识
+	ErrUnknownAPI = errors.New("unknown API key")
+
+	// ErrFrameTooLarge 帧的长度超过了Conn.MaxFrameBytes
+	ErrFrameTooLarge = errors.New("frame too large")
+
+	// ErrUnsupportedVersion 对端不支持这个API version，或者协商时双方支持的版本没有交集
+	ErrUnsupportedVersion = errors.New("unsupported API version")
+)
+
+// Conn 一条已经完成握手的连接
+// ReadXxx只能在一个goroutine中调用，WriteXxx可以并发调用，每个帧都是完整地写出去的
+// 客户端用Send或RoundTrip发送请求，第一次发送时启动一个读goroutine，按correlation ID把响应交给等待的调用方，
+// 所以可以有很多请求同时在路上；用了Send或RoundTrip就不能再自己调用ReadResponse
+type Conn struct {
+	conn   net.Conn
+	reader *bufio.Reader // 整个连接共用一个reader，读多了的字节留给下一个帧
+	codec  codec
+	name   Codec
+
+	// MaxFrameBytes 读取时允许的最大帧长度（不包括长度字段），0表示不限制
+	// 超过时返回ErrFrameTooLarge，剩下的字节没有读，连接不能再用了
+	MaxFrameBytes int
+
+	writeMu sync.Mutex // 帧头、帧体和Records要连续写完，不能和其他帧交错
+
+	mu       sync.Mutex
+	nextID   int32
+	versions map[protocol.RequestType]int16 // NegotiateVersions协商好的版本，Send按这个版本发送
+	pending  map[int32]*Call                // 已经发送、还没有收到响应的请求
+	reading  bool                           // 读goroutine是否已经启动
+	readErr  error                          // 读goroutine退出的原因，之后的Send都返回这个错误
+}
+
+// Call 一个已经发送、正在等待响应的请求
+type Call struct {
+	Request *protocol.Request
+
+	done     chan struct{}
+	response *protocol.Response
+	err      error
+}
+
+// Done 收到响应或者连接断开时关闭
+func (call *Call) Done() <-chan struct{} {
+	return call.done
+}
+
+// Wait 等待响应，连接断开时返回错误
+func (call *Call) Wait() (*protocol.Response, error) {
+	<-call.done
+	return call.response, call.err
+}
+
+// NewConn 不经过握手直接使用conn，双方必须事先约定好Codec
+func NewConn(conn net.Conn, c Codec) *Conn {
+	return &Conn{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		codec:  codecFor(c),
+		name:   c,
+	}
+}
+
+// Dial 连接到Broker并协商Codec
+func Dial(address string, c Codec) (*Conn, error) {
+	if codecFor(c) == nil {
+		return nil, fmt.Errorf("unknown codec %s", c)
+	}
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	preface := append([]byte(prefaceMagic), byte(c))
+	reply := make([]byte, len(preface))
+	if _, err := conn.Write(preface); err == nil {
+		_, err = io.ReadFull(conn, reply)
+	}
+	if err != nil {
+		conn.Close()
+		// 只认识换行分隔JSON的老Broker读到preface会报错并断开连接
+		return nil, fmt.Errorf("handshake with %s failed, the broker may not support the framed protocol: %w", address, err)
+	}
+	if !bytes.Equal(reply, preface) {
+		conn.Close()
+		return nil, fmt.Errorf("broker %s does not support the %s codec", address, c)
+	}
+	return NewConn(conn, c), nil
+}
+
+// Accept 读取客户端的preface，Codec不支持时告诉客户端并返回错误，由调用方关闭连接
+func Accept(conn net.Conn) (*Conn, error) {
+	preface := make([]byte, len(prefaceMagic)+1)
+	if _, err := io.ReadFull(conn, preface); err != nil {
+		return nil, fmt.Errorf("failed to read preface: %w", err)
+	}
+	if string(preface[:len(prefaceMagic)]) != prefaceMagic {
+		return nil, fmt.Errorf("bad preface %q, the client may not support the framed protocol", preface)
+	}
+	c := Codec(preface[len(prefaceMagic)])
+	if codecFor(c) == nil {
+		conn.Write(append([]byte(prefaceMagic), 0))
+		return nil, fmt.Errorf("unknown codec %s", c)
+	}
+	if _, err := conn.Write(preface); err != nil {
+		return nil, err
+	}
+	return NewConn(conn, c), nil
+}
+
+// Codec 这条连接使用的Codec
+func (c *Conn) Codec() Codec {
+	return c.name
+}
+
+// RemoteAddr 对端地址
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Close 关闭连接，还在等待响应的请求返回net.ErrClosed
+func (c *Conn) Close() error {
+	c.fail(net.ErrClosed)
+	return c.conn.Close()
+}
+
+// readFrame 读取一个完整的帧，返回长度字段之后的全部字节
+func (c *Conn) readFrame() ([]byte, error) {
+	var size [lengthSize]byte
+	if _, err := io.ReadFull(c.reader, size[:]); err != nil {
+		return nil, err
+	}
+	n := int64(int32(binary.BigEndian.Uint32(size[:])))
+	if n < headerSize {
+		return nil, fmt.Errorf("%w: frame length %d", ErrMalformedFrame, n)
+	}
+	if c.MaxFrameBytes > 0 && n > int64(c.MaxFrameBytes) {
+		return nil, fmt.Errorf("%w: %d bytes exceeds %d", ErrFrameTooLarge, n, c.MaxFrameBytes)
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(c.reader, frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return frame, nil
+}
+
+// writeFrame 填上长度字段之后发送，extra是帧之后还要单独发送的字节数
+func (c *Conn) writeFrame(frame []byte, extra int64) error {
+	n := int64(len(frame)-lengthSize) + extra
+	if n > math.MaxInt32 {
+		return fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, n)
+	}
+	binary.BigEndian.PutUint32(frame, uint32(n))
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// newFrame 返回留好长度字段并写好帧头的缓冲区
+func newFrame(apiKey, apiVersion int16, correlationID int32) []byte {
+	frame := make([]byte, lengthSize, 256)
+	frame = binary.BigEndian.AppendUint16(frame, uint16(apiKey))
+	frame = binary.BigEndian.AppendUint16(frame, uint16(apiVersion))
+	return binary.BigEndian.AppendUint32(frame, uint32(correlationID))
+}
+
+// parseHeader 解析readFrame返回的帧的帧头
+func parseHeader(frame []byte) (apiKey, apiVersion int16, correlationID int32) {
+	return int16(binary.BigEndian.Uint16(frame[0:2])),
+		int16(binary.BigEndian.Uint16(frame[2:4])),
+		int32(binary.BigEndian.Uint32(frame[4:8]))
+}
+
+// WriteRequest 发送请求，request.Data必须是request.Type对应的请求结构体
+func (c *Conn) WriteRequest(request *protocol.Request) error {
+	frame, err := c.encodeRequest(request)
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.writeFrame(frame, 0)
+}
+
+// encodeRequest 编码失败时还没有写任何东西，连接可以继续用
+func (c *Conn) encodeRequest(request *protocol.Request) ([]byte, error) {
+	api := protocol.APIByType(request.Type)
+	if api == nil {
+		return nil, fmt.Errorf("unknown request type %s", request.Type)
+	}
+	frame, err := c.codec.appendRequest(newFrame(api.Key, request.Version, request.RequestID), request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s request: %w", request.Type, err)
+	}
+	return frame, nil
+}
+
+// ReadRequest 读取下一个请求
+// 帧读完了但是API key不认识或者帧体解码失败时，同时返回request和错误，request带有帧头中的信息，
+// 可以回复一个错误响应之后继续读下一个请求；返回的request为nil时连接不能再用了
+func (c *Conn) ReadRequest() (*protocol.Request, error) {
+	frame, err := c.readFrame()
+	if err != nil {
+		return nil, err
+	}
+	apiKey, apiVersion, correlationID := parseHeader(frame)
+	request := &protocol.Request{
+		Version:   apiVersion,
+		RequestID: correlationID,
+	}
+	api := protocol.APIByKey(apiKey)
+	if api == nil {
+		return request, fmt.Errorf("%w %d", ErrUnknownAPI, apiKey)
+	}
+	request.Type = api.Type
+	if apiVersion < api.MinVersion || apiVersion > api.MaxVersion {
+		return request, fmt.Errorf("%w %d for %s, supported versions are %d-%d", ErrUnsupportedVersion, apiVersion, api.Type, api.MinVersion, api.MaxVersion)
+	}
+
+	data := api.NewRequest()
+	if err := c.codec.decodeRequest(frame[headerSize:], request, data); err != nil {
+		return request, fmt.Errorf("failed to decode %s request: %w", api.Type, err)
+	}
+	request.Data = data
+	return request, nil
+}
+
+// WriteResponse 发送响应，response.Records紧跟在帧体之后直接写到连接上，不会被关闭
+// response.Type不认识时帧头中的API key是-1，只能用来回复错误
+func (c *Conn) WriteResponse(response *protocol.Response) error {
+	apiKey := int16(-1)
+	if api := protocol.APIByType(response.Type); api != nil {
+		apiKey = api.Key
+	} else if response.Success {
+		return fmt.Errorf("unknown response type %s", response.Type)
+	}
+	frame, err := c.codec.appendResponse(newFrame(apiKey, response.Version, response.RequestID), response)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s response: %w", response.Type, err)
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if response.Records == nil {
+		return c.writeFrame(frame, 0)
+	}
+	if err := c.writeFrame(frame, response.Records.Size()); err != nil {
+		return err
+	}
+	// c.conn是*net.TCPConn，数据在segment文件中时会用sendfile从文件直接发送到socket
+	_, err = response.Records.WriteTo(c.conn)
+	return err
+}
+
+// ReadResponse 读取下一个响应，帧体之后的字节放在response.Records中
+func (c *Conn) ReadResponse() (*protocol.Response, error) {
+	frame, err := c.readFrame()
+	if err != nil {
+		return nil, err
+	}
+	apiKey, apiVersion, correlationID := parseHeader(frame)
+	response := &protocol.Response{
+		Version:   apiVersion,
+		RequestID: correlationID,
+	}
+	var newData func() interface{}
+	if api := protocol.APIByKey(apiKey); api != nil {
+		response.Type = api.Type
+		newData = api.NewResponse
+	}
+
+	n, err := c.codec.decodeResponse(frame[headerSize:], response, newData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s response: %w", response.Type, err)
+	}
+	if records := frame[headerSize+n:]; len(records) > 0 {
+		response.Records = record.MemoryRecords(records)
+	}
+	return response, nil
+}
+
+// Send 给请求分配一个correlation ID并发送，不等待响应
+// 协商过版本时request.Version设置成协商好的版本，否则按request.Version发送
+// 可以在多个goroutine中同时调用；同一个goroutine先后Send的请求，Broker也按这个顺序收到
+func (c *Conn) Send(request *protocol.Request) (*Call, error) {
+	c.mu.Lock()
+	if c.readErr != nil {
+		c.mu.Unlock()
+		return nil, c.readErr
+	}
+	c.nextID++
+	request.RequestID = c.nextID
+	if version, ok := c.versions[request.Type]; ok {
+		request.Version = version
+	}
+	c.mu.Unlock()
+
+	frame, err := c.encodeRequest(request)
+	if err != nil {
+		return nil, err
+	}
+
+	call := &Call{Request: request, done: make(chan struct{})}
+	c.mu.Lock()
+	if c.readErr != nil {
+		c.mu.Unlock()
+		return nil, c.readErr
+	}
+	if c.pending == nil {
+		c.pending = make(map[int32]*Call)
+	}
+	// 先登记再发送，响应可能在writeFrame返回之前就到了
+	c.pending[request.RequestID] = call
+	if !c.reading {
+		c.reading = true
+		go c.readLoop()
+	}
+	c.mu.Unlock()
+
+	c.writeMu.Lock()
+	err = c.writeFrame(frame, 0)
+	c.writeMu.Unlock()
+	if err != nil {
+		// 帧可能只写了一部分，连接不能再用了，关闭之后读goroutine会让所有等待的请求失败
+		err = fmt.Errorf("failed to send request: %w", err)
+		c.fail(err)
+		c.conn.Close()
+		return nil, err
+	}
+	return call, nil
+}
+
+// RoundTrip 发送请求并等待对应的响应，见Send
+func (c *Conn) RoundTrip(request *protocol.Request) (*protocol.Response, error) {
+	call, err := c.Send(request)
+	if err != nil {
+		return nil, err
+	}
+	return call.Wait()
+}
+
+// readLoop 读取响应，按correlation ID交给Send返回的Call，连接出错或者被关闭时退出
+func (c *Conn) readLoop() {
+	for {
+		response, err := c.ReadResponse()
+		if err != nil {
+			c.fail(fmt.Errorf("failed to receive response: %w", err))
+			return
+		}
+
+		c.mu.Lock()
+		call := c.pending[response.RequestID]
+		delete(c.pending, response.RequestID)
+		c.mu.Unlock()
+		if call == nil {
+			c.fail(fmt.Errorf("%w: got response %d but no such request is waiting", ErrMalformedFrame, response.RequestID))
+			c.conn.Close()
+			return
+		}
+		call.response = response
+		close(call.done)
+	}
+}
+
+// fail 让所有等待中的请求返回err，之后的Send也返回第一次失败的原因
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	if c.readErr == nil {
+		c.readErr = err
+	}
+	pending := c.pending
+	c.pending = nil
+	c.mu.Unlock()
+
+	for _, call := range pending {
+		call.err = err
+		close(call.done)
+	}
+}
+
+// NegotiateVersions 发送API_VERSIONS，为双方都支持的每种请求选择最高的共同版本
+// required中有Broker不支持的请求类型，或者双方支持的版本没有交集时返回ErrUnsupportedVersion
+func (c *Conn) NegotiateVersions(required ...protocol.RequestType) error {
+	response, err := c.RoundTrip(&protocol.Request{
+		Type: protocol.RequestTypeAPIVersions,
+		Data: &protocol.APIVersionsRequest{},
+	})
+	if err != nil {
+		return err
+	}
+	if !response.Success {
+		return fmt.Errorf("%w: broker does not support %s, it is probably older than this client: %s",
+			ErrUnsupportedVersion, protocol.RequestTypeAPIVersions, response.Error)
+	}
+
+	brokerRanges := make(map[int16]protocol.APIVersionRange)
+	for _, r := range response.Data.(*protocol.APIVersionsResponse).APIs {
+		brokerRanges[r.Key] = r
+	}
+	versions := make(map[protocol.RequestType]int16)
+	for _, api := range protocol.APIs() {
+		r, ok := brokerRanges[api.Key]
+		if !ok {
+			continue
+		}
+		if lo, hi := max(api.MinVersion, r.MinVersion), min(api.MaxVersion, r.MaxVersion); lo <= hi {
+			versions[api.Type] = hi
+		}
+	}
+
+	for _, t := range required {
+		if _, ok := versions[t]; ok {
+			continue
+		}
+		api := protocol.APIByType(t)
+		if api == nil {
+			return fmt.Errorf("unknown request type %s", t)
+		}
+		r, ok := brokerRanges[api.Key]
+		if !ok {
+			return fmt.Errorf("%w: broker does not support %s", ErrUnsupportedVersion, t)
+		}
+		return fmt.Errorf("%w: %s versions %d-%d are supported by this client but the broker only supports %d-%d",
+			ErrUnsupportedVersion, t, api.MinVersion, api.MaxVersion, r.MinVersion, r.MaxVersion)
+	}
+
+	c.mu.Lock()
+	c.versions = versions
+	c.mu.Unlock()
+	return nil
+}
+
+// Version NegotiateVersions为这种请求选择的版本，Broker不支持或者还没有协商时返回false
+func (c *Conn) Version(t protocol.RequestType) (int16, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	version, ok := c.versions[t]
+	return version, ok
+}
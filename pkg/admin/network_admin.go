@@ -0,0 +1,128 @@
+package admin
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/kafka-from-scratch/internal/protocol"
+	"github.com/kafka-from-scratch/internal/wire"
+)
+
+// NetworkAdmin 网络版管理客户端，通过TCP连接对Broker做快照、恢复、删除消息等管理操作
+type NetworkAdmin struct {
+	brokerAddress string
+	codec         wire.Codec
+	conn          *wire.Conn
+}
+
+// NewNetworkAdmin 创建网络版管理客户端
+func NewNetworkAdmin(brokerAddress string) *NetworkAdmin {
+	return &NetworkAdmin{
+		brokerAddress: brokerAddress,
+		codec:         wire.CodecBinary,
+	}
+}
+
+// SetCodec 选择帧体的编码方式，默认是wire.CodecBinary，调试时可以用wire.CodecJSON，要在Connect之前调用
+func (na *NetworkAdmin) SetCodec(codec wire.Codec) {
+	na.codec = codec
+}
+
+// Connect 连接到Broker
+func (na *NetworkAdmin) Connect() error {
+	conn, err := wire.Dial(na.brokerAddress, na.codec)
+	if err != nil {
+		return err
+	}
+	err = conn.NegotiateVersions(protocol.RequestTypeSnapshot, protocol.RequestTypeRestore, protocol.RequestTypeDeleteRecords)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	na.conn = conn
+	return nil
+}
+
+// Snapshot 把Broker的完整状态写成归档到w，返回归档的字节数
+func (na *NetworkAdmin) Snapshot(w io.Writer) (int64, error) {
+	request := &protocol.Request{
+		Type: protocol.RequestTypeSnapshot,
+		Data: &protocol.SnapshotRequest{},
+	}
+
+	res, err := na.sendRequest(request)
+	if err != nil {
+		return 0, err
+	}
+	if !res.Success {
+		return 0, fmt.Errorf("snapshot failed: %w", res.Err())
+	}
+
+	snapshotResp := res.Data.(*protocol.SnapshotResponse)
+	if res.Records == nil || res.Records.Size() != snapshotResp.ArchiveSize {
+		return 0, fmt.Errorf("snapshot response is truncated, expected %d bytes", snapshotResp.ArchiveSize)
+	}
+	return res.Records.WriteTo(w)
+}
+
+// Restore 把归档恢复到Broker，force为false时只要有一个Topic已经存在就拒绝
+func (na *NetworkAdmin) Restore(r io.Reader, force bool) (*protocol.RestoreResponse, error) {
+	archive, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	request := &protocol.Request{
+		Type: protocol.RequestTypeRestore,
+		Data: &protocol.RestoreRequest{
+			Archive: archive,
+			Force:   force,
+		},
+	}
+
+	res, err := na.sendRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	if !res.Success {
+		return nil, fmt.Errorf("restore failed: %w", res.Err())
+	}
+
+	return res.Data.(*protocol.RestoreResponse), nil
+}
+
+// DeleteRecords 删除每个分区中Offset之前的所有消息，返回每个分区新的low watermark
+// 单个分区失败时错误放在对应结果的Error中，不作为整体的错误返回
+func (na *NetworkAdmin) DeleteRecords(partitions []protocol.TopicPartitionOffset) ([]protocol.DeleteRecordsResult, error) {
+	request := &protocol.Request{
+		Type: protocol.RequestTypeDeleteRecords,
+		Data: &protocol.DeleteRecordsRequest{
+			Partitions: partitions,
+		},
+	}
+
+	res, err := na.sendRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	if !res.Success {
+		return nil, fmt.Errorf("delete records failed: %w", res.Err())
+	}
+
+	return res.Data.(*protocol.DeleteRecordsResponse).Partitions, nil
+}
+
+// Close 关闭连接
+func (na *NetworkAdmin) Close() error {
+	if na.conn != nil {
+		return na.conn.Close()
+	}
+	return nil
+}
+
+// 辅助方法：发送请求并接收响应
+func (na *NetworkAdmin) sendRequest(req *protocol.Request) (*protocol.Response, error) {
+	if na.conn == nil {
+		return nil, fmt.Errorf("not connected to broker")
+	}
+	return na.conn.RoundTrip(req)
+}
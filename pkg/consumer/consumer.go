@@ -1,7 +1,9 @@
 package consumer
 
 import (
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/kafka-from-scratch/internal/broker"
 	"github.com/kafka-from-scratch/internal/common"
@@ -18,6 +20,9 @@ type Consumer interface {
 	// Seek 设置消费位置到指定offset
 	Seek(topic string, partition int32, offset int64) error
 
+	// SeekToTimestamp 设置消费位置到第一条时间戳 >= t 的消息
+	SeekToTimestamp(topic string, partition int32, t time.Time) error
+
 	// Close 关闭Consumer并清理资源
 	Close() error
 }
@@ -110,6 +115,13 @@ func (c *MemoryConsumer) Poll(maxMessages int) ([]*common.Message, error) {
 			
 			// 从Broker拉取消息
 			messages, err := c.broker.ConsumeMessages(topicName, partitionID, currentOffset, remainingMessages)
+			if errors.Is(err, common.ErrOffsetOutOfRange) {
+				// 消息已经被保留策略清理，跳到最早的可用位置（相当于Kafka的auto.offset.reset=earliest）
+				if earliest, err := c.broker.GetEarliestOffset(topicName, partitionID); err == nil {
+					c.offsets[topicName][partitionID] = earliest
+				}
+				continue
+			}
 			if err != nil {
 				continue  // 跳过有问题的分区
 			}
@@ -167,6 +179,15 @@ func (c *MemoryConsumer) Seek(topic string, partition int32, offset int64) error
 	return nil
 }
 
+// SeekToTimestamp 先向Broker查询时间戳对应的offset，再Seek过去
+func (c *MemoryConsumer) SeekToTimestamp(topic string, partition int32, t time.Time) error {
+	offset, err := c.broker.GetOffsetForTimestamp(topic, partition, t)
+	if err != nil {
+		return err
+	}
+	return c.Seek(topic, partition, offset)
+}
+
 // Close 关闭Consumer
 func (c *MemoryConsumer) Close() error {
 	// 清理订阅信息
@@ -1,40 +1,94 @@
 package consumer
 
 import (
-	"encoding/json"
 	"fmt"
-	"net"
+	"sync"
+	"time"
 
-	"github.com/google/uuid"
+	"github.com/kafka-from-scratch/internal/common"
 	"github.com/kafka-from-scratch/internal/protocol"
+	"github.com/kafka-from-scratch/internal/record"
+	"github.com/kafka-from-scratch/internal/wire"
 )
 
+// ErrCorruptMessage 收到的RecordBatch校验和不匹配或格式错误，可以用errors.Is判断
+var ErrCorruptMessage = common.ErrCorruptMessage
+
+// Broker返回的错误也可以用errors.Is和下面的错误比较，用IsRetriable判断能不能重试
+var (
+	// ErrUnknownTopic 和 ErrUnknownPartition Topic或分区不存在
+	ErrUnknownTopic     = common.ErrUnknownTopic
+	ErrUnknownPartition = common.ErrUnknownPartition
+
+	// ErrOffsetOutOfRange offset早于log start offset，数据已经被清理了，需要Seek到新的位置
+	ErrOffsetOutOfRange = common.ErrOffsetOutOfRange
+
+	// Consumer Group的错误：前三个需要重新JoinGroup，后两个可以稍后重试
+	ErrUnknownGroup        = common.ErrUnknownGroup
+	ErrUnknownMember       = common.ErrUnknownMember
+	ErrIllegalGeneration   = common.ErrIllegalGeneration
+	ErrRebalanceInProgress = common.ErrRebalanceInProgress
+	ErrNotCoordinator      = common.ErrNotCoordinator
+)
+
+// IsRetriable err是不是Broker返回的可重试错误，例如ErrRebalanceInProgress，同样的请求稍后重试可能成功
+func IsRetriable(err error) bool {
+	return protocol.IsRetriable(err)
+}
+
 // NetworkConsumer 网络版Consumer，通过TCP连接与Broker通信
+// Connect之后可以在多个goroutine中同时调用，请求共用一个连接，不用等前一个请求的响应
 type NetworkConsumer struct {
 	brokerAddress string
-	conn          net.Conn
-	topics        []string                     // 已订阅的Topics
-	offsets       map[string]map[int32]int64   // topic -> partition -> offset
+	codec         wire.Codec
+	conn          *wire.Conn
+	mu            sync.Mutex                 // 保护topics和offsets
+	topics        []string                   // 已订阅的Topics
+	offsets       map[string]map[int32]int64 // topic -> partition -> offset
+
+	// Consume的长轮询参数，见SetFetchWait
+	fetchMinBytes int32
+	fetchMaxWait  time.Duration
 }
 
 // NewNetworkConsumer 创建网络版Consumer
 func NewNetworkConsumer(brokerAddress string) *NetworkConsumer {
 	return &NetworkConsumer{
 		brokerAddress: brokerAddress,
+		codec:         wire.CodecBinary,
 		topics:        make([]string, 0),
 		offsets:       make(map[string]map[int32]int64),
 	}
 }
 
+// SetCodec 选择帧体的编码方式，默认是wire.CodecBinary，调试时可以用wire.CodecJSON，要在Connect之前调用
+func (nc *NetworkConsumer) SetCodec(codec wire.Codec) {
+	nc.codec = codec
+}
+
+// SetFetchWait 让Consume在分区中没有足够的新数据时由Broker等待：不到minBytes字节就最多等maxWait再返回，
+// 不用在客户端反复发送Consume轮询。默认maxWait为0，Consume总是马上返回
+// Broker不支持CONSUME v2时这两个参数会被忽略，Consume仍然马上返回；和SetCodec一样要在Connect之前调用
+func (nc *NetworkConsumer) SetFetchWait(minBytes int32, maxWait time.Duration) {
+	nc.fetchMinBytes = minBytes
+	nc.fetchMaxWait = maxWait
+}
+
 // TODO: 你来实现这个方法！
 // 功能：连接到Broker
 // 提示：和Producer的Connect方法类似
 func (nc *NetworkConsumer) Connect() error {
 	// TODO: 实现连接逻辑
-	conn, err := net.Dial("tcp", nc.brokerAddress)
+	conn, err := wire.Dial(nc.brokerAddress, nc.codec)
 	if err != nil {
 		return err
 	}
+	err = conn.NegotiateVersions(protocol.RequestTypeSubscribe, protocol.RequestTypeConsume,
+		protocol.RequestTypeSeek, protocol.RequestTypeOffsetForTime)
+	if err != nil {
+		conn.Close()
+		return err
+	}
 	nc.conn = conn
 	return nil
 }
@@ -52,9 +106,8 @@ func (nc *NetworkConsumer) Subscribe(topics []string) error {
 	}
 
 	request := &protocol.Request{
-		Type:      protocol.RequestTypeSubscribe,
-		RequestID: uuid.New().String(),
-		Data:      subscribeReq,
+		Type: protocol.RequestTypeSubscribe,
+		Data: subscribeReq,
 	}
 
 	res, err := nc.sendRequest(request)
@@ -62,10 +115,12 @@ func (nc *NetworkConsumer) Subscribe(topics []string) error {
 		return err
 	}
 	if !res.Success {
-		return fmt.Errorf("subscribe failed: %s", res.Error)
+		return fmt.Errorf("subscribe failed: %w", res.Err())
 	}
 	
 	// 更新本地topics列表并初始化offset
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
 	nc.topics = topics
 	for _, topic := range topics {
 		if nc.offsets[topic] == nil {
@@ -88,12 +143,13 @@ func (nc *NetworkConsumer) Consume(topic string, partitionId int32, offset int64
 		PartitionId: partitionId,
 		Offset:      offset,
 		MaxMessages: maxMessages,
+		MaxWaitMs:   int32(nc.fetchMaxWait / time.Millisecond),
+		MinBytes:    nc.fetchMinBytes,
 	}
 
 	request := &protocol.Request{
-		Type:      protocol.RequestTypeConsume,
-		RequestID: uuid.New().String(),
-		Data:      consumeReq,
+		Type: protocol.RequestTypeConsume,
+		Data: consumeReq,
 	}
 
 	res, err := nc.sendRequest(request)
@@ -101,25 +157,63 @@ func (nc *NetworkConsumer) Consume(topic string, partitionId int32, offset int64
 		return nil, err
 	}
 	if !res.Success {
-		return nil, fmt.Errorf("consume failed: %s", res.Error)
+		return nil, fmt.Errorf("consume failed: %w", res.Err())
 	}
 	
-	// 解析响应
-	respData, _ := json.Marshal(res.Data)
-	var consumeResp protocol.ConsumeResponse
-	json.Unmarshal(respData, &consumeResp)
+	// 解析响应，batch数据在响应帧的最后
+	consumeResp := res.Data.(*protocol.ConsumeResponse)
+	records, _ := res.Records.(record.MemoryRecords)
+	if int64(len(records)) != consumeResp.RecordsSize {
+		return nil, fmt.Errorf("failed to receive records: expected %d bytes, got %d", consumeResp.RecordsSize, len(records))
+	}
+
+	messages, err := decodeRecords(records, offset, maxMessages)
+	if err != nil {
+		return nil, fmt.Errorf("%s-%d offset %d: %w", topic, partitionId, offset, err)
+	}
 	
 	// 更新本地offset
-	if nc.offsets[topic] == nil {
-		nc.offsets[topic] = make(map[int32]int64)
-	}
-	if len(consumeResp.Messages) > 0 {
+	if len(messages) > 0 {
 		// 设置为最后一条消息的offset + 1
-		lastMsg := consumeResp.Messages[len(consumeResp.Messages)-1]
-		nc.offsets[topic][partitionId] = lastMsg.Offset + 1
+		lastMsg := messages[len(messages)-1]
+		nc.setOffset(topic, partitionId, lastMsg.Offset+1)
 	}
 	
-	return consumeResp.Messages, nil
+	return messages, nil
+}
+
+// decodeRecords 校验并解码Broker返回的RecordBatch，跳过早于offset的消息，最多返回maxMessages条
+// 有损坏的batch时整批都不返回，也不前进offset
+func decodeRecords(records []byte, offset int64, maxMessages int) ([]*protocol.NetworkMessage, error) {
+	batches, err := record.Split(records)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]*protocol.NetworkMessage, 0)
+	for _, batch := range batches {
+		if err := batch.Verify(); err != nil {
+			return nil, err
+		}
+		decoded, err := batch.Messages()
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range decoded {
+			if msg.Offset < offset || len(messages) >= maxMessages {
+				continue
+			}
+			messages = append(messages, &protocol.NetworkMessage{
+				Key:       msg.Key,
+				Value:     msg.Value,
+				Headers:   msg.Headers,
+				Offset:    msg.Offset,
+				Timestamp: msg.Timestamp.Format(time.RFC3339),
+				Tombstone: msg.IsTombstone(),
+			})
+		}
+	}
+	return messages, nil
 }
 
 // TODO: 你来实现这个方法！
@@ -136,9 +230,8 @@ func (nc *NetworkConsumer) Seek(topic string, partitionId int32, offset int64) e
 	}
 	
 	request := &protocol.Request{
-		Type:      protocol.RequestTypeSeek,
-		RequestID: uuid.New().String(),
-		Data:      seekReq,
+		Type: protocol.RequestTypeSeek,
+		Data: seekReq,
 	}
 	
 	// 发送请求进行服务端验证
@@ -147,16 +240,51 @@ func (nc *NetworkConsumer) Seek(topic string, partitionId int32, offset int64) e
 		return err
 	}
 	if !res.Success {
-		return fmt.Errorf("seek failed: %s", res.Error)
+		return fmt.Errorf("seek failed: %w", res.Err())
 	}
 	
 	// 更新本地offset状态
+	nc.setOffset(topic, partitionId, offset)
+	
+	return nil
+}
+
+// SeekToTimestamp 设置消费位置到第一条时间戳 >= t 的消息
+// Broker根据时间索引查出offset，客户端再更新本地的消费位置
+func (nc *NetworkConsumer) SeekToTimestamp(topic string, partitionId int32, t time.Time) error {
+	offsetReq := &protocol.OffsetForTimeRequest{
+		Topic:       topic,
+		PartitionId: partitionId,
+		Timestamp:   t.UnixMilli(),
+	}
+
+	request := &protocol.Request{
+		Type: protocol.RequestTypeOffsetForTime,
+		Data: offsetReq,
+	}
+
+	res, err := nc.sendRequest(request)
+	if err != nil {
+		return err
+	}
+	if !res.Success {
+		return fmt.Errorf("seek to timestamp failed: %w", res.Err())
+	}
+
+	offsetResp := res.Data.(*protocol.OffsetForTimeResponse)
+	nc.setOffset(topic, partitionId, offsetResp.Offset)
+
+	return nil
+}
+
+// setOffset 更新本地的消费位置
+func (nc *NetworkConsumer) setOffset(topic string, partitionId int32, offset int64) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
 	if nc.offsets[topic] == nil {
 		nc.offsets[topic] = make(map[int32]int64)
 	}
 	nc.offsets[topic][partitionId] = offset
-	
-	return nil
 }
 
 // Close 关闭连接
@@ -172,19 +300,5 @@ func (nc *NetworkConsumer) sendRequest(req *protocol.Request) (*protocol.Respons
 	if nc.conn == nil {
 		return nil, fmt.Errorf("not connected to broker")
 	}
-
-	// 发送请求
-	encoder := json.NewEncoder(nc.conn)
-	if err := encoder.Encode(req); err != nil {
-		return nil, fmt.Errorf("failed to send request: %w", err)
-	}
-
-	// 接收响应
-	var response protocol.Response
-	decoder := json.NewDecoder(nc.conn)
-	if err := decoder.Decode(&response); err != nil {
-		return nil, fmt.Errorf("failed to receive response: %w", err)
-	}
-
-	return &response, nil
+	return nc.conn.RoundTrip(req)
 }
@@ -0,0 +1,231 @@
+package consumer_test
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/kafka-from-scratch/internal/broker"
+	"github.com/kafka-from-scratch/internal/server"
+	"github.com/kafka-from-scratch/internal/storage"
+	"github.com/kafka-from-scratch/internal/wire"
+	"github.com/kafka-from-scratch/pkg/consumer"
+	"github.com/kafka-from-scratch/pkg/producer"
+)
+
+var (
+	roundTripSeed     = flag.Int64("roundtrip.seed", 0, "随机用例的种子，0表示使用当前时间，用来重现失败的用例")
+	roundTripMessages = flag.Int("roundtrip.messages", 500, "随机用例的消息数")
+)
+
+// TestBinaryRoundTrip 用任意字节的key、value和header经过 NetworkProducer -> TCPServer -> NetworkConsumer 走一遍，
+// 检查Consumer收到的字节和发送的完全相同，nil和空的[]byte{}也要区分开
+// 内存版和磁盘版Broker都用binary和json两种codec测试
+func TestBinaryRoundTrip(t *testing.T) {
+	seed := *roundTripSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	t.Logf("seed %d", seed)
+
+	diskBroker, err := broker.NewDiskBroker(t.TempDir(), storage.LogConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { diskBroker.Close() })
+
+	brokers := []struct {
+		name   string
+		broker broker.Broker
+	}{
+		{"memory", broker.NewMemoryBroker()},
+		{"disk", diskBroker},
+	}
+	for _, b := range brokers {
+		tcpServer := server.NewTCPServer("127.0.0.1:0", b.broker)
+		if err := tcpServer.Listen(); err != nil {
+			t.Fatal(err)
+		}
+		go tcpServer.Serve()
+		t.Cleanup(func() { tcpServer.Stop() })
+		addr := tcpServer.Addr().String()
+
+		for _, codec := range []wire.Codec{wire.CodecBinary, wire.CodecJSON} {
+			cases := []struct {
+				name     string
+				messages []*message
+			}{
+				{"edge cases", edgeCases()},
+				{"random", randomMessages(rand.New(rand.NewSource(seed)), *roundTripMessages)},
+			}
+			for _, c := range cases {
+				t.Run(fmt.Sprintf("%s/%s/%s", b.name, codec, c.name), func(t *testing.T) {
+					if err := roundTrip(addr, codec, c.messages); err != nil {
+						t.Fatal(err)
+					}
+				})
+			}
+		}
+	}
+}
+
+type message struct {
+	key     []byte
+	value   []byte
+	headers map[string][]byte
+}
+
+// edgeCases nil和空的区别、不是合法UTF-8的字节、JSON里需要转义的字符和比较大的value
+func edgeCases() []*message {
+	allBytes := make([]byte, 256)
+	for i := range allBytes {
+		allBytes[i] = byte(i)
+	}
+	large := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(large)
+
+	return []*message{
+		{key: nil, value: []byte("no key")},
+		{key: []byte{}, value: []byte("empty key")},
+		{key: []byte("tombstone"), value: nil},
+		{key: []byte("empty value"), value: []byte{}},
+		{key: []byte{0}, value: []byte{0, 0, 0}},
+		{key: allBytes, value: allBytes},
+		{key: []byte{0xff, 0xfe, 0xfd}, value: []byte{0x80, 0xbf}},             // 不是UTF-8
+		{key: []byte{0xed, 0xa0, 0x80}, value: []byte{0xc0, 0xaf, 0xe0, 0x80}}, // 代理对和超长编码
+		{key: []byte(`"\u0000</script>`), value: []byte("\\\"\n\r\t ")},
+		{key: []byte("utf-8 文字 🎉"), value: []byte("value 值")},
+		{key: []byte("large"), value: large},
+		{key: []byte("headers"), value: []byte("v"), headers: map[string][]byte{
+			"nil":      nil,
+			"empty":    {},
+			"binary":   {0, 0xff, 0x80, 0xfe},
+			"\xff\x00": []byte("key is not UTF-8"),
+			"":         []byte("empty key"),
+			"utf-8 键名": []byte("值"),
+		}},
+		{key: []byte("empty headers"), value: []byte("v"), headers: map[string][]byte{}},
+	}
+}
+
+// randomMessages 长度和内容都随机，key和value有一定概率是nil或空的
+func randomMessages(r *rand.Rand, n int) []*message {
+	randomBytes := func(maxLen int) []byte {
+		switch r.Intn(10) {
+		case 0:
+			return nil
+		case 1:
+			return []byte{}
+		}
+		b := make([]byte, r.Intn(maxLen)+1)
+		r.Read(b)
+		return b
+	}
+
+	messages := make([]*message, n)
+	for i := range messages {
+		m := &message{key: randomBytes(64), value: randomBytes(4096)}
+		if r.Intn(2) == 0 {
+			m.headers = make(map[string][]byte)
+			for j := r.Intn(4); j >= 0; j-- {
+				m.headers[string(randomBytes(16))] = randomBytes(64)
+			}
+		}
+		messages[i] = m
+	}
+	return messages
+}
+
+// roundTrip 发送到一个新的单分区Topic，再从头消费，逐条和发送的比较
+func roundTrip(addr string, codec wire.Codec, messages []*message) error {
+	topic := fmt.Sprintf("test-binary-%s-%d", codec, time.Now().UnixNano())
+
+	p := producer.NewNetworkProducer(addr)
+	p.SetCodec(codec)
+	if err := p.Connect(); err != nil {
+		return err
+	}
+	defer p.Close()
+	if err := p.CreateTopic(topic, 1); err != nil {
+		return err
+	}
+
+	offsets := make([]int64, len(messages))
+	for i, m := range messages {
+		_, offset, err := p.SendWithHeaders(topic, m.key, m.value, m.headers)
+		if err != nil {
+			return fmt.Errorf("send message %d: %w", i, err)
+		}
+		offsets[i] = offset
+	}
+
+	c := consumer.NewNetworkConsumer(addr)
+	c.SetCodec(codec)
+	if err := c.Connect(); err != nil {
+		return err
+	}
+	defer c.Close()
+
+	next := 0
+	for next < len(messages) {
+		received, err := c.Consume(topic, 0, offsets[next], 100)
+		if err != nil {
+			return err
+		}
+		if len(received) == 0 {
+			return fmt.Errorf("no messages at offset %d", offsets[next])
+		}
+		for _, got := range received {
+			if next >= len(messages) {
+				return fmt.Errorf("unexpected message at offset %d", got.Offset)
+			}
+			want := messages[next]
+			if got.Offset != offsets[next] {
+				return fmt.Errorf("message %d: got offset %d, want %d", next, got.Offset, offsets[next])
+			}
+			if err := sameBytes("key", got.Key, want.key); err != nil {
+				return fmt.Errorf("message %d: %w", next, err)
+			}
+			if err := sameBytes("value", got.Value, want.value); err != nil {
+				return fmt.Errorf("message %d: %w", next, err)
+			}
+			if got.Tombstone != (want.value == nil) {
+				return fmt.Errorf("message %d: tombstone is %t", next, got.Tombstone)
+			}
+			if len(got.Headers) != len(want.headers) {
+				return fmt.Errorf("message %d: got %d headers, want %d", next, len(got.Headers), len(want.headers))
+			}
+			for k, v := range want.headers {
+				gv, ok := got.Headers[k]
+				if !ok {
+					return fmt.Errorf("message %d: header %q is missing", next, k)
+				}
+				if err := sameBytes(fmt.Sprintf("header %q", k), gv, v); err != nil {
+					return fmt.Errorf("message %d: %w", next, err)
+				}
+			}
+			next++
+		}
+	}
+	return nil
+}
+
+func sameBytes(name string, got, want []byte) error {
+	if (got == nil) != (want == nil) {
+		return fmt.Errorf("%s: got nil=%t, want nil=%t", name, got == nil, want == nil)
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("%s: got %d bytes %q, want %d bytes %q", name, len(got), truncate(got), len(want), truncate(want))
+	}
+	return nil
+}
+
+func truncate(b []byte) []byte {
+	if len(b) > 32 {
+		return b[:32]
+	}
+	return b
+}
@@ -1,39 +1,76 @@
 package producer
 
 import (
-	"encoding/json"
 	"fmt"
-	"net"
+	"time"
 
-	"github.com/google/uuid"
+	"github.com/kafka-from-scratch/internal/common"
 	"github.com/kafka-from-scratch/internal/protocol"
+	"github.com/kafka-from-scratch/internal/record"
+	"github.com/kafka-from-scratch/internal/wire"
 )
 
+// Broker返回的错误可以用errors.Is和下面的错误比较，用IsRetriable判断能不能重试
+var (
+	// ErrUnknownTopic Topic不存在，需要先CreateTopic
+	ErrUnknownTopic = common.ErrUnknownTopic
+
+	// ErrInvalidTopic 和 ErrInvalidConfig CreateTopic的参数不合法
+	ErrInvalidTopic  = common.ErrInvalidTopic
+	ErrInvalidConfig = common.ErrInvalidConfig
+
+	// ErrRecordTooLarge 消息超过了Topic或Broker允许的大小，重试也不会成功
+	ErrRecordTooLarge = common.ErrRecordTooLarge
+
+	// ErrBrokerFull Broker的内存预算用完了，可以稍后重试
+	ErrBrokerFull = common.ErrBrokerFull
+
+	// ErrCorruptMessage Broker校验batch失败
+	ErrCorruptMessage = common.ErrCorruptMessage
+)
+
+// IsRetriable err是不是Broker返回的可重试错误，例如ErrBrokerFull，同样的请求稍后重试可能成功
+func IsRetriable(err error) bool {
+	return protocol.IsRetriable(err)
+}
+
 // NetworkProducer 网络版Producer，通过TCP连接与Broker通信
+// Connect之后可以在多个goroutine中同时Send，请求共用一个连接，不用等前一个请求的响应
 type NetworkProducer struct {
 	brokerAddress string
-	conn          net.Conn
+	codec         wire.Codec
+	conn          *wire.Conn
 }
 
 // NewNetworkProducer 创建网络版Producer
 func NewNetworkProducer(brokerAddress string) *NetworkProducer {
 	return &NetworkProducer{
 		brokerAddress: brokerAddress,
+		codec:         wire.CodecBinary,
 	}
 }
 
+// SetCodec 选择帧体的编码方式，默认是wire.CodecBinary，调试时可以用wire.CodecJSON，要在Connect之前调用
+func (np *NetworkProducer) SetCodec(codec wire.Codec) {
+	np.codec = codec
+}
+
 // TODO: 你来实现这个方法！
 // 功能：连接到Broker
 // 提示：
-// 1. 使用 net.Dial("tcp", np.brokerAddress) 建立连接
-// 2. 保存连接到 np.conn
-// 3. 处理连接错误
+// 1. 使用 wire.Dial(np.brokerAddress, np.codec) 建立连接并协商codec
+// 2. 协商用到的请求的版本，Broker不支持时直接返回错误
+// 3. 保存连接到 np.conn
 func (np *NetworkProducer) Connect() error {
 	// TODO: 实现连接逻辑
-	conn, err := net.Dial("tcp", np.brokerAddress)
+	conn, err := wire.Dial(np.brokerAddress, np.codec)
 	if err != nil {
 		return err
 	}
+	if err := conn.NegotiateVersions(protocol.RequestTypeProduce, protocol.RequestTypeCreateTopic); err != nil {
+		conn.Close()
+		return err
+	}
 	np.conn = conn
 	return nil
 }
@@ -43,29 +80,35 @@ func (np *NetworkProducer) Connect() error {
 // 提示：
 // 1. 创建ProduceRequest
 // 2. 包装到protocol.Request中
-// 3. JSON序列化并发送
+// 3. 编码成帧并发送
 // 4. 读取并解析响应
 // 5. 返回分区ID和offset
 func (np *NetworkProducer) Send(topic string, key, value []byte) (int32, int64, error) {
+	return np.SendWithHeaders(topic, key, value, nil)
+}
+
+// SendWithHeaders 和Send一样，同时带上headers
+// key、value和header的value都按原样发送，Consumer收到的字节完全相同，nil和空的[]byte{}也会区分开
+func (np *NetworkProducer) SendWithHeaders(topic string, key, value []byte, headers map[string][]byte) (int32, int64, error) {
 	// TODO: 实现消息发送逻辑
 
-	// TopicName    string            `json:"topic_name"`
-	// PartitionKey string            `json:"partition_key"`
-	// Value        string            `json:"value"`
-	// Headers      map[string]string `json:"headers"`
-	// 1. 创建请求数据
+	// 1. 创建请求数据，消息编码成只有一条记录的batch
+	// key为nil表示没有key；value为nil表示tombstone，用于compact模式的Topic删除key
+	message := &common.Message{
+		Key:       key,
+		Value:     value,
+		Headers:   headers,
+		Timestamp: time.Now(),
+	}
 	produceReq := &protocol.ProduceRequest{
-		TopicName:    topic,
-		PartitionKey: string(key),
-		Value:        string(value),
-		Headers:      make(map[string]string),
+		TopicName: topic,
+		Records:   record.Build([]*common.Message{message}),
 	}
 
 	// 2. 包装到通用请求
 	request := &protocol.Request{
-		Type:      protocol.RequestTypeProduce,
-		RequestID: uuid.New().String(),
-		Data:      produceReq,
+		Type: protocol.RequestTypeProduce,
+		Data: produceReq,
 	}
 
 	res, err := np.sendRequest(request)
@@ -74,31 +117,112 @@ func (np *NetworkProducer) Send(topic string, key, value []byte) (int32, int64,
 	}
 
 	if !res.Success {
-		return 0, 0, fmt.Errorf("produce message failed: %s", res.Error)
+		return 0, 0, fmt.Errorf("produce message failed: %w", res.Err())
 	}
 
-	respData, _ := json.Marshal(res.Data)
-	var produceResp protocol.ProduceResponse
-	json.Unmarshal(respData, &produceResp)
+	produceResp := res.Data.(*protocol.ProduceResponse)
 	return produceResp.PartitionId, produceResp.Offset, nil
 }
 
+// PartitionAny 作为ProducerRecord.Partition时和Send一样由Broker按Key选择分区
+const PartitionAny int32 = -1
+
+// ProducerRecord SendBatch发送的一条消息
+type ProducerRecord struct {
+	Topic     string
+	Partition int32 // 写入的分区，PartitionAny表示按Key选择
+	Key       []byte
+	Value     []byte
+	Headers   map[string][]byte
+}
+
+// SendBatch 把多条消息放在一个请求里发送，可以发往多个Topic的多个分区，只需要一次网络往返
+// 发往同一个分区的消息由Broker写成一个batch，整个写入或者整个失败；Partition为PartitionAny的消息由Broker按Key选择分区，
+// 和Send选择的分区一样，再和指定了这个分区的消息合在一起
+// 返回每个分区的结果，顺序是分区第一次出现的顺序；同一个分区中先是指定了这个分区的消息，然后是PartitionAny的消息，
+// 各自保持在records中的顺序，offset从BaseOffset开始依次加一
+// 单个分区失败时错误放在对应结果中，用Err()获取，不作为整体的错误返回
+func (np *NetworkProducer) SendBatch(records []*ProducerRecord) ([]protocol.ProduceBatchResult, error) {
+	if len(records) == 0 {
+		return nil, nil
+	}
+	// Connect时不要求PRODUCE_BATCH，这样也能连接老版本的Broker，只是不能用SendBatch
+	if np.conn != nil {
+		if _, ok := np.conn.Version(protocol.RequestTypeProduceBatch); !ok {
+			return nil, fmt.Errorf("%w: broker does not support %s", wire.ErrUnsupportedVersion, protocol.RequestTypeProduceBatch)
+		}
+	}
+
+	// 每个分区一个batch；PartitionAny的消息每个Topic一个batch，由Broker按Key分到各个分区
+	type batchKey struct {
+		topic     string
+		partition int32
+	}
+	var keys []batchKey
+	groups := make(map[batchKey][]*common.Message)
+	now := time.Now()
+	for _, r := range records {
+		k := batchKey{topic: r.Topic, partition: r.Partition}
+		if r.Partition < 0 {
+			k.partition = PartitionAny
+		}
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], &common.Message{
+			Key:       r.Key,
+			Value:     r.Value,
+			Headers:   r.Headers,
+			Timestamp: now,
+		})
+	}
+
+	produceReq := &protocol.ProduceBatchRequest{
+		Partitions: make([]protocol.ProducePartitionData, 0, len(keys)),
+	}
+	for _, k := range keys {
+		produceReq.Partitions = append(produceReq.Partitions, protocol.ProducePartitionData{
+			Topic:       k.topic,
+			PartitionId: k.partition,
+			Records:     record.Build(groups[k]),
+		})
+	}
+
+	res, err := np.sendRequest(&protocol.Request{
+		Type: protocol.RequestTypeProduceBatch,
+		Data: produceReq,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !res.Success {
+		return nil, fmt.Errorf("produce batch failed: %w", res.Err())
+	}
+	return res.Data.(*protocol.ProduceBatchResponse).Partitions, nil
+}
+
 // TODO: 你来实现这个方法！
 // 功能：创建Topic
 // 提示：
 // 1. 创建CreateTopicRequest
 // 2. 发送请求并处理响应
 func (np *NetworkProducer) CreateTopic(name string, partitions int32) error {
+	return np.CreateTopicWithConfig(name, partitions, nil)
+}
+
+// CreateTopicWithConfig 创建Topic并指定Topic配置，例如 {"retention.ms": "3600000"}
+// 没有指定的配置项使用Broker的默认值
+func (np *NetworkProducer) CreateTopicWithConfig(name string, partitions int32, configs map[string]string) error {
 	// TODO: 实现Topic创建逻辑
 	sendReq := &protocol.CreateTopicRequest{
 		TopicName:    name,
 		PartitionNum: partitions,
+		Configs:      configs,
 	}
 
 	request := &protocol.Request{
-		Type:      protocol.RequestTypeCreateTopic,
-		RequestID: uuid.New().String(),
-		Data:      sendReq,
+		Type: protocol.RequestTypeCreateTopic,
+		Data: sendReq,
 	}
 
 	res, err := np.sendRequest(request)
@@ -107,11 +231,9 @@ func (np *NetworkProducer) CreateTopic(name string, partitions int32) error {
 	}
 
 	if !res.Success {
-		return fmt.Errorf("create topic err since %s", res.Error)
+		return fmt.Errorf("create topic err since %w", res.Err())
 	}
-	respData, _ := json.Marshal(res.Data)
-	var createResp protocol.CreateTopicResponse
-	json.Unmarshal(respData, &createResp)
+	createResp := res.Data.(*protocol.CreateTopicResponse)
 	fmt.Printf("Result of create topic is %d\n", createResp.Result)
 	return nil
 }
@@ -129,19 +251,5 @@ func (np *NetworkProducer) sendRequest(req *protocol.Request) (*protocol.Respons
 	if np.conn == nil {
 		return nil, fmt.Errorf("not connected to broker")
 	}
-
-	// 发送请求
-	encoder := json.NewEncoder(np.conn)
-	if err := encoder.Encode(req); err != nil {
-		return nil, fmt.Errorf("failed to send request: %w", err)
-	}
-
-	// 接收响应
-	var response protocol.Response
-	decoder := json.NewDecoder(np.conn)
-	if err := decoder.Decode(&response); err != nil {
-		return nil, fmt.Errorf("failed to receive response: %w", err)
-	}
-
-	return &response, nil
+	return np.conn.RoundTrip(req)
 }